@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// action frame categories
+const (
+	catSpectrum = 0
+	catBlockAck = 3
+	catPublic   = 4
+	catFT       = 6
+	catSAQuery  = 8
+)
+
+// kinds of action frame fields
+const (
+	afKeep = iota // kept as is
+	afMAC         // MAC address
+	afTime        // FTM TOD or TOA, in picoseconds
+)
+
+// actionField is a fixed field in the body of an action frame.
+type actionField struct {
+	kind int
+	size int
+}
+
+// actionLayouts are the fixed fields after the category and action, for the
+// action frames that are understood. Any information elements that follow
+// aren't handled.
+var actionLayouts = map[[2]byte][]actionField{
+	{catSpectrum, 0}: {{afKeep, 1}}, // measurement request: token
+	{catSpectrum, 1}: {{afKeep, 1}}, // measurement report: token
+	{catSpectrum, 2}: {{afKeep, 1}}, // TPC request: token
+	{catSpectrum, 3}: {{afKeep, 1}}, // TPC report: token
+	{catSpectrum, 4}: {},            // channel switch announcement
+
+	// ADDBA request: token, parameters, timeout, starting sequence control
+	{catBlockAck, 0}: {{afKeep, 7}},
+	// ADDBA response: token, status, parameters, timeout
+	{catBlockAck, 1}: {{afKeep, 7}},
+	// DELBA: parameters, reason
+	{catBlockAck, 2}: {{afKeep, 4}},
+
+	// FTM request: trigger
+	{catPublic, 32}: {{afKeep, 1}},
+	// FTM: token, follow up token, TOD, TOA, TOD error, TOA error
+	{catPublic, 33}: {{afKeep, 2}, {afTime, 6}, {afTime, 6}, {afKeep, 4}},
+
+	// FT request, response, confirm and ack: STA and target AP addresses,
+	// then status for responses and acks
+	{catFT, 1}: {{afMAC, 6}, {afMAC, 6}},
+	{catFT, 2}: {{afMAC, 6}, {afMAC, 6}, {afKeep, 2}},
+	{catFT, 3}: {{afMAC, 6}, {afMAC, 6}},
+	{catFT, 4}: {{afMAC, 6}, {afMAC, 6}, {afKeep, 2}},
+
+	{catSAQuery, 0}: {{afKeep, 2}}, // SA query request: transaction ID
+	{catSAQuery, 1}: {{afKeep, 2}}, // SA query response: transaction ID
+}
+
+// handleAction anonymizes the body of an unprotected action frame at offset n
+// in b, which is truncated before any FCS, returning the offset after the
+// fixed fields. Actions that aren't understood are left unhandled.
+func handleAction(b []byte, n int, anon Anonymizer) (int, error) {
+	if n+2 > len(b) {
+		return n, fmt.Errorf("short packet trying to slurp 2 bytes at pos %d "+
+			"(increase snaplen)", n)
+	}
+	layout, ok := actionLayouts[[2]byte{b[n], b[n+1]}]
+	if !ok {
+		return n, nil
+	}
+	m := n + 2
+	for _, f := range layout {
+		if m+f.size > len(b) {
+			return n, fmt.Errorf("short action frame trying to slurp %d bytes "+
+				"at pos %d (increase snaplen)", f.size, m)
+		}
+		switch f.kind {
+		case afMAC:
+			anon.MAC(b[m : m+f.size])
+		case afTime:
+			anon.Timestamp(b[m : m+f.size])
+		}
+		m += f.size
+	}
+	return m, nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ftpRewriter anonymizes FTP control connections, a line at a time: the
+// addresses in PORT and EPRT commands and in passive mode replies, and user
+// names, with passwords zeroed.
+type ftpRewriter struct{}
+
+// newFTPRewriter returns a new ftpRewriter.
+func newFTPRewriter() StreamRewriter {
+	return ftpRewriter{}
+}
+
+// Rewrite anonymizes a command or reply line.
+func (ftpRewriter) Rewrite(b []byte, fromServer bool, anon Anonymizer) int {
+	n := bytes.IndexByte(b, '\n') + 1
+	if n == 0 {
+		return 0
+	}
+	l := bytes.TrimRight(b[:n], "\r\n")
+	if fromServer {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		if bytes.HasPrefix(l, []byte("227")) {
+			if i := bytes.IndexAny(l[3:], "0123456789"); i >= 0 {
+				ftpHostPort(l[3+i:], anon)
+			}
+		}
+		return n
+	}
+	cmd, arg, _ := bytes.Cut(l, []byte(" "))
+	switch strings.ToUpper(string(cmd)) {
+	case "PORT":
+		ftpHostPort(arg, anon)
+	case "EPRT":
+		// |af|address|port|, with any delimiter
+		if len(arg) > 0 {
+			if f := bytes.Split(arg, arg[:1]); len(f) >= 4 {
+				rewriteIP(f[2], Src, anon)
+			}
+		}
+	case "USER":
+		anon.Name(arg)
+	case "PASS":
+		anon.Text(arg)
+	}
+	return n
+}
+
+// ftpHostPort anonymizes the address in the FTP host-port argument
+// h1,h2,h3,h4,p1,p2 at the start of b.
+func ftpHostPort(b []byte, anon Anonymizer) {
+	c := 0
+	for i, x := range b {
+		if x == ',' {
+			if c++; c == 4 {
+				rewriteIPv4(b[:i], ',', Src, anon)
+				return
+			}
+		} else if x < '0' || x > '9' {
+			return
+		}
+	}
+}
+
+// httpRewriter anonymizes HTTP requests: the host in the Host header, and the
+// client addresses in X-Forwarded-For and X-Real-IP headers. Bodies are left
+// alone, and chunked bodies are followed a chunk at a time.
+type httpRewriter struct {
+	// chunked is set while in a chunked body.
+	chunked bool
+}
+
+// newHTTPRewriter returns a new httpRewriter.
+func newHTTPRewriter() StreamRewriter {
+	return &httpRewriter{}
+}
+
+// Rewrite anonymizes a request, or skips a chunk of its body.
+func (h *httpRewriter) Rewrite(b []byte, fromServer bool,
+	anon Anonymizer) int {
+	if h.chunked {
+		return h.chunk(b)
+	}
+	n := headerEnd(b)
+	if n == 0 {
+		return 0
+	}
+	body := 0
+	ok := true
+	chunked := false
+	textHeaders(b[:n], func(name string, v []byte) {
+		switch name {
+		case "host":
+			rewriteHost(hostPort(v), Dst, anon)
+		case "x-forwarded-for", "x-real-ip":
+			for _, a := range bytes.Split(v, []byte(",")) {
+				rewriteIP(bytes.TrimSpace(a), Src, anon)
+			}
+		case "content-length":
+			var err error
+			if body, err = strconv.Atoi(string(v)); err != nil || body < 0 {
+				ok = false
+			}
+		case "transfer-encoding":
+			// chunked must be the last coding, and the others don't matter
+			// as the body is left alone
+			c := v[bytes.LastIndexByte(v, ',')+1:]
+			c = bytes.TrimSpace(c)
+			if bytes.EqualFold(c, []byte("chunked")) {
+				chunked = true
+			} else if !bytes.EqualFold(c, []byte("identity")) {
+				ok = false
+			}
+		}
+	})
+	if !ok {
+		return -1
+	}
+	if chunked {
+		// the length of a chunked body is in its chunks, not Content-Length
+		h.chunked = true
+		return n
+	}
+	return n + body
+}
+
+// chunk returns the length of the chunk of a chunked body at the start of b,
+// with its data and CRLF, or for the last chunk, its trailer section.
+func (h *httpRewriter) chunk(b []byte) int {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return 0
+	}
+	l := bytes.TrimRight(b[:i], "\r")
+	l, _, _ = bytes.Cut(l, []byte(";"))
+	n, err := strconv.ParseUint(string(bytes.TrimSpace(l)), 16, 32)
+	if err != nil {
+		return -1
+	}
+	if n > 0 {
+		return i + 1 + int(n) + 2
+	}
+	// the last chunk, with its trailer section ending with an empty line
+	e := headerEnd(b)
+	if e > 0 {
+		h.chunked = false
+	}
+	return e
+}
+
+// sipRewriter anonymizes SIP messages: the users and hosts of SIP URIs, the
+// hosts in Via headers and their received and maddr parameters, display names
+// and Call-IDs, and in SDP bodies, the origin user names and the addresses of
+// the origin and connection lines. Hosts are anonymized as the source, except
+// in the request URI and the To, Route, Record-Route and Refer-To headers.
+type sipRewriter struct{}
+
+// newSIPRewriter returns a new sipRewriter.
+func newSIPRewriter() StreamRewriter {
+	return sipRewriter{}
+}
+
+// Rewrite anonymizes a message.
+func (sipRewriter) Rewrite(b []byte, fromServer bool, anon Anonymizer) int {
+	n := headerEnd(b)
+	if n == 0 {
+		return 0
+	}
+	body, sdp, ok := 0, false, true
+	if sl := b[:bytes.IndexByte(b, '\n')]; !bytes.HasPrefix(sl,
+		[]byte("SIP/")) {
+		sipURIs(sl, Dst, anon)
+	}
+	textHeaders(b[:n], func(name string, v []byte) {
+		switch name {
+		case "via", "v":
+			sipVia(v, anon)
+		case "from", "f", "contact", "m", "p-asserted-identity",
+			"referred-by", "b":
+			sipAddresses(v, Src, anon)
+		case "to", "t", "route", "record-route", "refer-to", "r":
+			sipAddresses(v, Dst, anon)
+		case "call-id", "i":
+			anon.Name(v)
+		case "content-length", "l":
+			var err error
+			if body, err = strconv.Atoi(string(v)); err != nil || body < 0 {
+				ok = false
+			}
+		case "content-type", "c":
+			sdp = bytes.HasPrefix(bytes.ToLower(v), []byte("application/sdp"))
+		}
+	})
+	if !ok {
+		return -1
+	}
+	if n+body > len(b) {
+		return 0
+	}
+	if sdp {
+		sdpBody(b[n:n+body], anon)
+	}
+	return n + body
+}
+
+// sipAddresses anonymizes the display names and SIP URIs in the name-addr
+// list in b, with hosts anonymized for role r.
+func sipAddresses(b []byte, r Role, anon Anonymizer) {
+	for _, a := range bytes.Split(b, []byte(",")) {
+		a = bytes.TrimSpace(a)
+		if i := bytes.IndexByte(a, '<'); i > 0 {
+			name := bytes.TrimSpace(a[:i])
+			if len(name) > 1 && name[0] == '"' && name[len(name)-1] == '"' {
+				name = name[1 : len(name)-1]
+			}
+			anon.Name(name)
+		}
+	}
+	sipURIs(b, r, anon)
+}
+
+// sipURIs anonymizes the user and host of each SIP URI in b, with hosts
+// anonymized for role r.
+func sipURIs(b []byte, r Role, anon Anonymizer) {
+	lb := bytes.ToLower(b)
+	for i := 0; i < len(b); {
+		j := bytes.Index(lb[i:], []byte("sip"))
+		if j < 0 {
+			return
+		}
+		i += j + 3
+		if i < len(b) && lb[i] == 's' {
+			i++
+		}
+		if i >= len(b) || b[i] != ':' {
+			continue
+		}
+		i++
+		e := i
+		for e < len(b) && bytes.IndexByte([]byte(">;?, \t\r\n"), b[e]) < 0 {
+			e++
+		}
+		u := b[i:e]
+		if at := bytes.LastIndexByte(u, '@'); at >= 0 {
+			user, pass, _ := bytes.Cut(u[:at], []byte(":"))
+			anon.Name(user)
+			anon.Text(pass)
+			u = u[at+1:]
+		}
+		rewriteHost(hostPort(u), r, anon)
+		i = e
+	}
+}
+
+// sipVia anonymizes the hosts in the Via header value b, and the addresses in
+// their received and maddr parameters.
+func sipVia(b []byte, anon Anonymizer) {
+	for _, v := range bytes.Split(b, []byte(",")) {
+		v = bytes.TrimSpace(v)
+		// SIP/2.0/TCP host:port;params
+		i := bytes.IndexAny(v, " \t")
+		if i < 0 {
+			continue
+		}
+		params := bytes.Split(bytes.TrimSpace(v[i:]), []byte(";"))
+		rewriteHost(hostPort(bytes.TrimSpace(params[0])), Src, anon)
+		for _, p := range params[1:] {
+			k, val, _ := bytes.Cut(bytes.TrimSpace(p), []byte("="))
+			if bytes.EqualFold(k, []byte("received")) ||
+				bytes.EqualFold(k, []byte("maddr")) {
+				rewriteHost(val, Src, anon)
+			}
+		}
+	}
+}
+
+// sdpBody anonymizes the origin user name and address, and the connection
+// addresses, in SDP session description b.
+func sdpBody(b []byte, anon Anonymizer) {
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		l = bytes.TrimRight(l, "\r")
+		f := bytes.Split(l, []byte(" "))
+		switch {
+		// o=<username> <sess-id> <sess-version> IN <addrtype> <address>
+		case bytes.HasPrefix(l, []byte("o=")) && len(f) == 6:
+			if u := f[0][2:]; !bytes.Equal(u, []byte("-")) {
+				anon.Name(u)
+			}
+			rewriteHost(f[5], Src, anon)
+		// c=IN <addrtype> <address>[/<ttl>]
+		case bytes.HasPrefix(l, []byte("c=")) && len(f) == 3:
+			a, _, _ := bytes.Cut(f[2], []byte("/"))
+			rewriteHost(a, Src, anon)
+		}
+	}
+}
+
+// headerEnd returns the length of the header block of the text message at
+// the start of b, ending with an empty line, or 0 if it's not complete.
+func headerEnd(b []byte) int {
+	for i := 0; i < len(b); {
+		j := bytes.IndexByte(b[i:], '\n')
+		if j < 0 {
+			return 0
+		}
+		l := b[i : i+j]
+		i += j + 1
+		if len(l) == 0 || len(l) == 1 && l[0] == '\r' {
+			return i
+		}
+	}
+	return 0
+}
+
+// textHeaders calls fn with the lower case name and the trimmed value of each
+// header line in header block b, after its start line.
+func textHeaders(b []byte, fn func(name string, value []byte)) {
+	for _, l := range bytes.Split(b, []byte("\n"))[1:] {
+		if i := bytes.IndexByte(l, ':'); i > 0 {
+			fn(strings.ToLower(string(bytes.TrimSpace(l[:i]))),
+				bytes.TrimSpace(l[i+1:]))
+		}
+	}
+}
+
+// hostPort returns the host of host[:port] in b, with the brackets of an
+// IPv6 address.
+func hostPort(b []byte) []byte {
+	if len(b) > 0 && b[0] == '[' {
+		if i := bytes.IndexByte(b, ']'); i > 0 {
+			return b[:i+1]
+		}
+		return b
+	}
+	if i := bytes.IndexByte(b, ':'); i >= 0 &&
+		bytes.IndexByte(b[i+1:], ':') < 0 {
+		return b[:i]
+	}
+	return b
+}
+
+// rewriteHost anonymizes the host name or IP address in b in place, with IP
+// addresses anonymized for role r.
+func rewriteHost(b []byte, r Role, anon Anonymizer) {
+	if len(b) > 1 && b[0] == '[' && b[len(b)-1] == ']' {
+		b = b[1 : len(b)-1]
+	}
+	if !rewriteIP(b, r, anon) {
+		rewriteName(b, anon)
+	}
+}
+
+// rewriteName anonymizes each label of the host name in b in place, as in DNS
+// messages, so their pseudonyms are the same.
+func rewriteName(b []byte, anon Anonymizer) {
+	for _, l := range bytes.Split(b, []byte(".")) {
+		anon.Name(l)
+	}
+}
+
+// rewriteIP anonymizes the IPv4 or IPv6 address in b in place for role r,
+// returning false if b isn't one.
+func rewriteIP(b []byte, r Role, anon Anonymizer) bool {
+	return rewriteIPv4(b, '.', r, anon) || rewriteIPv6(b, r, anon)
+}
+
+// rewriteIPv4 anonymizes the IPv4 address written in decimal in b, with its
+// octets separated by sep, in place for role r, returning false if b isn't
+// one. The length is kept by padding the address with leading spaces, as
+// leading zeros may be read as octal, or if the anonymized address is longer,
+// it's replaced with the zero address.
+func rewriteIPv4(b []byte, sep byte, r Role, anon Anonymizer) bool {
+	f := bytes.Split(b, []byte{sep})
+	if len(f) != 4 {
+		return false
+	}
+	ip := make([]byte, 4)
+	for i, o := range f {
+		v, err := strconv.Atoi(string(o))
+		if err != nil || len(o) > 3 || o[0] < '0' || o[0] > '9' || v > 255 {
+			return false
+		}
+		ip[i] = byte(v)
+	}
+	anon.IPv4(ip, r)
+	if !padIPv4(b, ip, sep) {
+		padIPv4(b, make([]byte, 4), sep)
+	}
+	return true
+}
+
+// padIPv4 writes IPv4 address ip to b in decimal, with its octets separated
+// by sep, padded with leading spaces to fill b, or returns false if it doesn't
+// fit.
+func padIPv4(b, ip []byte, sep byte) bool {
+	var s []byte
+	for i, o := range ip {
+		if i > 0 {
+			s = append(s, sep)
+		}
+		s = strconv.AppendUint(s, uint64(o), 10)
+	}
+	n := len(b) - len(s)
+	if n < 0 {
+		return false
+	}
+	for i := range b[:n] {
+		b[i] = ' '
+	}
+	copy(b[n:], s)
+	return true
+}
+
+// rewriteIPv6 anonymizes the IPv6 address written in b in place for role r,
+// returning false if b isn't one. The length is kept by padding groups with
+// leading zeros and compressing zero groups as needed, or if the anonymized
+// address can't be written in the same length, it's replaced with the zero
+// address.
+func rewriteIPv6(b []byte, r Role, anon Anonymizer) bool {
+	if bytes.IndexByte(b, ':') < 0 {
+		return false
+	}
+	ip := net.ParseIP(string(b))
+	if ip == nil {
+		return false
+	}
+	anon.IPv6(ip, r)
+	if !padIPv6(b, ip) && !padIPv6(b, make([]byte, 16)) {
+		anon.Text(b)
+	}
+	return true
+}
+
+// padIPv6 writes IPv6 address ip to b in hex, padding groups with leading
+// zeros, and compressing a run of zero groups if needed, to fill b, or
+// returns false if it can't.
+func padIPv6(b, ip []byte) bool {
+	var g []string
+	for i := 0; i < 16; i += 2 {
+		g = append(g, strconv.FormatUint(
+			uint64(binary.BigEndian.Uint16(ip[i:])), 16))
+	}
+	if padGroups(b, g, nil, false) {
+		return true
+	}
+	for i := range g {
+		for j := i; j < len(g) && g[j] == "0"; j++ {
+			if padGroups(b, g[:i], g[j+1:], true) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// padGroups writes the IPv6 groups left, and if compressed, "::" and the
+// groups right, to b, padding groups with leading zeros to fill it, or
+// returns false if they don't fit.
+func padGroups(b []byte, left, right []string, compressed bool) bool {
+	n, room := 0, 0
+	for _, gs := range [][]string{left, right} {
+		for _, g := range gs {
+			n += len(g)
+			room += 4 - len(g)
+		}
+		if len(gs) > 1 {
+			n += len(gs) - 1
+		}
+	}
+	if compressed {
+		n += 2
+	}
+	extra := len(b) - n
+	if extra < 0 || extra > room {
+		return false
+	}
+	var s []byte
+	pad := func(gs []string) {
+		for i, g := range gs {
+			if i > 0 {
+				s = append(s, ':')
+			}
+			for ; extra > 0 && len(g) < 4; extra-- {
+				g = "0" + g
+			}
+			s = append(s, g...)
+		}
+	}
+	pad(left)
+	if compressed {
+		s = append(s, ':', ':')
+		pad(right)
+	}
+	copy(b, s)
+	return true
+}
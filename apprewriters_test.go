@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ipSetter is an Anonymizer that replaces IPv4 addresses with ip, leaving
+// other fields untouched.
+type ipSetter struct {
+	fieldLocator
+	ip []byte
+}
+
+func (s *ipSetter) IPv4(b []byte, r Role) { copy(b, s.ip) }
+
+func TestRewriteIPv4(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		sep  byte
+		ip   []byte
+		ok   bool
+		want string
+	}{
+		{"192.168.100.200", '.', []byte{10, 0, 0, 1}, true,
+			"       10.0.0.1"},
+		{"10.0.0.1", '.', []byte{10, 0, 0, 2}, true, "10.0.0.2"},
+		{"010.0.0.1", '.', []byte{10, 0, 0, 1}, true, " 10.0.0.1"},
+		{"10.0.0.1", '.', []byte{192, 168, 100, 200}, true, " 0.0.0.0"},
+		{"10,0,0,1", ',', []byte{172, 16, 0, 1}, true, " 0,0,0,0"},
+		{"172,16,0,1", ',', []byte{10, 0, 0, 1}, true, "  10,0,0,1"},
+		{"10.0.0", '.', nil, false, "10.0.0"},
+		{"10.0.0.256", '.', nil, false, "10.0.0.256"},
+		{"10.0.0.+1", '.', nil, false, "10.0.0.+1"},
+		{"10.0.0.0001", '.', nil, false, "10.0.0.0001"},
+		{"10.0.0.1", ',', nil, false, "10.0.0.1"},
+	} {
+		b := []byte(c.in)
+		ok := rewriteIPv4(b, c.sep, Src, &ipSetter{ip: c.ip})
+		if ok != c.ok || string(b) != c.want {
+			t.Errorf("%q: got %t, %q, want %t, %q", c.in, ok, b, c.ok,
+				c.want)
+		}
+	}
+}
+
+func TestHeaderEnd(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want int
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\nbody", 27},
+		{"GET / HTTP/1.1\nHost: a\n\nbody", 24},
+		{"\r\n", 2},
+		{"GET / HTTP/1.1\r\nHost: a\r\n", 0},
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r", 0},
+		{"", 0},
+	} {
+		if got := headerEnd([]byte(c.in)); got != c.want {
+			t.Errorf("%q: got %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:db8::1]:443", "[2001:db8::1]"},
+		{"[2001:db8::1]", "[2001:db8::1]"},
+		{"[2001:db8::1", "[2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"", ""},
+	} {
+		if got := hostPort([]byte(c.in)); string(got) != c.want {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestHTTPRewriter(t *testing.T) {
+	// each case is a sequence of segments given to one rewriter, with the
+	// length returned for each
+	type step struct {
+		in   string
+		want int
+	}
+	for _, c := range []struct {
+		name  string
+		steps []step
+		names []string
+	}{
+		{"content length", []step{
+			{"POST / HTTP/1.1\r\nHost: a.b\r\nContent-Length: 4\r\n\r\nbody",
+				53},
+			{"GET / HTTP/1.1\r\nHost: c\r\n\r\n", 27},
+		}, []string{"a", "b", "c"}},
+		{"chunked", []step{
+			{"POST / HTTP/1.1\r\nHost: a\r\n" +
+				"Transfer-Encoding: gzip, chunked\r\n\r\n", 62},
+			{"4\r\nwiki\r\n", 9},
+			{"5;ext=1\r\npedia\r\n", 16},
+			{"0\r\nTrailer: x\r\n\r\n", 17},
+			{"GET / HTTP/1.1\r\nHost: c\r\n\r\n", 27},
+		}, []string{"a", "c"}},
+		{"incomplete chunk size", []step{
+			{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", 47},
+			{"4", 0},
+			{"0\r\n", 0},
+			{"0\r\n\r\n", 5},
+		}, nil},
+		{"invalid chunk size", []step{
+			{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", 47},
+			{"zz\r\n", -1},
+		}, nil},
+		{"incomplete", []step{
+			{"GET / HTTP/1.1\r\nHost: a\r\n", 0},
+		}, nil},
+		{"invalid content length", []step{
+			{"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", -1},
+		}, nil},
+		{"unknown coding", []step{
+			{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", -1},
+		}, nil},
+	} {
+		r := &fieldRecorder{}
+		h := newHTTPRewriter()
+		for i, s := range c.steps {
+			if got := h.Rewrite([]byte(s.in), false, r); got != s.want {
+				t.Errorf("%s: step %d: got %d, want %d", c.name, i, got,
+					s.want)
+			}
+		}
+		if !reflect.DeepEqual(r.names, c.names) {
+			t.Errorf("%s: got names %q, want %q", c.name, r.names, c.names)
+		}
+	}
+}
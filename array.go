@@ -1,5 +1,11 @@
 package main
 
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func isAllZeroes(b []byte) bool {
 	z := true
 	for _, x := range b {
@@ -37,6 +43,13 @@ func toSlice4(b []byte, a [4]byte) {
 	}
 }
 
+func toArray6(b []byte) (ba [6]byte) {
+	for i, x := range b {
+		ba[i] = x
+	}
+	return
+}
+
 func toArray16(b []byte) (ba [16]byte) {
 	for i, x := range b {
 		ba[i] = x
@@ -49,3 +62,9 @@ func toSlice16(b []byte, a [16]byte) {
 		b[i] = x
 	}
 }
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
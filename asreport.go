@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+var asReportPath = flag.String("as-report", "",
+	"file to write a table of the anonymized addresses and the origin ASes of "+
+		"their originals to, from -routes")
+
+var routesPath = flag.String("routes", "",
+	"routing table dump for -as-report, with a prefix and origin AS per line "+
+		"(CAIDA pfx2as or bgpdump -m)")
+
+// RoutingTable maps prefixes to their origin ASes, for longest prefix
+// matches. IPv4 prefixes are kept in their IPv4-mapped IPv6 form.
+type RoutingTable struct {
+	prefixes map[int]map[[16]byte]string
+	lens     []int
+}
+
+// ReadRoutingTable reads a routing table dump from r. Each line holds a
+// prefix in CIDR notation and its origin AS, an address, prefix length and
+// origin AS, as in CAIDA's pfx2as files, or a route in bgpdump -m format,
+// with the last AS of the path as the origin. Origin ASes are kept as given,
+// so multi-origin prefixes and AS sets appear in the report as in the dump.
+// Blank lines and lines starting with # are ignored.
+func ReadRoutingTable(r io.Reader) (t *RoutingTable, err error) {
+	t = &RoutingTable{prefixes: make(map[int]map[[16]byte]string)}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if err = t.parse(s); err != nil {
+			err = fmt.Errorf("routing table line %d: %s", line, err)
+			return
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lens)))
+	return
+}
+
+// parse parses one route.
+func (t *RoutingTable) parse(s string) (err error) {
+	var prefix, origin string
+	if f := strings.Split(s, "|"); len(f) > 1 {
+		if len(f) < 7 {
+			return fmt.Errorf("expected bgpdump -m route: %s", s)
+		}
+		path := strings.Fields(f[6])
+		if len(path) == 0 {
+			return fmt.Errorf("empty AS path: %s", s)
+		}
+		prefix, origin = f[5], path[len(path)-1]
+	} else {
+		switch f := strings.Fields(s); len(f) {
+		case 2:
+			prefix, origin = f[0], f[1]
+		case 3:
+			prefix, origin = f[0]+"/"+f[1], f[2]
+		default:
+			return fmt.Errorf("expected prefix and origin AS: %s", s)
+		}
+	}
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %s", prefix)
+	}
+	l, _ := n.Mask.Size()
+	if n.IP.To4() != nil {
+		l += 96
+	}
+	m, ok := t.prefixes[l]
+	if !ok {
+		m = make(map[[16]byte]string)
+		t.prefixes[l] = m
+		t.lens = append(t.lens, l)
+	}
+	m[to16(n.IP)] = origin
+	return
+}
+
+// loadRoutingTable reads the routing table dump at path.
+func loadRoutingTable(path string) (*RoutingTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRoutingTable(f)
+}
+
+// origin returns the origin AS of the longest prefix containing address a,
+// and false if there's none.
+func (t *RoutingTable) origin(a [16]byte) (string, bool) {
+	for _, l := range t.lens {
+		if o, ok := t.prefixes[l][to16(maskBits(a[:], l))]; ok {
+			return o, true
+		}
+	}
+	return "", false
+}
+
+// ASReport wraps an Anonymizer and records the origin AS of each IPv4 and
+// IPv6 address it anonymizes, looked up by the original address, so
+// recipients of a trace can do AS-level analysis without seeing the real
+// prefixes. The report is written in the CIDR notation format of the routing
+// table dumps, with one host prefix per anonymized address.
+type ASReport struct {
+	Anonymizer
+	routes *RoutingTable
+
+	// NoRoute is the number of distinct addresses without a route.
+	NoRoute int
+
+	origins  map[[16]byte]string
+	noRoutes map[[16]byte]bool
+}
+
+// NewASReport returns a new, empty report wrapping a, with origin ASes from
+// routing table t.
+func NewASReport(a Anonymizer, t *RoutingTable) *ASReport {
+	return &ASReport{
+		Anonymizer: a,
+		routes:     t,
+		origins:    make(map[[16]byte]string),
+		noRoutes:   make(map[[16]byte]bool),
+	}
+}
+
+// IPv4 anonymizes an IPv4 address, recording its origin AS.
+func (r *ASReport) IPv4(b []byte, role Role) {
+	o := to16(b)
+	r.Anonymizer.IPv4(b, role)
+	r.add(o, to16(b))
+}
+
+// IPv6 anonymizes an IPv6 address, recording its origin AS.
+func (r *ASReport) IPv6(b []byte, role Role) {
+	o := to16(b)
+	r.Anonymizer.IPv6(b, role)
+	r.add(o, to16(b))
+}
+
+// add records the origin AS of original address o for anonymized address a.
+func (r *ASReport) add(o, a [16]byte) {
+	if _, ok := r.origins[a]; ok || r.noRoutes[a] {
+		return
+	}
+	if as, ok := r.routes.origin(o); ok {
+		r.origins[a] = as
+	} else {
+		r.noRoutes[a] = true
+		r.NoRoute++
+	}
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (r *ASReport) Stats() (s AnonymizerStats) {
+	if sa, ok := r.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (r *ASReport) Err() (err error) {
+	if ea, ok := r.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// Addresses returns the number of addresses with an origin AS.
+func (r *ASReport) Addresses() int {
+	return len(r.origins)
+}
+
+// Write writes the report to w, by anonymized address.
+func (r *ASReport) Write(w io.Writer) (err error) {
+	var ks [][16]byte
+	for k := range r.origins {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return bytes.Compare(ks[i][:], ks[j][:]) < 0
+	})
+	for _, k := range ks {
+		ip := net.IP(k[:])
+		l := 128
+		if ip.To4() != nil {
+			l = 32
+		}
+		if _, err = fmt.Fprintf(w, "%s/%d %s\n", ip, l,
+			r.origins[k]); err != nil {
+			return
+		}
+	}
+	return
+}
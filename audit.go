@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// AuditAnonymizer wraps an Anonymizer and records the type, offset and
+// length of each field it changes, but never the values. Offsets are found
+// from slice capacities, so handlers must pass subslices of the packet.
+type AuditAnonymizer struct {
+	Anonymizer
+	w      io.Writer
+	pkt    []byte
+	fields []auditField
+	totals map[string]auditTotal
+}
+
+type auditField struct {
+	typ    string
+	offset int
+	len    int
+}
+
+// auditTotal is the number of fields of a type recorded, and their length.
+type auditTotal struct {
+	fields uint64
+	bytes  uint64
+}
+
+// NewAuditAnonymizer returns a new audit anonymizer that writes CSV records to
+// w.
+func NewAuditAnonymizer(a Anonymizer, w io.Writer) (*AuditAnonymizer, error) {
+	if _, err := fmt.Fprintln(w, "packet,field,offset,len"); err != nil {
+		return nil, err
+	}
+	return &AuditAnonymizer{Anonymizer: a, w: w,
+		totals: make(map[string]auditTotal)}, nil
+}
+
+// Begin starts auditing a packet.
+func (a *AuditAnonymizer) Begin(b []byte) {
+	a.pkt = b
+	a.fields = a.fields[:0]
+}
+
+// End writes the records for packet number i, truncated to n bytes. Fields
+// that were truncated away aren't recorded.
+func (a *AuditAnonymizer) End(i uint64, n int) (err error) {
+	if n < len(a.pkt) {
+		a.fields = append(a.fields, auditField{"truncate", n, len(a.pkt) - n})
+	}
+	for _, f := range a.fields {
+		if f.typ != "truncate" && f.offset >= n {
+			continue
+		}
+		if _, err = fmt.Fprintf(a.w, "%d,%s,%d,%d\n", i, f.typ, f.offset,
+			f.len); err != nil {
+			return
+		}
+		t := a.totals[f.typ]
+		t.fields++
+		t.bytes += uint64(f.len)
+		a.totals[f.typ] = t
+	}
+	return
+}
+
+// WriteTotals writes the number of fields recorded of each type and their
+// length, where truncate counts the packets truncated or dropped.
+func (a *AuditAnonymizer) WriteTotals(w io.Writer) (err error) {
+	var types []string
+	for t := range a.totals {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		n := "fields"
+		if t == "truncate" {
+			n = "packets"
+		}
+		if _, err = fmt.Fprintf(w, "%s: %d %s, %d bytes\n", t,
+			a.totals[t].fields, n, a.totals[t].bytes); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// record records field b of type typ if the wrapped anonymizer changed it.
+func (a *AuditAnonymizer) record(typ string, b []byte, changed uint64) {
+	if a.Anonymizer.Changed() != changed {
+		a.fields = append(a.fields,
+			auditField{typ, cap(a.pkt) - cap(b), len(b)})
+	}
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (a *AuditAnonymizer) Stats() (s AnonymizerStats) {
+	if sa, ok := a.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (a *AuditAnonymizer) Err() (err error) {
+	if ea, ok := a.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// MAC anonymizes and audits a MAC address.
+func (a *AuditAnonymizer) MAC(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.MAC(b)
+	a.record("mac", b, c)
+}
+
+// EUI64 anonymizes and audits an EUI-64.
+func (a *AuditAnonymizer) EUI64(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.EUI64(b)
+	a.record("eui64", b, c)
+}
+
+// DevAddr anonymizes and audits a LoRaWAN DevAddr.
+func (a *AuditAnonymizer) DevAddr(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.DevAddr(b)
+	a.record("devaddr", b, c)
+}
+
+// IPv4 anonymizes and audits an IPv4 address.
+func (a *AuditAnonymizer) IPv4(b []byte, r Role) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.IPv4(b, r)
+	a.record("ipv4", b, c)
+}
+
+// IPv6 anonymizes and audits an IPv6 address.
+func (a *AuditAnonymizer) IPv6(b []byte, r Role) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.IPv6(b, r)
+	a.record("ipv6", b, c)
+}
+
+// Sequence anonymizes and audits an 802.11 sequence number.
+func (a *AuditAnonymizer) Sequence(b []byte, ta, anonTA []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Sequence(b, ta, anonTA)
+	a.record("seq", b, c)
+}
+
+// CANID anonymizes and audits a CAN ID.
+func (a *AuditAnonymizer) CANID(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.CANID(b)
+	a.record("can-id", b, c)
+}
+
+// CANData anonymizes and audits CAN frame data.
+func (a *AuditAnonymizer) CANData(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.CANData(b)
+	a.record("can-data", b, c)
+}
+
+// Port anonymizes and audits a port.
+func (a *AuditAnonymizer) Port(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Port(b)
+	a.record("port", b, c)
+}
+
+// Name anonymizes and audits a name.
+func (a *AuditAnonymizer) Name(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Name(b)
+	a.record("name", b, c)
+}
+
+// ID anonymizes and audits an opaque identifier.
+func (a *AuditAnonymizer) ID(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.ID(b)
+	a.record("id", b, c)
+}
+
+// Timestamp anonymizes and audits a hardware timestamp.
+func (a *AuditAnonymizer) Timestamp(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Timestamp(b)
+	a.record("timestamp", b, c)
+}
+
+// BeaconTimestamp anonymizes and audits a beacon timestamp.
+func (a *AuditAnonymizer) BeaconTimestamp(b []byte, ta []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.BeaconTimestamp(b, ta)
+	a.record("timestamp", b, c)
+}
+
+// Country anonymizes and audits a country IE.
+func (a *AuditAnonymizer) Country(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Country(b)
+	a.record("country", b, c)
+}
+
+// VendorData anonymizes and audits vendor data.
+func (a *AuditAnonymizer) VendorData(b []byte, oui []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.VendorData(b, oui)
+	a.record("vendor", b, c)
+}
+
+// Text anonymizes and audits free text.
+func (a *AuditAnonymizer) Text(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.Text(b)
+	a.record("text", b, c)
+}
+
+// VLAN anonymizes and audits a VLAN ID.
+func (a *AuditAnonymizer) VLAN(b []byte) {
+	c := a.Anonymizer.Changed()
+	a.Anonymizer.VLAN(b)
+	a.record("vlan", b, c)
+}
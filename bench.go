@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var benchPackets = flag.Int("bench-packets", 200000,
+	"number of packets per benchmark run by the bench command")
+var cpuProfile = flag.String("cpuprofile", "", "write a CPU profile to file")
+var memProfile = flag.String("memprofile", "",
+	"write a memory profile to file on exit")
+
+// benchMode is set by the bench command.
+var benchMode bool
+
+// benchAddrs is the number of distinct addresses in benchmark traffic.
+const benchAddrs = 4096
+
+// fieldLen is the length of fields in audit records.
+var fieldLen = map[string]int{"mac": 6, "eui64": 8, "devaddr": 4, "ipv4": 4,
+	"ipv6": 16}
+
+// benchTraffic returns n packets for link, cycling through the self test
+// frames with benchAddrs distinct values in each address field.
+func benchTraffic(link uint32, n int) (pkts [][]byte) {
+	var ts []selfTest
+	for _, t := range selfTests {
+		if t.link == link {
+			ts = append(ts, t)
+		}
+	}
+	for i := 0; i < n; i++ {
+		t := ts[i%len(ts)]
+		p := append([]byte(nil), t.pkt...)
+		a := i / len(ts) % benchAddrs
+		for _, f := range t.fields {
+			s := strings.SplitN(f, "@", 2)
+			off, _ := strconv.Atoi(s[1])
+			if l, ok := fieldLen[s[0]]; ok {
+				p[off+l-2] = byte(a >> 8)
+				p[off+l-1] = byte(a)
+			}
+		}
+		pkts = append(pkts, p)
+	}
+	return
+}
+
+// runBench runs the benchmarks, writing results to w.
+func runBench(w io.Writer) (err error) {
+	var links []int
+	for l := range Handlers {
+		links = append(links, int(l))
+	}
+	sort.Ints(links)
+	for _, l := range links {
+		pkts := benchTraffic(uint32(l), *benchPackets)
+		var sz int
+		for _, p := range pkts {
+			sz += len(p)
+		}
+		pcap := selfTestPcap(uint32(l), pkts)
+		for _, m := range []AnonMethod{Encrypt, Pseudonym, Leave} {
+			// the input is anonymized in place, so use a fresh copy
+			in := bytes.NewBuffer(append([]byte(nil), pcap...))
+			cfg := &Config{Truncate: true}
+			t0 := time.Now()
+			if _, err = run(context.Background(), in, ioutil.Discard,
+				selfTestAnonymizer(m, false), cfg); err != io.EOF {
+				return
+			}
+			err = nil
+			d := time.Since(t0).Seconds()
+			fmt.Fprintf(w, "link type %d, %s: %d packets in %.3fs, "+
+				"%.0f packets/sec, %.1f MB/sec\n", l, m, len(pkts), d,
+				float64(len(pkts))/d, float64(sz)/d/1000000)
+		}
+	}
+	return
+}
+
+// startProfile starts any profiles requested by flags, and returns a function
+// to stop them.
+func startProfile() (stop func()) {
+	var cf *os.File
+	if *cpuProfile != "" {
+		var err error
+		if cf, err = os.Create(*cpuProfile); err != nil {
+			errorf("%s", err)
+			os.Exit(1)
+		}
+		if err = pprof.StartCPUProfile(cf); err != nil {
+			errorf("%s", err)
+			os.Exit(1)
+		}
+	}
+	return func() {
+		if cf != nil {
+			pprof.StopCPUProfile()
+			cf.Close()
+		}
+		if *memProfile != "" {
+			f, err := os.Create(*memProfile)
+			if err != nil {
+				errorf("%s", err)
+				return
+			}
+			runtime.GC()
+			if err = pprof.WriteHeapProfile(f); err != nil {
+				errorf("%s", err)
+			}
+			f.Close()
+		}
+	}
+}
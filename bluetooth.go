@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// H4 packet types
+const (
+	h4Command = 1
+	h4ACL     = 2
+	h4SCO     = 3
+	h4Event   = 4
+	h4ISO     = 5
+)
+
+// HCI events that need more than a fixed layout
+const (
+	evInquiryResult     = 0x02
+	evCommandComplete   = 0x0e
+	evInquiryResultRSSI = 0x22
+	evExtInquiryResult  = 0x2f
+	evLEMeta            = 0x3e
+)
+
+// LE meta subevents that need more than a fixed layout
+const (
+	leAdvReport         = 0x02
+	leDirectedAdvReport = 0x0b
+	leExtAdvReport      = 0x0d
+)
+
+// Linux Bluetooth monitor opcodes
+const (
+	monNewIndex    = 0
+	monDelIndex    = 1
+	monOpenIndex   = 8
+	monCloseIndex  = 9
+	monIndexInfo   = 10
+	monSystemNote  = 12
+	monUserLogging = 13
+)
+
+// monH4Types maps the Linux monitor opcodes for HCI packets to their H4
+// types.
+var monH4Types = map[uint16]byte{
+	2:  h4Command,
+	3:  h4Event,
+	4:  h4ACL,
+	5:  h4ACL,
+	6:  h4SCO,
+	7:  h4SCO,
+	18: h4ISO,
+	19: h4ISO,
+}
+
+// kinds of HCI parameter fields
+const (
+	hfKeep = iota // kept as is
+	hfAddr        // BD_ADDR
+)
+
+// hciField is a fixed field in the parameters of an HCI packet.
+type hciField struct {
+	kind int
+	size int
+}
+
+// hciCommands are the fixed fields in the parameters of the HCI commands that
+// are understood, by opcode. Anything that follows, such as keys, PINs and
+// passkeys, isn't handled.
+var hciCommands = map[uint16][]hciField{
+	0x0401: {{hfKeep, 5}},               // inquiry: LAP, length, responses
+	0x0402: {},                          // inquiry cancel
+	0x0405: {{hfAddr, 6}, {hfKeep, 7}},  // create connection
+	0x0406: {{hfKeep, 3}},               // disconnect: handle, reason
+	0x0408: {{hfAddr, 6}},               // create connection cancel
+	0x0409: {{hfAddr, 6}, {hfKeep, 1}},  // accept connection: role
+	0x040a: {{hfAddr, 6}, {hfKeep, 1}},  // reject connection: reason
+	0x040b: {{hfAddr, 6}},               // link key request reply
+	0x040c: {{hfAddr, 6}},               // link key request negative reply
+	0x040d: {{hfAddr, 6}},               // PIN code request reply
+	0x040e: {{hfAddr, 6}},               // PIN code request negative reply
+	0x0419: {{hfAddr, 6}, {hfKeep, 4}},  // remote name request
+	0x041a: {{hfAddr, 6}},               // remote name request cancel
+	0x0429: {{hfAddr, 6}, {hfKeep, 15}}, // accept synchronous connection
+	0x042a: {{hfAddr, 6}, {hfKeep, 1}},  // reject synchronous connection
+	0x042b: {{hfAddr, 6}, {hfKeep, 3}},  // IO capability request reply
+	0x042c: {{hfAddr, 6}},               // user confirmation request reply
+	0x042d: {{hfAddr, 6}},               // user confirmation negative reply
+	0x042e: {{hfAddr, 6}},               // user passkey request reply
+	0x042f: {{hfAddr, 6}},               // user passkey negative reply
+	0x0430: {{hfAddr, 6}},               // remote OOB data request reply
+	0x0433: {{hfAddr, 6}},               // remote OOB data negative reply
+	0x0434: {{hfAddr, 6}, {hfKeep, 1}},  // IO capability negative reply
+	0x0c01: {{hfKeep, 8}},               // set event mask
+	0x0c03: {},                          // reset
+	0x0c0d: {{hfAddr, 6}, {hfKeep, 1}},  // read stored link key
+	0x0c12: {{hfAddr, 6}, {hfKeep, 1}},  // delete stored link key
+	0x1001: {},                          // read local version
+	0x1002: {},                          // read local supported commands
+	0x1003: {},                          // read local supported features
+	0x1005: {},                          // read buffer size
+	0x1009: {},                          // read BD_ADDR
+	0x2001: {{hfKeep, 8}},               // LE set event mask
+	0x2002: {},                          // LE read buffer size
+	0x2005: {{hfAddr, 6}},               // LE set random address
+	0x200a: {{hfKeep, 1}},               // LE set advertising enable
+	0x200b: {{hfKeep, 7}},               // LE set scan parameters
+	0x200c: {{hfKeep, 2}},               // LE set scan enable
+	0x200e: {},                          // LE create connection cancel
+	0x2010: {},                          // LE read accept list size
+	0x2011: {{hfKeep, 1}, {hfAddr, 6}},  // LE add device to accept list
+	0x2012: {{hfKeep, 1}, {hfAddr, 6}},  // LE remove from accept list
+	0x2027: {{hfKeep, 1}, {hfAddr, 6}},  // LE add to resolving list
+	0x2028: {{hfKeep, 1}, {hfAddr, 6}},  // LE remove from resolving list
+	0x2035: {{hfKeep, 1}, {hfAddr, 6}},  // LE set advertising set address
+	0x2042: {{hfKeep, 6}},               // LE set extended scan enable
+	0x2043: {{hfKeep, 3}, {hfAddr, 6}},  // LE extended create connection
+
+	// LE set advertising parameters: intervals, type and address types, then
+	// peer address, channel map and filter policy
+	0x2006: {{hfKeep, 7}, {hfAddr, 6}, {hfKeep, 2}},
+	// LE create connection: scan interval and window, filter policy and peer
+	// address type, then peer address, own address type and parameters
+	0x200d: {{hfKeep, 6}, {hfAddr, 6}, {hfKeep, 13}},
+	// LE set extended advertising parameters
+	0x2036: {{hfKeep, 12}, {hfAddr, 6}, {hfKeep, 7}},
+}
+
+// hciReturns are the fixed fields in the return parameters of the Command
+// Complete events that are understood, by opcode, starting with the status.
+var hciReturns = map[uint16][]hciField{
+	0x0401: {{hfKeep, 1}},
+	0x0402: {{hfKeep, 1}},
+	0x0408: {{hfKeep, 1}, {hfAddr, 6}},
+	0x040b: {{hfKeep, 1}, {hfAddr, 6}},
+	0x040c: {{hfKeep, 1}, {hfAddr, 6}},
+	0x040d: {{hfKeep, 1}, {hfAddr, 6}},
+	0x040e: {{hfKeep, 1}, {hfAddr, 6}},
+	0x041a: {{hfKeep, 1}, {hfAddr, 6}},
+	0x042b: {{hfKeep, 1}, {hfAddr, 6}},
+	0x042c: {{hfKeep, 1}, {hfAddr, 6}},
+	0x042d: {{hfKeep, 1}, {hfAddr, 6}},
+	0x042e: {{hfKeep, 1}, {hfAddr, 6}},
+	0x042f: {{hfKeep, 1}, {hfAddr, 6}},
+	0x0430: {{hfKeep, 1}, {hfAddr, 6}},
+	0x0433: {{hfKeep, 1}, {hfAddr, 6}},
+	0x0434: {{hfKeep, 1}, {hfAddr, 6}},
+	0x0c01: {{hfKeep, 1}},
+	0x0c03: {{hfKeep, 1}},
+	0x0c0d: {{hfKeep, 5}},  // max and number of keys read
+	0x0c12: {{hfKeep, 3}},  // number of keys deleted
+	0x1001: {{hfKeep, 9}},  // versions and manufacturer
+	0x1002: {{hfKeep, 65}}, // supported commands
+	0x1003: {{hfKeep, 9}},  // features
+	0x1005: {{hfKeep, 8}},  // buffer sizes
+	0x1009: {{hfKeep, 1}, {hfAddr, 6}},
+	0x2001: {{hfKeep, 1}},
+	0x2002: {{hfKeep, 4}}, // buffer size
+	0x2005: {{hfKeep, 1}},
+	0x2006: {{hfKeep, 1}},
+	0x200a: {{hfKeep, 1}},
+	0x200b: {{hfKeep, 1}},
+	0x200c: {{hfKeep, 1}},
+	0x200e: {{hfKeep, 1}},
+	0x2010: {{hfKeep, 2}}, // accept list size
+	0x2011: {{hfKeep, 1}},
+	0x2012: {{hfKeep, 1}},
+	0x2027: {{hfKeep, 1}},
+	0x2028: {{hfKeep, 1}},
+	0x2035: {{hfKeep, 1}},
+	0x2036: {{hfKeep, 2}}, // selected TX power
+	0x2042: {{hfKeep, 1}},
+}
+
+// hciEvents are the fixed fields in the parameters of the HCI events that are
+// understood, by event code. Anything that follows, such as names and keys,
+// isn't handled.
+var hciEvents = map[byte][]hciField{
+	0x01: {{hfKeep, 1}},                           // inquiry complete
+	0x03: {{hfKeep, 3}, {hfAddr, 6}, {hfKeep, 2}}, // connection complete
+	0x04: {{hfAddr, 6}, {hfKeep, 4}},              // connection request
+	0x05: {{hfKeep, 4}},                           // disconnection complete
+	0x07: {{hfKeep, 1}, {hfAddr, 6}},              // remote name complete
+	0x08: {{hfKeep, 4}},                           // encryption change
+	0x0f: {{hfKeep, 4}},                           // command status
+	0x12: {{hfKeep, 1}, {hfAddr, 6}, {hfKeep, 1}}, // role change
+	0x13: {{hfKeep, 1}},                           // completed packets
+	0x16: {{hfAddr, 6}},                           // PIN code request
+	0x17: {{hfAddr, 6}},                           // link key request
+	0x18: {{hfAddr, 6}},                           // link key notification
+	0x2c: {{hfKeep, 3}, {hfAddr, 6}, {hfKeep, 8}}, // sync connection complete
+	0x31: {{hfAddr, 6}},                           // IO capability request
+	0x32: {{hfAddr, 6}, {hfKeep, 3}},              // IO capability response
+	0x33: {{hfAddr, 6}},                           // user confirmation request
+	0x34: {{hfAddr, 6}},                           // user passkey request
+	0x35: {{hfAddr, 6}},                           // remote OOB data request
+	0x36: {{hfKeep, 1}, {hfAddr, 6}},              // simple pairing complete
+	0x3b: {{hfAddr, 6}},                           // user passkey notification
+	0x3d: {{hfAddr, 6}, {hfKeep, 8}},              // remote host features
+}
+
+// hciLEEvents are the fixed fields after the subevent code of the LE meta
+// events that are understood, by subevent.
+var hciLEEvents = map[byte][]hciField{
+	// connection complete: status, handle, role and peer address type, then
+	// peer address, parameters and clock accuracy
+	0x01: {{hfKeep, 5}, {hfAddr, 6}, {hfKeep, 7}},
+	0x03: {{hfKeep, 9}},  // connection update complete
+	0x04: {{hfKeep, 11}}, // remote features complete
+	0x05: {{hfKeep, 2}},  // long term key request: handle
+	// enhanced connection complete, with the peer address, and the local and
+	// peer resolvable private addresses
+	0x0a: {{hfKeep, 5}, {hfAddr, 6}, {hfAddr, 6}, {hfAddr, 6}, {hfKeep, 7}},
+	0x0c: {{hfKeep, 5}},              // PHY update complete
+	0x13: {{hfKeep, 2}, {hfAddr, 6}}, // scan request received
+}
+
+// BluetoothH4Handler anonymizes Bluetooth HCI packets in H4 format, with a
+// 4-byte direction pseudo-header.
+type BluetoothH4Handler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *BluetoothH4Handler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 5 {
+		err = fmt.Errorf("short H4 header (increase snaplen)")
+		return
+	}
+	return handleHCI(b, 5, b[4], anon)
+}
+
+// BluetoothMonitorHandler anonymizes Linux Bluetooth monitor packets, as
+// captured from the bluetooth-monitor interface. The controller address in
+// index packets is anonymized, and system notes and user logging are zeroed.
+type BluetoothMonitorHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *BluetoothMonitorHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 4 {
+		err = fmt.Errorf("short Bluetooth monitor header (increase snaplen)")
+		return
+	}
+	op := binary.BigEndian.Uint16(b[2:])
+	n = 4
+	if t, ok := monH4Types[op]; ok {
+		return handleHCI(b, n, t, anon)
+	}
+	switch op {
+	case monNewIndex:
+		// type, bus, address and name
+		return hciLayout(b, n, []hciField{{hfKeep, 2}, {hfAddr, 6},
+			{hfKeep, 8}}, anon)
+	case monIndexInfo:
+		// address and manufacturer
+		return hciLayout(b, n, []hciField{{hfAddr, 6}, {hfKeep, 2}}, anon)
+	case monDelIndex, monOpenIndex, monCloseIndex:
+	case monSystemNote:
+		if len(b) > n {
+			anon.Text(b[n:])
+		}
+		n = len(b)
+	case monUserLogging:
+		// priority and ident length, then ident and message
+		if len(b) < n+2 {
+			err = fmt.Errorf("short Bluetooth monitor log (increase snaplen)")
+			return
+		}
+		if len(b) > n+2 {
+			anon.Text(b[n+2:])
+		}
+		n = len(b)
+	default:
+		err = ErrUnknown
+	}
+	return
+}
+
+// handleHCI anonymizes the HCI packet of H4 type t at offset n in b,
+// returning the offset after the parameters or headers that are understood.
+// ACL, SCO and ISO data is truncated after its headers.
+func handleHCI(b []byte, n int, t byte, anon Anonymizer) (int, error) {
+	short := func() error {
+		return fmt.Errorf("short HCI packet (increase snaplen)")
+	}
+	switch t {
+	case h4Command:
+		if n+3 > len(b) {
+			return n, short()
+		}
+		op := binary.LittleEndian.Uint16(b[n:])
+		n += 3
+		l, ok := hciCommands[op]
+		if !ok {
+			return n, ErrUnknown
+		}
+		return hciLayout(b, n, l, anon)
+	case h4Event:
+		if n+2 > len(b) {
+			return n, short()
+		}
+		return handleHCIEvent(b, n, anon)
+	case h4ACL:
+		// the L2CAP header is only in the first fragment
+		if n+4 > len(b) {
+			return n, short()
+		}
+		pb := b[n+1] >> 4 & 0x3
+		n += 4
+		if pb != 1 {
+			if n+4 > len(b) {
+				return n, short()
+			}
+			n += 4
+		}
+		return n, nil
+	case h4SCO:
+		if n+3 > len(b) {
+			return n, short()
+		}
+		return n + 3, nil
+	case h4ISO:
+		if n+4 > len(b) {
+			return n, short()
+		}
+		return n + 4, nil
+	}
+	return n, ErrUnknown
+}
+
+// handleHCIEvent anonymizes the HCI event at offset n in b.
+func handleHCIEvent(b []byte, n int, anon Anonymizer) (int, error) {
+	short := func() error {
+		return fmt.Errorf("short HCI event (increase snaplen)")
+	}
+	code := b[n]
+	n += 2
+	switch code {
+	case evCommandComplete:
+		// number of packets and opcode, then return parameters
+		if n+3 > len(b) {
+			return n, short()
+		}
+		op := binary.LittleEndian.Uint16(b[n+1:])
+		n += 3
+		l, ok := hciReturns[op]
+		if !ok {
+			return n, ErrUnknown
+		}
+		return hciLayout(b, n, l, anon)
+	case evInquiryResult, evInquiryResultRSSI, evExtInquiryResult:
+		// responses of 14 bytes, starting with the address, and for
+		// extended results, an EIR that isn't handled
+		if n+1 > len(b) {
+			return n, short()
+		}
+		nr := int(b[n])
+		n++
+		for i := 0; i < nr; i++ {
+			var err error
+			if n, err = hciLayout(b, n, []hciField{{hfAddr, 6},
+				{hfKeep, 8}}, anon); err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	case evLEMeta:
+		if n+1 > len(b) {
+			return n, short()
+		}
+		sub := b[n]
+		n++
+		switch sub {
+		case leAdvReport, leDirectedAdvReport, leExtAdvReport:
+			return handleAdvReports(b, n, sub, anon)
+		}
+		l, ok := hciLEEvents[sub]
+		if !ok {
+			return n, ErrUnknown
+		}
+		return hciLayout(b, n, l, anon)
+	}
+	l, ok := hciEvents[code]
+	if !ok {
+		return n, ErrUnknown
+	}
+	return hciLayout(b, n, l, anon)
+}
+
+// handleAdvReports anonymizes the LE advertising reports of subevent sub at
+// offset n in b. The advertising data, which can hold device names and vendor
+// identifiers, is zeroed.
+func handleAdvReports(b []byte, n int, sub byte, anon Anonymizer) (int, error) {
+	if n+1 > len(b) {
+		return n, fmt.Errorf("short LE advertising report (increase snaplen)")
+	}
+	nr := int(b[n])
+	n++
+	for i := 0; i < nr; i++ {
+		var l []hciField
+		switch sub {
+		case leAdvReport:
+			// event and address types, address and data length
+			l = []hciField{{hfKeep, 2}, {hfAddr, 6}, {hfKeep, 1}}
+		case leDirectedAdvReport:
+			// event and address types, address, direct address type,
+			// direct address and RSSI, with no data
+			l = []hciField{{hfKeep, 2}, {hfAddr, 6}, {hfKeep, 1}, {hfAddr, 6},
+				{hfKeep, 1}}
+		case leExtAdvReport:
+			// event and address types, address, PHYs, SID, TX power, RSSI,
+			// periodic interval, direct address type, direct address and
+			// data length
+			l = []hciField{{hfKeep, 3}, {hfAddr, 6}, {hfKeep, 8}, {hfAddr, 6},
+				{hfKeep, 1}}
+		}
+		var err error
+		if n, err = hciLayout(b, n, l, anon); err != nil {
+			return n, err
+		}
+		if sub == leDirectedAdvReport {
+			continue
+		}
+		dl := int(b[n-1])
+		if n+dl > len(b) {
+			return n, fmt.Errorf("short LE advertising data (increase snaplen)")
+		}
+		if dl > 0 {
+			anon.Text(b[n : n+dl])
+		}
+		n += dl
+		if sub == leAdvReport {
+			// RSSI
+			if n+1 > len(b) {
+				return n, fmt.Errorf("short LE advertising report " +
+					"(increase snaplen)")
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// hciLayout anonymizes the fixed fields in layout l at offset n in b,
+// returning the offset after them. All-zero addresses, which are unused, are
+// left alone.
+func hciLayout(b []byte, n int, l []hciField, anon Anonymizer) (int, error) {
+	for _, f := range l {
+		if n+f.size > len(b) {
+			return n, fmt.Errorf("short HCI packet trying to slurp %d bytes "+
+				"at pos %d (increase snaplen)", f.size, n)
+		}
+		if f.kind == hfAddr && !isAllZeroes(b[n:n+f.size]) {
+			btAddr(b[n:n+f.size], anon)
+		}
+		n += f.size
+	}
+	return n, nil
+}
+
+// btAddr anonymizes a BD_ADDR, which is sent least significant byte first.
+func btAddr(b []byte, anon Anonymizer) {
+	reverse(b)
+	anon.MAC(b)
+	reverse(b)
+}
@@ -0,0 +1,75 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	PseudonymStores["bolt"] = openBoltStore
+}
+
+// BoltStore is a PseudonymStore in a BoltDB file, with a bucket for each
+// class, for captures with more addresses than fit in memory. The file is
+// locked while it's open, so it can't be shared by processes, but keeps
+// pseudonyms across runs. Writes aren't synced until the store is closed.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the store for a bolt:file URL, creating the file if
+// needed.
+func openBoltStore(url string) (PseudonymStore, error) {
+	db, err := bolt.Open(strings.TrimPrefix(url, "bolt:"), 0600,
+		&bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	return &BoltStore{db}, nil
+}
+
+// Get returns the pseudonym for orig.
+func (s *BoltStore) Get(class string, orig []byte) (p []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(class)); bk != nil {
+			if v := bk.Get(orig); v != nil {
+				p = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Put stores pseudo as the pseudonym for orig, unless one was stored first.
+func (s *BoltStore) Put(class string, orig, pseudo []byte) (p []byte,
+	err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(class))
+		if err != nil {
+			return err
+		}
+		if v := bk.Get(orig); v != nil {
+			p = append([]byte(nil), v...)
+			return nil
+		}
+		p = append([]byte(nil), pseudo...)
+		return bk.Put(orig, p)
+	})
+	return
+}
+
+// Close syncs and closes the file.
+func (s *BoltStore) Close() (err error) {
+	err = s.db.Sync()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
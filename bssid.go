@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+var bssidReportPath = flag.String("bssid-report", "",
+	"file to write a report of the anonymized BSSIDs in a radiotap + 802.11 "+
+		"capture to")
+
+// BSSIDReport is an inventory of the BSSIDs in a radiotap + 802.11 capture,
+// with their stations, frame counts and SSIDs, by anonymized address. SSIDs
+// are given as aliases, numbered in the order they're first seen.
+type BSSIDReport struct {
+	bssids map[[6]byte]*bssidEntry
+	ssids  map[string]int
+}
+
+type bssidEntry struct {
+	frames   uint64
+	stations map[[6]byte]bool
+	ssids    map[int]bool
+}
+
+// NewBSSIDReport returns a new, empty BSSID report.
+func NewBSSIDReport() *BSSIDReport {
+	return &BSSIDReport{
+		bssids: make(map[[6]byte]*bssidEntry),
+		ssids:  make(map[string]int),
+	}
+}
+
+// add adds a frame to the report, given its original and anonymized content.
+// The original is used to find the BSSID and stations, so group addresses can
+// be told apart after anonymization.
+func (r *BSSIDReport) add(orig, anon []byte) {
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(orig)) != nil {
+		return
+	}
+	off := int(rh.Len)
+	if off+24 > len(orig) || len(anon) < len(orig) || orig[off]&0x3 != 0 {
+		return
+	}
+	_, typ, styp := parseFC(orig[off])
+	tods, fromds, order := parseFlags(orig[off+1])
+	addr := func(i int) []byte {
+		return orig[off+4+6*i : off+10+6*i]
+	}
+
+	bi, si := bssidIndex(typ, styp, tods, fromds)
+	if bi < 0 || addr(bi)[0]&0x01 != 0 {
+		return
+	}
+	e := r.entry(anon[off+4+6*bi : off+10+6*bi])
+	e.frames++
+	for _, i := range si {
+		if a := addr(i); a[0]&0x01 == 0 && !bytes.Equal(a, addr(bi)) {
+			e.stations[toArray6(anon[off+4+6*i:off+10+6*i])] = true
+		}
+	}
+
+	// SSIDs, from the SSID IE in beacons and probe responses
+	if typ == typeMgmt && (styp == mgmtBeacon || styp == mgmtProbeResp) {
+		i := off + 24 + 12
+		if order {
+			i += 4
+		}
+		for i+2 <= len(orig) && i+2+int(orig[i+1]) <= len(orig) {
+			if orig[i] == 0 {
+				e.ssids[r.ssidAlias(orig[i+2:i+2+int(orig[i+1])])] = true
+				break
+			}
+			i += 2 + int(orig[i+1])
+		}
+	}
+}
+
+// bssidIndex returns the index of the BSSID among the first three addresses
+// of an 802.11 frame of the given type, subtype and DS bits, or -1 if it's not
+// there, and the indexes of the addresses that may be stations.
+func bssidIndex(typ, styp uint, tods, fromds bool) (bi int, si []int) {
+	bi = -1
+	switch typ {
+	case typeMgmt:
+		bi, si = 2, []int{0, 1}
+	case typeData:
+		switch {
+		case !tods && !fromds:
+			bi, si = 2, []int{0, 1}
+		case tods && !fromds:
+			bi, si = 0, []int{1}
+		case !tods && fromds:
+			bi, si = 1, []int{0}
+		}
+	case typeControl:
+		if styp == cfPSPoll {
+			bi, si = 0, []int{1}
+		}
+	}
+	return
+}
+
+// entry returns the entry for anonymized BSSID b, adding it if needed.
+func (r *BSSIDReport) entry(b []byte) *bssidEntry {
+	k := toArray6(b)
+	e, ok := r.bssids[k]
+	if !ok {
+		e = &bssidEntry{
+			stations: make(map[[6]byte]bool),
+			ssids:    make(map[int]bool),
+		}
+		r.bssids[k] = e
+	}
+	return e
+}
+
+// ssidAlias returns the alias number for ssid, or 0 if it's hidden.
+func (r *BSSIDReport) ssidAlias(ssid []byte) int {
+	if len(bytes.Trim(ssid, "\x00")) == 0 {
+		return 0
+	}
+	a, ok := r.ssids[string(ssid)]
+	if !ok {
+		a = len(r.ssids) + 1
+		r.ssids[string(ssid)] = a
+	}
+	return a
+}
+
+// Write writes the report as a table to w, by descending frame count.
+func (r *BSSIDReport) Write(w io.Writer) (err error) {
+	var ks [][6]byte
+	for k := range r.bssids {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		fi, fj := r.bssids[ks[i]].frames, r.bssids[ks[j]].frames
+		if fi != fj {
+			return fi > fj
+		}
+		return bytes.Compare(ks[i][:], ks[j][:]) < 0
+	})
+	if _, err = fmt.Fprintf(w, "%-17s %8s %10s  %s\n", "bssid", "stations",
+		"frames", "ssids"); err != nil {
+		return
+	}
+	for _, k := range ks {
+		e := r.bssids[k]
+		var as []int
+		for a := range e.ssids {
+			as = append(as, a)
+		}
+		sort.Ints(as)
+		ss := []string{"-"}
+		if len(as) > 0 {
+			ss = nil
+		}
+		for _, a := range as {
+			if a == 0 {
+				ss = append(ss, "hidden")
+			} else {
+				ss = append(ss, fmt.Sprintf("ssid-%d", a))
+			}
+		}
+		if _, err = fmt.Fprintf(w, "%-17s %8d %10d  %s\n",
+			net.HardwareAddr(k[:]), len(e.stations), e.frames,
+			strings.Join(ss, ",")); err != nil {
+			return
+		}
+	}
+	return
+}
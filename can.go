@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SocketCAN CAN ID flags and masks
+const (
+	canEFF     = 0x80000000
+	canRTR     = 0x40000000
+	canERR     = 0x20000000
+	canSFFMask = 0x000007ff
+	canEFFMask = 0x1fffffff
+)
+
+// canXLF is the flag in the byte after the CAN ID that marks a CAN XL frame,
+// where classic and FD frames have their payload length.
+const canXLF = 0x80
+
+// CANHandler anonymizes SocketCAN frames. The CAN ID is anonymized, and the
+// data, which may be zeroed, is truncated. Error frames have their IDs left
+// alone, as they hold the error class. CAN XL frames aren't understood.
+type CANHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *CANHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 8 {
+		err = fmt.Errorf("short SocketCAN header (increase snaplen)")
+		return
+	}
+	if b[4]&canXLF != 0 {
+		err = unknownProtocol("CAN XL")
+		return
+	}
+	n = 8
+	if binary.BigEndian.Uint32(b)&canERR != 0 {
+		return
+	}
+	anon.CANID(b[0:4])
+	l := int(b[4])
+	if n+l > len(b) {
+		l = len(b) - n
+	}
+	if l > 0 {
+		anon.CANData(b[n : n+l])
+	}
+	return
+}
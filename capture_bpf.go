@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkCaptureDevice returns an error if no BPF device can be opened, as the
+// capture command will then fail, unless it gains privileges itself, such as
+// with sudo.
+func checkCaptureDevice() error {
+	ds, _ := filepath.Glob("/dev/bpf*")
+	for _, d := range ds {
+		if f, err := os.OpenFile(d, os.O_RDONLY, 0); err == nil {
+			f.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("no BPF device (/dev/bpf*) could be opened, so " +
+		"capturing may require root, or read access to them")
+}
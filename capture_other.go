@@ -0,0 +1,10 @@
+//go:build !darwin && !freebsd && !netbsd && !openbsd
+// +build !darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+// checkCaptureDevice returns nil, as capture devices are only checked on
+// platforms that capture with BPF.
+func checkCaptureDevice() error {
+	return nil
+}
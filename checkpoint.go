@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var checkpointPath = flag.String("checkpoint", "",
+	"file to save checkpoints to during a long run with -out, and resume "+
+		"from if it exists")
+
+var checkpointInterval = flag.Duration("checkpoint-interval", time.Minute,
+	"with -checkpoint, the time between checkpoints")
+
+// checkpointVersion is the version of the checkpoint file format.
+const checkpointVersion = 1
+
+// partialSuffix is appended to the output path for the output of a run with
+// checkpoints, until it completes.
+const partialSuffix = ".partial"
+
+// checkpointState is a checkpoint, holding the offsets in the input and
+// output after the packets processed so far, the run's stats, and the
+// anonymizer's state, as saved by SaveState.
+type checkpointState struct {
+	Version int             `json:"version"`
+	Input   int64           `json:"input_offset"`
+	Output  int64           `json:"output_offset"`
+	Stats   RunStats        `json:"stats"`
+	State   json.RawMessage `json:"state"`
+}
+
+// checkpointFileContent is the content of a checkpoint file, the checkpoint
+// and its HMAC.
+type checkpointFileContent struct {
+	Checkpoint json.RawMessage `json:"checkpoint"`
+	HMAC       string          `json:"hmac"`
+}
+
+// checkpointMAC returns the HMAC of checkpoint b, using key.
+func checkpointMAC(key, b []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("wanonpcap checkpoint"))
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// Checkpointer periodically saves checkpoints of a run over a pcap file, so
+// that if it's interrupted, such as hours into a huge capture, it may resume
+// where the last checkpoint left off. Output goes to a partial file, the
+// output path with partialSuffix, renamed to the output path once the run
+// completes. At each checkpoint, the output is flushed and synced, then the
+// input and output offsets, the run's stats and the anonymizer's state are
+// saved. On resume, the partial file is truncated to the saved output
+// offset, so packets written after the checkpoint aren't duplicated, and
+// reading skips to the saved input offset without processing the packets
+// before it. Other per-run state, such as for -dedup or the reports, starts
+// afresh on resume.
+type Checkpointer struct {
+	// Path is the checkpoint file.
+	Path string
+
+	// Interval is the time between checkpoints.
+	Interval time.Duration
+
+	// Resumed is true if the run resumes from a checkpoint.
+	Resumed bool
+
+	// Saved is the number of checkpoints saved.
+	Saved int
+
+	anon  *DefaultAnonymizer
+	key   []byte
+	out   *partialOutput
+	input int64
+	stats RunStats
+	last  time.Time
+}
+
+// NewCheckpointer returns a new Checkpointer saving checkpoints of anon's
+// state to path, authenticated with key, and resuming from it if it exists.
+// Output is written to a partial file for outPath, which is truncated to the
+// checkpoint's output offset when resuming.
+func NewCheckpointer(path string, interval time.Duration,
+	anon *DefaultAnonymizer, key []byte, outPath string) (c *Checkpointer,
+	err error) {
+	if interval <= 0 {
+		err = fmt.Errorf("invalid checkpoint interval: %s", interval)
+		return
+	}
+	c = &Checkpointer{Path: path, Interval: interval, anon: anon, key: key,
+		last: time.Now()}
+	var output int64
+	var f *os.File
+	if f, err = os.Open(path); err == nil {
+		defer f.Close()
+		var s checkpointState
+		if s, err = c.read(f); err != nil {
+			err = fmt.Errorf("%s: %s", path, err)
+			return
+		}
+		c.Resumed = true
+		c.input, output, c.stats = s.Input, s.Output, s.Stats
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	c.out, err = openPartial(outPath, output, c.Resumed)
+	return
+}
+
+// read reads a checkpoint, restoring the anonymizer's state.
+func (c *Checkpointer) read(r io.Reader) (s checkpointState, err error) {
+	var b []byte
+	if b, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	var fc checkpointFileContent
+	if err = json.Unmarshal(b, &fc); err != nil {
+		err = fmt.Errorf("invalid checkpoint: %s", err)
+		return
+	}
+	var cb bytes.Buffer
+	if err = json.Compact(&cb, fc.Checkpoint); err != nil {
+		err = fmt.Errorf("invalid checkpoint: %s", err)
+		return
+	}
+	var m []byte
+	if m, err = hex.DecodeString(fc.HMAC); err != nil ||
+		!hmac.Equal(m, checkpointMAC(c.key, cb.Bytes())) {
+		err = fmt.Errorf("checkpoint integrity check failed " +
+			"(modified, or written with a different key)")
+		return
+	}
+	if err = json.Unmarshal(cb.Bytes(), &s); err != nil {
+		err = fmt.Errorf("invalid checkpoint: %s", err)
+		return
+	}
+	if s.Version != checkpointVersion {
+		err = fmt.Errorf("unsupported checkpoint version: %d", s.Version)
+		return
+	}
+	err = c.anon.LoadState(bytes.NewReader(s.State), c.key)
+	return
+}
+
+// Output returns the partial output file.
+func (c *Checkpointer) Output() Output {
+	return c.out
+}
+
+// due returns true if it's time for a checkpoint.
+func (c *Checkpointer) due() bool {
+	return time.Since(c.last) >= c.Interval
+}
+
+// save saves a checkpoint after the packets read up to input offset in, with
+// stats s, once the output written so far has been flushed.
+func (c *Checkpointer) save(in int64, s RunStats) (err error) {
+	var output int64
+	if output, err = c.out.sync(); err != nil {
+		return
+	}
+	var sb bytes.Buffer
+	if err = c.anon.SaveState(&sb, c.key); err != nil {
+		return
+	}
+	cs := checkpointState{
+		Version: checkpointVersion,
+		Input:   in,
+		Output:  output,
+		Stats:   s,
+		State:   sb.Bytes(),
+	}
+	var b []byte
+	if b, err = json.Marshal(cs); err != nil {
+		return
+	}
+	fc := checkpointFileContent{b, hex.EncodeToString(checkpointMAC(c.key, b))}
+	if b, err = json.MarshalIndent(fc, "", "  "); err != nil {
+		return
+	}
+	var f *fileOutput
+	if f, err = createFile(c.Path, true, 0600); err != nil {
+		return
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Abort()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Abort()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	c.Saved++
+	c.last = time.Now()
+	return
+}
+
+// Remove removes the checkpoint file, once the run has completed.
+func (c *Checkpointer) Remove() error {
+	if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// partialOutput writes to the partial file of an output with checkpoints,
+// which is renamed to the output path on Close, but kept on Abort, so the
+// run may resume.
+type partialOutput struct {
+	*os.File
+	path string
+}
+
+// openPartial opens the partial file for path. If resuming, the partial
+// file is truncated to offset, otherwise it's created, and unless -force is
+// given, it's an error if path already exists.
+func openPartial(path string, offset int64, resume bool) (p *partialOutput,
+	err error) {
+	var f *os.File
+	if resume {
+		if f, err = os.OpenFile(path+partialSuffix, os.O_RDWR, 0); err != nil {
+			return
+		}
+		if err = f.Truncate(offset); err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return
+		}
+	} else {
+		if !*forceOutput {
+			if _, err = os.Lstat(path); err == nil {
+				err = fmt.Errorf("%s exists (use -force to overwrite)", path)
+				return
+			} else if !os.IsNotExist(err) {
+				return
+			}
+		}
+		if f, err = os.OpenFile(path+partialSuffix,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
+			return
+		}
+	}
+	p = &partialOutput{f, path}
+	return
+}
+
+// sync syncs the partial file, returning its size.
+func (p *partialOutput) sync() (n int64, err error) {
+	if err = p.Sync(); err != nil {
+		return
+	}
+	return p.Seek(0, io.SeekCurrent)
+}
+
+// Close closes the partial file and renames it to the output path.
+func (p *partialOutput) Close() (err error) {
+	if err = p.File.Close(); err != nil {
+		return
+	}
+	return os.Rename(p.Name(), p.path)
+}
+
+// Abort closes the partial file, keeping it to resume from.
+func (p *partialOutput) Abort() error {
+	return p.File.Close()
+}
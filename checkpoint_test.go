@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run.checkpoint")
+	out := filepath.Join(dir, "out.pcap")
+	key := deriveKey("checkpoint")
+
+	c, err := NewCheckpointer(path, time.Minute, testAnonymizer(t), key, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Resumed {
+		t.Fatal("resumed without a checkpoint")
+	}
+	if _, err = c.out.Write([]byte("saved")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.save(100, RunStats{Packets: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// written after the checkpoint, so truncated on resume
+	if _, err = c.out.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	c.out.Abort()
+
+	if c, err = NewCheckpointer(path, time.Minute, testAnonymizer(t), key,
+		out); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Resumed || c.input != 100 || c.stats.Packets != 3 {
+		t.Errorf("resumed %t at input %d with %d packets, want true, 100, 3",
+			c.Resumed, c.input, c.stats.Packets)
+	}
+	if err = c.out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(out); err != nil || string(b) != "saved" {
+		t.Errorf("output %q, %v, want %q", b, err, "saved")
+	}
+	if err = c.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	key := deriveKey("checkpoint")
+	for _, c := range []struct {
+		name       string
+		interval   time.Duration
+		checkpoint string
+		key        []byte
+		output     bool
+		err        string
+	}{
+		{"zero interval", 0, "", key, false, "invalid checkpoint interval"},
+		{"output exists", time.Minute, "", key, true, "exists"},
+		{"not json", time.Minute, "checkpoint", key, false,
+			"invalid checkpoint"},
+		{"bad hmac", time.Minute, `{"checkpoint": {}, "hmac": "00"}`, key,
+			false, "integrity check failed"},
+		{"wrong key", time.Minute, "saved", deriveKey("other"), false,
+			"integrity check failed"},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "run.checkpoint")
+		out := filepath.Join(dir, "out.pcap")
+		switch c.checkpoint {
+		case "":
+		case "saved":
+			cp, err := NewCheckpointer(path, time.Minute, testAnonymizer(t),
+				key, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cp.save(0, RunStats{}); err != nil {
+				t.Fatal(err)
+			}
+			cp.out.Abort()
+		default:
+			if err := os.WriteFile(path, []byte(c.checkpoint),
+				0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.output {
+			if err := os.WriteFile(out, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := NewCheckpointer(path, c.interval, testAnonymizer(t), c.key,
+			out)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Command is a subcommand, given as the first argument(s).
+type Command int
+
+const (
+	// CmdAnonymize anonymizes stdin to the output, and is the default.
+	CmdAnonymize Command = iota
+
+	// CmdDeanonymize decrypts a capture encrypted with the same key.
+	CmdDeanonymize
+
+	// CmdVerify compares an original capture to its anonymized output.
+	CmdVerify
+
+	// CmdStats reports the fields found in a capture, without changing it.
+	CmdStats
+
+	// CmdMapExport anonymizes stdin and writes only the pseudonym mappings.
+	CmdMapExport
+
+	// CmdMapImport anonymizes stdin, starting from previously exported
+	// pseudonym mappings.
+	CmdMapImport
+
+	// CmdMapPrune removes the pseudonym mappings not seen since a time.
+	CmdMapPrune
+
+	// CmdMapMerge combines pseudonym mappings from several runs.
+	CmdMapMerge
+
+	// CmdMapLookup writes the pseudonyms of addresses in pseudonym mappings.
+	CmdMapLookup
+
+	// CmdMapRLookup writes the originals of pseudonyms in pseudonym
+	// mappings.
+	CmdMapRLookup
+
+	// CmdMerge anonymizes captures given as arguments, merged in
+	// chronological order.
+	CmdMerge
+
+	// CmdSelfTest runs the built-in self tests.
+	CmdSelfTest
+
+	// CmdBench runs the benchmarks.
+	CmdBench
+
+	// CmdServe starts the HTTP server.
+	CmdServe
+)
+
+// commands are the subcommands, in the order listed in the usage.
+var commands = []struct {
+	name  string
+	cmd   Command
+	args  string
+	usage string
+}{
+	{"anonymize", CmdAnonymize, "< in.pcap > out.pcap",
+		"anonymize a capture (the default without a command)"},
+	{"deanonymize", CmdDeanonymize, "< enc.pcap > out.pcap",
+		"decrypt a capture encrypted with the same key and methods"},
+	{"verify", CmdVerify, "original.pcap anonymized.pcap",
+		"compare an original capture to its anonymized output"},
+	{"stats", CmdStats, "< in.pcap",
+		"report the address fields found in a capture"},
+	{"map export", CmdMapExport, "< in.pcap > maps.csv",
+		"write the pseudonym mappings for a capture as CSV"},
+	{"map import", CmdMapImport, "maps.csv < in.pcap > out.pcap",
+		"anonymize starting from exported pseudonym mappings"},
+	{"map prune", CmdMapPrune, "-since 2024-01-01 < maps.csv > pruned.csv",
+		"remove pseudonym mappings not seen since a time"},
+	{"map merge", CmdMapMerge, "a.csv b.csv ... > maps.csv",
+		"combine pseudonym mappings from several runs"},
+	{"map lookup", CmdMapLookup, "maps.csv 10.0.0.1 ...",
+		"write the pseudonyms of addresses in mappings or a state file"},
+	{"map rlookup", CmdMapRLookup, "maps.csv 43.35.78.51 ...",
+		"write the originals of pseudonyms in mappings or a state file"},
+	{"merge", CmdMerge, "a.pcap b.pcap ... > out.pcap",
+		"anonymize captures merged in chronological order"},
+	{"selftest", CmdSelfTest, "",
+		"run built-in self tests"},
+	{"bench", CmdBench, "",
+		"measure throughput on synthetic traffic"},
+	{"serve", CmdServe, "",
+		"serve the HTTP upload API on -http-addr"},
+}
+
+// parseCommand removes any subcommand from the start of args, and returns it
+// with the remaining args. Without one, CmdAnonymize is returned, so
+// `wanonpcap < in > out` works as before subcommands.
+func parseCommand(args []string) (cmd Command, rest []string, err error) {
+	rest = args
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		return
+	}
+	name := args[1]
+	n := 2
+	if name == "map" {
+		if len(args) < 3 {
+			err = fmt.Errorf("map requires export, import, prune, merge, " +
+				"lookup or rlookup")
+			return
+		}
+		name += " " + args[2]
+		n = 3
+	}
+	for _, c := range commands {
+		if c.name == name {
+			cmd = c.cmd
+			rest = append([]string{args[0]}, args[n:]...)
+			return
+		}
+	}
+	err = fmt.Errorf("unknown command: %s", name)
+	return
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+// usage prints the commands and flags.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: %s [command] [flags] [args]\n\ncommands:\n",
+		os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.usage)
+		if c.args != "" {
+			fmt.Fprintf(w, "  %-12s   %s %s %s\n", "", os.Args[0], c.name,
+				c.args)
+		}
+	}
+	fmt.Fprintf(w, "\nflags:\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"hash/maphash"
+)
+
+var dedupFlag = flag.Bool("dedup", false,
+	"drop packets identical to a recent packet, such as SPAN port duplicates")
+
+var dedupWindow = flag.Int("dedup-window", defaultDedupWindow,
+	"with -dedup, the number of recent packets to compare with")
+
+// defaultDedupWindow is the default number of recent packets compared.
+const defaultDedupWindow = 32
+
+// Deduplicator finds packets identical to one of a window of recent packets,
+// as captures from SPAN ports often contain duplicates. Packets are compared
+// by original length and captured data, ignoring timestamps, using a hash to
+// find candidates.
+type Deduplicator struct {
+	seed   maphash.Seed
+	recent []dedupEntry
+	next   int
+}
+
+// dedupEntry is a recent packet.
+type dedupEntry struct {
+	sum     uint64
+	origLen uint32
+	b       []byte
+}
+
+// NewDeduplicator returns a new deduplicator comparing packets with the last
+// window packets.
+func NewDeduplicator(window int) *Deduplicator {
+	if window < 1 {
+		window = 1
+	}
+	return &Deduplicator{
+		seed:   maphash.MakeSeed(),
+		recent: make([]dedupEntry, window),
+	}
+}
+
+// duplicate reports if the packet b, with original length origLen, is a
+// duplicate of a recent packet, and if not, adds it to the window.
+func (d *Deduplicator) duplicate(origLen uint32, b []byte) bool {
+	var h maphash.Hash
+	h.SetSeed(d.seed)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], origLen)
+	h.Write(l[:])
+	h.Write(b)
+	sum := h.Sum64()
+	for _, e := range d.recent {
+		if e.b != nil && e.sum == sum && e.origLen == origLen &&
+			bytes.Equal(e.b, b) {
+			return true
+		}
+	}
+	e := &d.recent[d.next]
+	e.sum = sum
+	e.origLen = origLen
+	e.b = append(e.b[:0], b...)
+	d.next = (d.next + 1) % len(d.recent)
+	return false
+}
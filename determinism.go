@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var deterministic = flag.Bool("deterministic", false,
+	"guarantee byte-identical output for identical input, key and flags, "+
+		"rejecting options that would prevent it")
+
+// checkDeterministic returns an error if, with -deterministic, options are
+// used that make the output depend on more than the input, key and flags.
+// Otherwise, runs are already reproducible: pseudonyms and encryption come
+// from key streams, map and report files are sorted, and packets are written
+// in the order they're read. What's left is a key generated at random, the
+// shared state of a pseudonym store or state file, which other runs change,
+// and the concurrent streams of the gRPC server, which share an anonymizer.
+func checkDeterministic(keyStr string) error {
+	if !*deterministic {
+		return nil
+	}
+	switch {
+	case keyStr == "":
+		return fmt.Errorf("-deterministic requires -key or a wrapped key")
+	case *pseudonymStoreURL != "":
+		return fmt.Errorf("-deterministic may not be used with " +
+			"-pseudonym-store")
+	case *stateFile != "":
+		return fmt.Errorf("-deterministic may not be used with -state-file")
+	}
+	return nil
+}
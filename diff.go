@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fieldLocator is an Anonymizer that leaves all fields untouched but counts
+// each as changed, so an AuditAnonymizer wrapping it locates every field.
+type fieldLocator struct {
+	n uint64
+}
+
+func (l *fieldLocator) MAC(b []byte) { l.n++ }
+
+func (l *fieldLocator) EUI64(b []byte) { l.n++ }
+
+func (l *fieldLocator) DevAddr(b []byte) { l.n++ }
+
+func (l *fieldLocator) IPv4(b []byte, r Role) { l.n++ }
+
+func (l *fieldLocator) IPv6(b []byte, r Role) { l.n++ }
+
+func (l *fieldLocator) VLAN(b []byte) { l.n++ }
+
+func (l *fieldLocator) Sequence(b []byte, ta, anonTA []byte) { l.n++ }
+
+func (l *fieldLocator) CANID(b []byte) { l.n++ }
+
+func (l *fieldLocator) CANData(b []byte) { l.n++ }
+
+func (l *fieldLocator) Port(b []byte) { l.n++ }
+
+func (l *fieldLocator) Name(b []byte) { l.n++ }
+
+func (l *fieldLocator) ID(b []byte) { l.n++ }
+
+func (l *fieldLocator) Timestamp(b []byte) { l.n++ }
+
+func (l *fieldLocator) BeaconTimestamp(b []byte, ta []byte) { l.n++ }
+
+func (l *fieldLocator) Country(b []byte) { l.n++ }
+
+func (l *fieldLocator) Text(b []byte) { l.n++ }
+
+func (l *fieldLocator) VendorData(b []byte, oui []byte) { l.n++ }
+
+func (l *fieldLocator) Changed() uint64 { return l.n }
+
+func (l *fieldLocator) Pseudonyms() int { return 0 }
+
+// optionalFields are the field types that are only changed by some policies,
+// so they aren't flagged when unchanged.
+var optionalFields = map[string]bool{"seq": true, "timestamp": true,
+	"country": true, "vendor": true, "text": true, "can-id": true,
+	"can-data": true, "port": true, "name": true, "id": true}
+
+// DiffStats are the results of comparing two captures.
+type DiffStats struct {
+	Packets    uint64
+	Dropped    uint64
+	Changed    uint64
+	Unchanged  uint64
+	Unexpected uint64
+
+	// Retries, if not nil, checked the retry and duplicate relationships of
+	// radiotap + 802.11 captures.
+	Retries *RetryCheck
+}
+
+// runDiff compares an original capture to its anonymized output, writing a
+// report of what changed in each packet to w. Address fields that didn't
+// change, and bytes outside of address fields that did, are flagged with "!".
+// For radiotap + 802.11, frames whose duplicate relationship wasn't kept are
+// also flagged. If pad is not nil, the anonymized capture was padded with
+// -pad-to, so packets may grow to their padded size, and their zero tails are
+// counted as padding.
+func runDiff(origPath, anonPath string, pad *Padder, w io.Writer) (
+	s DiffStats, err error) {
+	var of, af *os.File
+	if of, err = os.Open(origPath); err != nil {
+		return
+	}
+	defer of.Close()
+	if af, err = os.Open(anonPath); err != nil {
+		return
+	}
+	defer af.Close()
+	var or, ar *PcapReader
+	if or, err = NewCaptureReader(bufio.NewReader(of)); err != nil {
+		return
+	}
+	if ar, err = NewCaptureReader(bufio.NewReader(af)); err != nil {
+		return
+	}
+	if or.header.LinkLayer != ar.header.LinkLayer {
+		err = fmt.Errorf("link layers differ: %d != %d", or.header.LinkLayer,
+			ar.header.LinkLayer)
+		return
+	}
+	h, ok := Handlers[or.header.LinkLayer]
+	if !ok {
+		err = fmt.Errorf("unsupported link layer: %d", or.header.LinkLayer)
+		return
+	}
+	loc := &AuditAnonymizer{Anonymizer: &fieldLocator{}}
+	if or.header.LinkLayer == 127 {
+		s.Retries = NewRetryCheck()
+	}
+
+	// -time-base shifts timestamps by whole seconds, so the shift is taken
+	// from the first packets with the same fraction of a second
+	var shift int64
+	var shifted bool
+
+	var aph PacketHeader
+	var ab []byte
+	aok := true
+	if aph, ab, err = ar.ReadPacket(); err != nil {
+		if err != io.EOF {
+			return
+		}
+		aok = false
+	}
+	for i := uint64(1); ; i++ {
+		var oph PacketHeader
+		var ob []byte
+		if oph, ob, err = or.ReadPacket(); err != nil {
+			if err == io.EOF {
+				err = nil
+				if aok {
+					fmt.Fprintf(w, "! anonymized capture has extra packets\n")
+					s.Unexpected++
+				}
+			}
+			return
+		}
+		s.Packets++
+
+		// packets with different timestamps, once shifted, are assumed dropped
+		match := aok && oph.TimestampUsec == aph.TimestampUsec
+		if match && !shifted {
+			shift = int64(aph.TimestampSec) - int64(oph.TimestampSec)
+			shifted = true
+			if shift != 0 {
+				fmt.Fprintf(w, "timestamps shifted by %ds\n", shift)
+			}
+		}
+		if !match || int64(oph.TimestampSec)+shift != int64(aph.TimestampSec) {
+			fmt.Fprintf(w, "%d: dropped\n", i)
+			s.Dropped++
+			continue
+		}
+
+		// al is the length of the anonymized packet without any padding
+		al := len(ab)
+		if pad != nil {
+			for al > 0 && ab[al-1] == 0 {
+				al--
+			}
+		}
+
+		// locate fields in the original
+		loc.Begin(ob)
+		n, herr := handle(h, or.context(&oph), ob, loc)
+		var r []string
+		if herr != nil && !errors.Is(herr, ErrUnknown) {
+			r = append(r, fmt.Sprintf("parse error (%s)", herr))
+			n = 0
+		}
+		covered := make([]bool, len(ob))
+		if th, ok := h.(TrailerHandler); ok {
+			if tl, fl := th.TrailerLen(ob); tl > 0 {
+				// trailers may be updated, or removed along with their flag
+				for j := len(ob) - tl; j < len(ob); j++ {
+					covered[j] = true
+				}
+				if fl >= 0 {
+					covered[fl] = true
+				}
+				r = append(r, fmt.Sprintf("trailer@%d", len(ob)-tl))
+			}
+		}
+		for _, f := range loc.fields {
+			for j := f.offset; j < f.offset+f.len; j++ {
+				covered[j] = true
+			}
+			fs := fmt.Sprintf("%s@%d", f.typ, f.offset)
+			switch {
+			case f.offset+f.len > al:
+				r = append(r, fs+" truncated")
+			case bytes.Equal(ob[f.offset:f.offset+f.len],
+				ab[f.offset:f.offset+f.len]) && optionalFields[f.typ]:
+			case bytes.Equal(ob[f.offset:f.offset+f.len],
+				ab[f.offset:f.offset+f.len]):
+				r = append(r, fs+" unchanged!")
+				s.Unchanged++
+			default:
+				r = append(r, fs+" changed")
+				s.Changed++
+			}
+		}
+
+		// look for unexpected changes outside of fields
+		for j := 0; j < len(ob) && j < al; j++ {
+			if covered[j] || ob[j] == ab[j] {
+				continue
+			}
+			k := j
+			for k < len(ob) && k < al && !covered[k] && ob[k] != ab[k] {
+				k++
+			}
+			r = append(r, fmt.Sprintf("bytes %d-%d changed unexpectedly!", j,
+				k-1))
+			s.Unexpected++
+			j = k
+		}
+
+		if s.Retries != nil {
+			if m := s.Retries.add(ob, ab); m != "" {
+				r = append(r, m)
+			}
+		}
+
+		// lengths
+		if len(ab) != len(ob) {
+			r = append(r, fmt.Sprintf("len %d->%d (parsed %d)", len(ob),
+				len(ab), n))
+		}
+		switch {
+		case pad == nil && len(ab) > len(ob),
+			pad != nil && len(ab) > pad.size(len(ob)):
+			r = append(r, "anonymized packet longer than original!")
+			s.Unexpected++
+		case pad != nil && len(ab) != pad.size(len(ab)):
+			r = append(r, "anonymized packet not padded to a -pad-to size!")
+			s.Unexpected++
+		}
+		if al > n {
+			r = append(r, fmt.Sprintf("%d bytes retained beyond parsed headers",
+				al-n))
+		}
+		if al < len(ab) {
+			r = append(r, fmt.Sprintf("%d bytes padding", len(ab)-al))
+		}
+		if aph.OrigLen != oph.OrigLen {
+			r = append(r, fmt.Sprintf("origlen %d->%d", oph.OrigLen,
+				aph.OrigLen))
+		}
+		fmt.Fprintf(w, "%d: %s\n", i, strings.Join(r, ", "))
+
+		if aph, ab, err = ar.ReadPacket(); err != nil {
+			if err != io.EOF {
+				return
+			}
+			err = nil
+			aok = false
+		}
+	}
+}
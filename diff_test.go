@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunDiff(t *testing.T) {
+	pkts := [][]byte{selfTests[0].pkt, selfTests[2].pkt}
+	anon, _, err := selfTestRun(1, pkts, selfTestAnonymizer(Pseudonym, false),
+		true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the anonymized packets with a byte of the IP header outside of the
+	// address fields changed
+	var modified [][]byte
+	for _, p := range anon {
+		m := append([]byte(nil), p...)
+		m[15] ^= 0xff
+		modified = append(modified, m)
+	}
+	dir := t.TempDir()
+	write := func(name string, link uint32, pkts [][]byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, selfTestPcap(link, pkts), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	orig := write("orig.pcap", 1, pkts)
+	for _, c := range []struct {
+		name       string
+		anon       string
+		err        bool
+		changed    uint64
+		unchanged  uint64
+		unexpected uint64
+	}{
+		{"anonymized", write("anon.pcap", 1, anon), false, 8, 0, 0},
+		{"unchanged", orig, false, 0, 8, 0},
+		{"modified", write("modified.pcap", 1, modified), false, 8, 0,
+			2},
+		{"dropped", write("dropped.pcap", 1, anon[:1]), false, 4, 0, 0},
+		{"link layer", write("link.pcap", 105, anon), true, 0, 0, 0},
+	} {
+		s, err := runDiff(orig, c.anon, nil, io.Discard)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error %t", c.name, err, c.err)
+			continue
+		}
+		if s.Changed != c.changed || s.Unchanged != c.unchanged ||
+			s.Unexpected != c.unexpected {
+			t.Errorf("%s: %d changed, %d unchanged, %d unexpected, "+
+				"want %d, %d, %d", c.name, s.Changed, s.Unchanged,
+				s.Unexpected, c.changed, c.unchanged, c.unexpected)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// dnsHdrLen is the length of a DNS header.
+const dnsHdrLen = 12
+
+// DNS resource record types
+const (
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypePTR   = 12
+	dnsTypeAAAA  = 28
+)
+
+// DNSHandler anonymizes DNS messages. Each label of the names in questions
+// and records is anonymized separately with the name method, so compressed
+// names stay consistent, and the addresses in A and AAAA records with the IP
+// methods. Parsing stops at the first record with other data, after which
+// the message is unknown structure.
+type DNSHandler struct {
+}
+
+// Handle anonymizes one message.
+func (h *DNSHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < dnsHdrLen {
+		err = fmt.Errorf("short DNS header (increase snaplen)")
+		return
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	rr := int(binary.BigEndian.Uint16(b[6:])) +
+		int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+	n = dnsHdrLen
+
+	// questions, with a name, type and class
+	for i := 0; i < qd; i++ {
+		if n, err = dnsName(b, n, anon); err != nil {
+			return
+		}
+		if n+4 > len(b) {
+			err = fmt.Errorf("short DNS question (increase snaplen)")
+			return
+		}
+		n += 4
+	}
+
+	// answer, authority and additional records, with a name, type, class,
+	// TTL, data length and data
+	for i := 0; i < rr; i++ {
+		m := n
+		if m, err = dnsName(b, m, anon); err != nil {
+			return
+		}
+		if m+10 > len(b) {
+			err = fmt.Errorf("short DNS record (increase snaplen)")
+			return
+		}
+		t := binary.BigEndian.Uint16(b[m:])
+		l := int(binary.BigEndian.Uint16(b[m+8:]))
+		m += 10
+		if m+l > len(b) {
+			err = fmt.Errorf("short DNS record data (increase snaplen)")
+			return
+		}
+		d := b[m : m+l]
+		switch {
+		case t == dnsTypeA && l == 4:
+			anon.IPv4(d, Dst)
+		case t == dnsTypeAAAA && l == 16:
+			anon.IPv6(d, Dst)
+		case t == dnsTypeNS || t == dnsTypeCNAME || t == dnsTypePTR:
+			var e int
+			if e, err = dnsName(d, 0, anon); err != nil {
+				return
+			}
+			if e != l {
+				err = ErrUnknown
+				return
+			}
+		default:
+			err = unknownProtocol("DNS record type %d", t)
+			return
+		}
+		n = m + l
+	}
+	return
+}
+
+// dnsName anonymizes the labels of the name at offset n in b, returning the
+// offset after it. Names end at a root label or a compression pointer.
+func dnsName(b []byte, n int, anon Anonymizer) (int, error) {
+	for {
+		if n >= len(b) {
+			return n, fmt.Errorf("short DNS name (increase snaplen)")
+		}
+		l := int(b[n])
+		switch {
+		case l == 0:
+			return n + 1, nil
+		case l&0xc0 == 0xc0:
+			if n+2 > len(b) {
+				return n, fmt.Errorf("short DNS name (increase snaplen)")
+			}
+			return n + 2, nil
+		case l&0xc0 != 0:
+			return n, ErrUnknown
+		}
+		if n+1+l > len(b) {
+			return n, fmt.Errorf("short DNS label (increase snaplen)")
+		}
+		anon.Name(b[n+1 : n+1+l])
+		n += 1 + l
+	}
+}
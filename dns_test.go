@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fieldRecorder is an Anonymizer that leaves fields untouched, recording the
+// names and counting the addresses given to it.
+type fieldRecorder struct {
+	fieldLocator
+	names []string
+	addrs int
+}
+
+func (r *fieldRecorder) Name(b []byte) { r.names = append(r.names, string(b)) }
+
+func (r *fieldRecorder) IPv4(b []byte, role Role) { r.addrs++ }
+
+func (r *fieldRecorder) IPv6(b []byte, role Role) { r.addrs++ }
+
+func TestDNSHandler(t *testing.T) {
+	// header with the question, answer, authority and additional counts
+	hdr := func(qd, an byte) []byte {
+		return []byte{0x12, 0x34, 0x81, 0x80, 0, qd, 0, an, 0, 0, 0, 0}
+	}
+	qname := []byte("\x03www\x07example\x03com\x00")
+	question := cat(qname, []byte{0, 1, 0, 1})
+	// record with a pointer to the question name, type, TTL and data
+	record := func(typ byte, data []byte) []byte {
+		return cat([]byte{0xc0, dnsHdrLen, 0, typ, 0, 1, 0, 0, 0, 60, 0,
+			byte(len(data))}, data)
+	}
+	a := record(dnsTypeA, []byte{192, 0, 2, 1})
+	aaaa := record(dnsTypeAAAA, make([]byte, 16))
+	cname := record(dnsTypeCNAME, []byte("\x04host\xc0\x10"))
+	for _, c := range []struct {
+		name  string
+		msg   []byte
+		n     int
+		names []string
+		addrs int
+		err   string
+	}{
+		{"query", cat(hdr(1, 0), question), 33,
+			[]string{"www", "example", "com"}, 0, ""},
+		{"a", cat(hdr(1, 1), question, a), 49,
+			[]string{"www", "example", "com"}, 1, ""},
+		{"aaaa", cat(hdr(1, 1), question, aaaa), 61,
+			[]string{"www", "example", "com"}, 1, ""},
+		{"cname", cat(hdr(1, 1), question, cname), 52,
+			[]string{"www", "example", "com", "host"}, 0, ""},
+		{"short header", hdr(1, 0)[:8], 0, nil, 0, "short DNS header"},
+		{"short question", cat(hdr(1, 0), qname), 0, nil, 0,
+			"short DNS question"},
+		{"short label", cat(hdr(1, 0), qname[:6]), 0, nil, 0,
+			"short DNS label"},
+		{"short data", cat(hdr(1, 1), question, a[:len(a)-1]), 0, nil, 0,
+			"short DNS record data"},
+		{"label type", cat(hdr(1, 0), []byte{0x40}), 0, nil, 0,
+			ErrUnknown.Error()},
+		{"record type", cat(hdr(1, 1), question, record(16, []byte("txt"))),
+			0, nil, 0, "DNS record type 16"},
+	} {
+		r := &fieldRecorder{}
+		n, err := (&DNSHandler{}).Handle(c.msg, r)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if n != c.n || !reflect.DeepEqual(r.names, c.names) ||
+			r.addrs != c.addrs {
+			t.Errorf("%s: got %d, %q, %d addresses, want %d, %q, %d", c.name,
+				n, r.names, r.addrs, c.n, c.names, c.addrs)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// DOCSIS FC types
+const (
+	docsisPacketPDU   = 0
+	docsisMACSpecific = 3
+)
+
+// DOCSIS MAC specific header FC_PARMs
+const (
+	docsisTiming     = 0
+	docsisManagement = 1
+	docsisRequest    = 2
+)
+
+// docsisMgmtLen is the length of a MAC management message header: DA, SA,
+// length, DSAP, SSAP, control, version, type and reserved.
+const docsisMgmtLen = 20
+
+// DOCSISHandler anonymizes DOCSIS MAC frames. Packet PDUs are anonymized as
+// Ethernet, and the addresses of MAC management messages are anonymized, but
+// their bodies, which may also hold CM MACs, aren't handled.
+type DOCSISHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *DOCSISHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	// FC, MAC_PARM, LEN, any extended header, and HCS
+	if len(b) < 6 {
+		err = fmt.Errorf("short DOCSIS header (increase snaplen)")
+		return
+	}
+	fc := b[0]
+	typ, parm := fc>>6, (fc>>1)&0x1f
+	n = 6
+	if fc&0x01 != 0 {
+		n += int(b[1])
+	}
+	if n > len(b) {
+		err = fmt.Errorf("short DOCSIS extended header (increase snaplen)")
+		return
+	}
+
+	switch {
+	case typ == docsisPacketPDU:
+		var m int
+		m, err = (&EthHandler{}).Handle(b[n:], anon)
+		n += m
+	case typ == docsisMACSpecific &&
+		(parm == docsisTiming || parm == docsisManagement):
+		if n+docsisMgmtLen > len(b) {
+			err = fmt.Errorf("short DOCSIS MAC management header " +
+				"(increase snaplen)")
+			return
+		}
+		anon.MAC(b[n : n+6])
+		anon.MAC(b[n+6 : n+12])
+		n += docsisMgmtLen
+	case typ == docsisMACSpecific && parm == docsisRequest:
+	default:
+		err = ErrUnknown
+	}
+	return
+}
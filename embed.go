@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var embeddedStr = flag.String("embedded-captures", "none",
+	"with -no-truncate, find pcap and pcapng files in kept payloads, such as "+
+		"in TFTP or HTTP transfers- none, drop or anonymize")
+
+// EmbeddedAction is what's done with captures found in payloads.
+type EmbeddedAction int
+
+const (
+	// EmbeddedNone means don't look for embedded captures.
+	EmbeddedNone EmbeddedAction = iota
+
+	// EmbeddedDrop means drop the packets with embedded captures.
+	EmbeddedDrop
+
+	// EmbeddedAnonymize means anonymize the packets in embedded captures.
+	EmbeddedAnonymize
+)
+
+func parseEmbeddedAction(s string) (a EmbeddedAction, err error) {
+	switch s {
+	case "none":
+		a = EmbeddedNone
+	case "drop":
+		a = EmbeddedDrop
+	case "anonymize":
+		a = EmbeddedAnonymize
+	default:
+		err = fmt.Errorf("unknown embedded capture action: %s", s)
+	}
+	return
+}
+
+// pcapNanoMagic is the magic of pcap files with nanosecond timestamps, read
+// big-endian.
+const pcapNanoMagic = 0xa1b23c4d
+
+// maxEmbeddedDepth is the deepest a capture may be nested in captures to be
+// anonymized. Deeper captures are zeroed.
+const maxEmbeddedDepth = 4
+
+// EmbeddedScanner finds pcap and pcapng files in the payloads kept with
+// -no-truncate, by their magic and header, so captures transferred in a
+// capture don't leak their addresses. Payloads aren't reassembled, so once
+// a capture is found, the later packets between the same addresses are
+// treated as continuing it. With EmbeddedDrop, those packets are dropped.
+// With EmbeddedAnonymize, the complete packets of a pcap file within a
+// packet are anonymized in place, without truncation, by the handler for its
+// link type and the same anonymizer, so they share pseudonyms, and captures
+// in their payloads are anonymized in turn. Everything else that could hold
+// captured data, such as a partial packet or pcapng file, or the payloads of
+// the packets continuing a capture, is zeroed.
+type EmbeddedScanner struct {
+	Action EmbeddedAction
+
+	// Found is the number of embedded captures found.
+	Found uint64
+
+	// Continued is the number of packets treated as continuing a capture.
+	Continued uint64
+
+	// Dropped is the number of packets dropped.
+	Dropped uint64
+
+	flows map[string]bool
+}
+
+// NewEmbeddedScanner returns a new scanner taking action on the captures
+// found.
+func NewEmbeddedScanner(action EmbeddedAction) *EmbeddedScanner {
+	return &EmbeddedScanner{Action: action, flows: make(map[string]bool)}
+}
+
+// scan looks for a capture in the payload of packet b after the n bytes
+// handled by h, after anonymization with a. It returns if the packet should
+// be dropped.
+func (e *EmbeddedScanner) scan(h Handler, c *PacketContext, b []byte, n int,
+	a Anonymizer) (drop bool) {
+	if n >= len(b) {
+		return
+	}
+	sc := &splitClassifier{}
+	handle(h, c, b, sc)
+	var k strings.Builder
+	for _, ip := range sc.addrs {
+		k.WriteString(ip.String())
+		k.WriteByte(' ')
+	}
+	key := k.String()
+	p := b[n:]
+	if i := embeddedCapture(p); i >= 0 {
+		e.Found++
+		e.flows[key] = true
+		if e.Action == EmbeddedDrop {
+			e.Dropped++
+			return true
+		}
+		e.anonymize(p[i:], a, 1)
+		return
+	}
+	if key != "" && e.flows[key] {
+		e.Continued++
+		if e.Action == EmbeddedDrop {
+			e.Dropped++
+			return true
+		}
+		zero(p)
+	}
+	return
+}
+
+// anonymize anonymizes the capture at the start of b, at the given depth,
+// zeroing what can't be anonymized.
+func (e *EmbeddedScanner) anonymize(b []byte, a Anonymizer, depth int) {
+	if depth > maxEmbeddedDepth || len(b) < 24 ||
+		bytes.Equal(b[:4], ngMagic) {
+		zero(b)
+		return
+	}
+	var o binary.ByteOrder = binary.BigEndian
+	if m := binary.LittleEndian.Uint32(b); m == uint32(MagicBE) ||
+		m == pcapNanoMagic {
+		o = binary.LittleEndian
+	}
+	link := o.Uint32(b[20:]) & 0x0fffffff
+	h, ok := Handlers[link]
+	b = b[24:]
+	for len(b) >= 16 {
+		l := int(o.Uint32(b[8:]))
+		if !ok || l > len(b)-16 {
+			break
+		}
+		c := &PacketContext{OrigLen: o.Uint32(b[12:]), LinkType: link}
+		p := b[16 : 16+l]
+		n, err := handle(h, c, p, a)
+		if err != nil && !errors.Is(err, ErrUnknown) {
+			zero(p)
+		} else if n < len(p) {
+			if i := embeddedCapture(p[n:]); i >= 0 {
+				e.Found++
+				e.anonymize(p[n+i:], a, depth+1)
+			}
+		}
+		b = b[16+l:]
+	}
+	zero(b)
+}
+
+// embeddedCapture returns the offset of the first pcap or pcapng file in b,
+// found by the magic and version of its header, or -1 if there's none.
+func embeddedCapture(b []byte) int {
+	for i := 0; i+12 <= len(b); i++ {
+		switch binary.BigEndian.Uint32(b[i:]) {
+		case uint32(MagicBE), pcapNanoMagic:
+			if i+24 <= len(b) && binary.BigEndian.Uint16(b[i+4:]) == 2 &&
+				binary.BigEndian.Uint16(b[i+6:]) == 4 {
+				return i
+			}
+		case uint32(MagicLE), 0x4d3cb2a1:
+			if i+24 <= len(b) && binary.LittleEndian.Uint16(b[i+4:]) == 2 &&
+				binary.LittleEndian.Uint16(b[i+6:]) == 4 {
+				return i
+			}
+		case ngSectionHeader:
+			m := b[i+8 : i+12]
+			if binary.BigEndian.Uint32(m) == ngByteOrderMagic ||
+				binary.LittleEndian.Uint32(m) == ngByteOrderMagic {
+				return i
+			}
+		}
+	}
+	return -1
+}
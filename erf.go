@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+)
+
+var erfFormat = flag.Bool("erf", false,
+	"read and write ERF (Endace) records instead of pcap")
+
+// erfLinkType is the pcap link type for ERF records.
+const erfLinkType = 197
+
+// ERF record types
+const (
+	erfTypeHDLCPoS         = 1
+	erfTypeEth             = 2
+	erfTypeColorEth        = 10
+	erfTypeColorHDLCPoS    = 11
+	erfTypeDSMColorHDLCPoS = 15
+	erfTypeDSMColorEth     = 16
+	erfTypeIPv4            = 22
+	erfTypeIPv6            = 23
+)
+
+// erfExtHeader is the type bit for extension headers being present.
+const erfExtHeader = 0x80
+
+// PPP protocols
+const (
+	pppIPv4 = 0x0021
+	pppIPv6 = 0x0057
+)
+
+// NewERFReader returns a reader for ERF records, each presented as a packet
+// of link type 197, holding the whole record.
+func NewERFReader(r io.Reader) *PcapReader {
+	p := &PcapReader{
+		r:     r,
+		order: binary.LittleEndian,
+		magic: MagicLE,
+		header: GlobalHeader{2, 4, 0, 0, uint32(MaxPacketLen),
+			erfLinkType},
+	}
+	p.read = p.readERF
+	return p
+}
+
+// readERF reads the next ERF record. The timestamp is a 64-bit little endian
+// fixed point number of seconds, and the record length is big endian.
+func (p *PcapReader) readERF() (ph PacketHeader, b []byte, err error) {
+	var h []byte
+	buf, mapped := p.r.(memReader)
+	if mapped {
+		if buf.Len() == 0 {
+			err = io.EOF
+			return
+		}
+		if buf.Len() < 16 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		h = buf.Bytes()[:16]
+	} else {
+		h = make([]byte, 16)
+		if _, err = io.ReadFull(p.r, h); err != nil {
+			return
+		}
+	}
+	rlen := uint32(binary.BigEndian.Uint16(h[10:]))
+	if rlen < 16 {
+		err = fmt.Errorf("invalid ERF record length: %d", rlen)
+		return
+	}
+	ts := binary.LittleEndian.Uint64(h)
+	ph.TimestampSec = uint32(ts >> 32)
+	ph.TimestampUsec = uint32((ts & 0xffffffff) * 1000000 >> 32)
+	ph.Len = rlen
+	ph.OrigLen = rlen
+	if mapped {
+		if buf.Len() < int(rlen) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		b = buf.Next(int(rlen))
+		return
+	}
+	b = make([]byte, rlen)
+	copy(b, h)
+	_, err = io.ReadFull(p.r, b[16:])
+	return
+}
+
+// ERFWriter writes ERF records, from packets of link type 197.
+type ERFWriter struct {
+	w io.Writer
+}
+
+// WriteHeader does nothing, as ERF files have no header.
+func (p *ERFWriter) WriteHeader(gh *GlobalHeader) error {
+	if gh.LinkLayer != erfLinkType {
+		return fmt.Errorf("ERF output requires ERF records, not link type %d",
+			gh.LinkLayer)
+	}
+	return nil
+}
+
+// WritePacket writes a record (comments are unsupported).
+func (p *ERFWriter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	_, err = p.w.Write(b)
+	return
+}
+
+// ERFHandler anonymizes ERF records with Ethernet, PoS or IP payloads.
+type ERFHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *ERFHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 16 {
+		err = fmt.Errorf("short ERF record header (increase snaplen)")
+		return
+	}
+	typ := b[8]
+	n = 16
+
+	// extension headers, each with a bit for another following it
+	for ext := typ&erfExtHeader != 0; ext; {
+		if n+8 > len(b) {
+			err = fmt.Errorf("short ERF extension header (increase snaplen)")
+			return
+		}
+		ext = b[n]&0x80 != 0
+		n += 8
+	}
+
+	var m int
+	switch typ &^ erfExtHeader {
+	case erfTypeEth, erfTypeColorEth, erfTypeDSMColorEth:
+		// offset and pad
+		if n+2 > len(b) {
+			err = fmt.Errorf("short ERF Ethernet header (increase snaplen)")
+			return
+		}
+		n += 2
+		m, err = (&EthHandler{}).Handle(b[n:], anon)
+		n += m
+	case erfTypeHDLCPoS, erfTypeColorHDLCPoS, erfTypeDSMColorHDLCPoS:
+		// Cisco HDLC or PPP in HDLC framing
+		if n+4 > len(b) {
+			err = fmt.Errorf("short ERF PoS header (increase snaplen)")
+			return
+		}
+		if b[n] == 0xff && b[n+1] == 0x03 {
+			switch binary.BigEndian.Uint16(b[n+2:]) {
+			case pppIPv4:
+				return handleIPv4(b, n+4, anon)
+			case pppIPv6:
+				return handleIPv6(b, n+4, anon)
+			}
+			err = unknownProtocol("PPP protocol 0x%04x",
+				binary.BigEndian.Uint16(b[n+2:]))
+			return
+		}
+		m, err = (&CiscoHDLCHandler{}).Handle(b[n:], anon)
+		n += m
+	case erfTypeIPv4:
+		return handleIPv4(b, n, anon)
+	case erfTypeIPv6:
+		return handleIPv6(b, n, anon)
+	default:
+		err = unknownProtocol("ERF type %d", typ&^erfExtHeader)
+	}
+	return
+}
+
+// Trailer updates the record length of truncated records.
+func (h *ERFHandler) Trailer(b []byte, truncated bool) int {
+	if truncated && len(b) >= 16 {
+		binary.BigEndian.PutUint16(b[10:], uint16(len(b)))
+	}
+	return len(b)
+}
+
+// TrailerLen returns 0 and -1, as ERF records have no trailer.
+func (h *ERFHandler) TrailerLen(b []byte) (n int, flag int) {
+	return 0, -1
+}
@@ -15,6 +15,16 @@ const vlanEtherType = 0x8100
 
 const arpEtherType = 0x0806
 
+// ipv4FragMask masks the more fragments flag and fragment offset in the IPv4
+// flags and fragment offset field.
+const ipv4FragMask = 0x3fff
+
+// ipv6FragmentHeader is the IPv6 next header value for a fragment header.
+const ipv6FragmentHeader = 44
+
+// ipv6FragHdrLen is the length of an IPv6 fragment header.
+const ipv6FragHdrLen = 8
+
 // EthHandler anonymizes Ethernet packets.
 type EthHandler struct {
 }
@@ -39,13 +49,15 @@ func (h *EthHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
 	if err = eh.Read(r); err != nil {
 		return
 	}
-	anon.MAC(eh.DestMAC[:])
-	anon.MAC(eh.SrcMAC[:])
-	w := &bytes.Buffer{}
-	if n, err = eh.Write(w); err != nil {
-		return
+	annotate(anon, roleDst)
+	anon.MAC(b[0:6])
+	annotate(anon, roleSrc)
+	anon.MAC(b[6:12])
+	n = 14
+	if eh.VLAN {
+		anon.VLAN(b[14:16])
+		n += 4
 	}
-	copy(b, w.Bytes())
 
 	// anonymize IP addresses
 	switch eh.EtherType {
@@ -53,45 +65,86 @@ func (h *EthHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
 		if err = slurp(8, true); err != nil {
 			return
 		}
-		for i := 0; i < 2; i++ {
+		for i, role := range []string{roleARPSender, roleARPTarget} {
 			if err = slurp(6, false); err != nil {
 				return
 			}
 			if !isAllZeroes(b[n : n+6]) {
+				annotate(anon, role)
 				anon.MAC(b[n : n+6])
 			}
 			n += 6
 			if err = slurp(4, false); err != nil {
 				return
 			}
-			anon.IPv4(b[n : n+4])
+			annotate(anon, role)
+			anon.IPv4(b[n:n+4], Role(i))
 			n += 4
 		}
 	case ipv4EtherType:
-		if err = slurp(20, false); err != nil {
-			return
-		}
-		anon.IPv4(b[n+12 : n+16])
-		anon.IPv4(b[n+16 : n+20])
-		n += 20
-		ihl := int(b[0] & 0xf)
-		if ihl > 5 {
-			if err = slurp((ihl-5)*4, true); err != nil {
-				return
-			}
-		}
+		n, err = handleIPv4(b, n, anon)
 	case ipv6EtherType:
-		if err = slurp(40, false); err != nil {
-			return
-		}
-		anon.IPv6(b[n+8 : n+24])
-		anon.IPv6(b[n+24 : n+40])
-		n += 40
+		n, err = handleIPv6(b, n, anon)
+	default:
+		err = unknownProtocol("EtherType 0x%04x", eh.EtherType)
 	}
 
 	return
 }
 
+// handleIPv4 anonymizes the IPv4 header at offset n in b, returning the offset
+// after it, including any options, or after any UDP payload that's handled.
+// The payloads of fragments are never parsed, as only the first fragment has
+// the UDP header, and it only has part of the payload.
+func handleIPv4(b []byte, n int, anon Anonymizer) (int, error) {
+	if n+20 > len(b) {
+		return n, fmt.Errorf(
+			"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
+			20, n)
+	}
+	anon.IPv4(b[n+12:n+16], Src)
+	anon.IPv4(b[n+16:n+20], Dst)
+	ihl := int(b[n] & 0xf)
+	proto := b[n+9]
+	frag := binary.BigEndian.Uint16(b[n+6:])&ipv4FragMask != 0
+	n += 20
+	if ihl > 5 {
+		if n+(ihl-5)*4 > len(b) {
+			return n, fmt.Errorf(
+				"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
+				(ihl-5)*4, n)
+		}
+		n += (ihl - 5) * 4
+	}
+	if proto == udpProtocol && !frag {
+		return handleUDP(b, n, anon)
+	}
+	return n, nil
+}
+
+// handleIPv6 anonymizes the IPv6 header at offset n in b, returning the offset
+// after it, or after any UDP payload that's handled. A fragment header is kept,
+// but as for IPv4, the payloads of fragments aren't parsed. Other extension
+// headers aren't parsed.
+func handleIPv6(b []byte, n int, anon Anonymizer) (int, error) {
+	if n+40 > len(b) {
+		return n, fmt.Errorf(
+			"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
+			40, n)
+	}
+	anon.IPv6(b[n+8:n+24], Src)
+	anon.IPv6(b[n+24:n+40], Dst)
+	switch b[n+6] {
+	case udpProtocol:
+		return handleUDP(b, n+40, anon)
+	case ipv6FragmentHeader:
+		if n+40+ipv6FragHdrLen <= len(b) {
+			return n + 40 + ipv6FragHdrLen, nil
+		}
+	}
+	return n + 40, nil
+}
+
 // EthHeader is an Ethernet header.
 type EthHeader struct {
 	DestMAC   [6]byte
@@ -133,6 +186,10 @@ func (h *EthHeader) Write(w io.Writer) (n int, err error) {
 	}
 	n += 6
 	if h.VLAN {
+		var tpid uint16 = vlanEtherType
+		if err = binary.Write(w, binary.BigEndian, &tpid); err != nil {
+			return
+		}
 		if err = binary.Write(w, binary.BigEndian, &h.TCI); err != nil {
 			return
 		}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Wireshark extcap flags (https://www.wireshark.org/docs/man-pages/extcap.html)
+var (
+	extcapInterfaces = flag.Bool("extcap-interfaces", false,
+		"list extcap interfaces for Wireshark")
+	extcapVersion   = flag.String("extcap-version", "", "Wireshark version")
+	extcapInterface = flag.String("extcap-interface", "",
+		"extcap interface to use")
+	extcapDLTs   = flag.Bool("extcap-dlts", false, "list extcap DLTs")
+	extcapConfig = flag.Bool("extcap-config", false,
+		"list extcap configuration options")
+	extcapCapture = flag.Bool("capture", false, "start an extcap capture")
+	extcapFifo    = flag.String("fifo", "", "extcap capture output fifo")
+	extcapFilter  = flag.String("extcap-capture-filter", "",
+		"extcap capture filter")
+	captureInterface = flag.String("capture-interface", "",
+		"network interface to capture from in extcap mode")
+	captureCommand = flag.String("capture-command", "",
+		"command that writes a pcap to stdout in extcap mode, or on the "+
+			"-remote host, followed by the interface and filter (tcpdump or "+
+			"dumpcap if empty)")
+)
+
+const extcapName = "wanonpcap"
+
+func init() {
+	Servers = append(Servers, extcapServe)
+}
+
+// extcapQuery answers Wireshark's extcap queries, returning true if it did.
+func extcapQuery(w io.Writer) bool {
+	switch {
+	case *extcapInterfaces:
+		fmt.Fprintf(w, "extcap {version=%s}{help=%s}\n", Version,
+			"https://github.com/heistp/wanonpcap")
+		fmt.Fprintf(w, "interface {value=%s}{display=%s}\n", extcapName,
+			"Anonymized capture (wanonpcap)")
+	case *extcapDLTs:
+		fmt.Fprintln(w, "dlt {number=1}{name=EN10MB}{display=Ethernet}")
+	case *extcapConfig:
+		arg := 0
+		opt := func(call, display, typ, tooltip, extra string) {
+			fmt.Fprintf(w, "arg {number=%d}{call=--%s}{display=%s}{type=%s}"+
+				"{tooltip=%s}%s\n", arg, call, display, typ, tooltip, extra)
+			arg++
+		}
+		sel := func(call, display string, values []string, def string) {
+			opt(call, display, "selector", display+" anonymization method", "")
+			for _, v := range values {
+				d := ""
+				if v == def {
+					d = "{default=true}"
+				}
+				fmt.Fprintf(w, "value {arg=%d}{value=%s}{display=%s}%s\n",
+					arg-1, v, v, d)
+			}
+		}
+		methods := []string{"pseudonym", "encrypt", "leave"}
+		opt("capture-interface", "Interface", "string",
+			"Network interface to capture from", "{required=true}")
+		opt("key", "Key", "password",
+			"Key for anonymization (random if empty)", "")
+		sel("mac-oui", "MAC OUI", methods, "pseudonym")
+		sel("mac-nic", "MAC NIC", methods, "pseudonym")
+		sel("ipv4", "IPv4", methods, "pseudonym")
+		sel("ipv6", "IPv6", methods, "pseudonym")
+		sel("vlan", "VLAN", []string{"leave", "pseudonym", "zero"}, "leave")
+		opt("capture-command", "Capture command", "string",
+			"Command that writes a pcap to stdout, followed by the interface "+
+				"(tcpdump or dumpcap if empty)", "")
+	default:
+		return false
+	}
+	return true
+}
+
+// extcapServe runs an extcap capture, anonymizing the output of the capture
+// command to the fifo given by Wireshark.
+func extcapServe(p Policy, k *Keys, cfg *Config) (ok bool, err error) {
+	if !*extcapCapture {
+		return
+	}
+	ok = true
+	if *extcapInterface != extcapName {
+		err = fmt.Errorf("unknown extcap interface: %s", *extcapInterface)
+		return
+	}
+	if *captureInterface == "" {
+		err = fmt.Errorf("no capture interface given")
+		return
+	}
+	var args []string
+	if args, err = captureArgs(*captureInterface, *extcapFilter); err != nil {
+		return
+	}
+	if derr := checkCaptureDevice(); derr != nil {
+		printf("%s", derr)
+	}
+	var fifo *os.File
+	if fifo, err = os.OpenFile(*extcapFifo, os.O_WRONLY, 0); err != nil {
+		return
+	}
+	defer fifo.Close()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	var out io.ReadCloser
+	if out, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	var streams Streams
+	if streams, err = k.Streams(); err != nil {
+		return
+	}
+	c := *cfg
+	c.AsyncWrite = false
+	_, err = run(context.Background(), out, fifo,
+		NewDefaultAnonymizer(p, streams), &c)
+	cmd.Process.Kill()
+	cmd.Wait()
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// captureArgs returns the command line to capture from iface with filter.
+// Without -capture-command, tcpdump is used if it's found, or else
+// Wireshark's dumpcap, which captures with Npcap on Windows, where tcpdump is
+// rarely installed.
+func captureArgs(iface, filter string) (args []string, err error) {
+	if *captureCommand != "" {
+		args = append(strings.Fields(*captureCommand), iface)
+		if filter != "" {
+			args = append(args, filter)
+		}
+		return
+	}
+	if _, lerr := exec.LookPath("tcpdump"); lerr == nil {
+		args = []string{"tcpdump", "-U", "-w", "-", "-i", iface}
+		if filter != "" {
+			args = append(args, filter)
+		}
+		return
+	}
+	var d string
+	if d, err = findDumpcap(); err != nil {
+		return
+	}
+	args = []string{d, "-q", "-w", "-", "-i", iface}
+	if filter != "" {
+		args = append(args, "-f", filter)
+	}
+	return
+}
+
+// findDumpcap returns the path to dumpcap, from the PATH, beside Wireshark's
+// global extcap directory, if the executable is in it, or in Wireshark's
+// default install location.
+func findDumpcap() (string, error) {
+	if p, err := exec.LookPath("dumpcap"); err == nil {
+		return p, nil
+	}
+	var ps []string
+	if exe, err := os.Executable(); err == nil {
+		ps = append(ps, filepath.Join(filepath.Dir(filepath.Dir(exe)),
+			"dumpcap"))
+	}
+	switch runtime.GOOS {
+	case "windows":
+		ps = append(ps, filepath.Join(os.Getenv("ProgramFiles"), "Wireshark",
+			"dumpcap"))
+		for i := range ps {
+			ps[i] += ".exe"
+		}
+	case "darwin":
+		ps = append(ps, "/Applications/Wireshark.app/Contents/MacOS/dumpcap")
+	}
+	for _, p := range ps {
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("neither tcpdump nor dumpcap found " +
+		"(give the capture command)")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var flowsOut = flag.String("flows-out", "",
+	"file to write a log of the anonymized flows to, for recipients who only "+
+		"need flow data")
+
+var flowsFormat = flag.String("flows-format", "csv",
+	"format of -flows-out- csv or json (one object per line)")
+
+// tcpFlagNames are the letters for the TCP flags, from the least significant
+// bit, as in the flag summaries of flow tools.
+const tcpFlagNames = "FSRPAUEC"
+
+// flow is the summary of a flow.
+type flow struct {
+	flowKey
+	v4       bool
+	start    time.Time
+	end      time.Time
+	packets  uint64
+	bytes    uint64
+	tcpFlags uint8
+}
+
+// FlowLog wraps an Anonymizer and summarizes the flows of the packets written,
+// by the anonymized addresses of their outer IP header, the protocol, ports
+// and TCP flags, in the same pass. The IP header is found from the offset of
+// the first source address anonymized, so handlers must pass subslices of the
+// packet, as for an AuditAnonymizer. As transport headers may be truncated
+// from the output, ports and flags are taken before truncation, and ports are
+// anonymized with the port anonymizer, which should not record fields.
+type FlowLog struct {
+	Anonymizer
+	ports Anonymizer
+	pkt   []byte
+	hdr   int
+	flows map[flowKey]*flow
+	order []*flow
+}
+
+// NewFlowLog returns a new, empty flow log wrapping a, with ports anonymized
+// by ports.
+func NewFlowLog(a, ports Anonymizer) *FlowLog {
+	return &FlowLog{
+		Anonymizer: a,
+		ports:      ports,
+		flows:      make(map[flowKey]*flow),
+	}
+}
+
+// Begin starts summarizing packet b.
+func (l *FlowLog) Begin(b []byte) {
+	l.pkt = b
+	l.hdr = -1
+}
+
+// IPv4 anonymizes an IPv4 address, recording the IP header of the first
+// source address.
+func (l *FlowLog) IPv4(b []byte, role Role) {
+	l.Anonymizer.IPv4(b, role)
+	l.header(b, role, 12, 4)
+}
+
+// IPv6 anonymizes an IPv6 address, recording the IP header of the first
+// source address.
+func (l *FlowLog) IPv6(b []byte, role Role) {
+	l.Anonymizer.IPv6(b, role)
+	l.header(b, role, 8, 6)
+}
+
+// header records the offset of the IP header of version v if source address
+// b, at offset o in the header, is the packet's first.
+func (l *FlowLog) header(b []byte, role Role, o int, v byte) {
+	if l.hdr >= 0 || role != Src {
+		return
+	}
+	l.hdr = ipHeader(l.pkt, b, o, v)
+}
+
+// add adds the packet begun, with header ph, to its flow, if its IP header
+// was found.
+func (l *FlowLog) add(ph *PacketHeader) {
+	h := l.hdr
+	if h < 0 {
+		return
+	}
+	b := l.pkt
+	var k flowKey
+	var v4 bool
+	var n, ip int
+	var frag bool
+	if b[h]>>4 == 4 {
+		ihl := int(b[h]&0xf) * 4
+		if ihl < 20 || h+ihl > len(b) {
+			return
+		}
+		v4 = true
+		k.proto = b[h+9]
+		copy(k.src[:], net.IP(b[h+12:h+16]).To16())
+		copy(k.dst[:], net.IP(b[h+16:h+20]).To16())
+		// only the first fragment has the transport header
+		frag = binary.BigEndian.Uint16(b[h+6:])&0x1fff != 0
+		n, ip = h+ihl, int(binary.BigEndian.Uint16(b[h+2:]))
+	} else {
+		if h+40 > len(b) {
+			return
+		}
+		k.proto = b[h+6]
+		copy(k.src[:], b[h+8:h+24])
+		copy(k.dst[:], b[h+24:h+40])
+		n, ip = h+40, 40+int(binary.BigEndian.Uint16(b[h+4:]))
+	}
+	var flags uint8
+	if (k.proto == tcpProtocol || k.proto == udpProtocol) && !frag &&
+		n+4 <= len(b) {
+		p := make([]byte, 4)
+		copy(p, b[n:n+4])
+		l.ports.Port(p[:2])
+		l.ports.Port(p[2:])
+		k.srcPort = binary.BigEndian.Uint16(p)
+		k.dstPort = binary.BigEndian.Uint16(p[2:])
+		if k.proto == tcpProtocol && n+14 <= len(b) {
+			flags = b[n+13]
+		}
+	}
+
+	t := time.Unix(int64(ph.TimestampSec), int64(ph.TimestampUsec)*1000)
+	f, ok := l.flows[k]
+	if !ok {
+		f = &flow{flowKey: k, v4: v4, start: t}
+		l.flows[k] = f
+		l.order = append(l.order, f)
+	}
+	f.end = t
+	f.packets++
+	f.bytes += uint64(ip)
+	f.tcpFlags |= flags
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (l *FlowLog) Stats() (s AnonymizerStats) {
+	if sa, ok := l.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (l *FlowLog) Err() (err error) {
+	if ea, ok := l.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// Flows returns the number of flows.
+func (l *FlowLog) Flows() int {
+	return len(l.order)
+}
+
+// flowRecord is a flow as written.
+type flowRecord struct {
+	Proto    uint8  `json:"proto"`
+	Src      string `json:"src"`
+	SrcPort  uint16 `json:"src_port"`
+	Dst      string `json:"dst"`
+	DstPort  uint16 `json:"dst_port"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+	TCPFlags string `json:"tcp_flags"`
+}
+
+// record returns the record for flow f.
+func (f *flow) record() flowRecord {
+	src, dst := net.IP(f.src[:]), net.IP(f.dst[:])
+	if f.v4 {
+		src, dst = src.To4(), dst.To4()
+	}
+	var fl strings.Builder
+	for i := range tcpFlagNames {
+		if f.tcpFlags&(1<<i) != 0 {
+			fl.WriteByte(tcpFlagNames[i])
+		}
+	}
+	return flowRecord{
+		Proto:    f.proto,
+		Src:      src.String(),
+		SrcPort:  f.srcPort,
+		Dst:      dst.String(),
+		DstPort:  f.dstPort,
+		Start:    f.start.UTC().Format(time.RFC3339Nano),
+		End:      f.end.UTC().Format(time.RFC3339Nano),
+		Packets:  f.packets,
+		Bytes:    f.bytes,
+		TCPFlags: fl.String(),
+	}
+}
+
+// Write writes the flows to w in format, csv or json, in the order they
+// started. Bytes are counted from the IP headers' lengths.
+func (l *FlowLog) Write(w io.Writer, format string) (err error) {
+	if format == "json" {
+		e := json.NewEncoder(w)
+		for _, f := range l.order {
+			if err = e.Encode(f.record()); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if _, err = fmt.Fprintln(w, "proto,src,src_port,dst,dst_port,start,end,"+
+		"packets,bytes,tcp_flags"); err != nil {
+		return
+	}
+	for _, f := range l.order {
+		r := f.record()
+		if _, err = fmt.Fprintf(w, "%d,%s,%d,%s,%d,%s,%s,%d,%d,%s\n", r.Proto,
+			r.Src, r.SrcPort, r.Dst, r.DstPort, r.Start, r.End, r.Packets,
+			r.Bytes, r.TCPFlags); err != nil {
+			return
+		}
+	}
+	return
+}
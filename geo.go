@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+var geoIPFile = flag.String("geoip", "",
+	"GeoIP database (MMDB) for address pseudonyms in the same country and AS "+
+		"as the original (requires the geoip build tag)")
+
+// AddressMapper chooses IP address pseudonyms that keep some property of the
+// original address, in place of the random ones from the key stream. Mappers
+// must be safe for concurrent use, as a SyncAnonymizer anonymizes IPv4 and
+// IPv6 addresses in parallel.
+type AddressMapper interface {
+	// Map replaces the random pseudonym p for the original address o, which
+	// has the same length, using p as its source of randomness.
+	Map(o, p []byte)
+
+	// Reset forgets the pseudonyms chosen, when the anonymizer's maps are
+	// cleared.
+	Reset()
+}
+
+// GeoNetwork is a network from a GeoIP database, with a region naming the
+// country and AS its addresses belong to.
+type GeoNetwork struct {
+	Net    *net.IPNet
+	Region string
+}
+
+// readGeoDatabase reads the networks of a GeoIP database file, and is set by
+// the builds that support it.
+var readGeoDatabase func(file string) ([]GeoNetwork, error)
+
+// geoNet is a network of a GeoMapper, with IPv4 addresses in their
+// IPv4-mapped IPv6 form.
+type geoNet struct {
+	first, last [16]byte
+	region      geoRegion
+}
+
+// geoRegion selects the networks pseudonyms are chosen from.
+type geoRegion struct {
+	name string
+	ipv4 bool
+}
+
+// GeoMapper is an AddressMapper that chooses each pseudonym from the networks
+// of the original address's region in a GeoIP database, so the country and AS
+// of addresses are kept while the hosts are hidden. A network of the region
+// is chosen at random, then an address in it, moving on to the next address
+// if it's already a pseudonym. Addresses not in the database, such as private
+// ones, and those of regions with no addresses left, keep their random
+// pseudonym, which may be in any region. The pseudonyms chosen are kept in
+// state files, but those from a pseudonym store aren't known to the mapper,
+// so may be chosen again.
+type GeoMapper struct {
+	nets    []geoNet
+	regions map[geoRegion][]*geoNet
+
+	mu   sync.Mutex
+	used map[[16]byte]bool
+}
+
+// NewGeoMapper returns a new mapper for the given networks, which shouldn't
+// overlap.
+func NewGeoMapper(nets []GeoNetwork) *GeoMapper {
+	g := &GeoMapper{
+		regions: make(map[geoRegion][]*geoNet),
+		used:    make(map[[16]byte]bool),
+	}
+	names := make(map[string]string)
+	for _, n := range nets {
+		var gn geoNet
+		ip, mask := n.Net.IP, n.Net.Mask
+		if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv4len {
+			ip, mask = ip4.To16(), append(net.CIDRMask(96, 128)[:12], mask...)
+			gn.region.ipv4 = true
+		}
+		copy(gn.first[:], ip.Mask(mask))
+		for i := range gn.last {
+			gn.last[i] = gn.first[i] | ^mask[i]
+		}
+		if s, ok := names[n.Region]; ok {
+			gn.region.name = s
+		} else {
+			names[n.Region] = n.Region
+			gn.region.name = n.Region
+		}
+		g.nets = append(g.nets, gn)
+	}
+	sort.Slice(g.nets, func(i, j int) bool {
+		return bytes.Compare(g.nets[i].first[:], g.nets[j].first[:]) < 0
+	})
+	for i := range g.nets {
+		n := &g.nets[i]
+		g.regions[n.region] = append(g.regions[n.region], n)
+	}
+	return g
+}
+
+// openGeoMapper returns a mapper for the networks of a GeoIP database file.
+func openGeoMapper(file string) (*GeoMapper, error) {
+	if readGeoDatabase == nil {
+		return nil, fmt.Errorf("GeoIP databases unsupported " +
+			"(build with -tags geoip)")
+	}
+	nets, err := readGeoDatabase(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewGeoMapper(nets), nil
+}
+
+// find returns the network containing address a, or nil if there's none.
+func (g *GeoMapper) find(a [16]byte) *geoNet {
+	i := sort.Search(len(g.nets), func(i int) bool {
+		return bytes.Compare(g.nets[i].first[:], a[:]) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(a[:], g.nets[i].last[:]) > 0 {
+		return nil
+	}
+	return &g.nets[i]
+}
+
+// to16 returns the 16 byte form of IPv4 or IPv6 address b.
+func to16(b []byte) (a [16]byte) {
+	copy(a[:], net.IP(b).To16())
+	return
+}
+
+// Map replaces p with an unused address from a network of o's region.
+func (g *GeoMapper) Map(o, p []byte) {
+	n := g.find(to16(o))
+	if n == nil {
+		return
+	}
+	nets := g.regions[n.region]
+	r := to16(p)
+	i := int(binary.BigEndian.Uint32(p) % uint32(len(nets)))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for j := 0; j < len(nets); j++ {
+		n := nets[(i+j)%len(nets)]
+		var a [16]byte
+		for k := range a {
+			a[k] = n.first[k] | r[k]&(n.first[k]^n.last[k])
+		}
+		for s := a; ; {
+			if !g.used[a] {
+				g.used[a] = true
+				copy(p, a[16-len(p):])
+				return
+			}
+			if a == n.last {
+				a = n.first
+			} else {
+				inc(a[:])
+			}
+			if a == s {
+				break
+			}
+		}
+	}
+}
+
+// Reset forgets the pseudonyms chosen.
+func (g *GeoMapper) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.used = make(map[[16]byte]bool)
+}
+
+// geoMapperState is the state of a GeoMapper in a state file.
+type geoMapperState struct {
+	Used []string `json:"used"`
+}
+
+// mapperState returns the pseudonyms chosen, in hex in their 16 byte form.
+func (g *GeoMapper) mapperState() interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return geoMapperState{hexKeys(g.used)}
+}
+
+// loadMapperState restores the pseudonyms chosen.
+func (g *GeoMapper) loadMapperState(b []byte) (err error) {
+	var s geoMapperState
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, u := range s.Used {
+		var k [16]byte
+		if err = decodeHexKey(u, k[:]); err != nil {
+			return
+		}
+		g.used[k] = true
+	}
+	return
+}
+
+// inc increments the big-endian number b.
+func inc(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i]++; b[i] != 0 {
+			return
+		}
+	}
+}
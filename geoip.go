@@ -0,0 +1,49 @@
+//go:build geoip
+// +build geoip
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func init() {
+	readGeoDatabase = readMMDB
+}
+
+// mmdbRecord is the part of a GeoIP2 or GeoLite2 Country, City or ASN record
+// that names its region.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// readMMDB reads the networks of a MaxMind DB file, with the country code
+// and AS number as the region, for the databases that have them. Networks
+// with neither are skipped.
+func readMMDB(file string) (nets []GeoNetwork, err error) {
+	r, err := maxminddb.Open(file)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	it := r.Networks(maxminddb.SkipAliasedNetworks)
+	for it.Next() {
+		var rec mmdbRecord
+		n, err := it.Network(&rec)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Country.ISOCode == "" && rec.ASN == 0 {
+			continue
+		}
+		nets = append(nets, GeoNetwork{n,
+			fmt.Sprintf("%s/AS%d", rec.Country.ISOCode, rec.ASN)})
+	}
+	err = it.Err()
+	return
+}
@@ -0,0 +1,91 @@
+//go:build gopacket
+// +build gopacket
+
+package main
+
+import (
+	"flag"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var fallbackGopacket = flag.Bool("fallback-gopacket", false,
+	"use gopacket to decode link types that aren't natively supported")
+
+func init() {
+	FallbackHandler = func(link uint32) Handler {
+		if !*fallbackGopacket {
+			return nil
+		}
+		printf("using gopacket fallback for link layer %d", link)
+		return &GopacketHandler{layers.LinkType(link)}
+	}
+}
+
+// GopacketHandler anonymizes packets of any link type gopacket can decode. It's
+// slower than the native handlers, and only anonymizes the layers it knows
+// about, truncating after the last link or network layer.
+type GopacketHandler struct {
+	link layers.LinkType
+}
+
+// Handle anonymizes one packet.
+func (h *GopacketHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	// with NoCopy, decoded addresses are subslices of b, so they may be
+	// anonymized in place
+	p := gopacket.NewPacket(b, h.link, gopacket.DecodeOptions{NoCopy: true})
+	end := func(l gopacket.Layer) {
+		c := l.LayerContents()
+		if e := cap(b) - cap(c) + len(c); e > n {
+			n = e
+		}
+	}
+	mac := func(m []byte) {
+		if len(m) == 6 {
+			anon.MAC(m)
+		}
+	}
+
+	for _, l := range p.Layers() {
+		switch x := l.(type) {
+		case *layers.Ethernet:
+			mac(x.DstMAC)
+			mac(x.SrcMAC)
+		case *layers.Dot1Q:
+			anon.VLAN(x.LayerContents()[0:2])
+		case *layers.Dot11:
+			mac(x.Address1)
+			mac(x.Address2)
+			mac(x.Address3)
+			mac(x.Address4)
+		case *layers.ARP:
+			mac(x.SourceHwAddress)
+			if len(x.SourceProtAddress) == 4 {
+				anon.IPv4(x.SourceProtAddress, Src)
+			}
+			if !isAllZeroes(x.DstHwAddress) {
+				mac(x.DstHwAddress)
+			}
+			if len(x.DstProtAddress) == 4 {
+				anon.IPv4(x.DstProtAddress, Dst)
+			}
+		case *layers.IPv4:
+			anon.IPv4(x.SrcIP, Src)
+			anon.IPv4(x.DstIP, Dst)
+		case *layers.IPv6:
+			anon.IPv6(x.SrcIP, Src)
+			anon.IPv6(x.DstIP, Dst)
+		default:
+			if l.LayerType() == gopacket.LayerTypeDecodeFailure {
+				err = ErrUnknown
+			}
+			continue
+		}
+		end(l)
+	}
+	if n == 0 {
+		err = ErrUnknown
+	}
+	return
+}
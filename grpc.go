@@ -0,0 +1,252 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var grpcAddr = flag.String("grpc-addr", "",
+	"serve gRPC anonymization on this address instead of processing stdin")
+
+func init() {
+	encoding.RegisterCodec(rawCodec{})
+	Servers = append(Servers, serveGRPC)
+	tlsServerAddrs = append(tlsServerAddrs, grpcAddr)
+}
+
+// rawCodec passes messages as raw bytes, so the service needs no generated
+// code. Clients must use the "raw" content subtype.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *(v.(*[]byte)), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+// grpcServer serves the wanonpcap.Anonymizer service.
+//
+// Anonymize is a bidirectional stream. Each request is a 4-byte big-endian
+// pcap link type followed by a raw packet, and each response is the
+// anonymized (and possibly truncated) packet, or is empty if the packet has
+// unknown structure and is dropped with -drop-unknown, so responses still
+// match requests one for one. Packets are anonymized in the
+// order received with one shared key and mapping state, so all agents get
+// consistent pseudonyms.
+//
+// ExportMaps takes an empty request and returns the pseudonym mappings as CSV,
+// signed as by map export. Flush does the same, then clears the mappings, so
+// state may be migrated elsewhere. Both require a client certificate, as the
+// mappings reveal the originals.
+//
+// The server uses TLS with -listen-cert. With -listen-client-ca, client
+// certificates are verified if given, and required for ExportMaps and Flush,
+// and without it, those are refused.
+type grpcServer struct {
+	sync.Mutex
+	anon *DefaultAnonymizer
+	cfg  *Config
+}
+
+// grpcServiceName is the name of the service.
+const grpcServiceName = "wanonpcap.Anonymizer"
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ExportMaps", Handler: grpcExportMaps},
+		{MethodName: "Flush", Handler: grpcFlush},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Anonymize", Handler: grpcAnonymize, ServerStreams: true,
+			ClientStreams: true},
+	},
+}
+
+func serveGRPC(p Policy, k *Keys, cfg *Config) (bool, error) {
+	if *grpcAddr == "" {
+		return false, nil
+	}
+	if *deterministic {
+		// streams share the anonymizer, so pseudonyms depend on arrival order
+		return true, errors.New("-deterministic may not be used with " +
+			"-grpc-addr")
+	}
+	streams, err := k.Streams()
+	if err != nil {
+		return true, err
+	}
+	a := NewDefaultAnonymizer(p, streams)
+	tc, err := listenTLSConfig()
+	if err != nil {
+		return true, err
+	}
+	if tc == nil {
+		return true, errors.New("-grpc-addr requires -listen-cert")
+	}
+	if tc.ClientCAs != nil {
+		// Anonymize is open to any client, but map exports aren't
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	l, err := listen("grpc", *grpcAddr, true)
+	if err != nil {
+		return true, err
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(tc)))
+	s.RegisterService(&grpcServiceDesc, &grpcServer{anon: a, cfg: cfg})
+	printf("serving gRPC on %s", l.Addr())
+	notifyReady("serving gRPC on " + l.Addr().String())
+	return true, s.Serve(l)
+}
+
+// anonymize anonymizes one request packet.
+func (s *grpcServer) anonymize(req []byte) ([]byte, error) {
+	if len(req) < 4 {
+		return nil, status.Error(codes.InvalidArgument, "short request")
+	}
+	link := binary.BigEndian.Uint32(req)
+	h, ok := Handlers[link]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unsupported link layer: %d", link)
+	}
+	b := req[4:]
+	s.Lock()
+	np := s.anon.Pseudonyms()
+	c := &PacketContext{OrigLen: uint32(len(b)), LinkType: link}
+	n, err := handle(h, c, b, s.anon)
+	unknown := errors.Is(err, ErrUnknown)
+	drop := unknown && s.cfg.DropUnknown
+	if m := s.cfg.Metrics; m != nil {
+		if unknown {
+			m.unknown()
+		}
+		m.packet(np, s.anon.Pseudonyms(), drop)
+	}
+	s.Unlock()
+	if err != nil && !unknown {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if drop {
+		return []byte{}, nil
+	}
+	truncated := s.cfg.Truncate && n < len(b)
+	if truncated {
+		b = b[:n]
+	}
+	b = updateTrailer(h, b, truncated)
+	if m := s.cfg.Metrics; m != nil {
+		atomic.AddUint64(&m.bytes, uint64(len(b)))
+	}
+	return b, nil
+}
+
+func grpcAnonymize(srv interface{}, stream grpc.ServerStream) (err error) {
+	s := srv.(*grpcServer)
+	if m := s.cfg.Metrics; m != nil {
+		m.begin(nil)
+		defer func() {
+			m.end(err)
+		}()
+	}
+	for {
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		resp, err := s.anonymize(req)
+		if err != nil {
+			return err
+		}
+		if err = stream.SendMsg(&resp); err != nil {
+			return err
+		}
+	}
+}
+
+// exportMaps returns the mappings, signed with the map key, then clears them
+// if flush is true. The client must have presented a certificate verified
+// with -listen-client-ca.
+func (s *grpcServer) exportMaps(ctx context.Context, flush bool) (interface{},
+	error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "no peer")
+	}
+	ti, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(ti.State.VerifiedChains) == 0 {
+		return nil, status.Error(codes.PermissionDenied,
+			"a verified client certificate is required")
+	}
+	s.Lock()
+	defer s.Unlock()
+	b := &bytes.Buffer{}
+	if err := s.anon.WriteSignedMaps(b, s.cfg.MapKey, nil); err != nil {
+		return nil, err
+	}
+	if flush {
+		s.anon.ClearMaps()
+	}
+	resp := b.Bytes()
+	return &resp, nil
+}
+
+// grpcUnary handles a unary call to method, which takes an empty request,
+// passing it through any interceptor, as generated code does.
+func grpcUnary(srv interface{}, ctx context.Context,
+	dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+	method string, flush bool) (interface{}, error) {
+	var req []byte
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	s := srv.(*grpcServer)
+	if interceptor == nil {
+		return s.exportMaps(ctx, flush)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + grpcServiceName + "/" + method,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{},
+		error) {
+		return s.exportMaps(ctx, flush)
+	}
+	return interceptor(ctx, &req, info, handler)
+}
+
+func grpcExportMaps(srv interface{}, ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return grpcUnary(srv, ctx, dec, interceptor, "ExportMaps", false)
+}
+
+func grpcFlush(srv interface{}, ctx context.Context,
+	dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return grpcUnary(srv, ctx, dec, interceptor, "Flush", true)
+}
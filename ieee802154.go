@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// IEEE 802.15.4 frame types
+const (
+	wpanBeacon  = 0
+	wpanData    = 1
+	wpanAck     = 2
+	wpanCommand = 3
+)
+
+// IEEE 802.15.4 addressing modes
+const (
+	wpanAddrNone  = 0
+	wpanAddrShort = 2
+	wpanAddrExt   = 3
+)
+
+// wpanAddrLen are the address lengths for each addressing mode.
+var wpanAddrLen = [4]int{0, 0, 2, 8}
+
+// 6LoWPAN dispatch values (RFC 4944 and RFC 6282)
+const (
+	lowpanIPv6  = 0x41
+	lowpanBC0   = 0x50
+	lowpanIPHC  = 0x60
+	lowpanMesh  = 0x80
+	lowpanFrag1 = 0xc0
+	lowpanFragN = 0xe0
+)
+
+// IEEE802154Handler anonymizes IEEE 802.15.4 frames, and the 6LoWPAN and
+// IPv6 headers in data frames. Extended addresses are anonymized as EUI-64s,
+// while short addresses and PAN IDs, which are assigned by the coordinator,
+// are left alone. If fcs is true, frames end with a 2-byte FCS.
+type IEEE802154Handler struct {
+	fcs bool
+}
+
+// Handle anonymizes one packet.
+func (h *IEEE802154Handler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	end := len(b)
+	if h.fcs {
+		end -= 2
+	}
+	if end < 2 {
+		err = fmt.Errorf("short 802.15.4 frame control (increase snaplen)")
+		return
+	}
+
+	// frame control
+	fc := binary.LittleEndian.Uint16(b)
+	typ := fc & 0x7
+	secure := fc&0x8 != 0
+	comp := fc&0x40 != 0
+	ver := fc >> 12 & 0x3
+	dm, sm := int(fc>>10&0x3), int(fc>>14&0x3)
+	if typ > wpanCommand || ver > 2 || dm == 1 || sm == 1 {
+		err = ErrUnknown
+		return
+	}
+	n = 2
+
+	// sequence number, which may be suppressed, and addressing
+	if ver < 2 || fc&0x100 == 0 {
+		n++
+	}
+	dpan, span := wpanPANIDs(ver, dm, sm, comp)
+	if dpan {
+		n += 2
+	}
+	if n+wpanAddrLen[dm] > end {
+		err = fmt.Errorf("short 802.15.4 destination address (increase snaplen)")
+		return
+	}
+	if dm == wpanAddrExt {
+		eui64LE(b[n:n+8], anon)
+	}
+	n += wpanAddrLen[dm]
+	if span {
+		n += 2
+	}
+	if n+wpanAddrLen[sm] > end {
+		err = fmt.Errorf("short 802.15.4 source address (increase snaplen)")
+		return
+	}
+	if sm == wpanAddrExt {
+		eui64LE(b[n:n+8], anon)
+	}
+	n += wpanAddrLen[sm]
+
+	// header IEs aren't parsed, and secured payloads are opaque
+	if ver == 2 && fc&0x200 != 0 {
+		err = ErrUnknown
+		return
+	}
+	if secure {
+		return
+	}
+
+	switch typ {
+	case wpanBeacon:
+		return handleWPANBeacon(b[:end], n, anon)
+	case wpanData:
+		return handleLoWPAN(b[:end], n, anon)
+	case wpanCommand:
+		// command payloads aren't parsed
+		if n+1 > end {
+			err = fmt.Errorf("short 802.15.4 command (increase snaplen)")
+			return
+		}
+		n++
+	}
+	return
+}
+
+// wpanPANIDs returns whether the destination and source PAN IDs are present,
+// for the frame version, addressing modes and PAN ID compression flag.
+func wpanPANIDs(ver uint16, dm, sm int, comp bool) (dpan, span bool) {
+	if ver < 2 {
+		return dm != wpanAddrNone,
+			sm != wpanAddrNone && !(comp && dm != wpanAddrNone)
+	}
+	switch {
+	case dm == wpanAddrNone && sm == wpanAddrNone:
+		return comp, false
+	case sm == wpanAddrNone:
+		return !comp, false
+	case dm == wpanAddrNone:
+		return false, !comp
+	case dm == wpanAddrExt && sm == wpanAddrExt:
+		return !comp, false
+	default:
+		return true, !comp
+	}
+}
+
+// eui64LE anonymizes an EUI-64 that's sent least significant byte first, such
+// as an 802.15.4 extended address or LoRaWAN EUI.
+func eui64LE(b []byte, anon Anonymizer) {
+	reverse(b)
+	anon.EUI64(b)
+	reverse(b)
+}
+
+// handleWPANBeacon anonymizes the pending extended addresses in the beacon at
+// offset n in b, returning the offset after them. The beacon payload isn't
+// parsed.
+func handleWPANBeacon(b []byte, n int, anon Anonymizer) (int, error) {
+	// superframe spec, GTS spec and any GTS list
+	if n+3 > len(b) {
+		return n, fmt.Errorf("short 802.15.4 beacon (increase snaplen)")
+	}
+	n += 2
+	if gts := int(b[n] & 0x7); gts > 0 {
+		n += 1 + gts*3
+	}
+	n++
+
+	// pending addresses
+	if n+1 > len(b) {
+		return n, fmt.Errorf("short 802.15.4 beacon (increase snaplen)")
+	}
+	ns, ne := int(b[n]&0x7), int(b[n]>>4&0x7)
+	n++
+	if n+ns*2+ne*8 > len(b) {
+		return n, fmt.Errorf(
+			"short 802.15.4 pending addresses (increase snaplen)")
+	}
+	n += ns * 2
+	for i := 0; i < ne; i++ {
+		eui64LE(b[n:n+8], anon)
+		n += 8
+	}
+	return n, nil
+}
+
+// handleLoWPAN anonymizes the 6LoWPAN headers at offset n in b, and the IPv6
+// header they carry, returning the offset after them. Non-LoWPAN frames, such
+// as Zigbee, aren't understood.
+func handleLoWPAN(b []byte, n int, anon Anonymizer) (int, error) {
+	slurp := func(x int) error {
+		if n+x > len(b) {
+			return fmt.Errorf(
+				"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
+				x, n)
+		}
+		return nil
+	}
+
+	for {
+		if err := slurp(1); err != nil {
+			return n, err
+		}
+		d := b[n]
+		switch {
+		case d == lowpanIPv6:
+			return handleIPv6(b, n+1, anon)
+		case d == lowpanBC0:
+			if err := slurp(2); err != nil {
+				return n, err
+			}
+			n += 2
+		case d&0xe0 == lowpanIPHC:
+			return handleIPHC(b, n, anon)
+		case d&0xc0 == lowpanMesh:
+			// originator and final addresses, which are short if the V and
+			// F bits are set
+			l := 1
+			if d&0xf == 0xf {
+				l++
+			}
+			if err := slurp(l); err != nil {
+				return n, err
+			}
+			n += l
+			for _, short := range []bool{d&0x20 != 0, d&0x10 != 0} {
+				if short {
+					if err := slurp(2); err != nil {
+						return n, err
+					}
+					n += 2
+					continue
+				}
+				if err := slurp(8); err != nil {
+					return n, err
+				}
+				anon.EUI64(b[n : n+8])
+				n += 8
+			}
+		case d&0xf8 == lowpanFrag1:
+			if err := slurp(4); err != nil {
+				return n, err
+			}
+			n += 4
+		case d&0xf8 == lowpanFragN:
+			// subsequent fragments carry no headers
+			if err := slurp(5); err != nil {
+				return n, err
+			}
+			return n + 5, nil
+		default:
+			return n, unknownProtocol("6LoWPAN dispatch 0x%02x", d)
+		}
+	}
+}
+
+// iphcInline are the lengths of inline unicast addresses for each SAM or DAM
+// value, when stateless.
+var iphcInline = [4]int{16, 8, 2, 0}
+
+// iphcMulticast are the lengths of inline multicast addresses for each DAM
+// value, when stateless.
+var iphcMulticast = [4]int{16, 6, 4, 1}
+
+// handleIPHC anonymizes the inline addresses in the 6LoWPAN IPHC header at
+// offset n in b, returning the offset after it. Full addresses are anonymized
+// as IPv6 addresses, and 64-bit interface identifiers as EUI-64s, while
+// 16-bit short addresses and compressed multicast addresses are left alone.
+// Next headers compressed with NHC aren't parsed.
+func handleIPHC(b []byte, n int, anon Anonymizer) (int, error) {
+	short := func() error {
+		return fmt.Errorf("short 6LoWPAN IPHC header (increase snaplen)")
+	}
+	if n+2 > len(b) {
+		return n, short()
+	}
+	tf, nh, hlim := b[n]>>3&0x3, b[n]&0x4 != 0, b[n]&0x3
+	cid, sac, sam := b[n+1]&0x80 != 0, b[n+1]&0x40 != 0, b[n+1]>>4&0x3
+	m, dac, dam := b[n+1]&0x08 != 0, b[n+1]&0x04 != 0, b[n+1]&0x3
+	n += 2
+
+	// context identifiers, traffic class and flow label, next header and
+	// hop limit
+	l := [4]int{4, 3, 1, 0}[tf]
+	if cid {
+		l++
+	}
+	if !nh {
+		l++
+	}
+	if hlim == 0 {
+		l++
+	}
+	if n+l > len(b) {
+		return n, short()
+	}
+	n += l
+
+	// source address, which is unspecified for stateful SAM 0
+	sl := iphcInline[sam]
+	if sac && sam == 0 {
+		sl = 0
+	}
+	if n+sl > len(b) {
+		return n, short()
+	}
+	iphcAddr(b[n:n+sl], Src, anon)
+	n += sl
+
+	// destination address
+	var dl int
+	switch {
+	case !m && dac && dam == 0:
+		return n, ErrUnknown
+	case !m:
+		dl = iphcInline[dam]
+	case !dac:
+		dl = iphcMulticast[dam]
+	case dam == 0:
+		// unicast prefix based multicast, left alone
+		if n+6 > len(b) {
+			return n, short()
+		}
+		return n + 6, nil
+	default:
+		return n, ErrUnknown
+	}
+	if n+dl > len(b) {
+		return n, short()
+	}
+	if !m || dl == 16 {
+		iphcAddr(b[n:n+dl], Dst, anon)
+	}
+	n += dl
+	return n, nil
+}
+
+// iphcAddr anonymizes an inline IPHC address of any length. Interface
+// identifiers have the universal/local bit inverted from the EUI-64 they're
+// formed from, so it's restored while anonymizing them.
+func iphcAddr(b []byte, r Role, anon Anonymizer) {
+	switch len(b) {
+	case 16:
+		anon.IPv6(b, r)
+	case 8:
+		b[0] ^= 0x02
+		anon.EUI64(b)
+		b[0] ^= 0x02
+	}
+}
+
+// Trailer recomputes the FCS of untruncated frames if the FCS method is to do
+// so. FCSs can't be stripped, as the link type includes them.
+func (h *IEEE802154Handler) Trailer(b []byte, truncated bool) int {
+	if h.fcs && !truncated && fcsMethod == FCSRecompute && len(b) >= 2 {
+		binary.LittleEndian.PutUint16(b[len(b)-2:], wpanFCS(b[:len(b)-2]))
+	}
+	return len(b)
+}
+
+// TrailerLen returns 2 and -1 if frames have an FCS, or 0 and -1 if not.
+func (h *IEEE802154Handler) TrailerLen(b []byte) (n int, flag int) {
+	if h.fcs && len(b) >= 2 {
+		return 2, -1
+	}
+	return 0, -1
+}
+
+// wpanFCS returns the 802.15.4 FCS of b, the ITU-T CRC-16 computed least
+// significant bit first.
+func wpanFCS(b []byte) (c uint16) {
+	for _, x := range b {
+		c ^= uint16(x)
+		for i := 0; i < 8; i++ {
+			if c&1 != 0 {
+				c = c>>1 ^ 0x8408
+			} else {
+				c >>= 1
+			}
+		}
+	}
+	return
+}
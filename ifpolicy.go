@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var interfacePoliciesPath = flag.String("interface-policies", "",
+	"file of anonymization policies for the interfaces of pcapng input")
+
+// interfacePolicy is the policy for the interfaces matching a selector, an
+// interface index, name or description, or * for all, and for packets in
+// direction dir, or either if it's DirUnknown.
+type interfacePolicy struct {
+	selector string
+	dir      Direction
+	policy   Policy
+}
+
+// InterfacePolicies switch the policy of a DefaultAnonymizer according to the
+// interface of each packet in pcapng input. The anonymizer's maps are kept,
+// so pseudonyms are consistent across interfaces. Packets from interfaces
+// without a policy, and from other formats, use the base policy.
+type InterfacePolicies struct {
+	anon     *DefaultAnonymizer
+	base     Policy
+	policies []interfacePolicy
+	cur      *Interface
+	curDir   Direction
+}
+
+// ReadInterfacePolicies reads interface policies from r, to be applied to the
+// anonymizer a, whose current policy is the base policy. Each line holds an
+// interface selector, followed by policy options as name=value pairs, with
+// the names of the command line flags, which override the base policy. The
+// selector is an interface index, name or description, quoted if it contains
+// spaces, or * for all interfaces. The option direction=inbound or
+// direction=outbound limits the line to packets with that direction in their
+// flags, so e.g. only the addresses of outbound packets are anonymized. The
+// first line that matches a packet is used. Blank lines and lines starting
+// with # are ignored.
+func ReadInterfacePolicies(r io.Reader, a *DefaultAnonymizer) (
+	ip *InterfacePolicies, err error) {
+	ip = &InterfacePolicies{anon: a, base: a.policy}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		var p interfacePolicy
+		if p, err = ip.parse(t); err != nil {
+			err = fmt.Errorf("interface policy line %d: %s", line, err)
+			return
+		}
+		ip.policies = append(ip.policies, p)
+	}
+	err = sc.Err()
+	return
+}
+
+// parse parses one interface policy line.
+func (ip *InterfacePolicies) parse(t string) (p interfacePolicy, err error) {
+	var opts []string
+	if strings.HasPrefix(t, "\"") {
+		var q string
+		if q, err = strconv.QuotedPrefix(t); err != nil {
+			return
+		}
+		p.selector, _ = strconv.Unquote(q)
+		opts = strings.Fields(t[len(q):])
+	} else {
+		f := strings.Fields(t)
+		p.selector, opts = f[0], f[1:]
+	}
+	if p.selector == "" {
+		err = fmt.Errorf("empty interface selector")
+		return
+	}
+	p.policy = ip.base
+	for _, o := range opts {
+		name, value, ok := strings.Cut(o, "=")
+		if !ok {
+			err = fmt.Errorf("expected name=value: %s", o)
+			return
+		}
+		if name == "decrypt" {
+			err = fmt.Errorf("decrypt may only be set for all interfaces")
+			return
+		}
+		if name == "direction" {
+			switch value {
+			case "inbound":
+				p.dir = DirInbound
+			case "outbound":
+				p.dir = DirOutbound
+			default:
+				err = fmt.Errorf("invalid direction: %s", value)
+				return
+			}
+			continue
+		}
+		if err = p.policy.Set(name, value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// policy returns the policy for a packet from interface i, which may be nil,
+// in direction d.
+func (ip *InterfacePolicies) policy(i *Interface, d Direction) Policy {
+	if i == nil {
+		return ip.base
+	}
+	for _, p := range ip.policies {
+		if p.dir != DirUnknown && p.dir != d {
+			continue
+		}
+		if p.selector == "*" || p.selector == strconv.Itoa(i.Index) ||
+			p.selector == i.Name || p.selector == i.Description {
+			return p.policy
+		}
+	}
+	return ip.base
+}
+
+// apply sets the anonymizer's policy for a packet from interface i in
+// direction d.
+func (ip *InterfacePolicies) apply(i *Interface, d Direction) {
+	if i == ip.cur && d == ip.curDir {
+		return
+	}
+	ip.cur, ip.curDir = i, d
+	ip.anon.SetPolicy(ip.policy(i, d))
+}
+
+// loadInterfacePolicies reads the interface policies file at path.
+func loadInterfacePolicies(path string, a *DefaultAnonymizer) (
+	*InterfacePolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadInterfacePolicies(f, a)
+}
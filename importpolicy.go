@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var importPolicyPath = flag.String("import-policy", "",
+	"TraceWrangler (XML) or tcpanon policy file to translate into the "+
+		"anonymization policy, overridden by any policy flags given")
+
+// policyOption is a policy option, by the name of its command line flag.
+type policyOption struct {
+	name  string
+	value string
+}
+
+// importedPolicy is a policy translated from another tool's format, as the
+// options to set, and notes on the settings that couldn't be translated
+// exactly.
+type importedPolicy struct {
+	opts  []policyOption
+	notes []string
+
+	// macs holds the methods given for source and destination MAC
+	// addresses, which wanonpcap anonymizes alike.
+	macs map[string]string
+}
+
+// importFields maps the field names used by TraceWrangler and tcpanon, in
+// lower case without separators, to the policy options they translate to.
+// Fields without a role apply to both source and destination. Fields that
+// aren't here, such as payloads or checksums, have no equivalent.
+var importFields = map[string][]string{
+	"ethernet":   {"mac"},
+	"eth":        {"mac"},
+	"mac":        {"mac"},
+	"ethaddr":    {"mac"},
+	"ethsrc":     {"mac-src"},
+	"ethdst":     {"mac-dst"},
+	"macsrc":     {"mac-src"},
+	"macdst":     {"mac-dst"},
+	"ip":         {"ipv4"},
+	"ipv4":       {"ipv4"},
+	"ipaddr":     {"ipv4"},
+	"ipsrc":      {"ipv4-src"},
+	"ipdst":      {"ipv4-dst"},
+	"ipv4src":    {"ipv4-src"},
+	"ipv4dst":    {"ipv4-dst"},
+	"ipv6":       {"ipv6"},
+	"ipv6addr":   {"ipv6"},
+	"ipv6src":    {"ipv6-src"},
+	"ipv6dst":    {"ipv6-dst"},
+	"vlan":       {"vlan"},
+	"dot1q":      {"vlan"},
+	"vlanid":     {"vlan"},
+	"tcp":        {"port"},
+	"udp":        {"port"},
+	"port":       {"port"},
+	"ports":      {"port"},
+	"tcpport":    {"port"},
+	"udpport":    {"port"},
+	"dns":        {"name"},
+	"dnsname":    {"name"},
+	"hostname":   {"name"},
+	"timestamp":  {"zero-timestamps"},
+	"timestamps": {"zero-timestamps"},
+	"wlanseq":    {"seq"},
+	"wlanseqnum": {"seq"},
+}
+
+// importName normalizes a field or method name for lookup.
+func importName(s string) string {
+	return strings.NewReplacer(".", "", "-", "", "_", "", " ", "").Replace(
+		strings.ToLower(strings.TrimSpace(s)))
+}
+
+// importMethod translates a method, as named by TraceWrangler or tcpanon, for
+// option name, returning the value to set it to, or "" if it has no
+// equivalent.
+func (ip *importedPolicy) importMethod(name, method string) (
+	value string, err error) {
+	m := importName(method)
+	switch m {
+	case "leave", "keep", "none", "off", "false", "no", "disabled",
+		"original", "unchanged":
+		value = "leave"
+	case "pseudonym", "pseudonymize", "replace", "random", "randomize", "map",
+		"mapping", "sequential", "true", "on", "yes", "anonymize":
+		value = "pseudonym"
+	case "cryptopan", "prefixpreserving":
+		value = "pseudonym"
+		ip.note("%s: prefix-preserving anonymization translated to "+
+			"pseudonyms (see -preserve-prefix-len)", name)
+	case "encrypt", "encryption", "aes", "xor":
+		value = "encrypt"
+	case "zero", "remove", "clear", "strip":
+		value = "zero"
+	default:
+		err = fmt.Errorf("%s: unknown method: %s", name, method)
+		return
+	}
+	switch name {
+	case "vlan":
+		if value == "encrypt" {
+			ip.note("vlan: VLAN IDs can't be encrypted, translated to " +
+				"pseudonyms")
+			value = "pseudonym"
+		}
+	case "zero-timestamps":
+		value = fmt.Sprint(value != "leave")
+	case "seq":
+		switch value {
+		case "pseudonym", "encrypt":
+			value = "resequence"
+		case "zero":
+		default:
+			value = "leave"
+		}
+	case "name":
+		if value == "encrypt" {
+			ip.note("name: names can't be encrypted, translated to pseudonyms")
+			value = "pseudonym"
+		}
+	}
+	if value == "zero" && name != "vlan" && name != "seq" {
+		ip.note("%s: %s has no equivalent, not translated", name, method)
+		value = ""
+	}
+	return
+}
+
+// note adds a note on a setting that couldn't be translated exactly.
+func (ip *importedPolicy) note(format string, args ...interface{}) {
+	ip.notes = append(ip.notes, fmt.Sprintf(format, args...))
+}
+
+// set translates field, set to method, into policy options.
+func (ip *importedPolicy) set(field, method string) (err error) {
+	names, ok := importFields[importName(field)]
+	if !ok {
+		ip.note("%s: no equivalent, not translated", field)
+		return
+	}
+	for _, n := range names {
+		var v string
+		if v, err = ip.importMethod(n, method); err != nil || v == "" {
+			return
+		}
+		switch n {
+		case "mac-src", "mac-dst":
+			ip.macs[n] = v
+		case "mac":
+			ip.macs["mac-src"], ip.macs["mac-dst"] = v, v
+		default:
+			ip.opts = append(ip.opts, policyOption{n, v})
+		}
+	}
+	return
+}
+
+// keepOUI translates the option to keep the OUI of MAC addresses.
+func (ip *importedPolicy) keepOUI(value string) (err error) {
+	var v string
+	if v, err = ip.importMethod("mac-oui", value); err != nil {
+		return
+	}
+	if v != "leave" && v != "" {
+		ip.opts = append(ip.opts, policyOption{"mac-oui", "leave"})
+	}
+	return
+}
+
+// finish adds the MAC options, once all settings are translated.
+func (ip *importedPolicy) finish() (err error) {
+	src, dst := ip.macs["mac-src"], ip.macs["mac-dst"]
+	if src == "" && dst == "" {
+		return
+	}
+	if src != dst && src != "" && dst != "" {
+		return fmt.Errorf("source and destination MAC addresses have " +
+			"different methods, but are anonymized alike")
+	}
+	v := src
+	if v == "" {
+		v = dst
+	}
+	// the OUI option, if given, overrides the MAC method
+	opts := []policyOption{{"mac-oui", v}, {"mac-nic", v}}
+	ip.opts = append(opts, ip.opts...)
+	return
+}
+
+// readTraceWranglerPolicy reads a TraceWrangler anonymization task, an XML
+// document whose elements are named for the fields or protocol layers they
+// configure, e.g. <IPv4 Method="CryptoPAn"/>, with the method given by their
+// Method, Action or Mode attribute, or a child element or text of the same
+// name, and Enabled="false" leaving the field alone. KeepOUI attributes or elements on Ethernet layers keep the OUI of
+// MAC addresses. Elements with no method are containers, and are skipped.
+func readTraceWranglerPolicy(r io.Reader, ip *importedPolicy) (err error) {
+	type element struct {
+		name     string
+		method   string
+		disabled bool
+		text     strings.Builder
+	}
+	var stack []*element
+	d := xml.NewDecoder(r)
+	for {
+		var t xml.Token
+		if t, err = d.Token(); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := &element{name: t.Name.Local}
+			for _, a := range t.Attr {
+				switch importName(a.Name.Local) {
+				case "method", "action", "mode":
+					e.method = a.Value
+				case "keepoui":
+					if err = ip.keepOUI(a.Value); err != nil {
+						return
+					}
+				case "enabled":
+					e.disabled = importName(a.Value) == "false"
+				}
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			text := strings.TrimSpace(e.text.String())
+			var parent *element
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			switch importName(e.name) {
+			case "method", "action", "mode":
+				if parent != nil {
+					parent.method = text
+				}
+				continue
+			case "keepoui":
+				if err = ip.keepOUI(text); err != nil {
+					return
+				}
+				continue
+			}
+			if e.method == "" {
+				e.method = text
+			}
+			if e.disabled {
+				e.method = "leave"
+			}
+			if e.method == "" {
+				continue
+			}
+			if err = ip.set(e.name, e.method); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readTCPAnonPolicy reads a tcpanon configuration, with lines holding a field
+// and its method, separated by whitespace, = or :, e.g. ip.src = random.
+// Blank lines and lines starting with # are ignored.
+func readTCPAnonPolicy(r io.Reader, ip *importedPolicy) (err error) {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		f := strings.FieldsFunc(t, func(c rune) bool {
+			return c == '=' || c == ':' || c == ' ' || c == '\t'
+		})
+		if len(f) != 2 {
+			return fmt.Errorf("tcpanon line %d: expected field and method: %s",
+				line, t)
+		}
+		if strings.EqualFold(f[0], "keep-oui") ||
+			strings.EqualFold(f[0], "keep_oui") {
+			err = ip.keepOUI(f[1])
+		} else {
+			err = ip.set(f[0], f[1])
+		}
+		if err != nil {
+			return fmt.Errorf("tcpanon line %d: %s", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+// ImportPolicy reads a policy file from TraceWrangler or tcpanon, detected by
+// whether it's XML, and returns the wanonpcap policy options it translates
+// to, in the order to set them, and notes on any settings that couldn't be
+// translated exactly. Settings with no equivalent are noted and skipped, so
+// the rest of a policy may be migrated, but methods that aren't recognized
+// are errors.
+func ImportPolicy(r io.Reader) (opts []policyOption, notes []string,
+	err error) {
+	var b []byte
+	if b, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	ip := &importedPolicy{macs: make(map[string]string)}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("<")) {
+		err = readTraceWranglerPolicy(bytes.NewReader(b), ip)
+	} else {
+		err = readTCPAnonPolicy(bytes.NewReader(b), ip)
+	}
+	if err == nil {
+		err = ip.finish()
+	}
+	return ip.opts, ip.notes, err
+}
+
+// loadImportPolicy reads the policy file to import at path.
+func loadImportPolicy(path string) ([]policyOption, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return ImportPolicy(f)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+var indexPath = flag.String("index", "",
+	"file to write an index of the output to, with the byte offset and "+
+		"timestamp of each packet, for seeking")
+
+// Index records the byte offset and timestamp of each packet written to an
+// output, so downstream tools can seek into large captures without reading
+// them from the start. It's written as CSV, with the number of each packet
+// in the output, from 1, the offset of its record, and its timestamp in
+// seconds since the Unix epoch.
+type Index struct {
+	w       io.Writer
+	offset  uint64
+	packets uint64
+}
+
+// NewIndex returns a new index that writes to w.
+func NewIndex(w io.Writer) (*Index, error) {
+	if _, err := fmt.Fprintln(w, "packet,offset,time"); err != nil {
+		return nil, err
+	}
+	return &Index{w: w}, nil
+}
+
+// writer returns a Writer that counts the bytes written to w, which must be
+// the output the index is for.
+func (x *Index) writer(w io.Writer) io.Writer {
+	return &countingWriter{w, &x.offset}
+}
+
+// packetWriter returns a PacketWriter that indexes the packets written with
+// pw, which must write to the Writer returned by writer.
+func (x *Index) packetWriter(pw PacketWriter) PacketWriter {
+	return &indexWriter{pw, x}
+}
+
+// Packets returns the number of packets indexed.
+func (x *Index) Packets() uint64 {
+	return x.packets
+}
+
+// indexWriter is a PacketWriter that indexes each packet before writing it.
+type indexWriter struct {
+	PacketWriter
+	x *Index
+}
+
+// WritePacket indexes and writes a packet. For pcapng output, the interface
+// description block of a new interface is written first, so the offset is
+// that of the packet's own block.
+func (w *indexWriter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	if ng, ok := w.PacketWriter.(*PcapNGWriter); ok {
+		if i := ng.iface(); i != nil {
+			if _, err = ng.interfaceID(i); err != nil {
+				return
+			}
+		}
+	}
+	w.x.packets++
+	if _, err = fmt.Fprintf(w.x.w, "%d,%d,%d.%06d\n", w.x.packets,
+		atomic.LoadUint64(&w.x.offset), ph.TimestampSec,
+		ph.TimestampUsec); err != nil {
+		return
+	}
+	return w.PacketWriter.WritePacket(ph, b, comment)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var inPlace = flag.Bool("in-place", false,
+	"anonymize the capture file given as an argument, atomically replacing it")
+var shred = flag.Bool("shred", false,
+	"with -in-place, zero-fill the original file's blocks after replacing it")
+
+// shredBufSize is the size of writes when zero-filling a file.
+const shredBufSize = 1 << 20
+
+// openInPlace opens the capture at path for anonymizing in place, returning it
+// for input, and an output that replaces it when closed, with the same
+// permissions. With -shred, the input is opened for writing, so it may be
+// zero-filled through the open file after it's been replaced.
+func openInPlace(path string) (in *os.File, out *fileOutput, err error) {
+	flags := os.O_RDONLY
+	if *shred {
+		flags = os.O_RDWR
+	}
+	if in, err = os.OpenFile(path, flags, 0); err != nil {
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = in.Stat(); err != nil {
+		in.Close()
+		in = nil
+		return
+	}
+	if out, err = createFile(path, true, fi.Mode().Perm()); err != nil {
+		in.Close()
+		in = nil
+		return
+	}
+	// the umask may have cleared some permissions
+	if err = out.Chmod(fi.Mode().Perm()); err != nil {
+		out.Abort()
+		in.Close()
+		in, out = nil, nil
+	}
+	return
+}
+
+// shredFile overwrites the contents of f with zeros and syncs it to disk. On
+// copy-on-write or journaling file systems and SSDs, the original blocks may
+// survive elsewhere on the device.
+func shredFile(f *os.File) (err error) {
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	z := make([]byte, shredBufSize)
+	for off := int64(0); off < fi.Size(); off += int64(len(z)) {
+		b := z
+		if r := fi.Size() - off; r < int64(len(b)) {
+			b = b[:r]
+		}
+		if _, err = f.WriteAt(b, off); err != nil {
+			return
+		}
+	}
+	return f.Sync()
+}
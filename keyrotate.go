@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var keyRotate = flag.Duration("key-rotate", 0,
+	"rotate keys and start new pseudonyms every this much capture time "+
+		"(e.g. 24h), in windows aligned to the Unix epoch")
+
+// KeyRotator rotates the keys of a DefaultAnonymizer by capture time, for
+// continuous operation, so disclosing one window's keys doesn't reveal the
+// addresses of the others. The keys for each window are derived from the
+// given keys, and the pseudonym mappings start over, so pseudonyms aren't
+// consistent between windows. Windows only move forward, so packets whose
+// timestamps go back across a boundary stay in the later window, which is the
+// same when decrypting with the same -key-rotate.
+type KeyRotator struct {
+	anon     *DefaultAnonymizer
+	keys     *Keys
+	interval uint32
+	start    uint32
+	started  bool
+}
+
+// NewKeyRotator returns a new rotator for anonymizer a, with windows of the
+// given interval, which must be a whole number of seconds.
+func NewKeyRotator(a *DefaultAnonymizer, keys *Keys,
+	interval time.Duration) (*KeyRotator, error) {
+	if interval < time.Second || interval%time.Second != 0 ||
+		interval/time.Second > 1<<32-1 {
+		return nil, fmt.Errorf("invalid key rotation interval: %s", interval)
+	}
+	return &KeyRotator{
+		anon:     a,
+		keys:     keys,
+		interval: uint32(interval / time.Second),
+	}, nil
+}
+
+// windowKeys returns the keys for the window starting at start.
+func (k *KeyRotator) windowKeys(start uint32) *Keys {
+	derive := func(key []byte) []byte {
+		if key == nil {
+			return nil
+		}
+		return deriveKey(deriveWindowKey(key, start))
+	}
+	return &Keys{
+		Main: derive(k.keys.Main),
+		MAC:  derive(k.keys.MAC),
+		IPv4: derive(k.keys.IPv4),
+		IPv6: derive(k.keys.IPv6),
+		VLAN: derive(k.keys.VLAN),
+	}
+}
+
+// rotate rekeys the anonymizer if capture time ts is in a later window than
+// the current one, returning a description of the new window for the output
+// metadata, or an empty string if the window is the same.
+func (k *KeyRotator) rotate(ts uint32) (window string, err error) {
+	start := ts - ts%k.interval
+	if k.started && start <= k.start {
+		return
+	}
+	keys := k.windowKeys(start)
+	var s Streams
+	if s, err = keys.Streams(); err != nil {
+		return
+	}
+	k.anon.Rekey(s)
+	k.start = start
+	k.started = true
+	window = fmt.Sprintf("key window from %s, key fingerprint %s",
+		time.Unix(int64(start), 0).UTC().Format(time.RFC3339),
+		keyFingerprint(keys.Main))
+	return
+}
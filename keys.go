@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// deriveKey derives an AES-256 key from a passphrase.
+//
+// It's not ideal either to use SHA256 for a password hash, or to use a fixed
+// IV, but we'll at least warn to use new keys each time in the doc.
+func deriveKey(pass string) []byte {
+	h := sha256.Sum256([]byte(pass))
+	return h[:]
+}
+
+// Keys are the keys for each class of field. Class keys that are nil share the
+// key stream for the Main key. Fields without a class of their own share one:
+// EUI-64s, DevAddrs, names, IDs and sequence numbers use the MAC key stream,
+// and CAN IDs and ports use the VLAN key stream.
+type Keys struct {
+	Main []byte
+	MAC  []byte
+	IPv4 []byte
+	IPv6 []byte
+	VLAN []byte
+}
+
+// Streams returns new key streams for the keys.
+func (k *Keys) Streams() (s Streams, err error) {
+	var ms cipher.Stream
+	if ms, err = newKeyStream(k.Main); err != nil {
+		return
+	}
+	for _, c := range []struct {
+		key []byte
+		s   *cipher.Stream
+	}{
+		{k.MAC, &s.MAC},
+		{k.IPv4, &s.IPv4},
+		{k.IPv6, &s.IPv6},
+		{k.VLAN, &s.VLAN},
+	} {
+		*c.s = ms
+		if c.key != nil {
+			if *c.s, err = newKeyStream(c.key); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// newKeyStream returns a new key stream for a key.
+func newKeyStream(key []byte) (cipher.Stream, error) {
+	bc, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStream{Stream: cipher.NewCTR(bc, iv)}, nil
+}
+
+// countingStream is a key stream that counts the bytes it has used, so its
+// position may be saved and restored.
+type countingStream struct {
+	cipher.Stream
+	n uint64
+}
+
+func (c *countingStream) XORKeyStream(dst, src []byte) {
+	c.Stream.XORKeyStream(dst, src)
+	c.n += uint64(len(src))
+}
+
+// deriveSubkey derives the passphrase for a field class subkey from key, so it
+// may be disclosed and given with -<class>-key.
+func deriveSubkey(key []byte, class string) string {
+	return hkdfKey(key, "wanonpcap subkey", class)
+}
+
+// deriveWindowKey derives the passphrase for the key window starting at
+// start seconds after the Unix epoch from key, so the key of one window
+// doesn't reveal those of the others.
+func deriveWindowKey(key []byte, start uint32) string {
+	return hkdfKey(key, "wanonpcap key window",
+		strconv.FormatUint(uint64(start), 10))
+}
+
+// deriveRequestKey derives the passphrase for the serve request with nonce
+// from key, so no two requests use the same key stream.
+func deriveRequestKey(key []byte, nonce string) string {
+	return hkdfKey(key, "wanonpcap request", nonce)
+}
+
+// hkdfKey derives a passphrase from key using HKDF-SHA256 (RFC 5869), with
+// salt for the use and info for the key within it.
+func hkdfKey(key []byte, salt, info string) string {
+	ext := hmac.New(sha256.New, []byte(salt))
+	ext.Write(key)
+	prk := ext.Sum(nil)
+	exp := hmac.New(sha256.New, prk)
+	exp.Write([]byte(info))
+	exp.Write([]byte{1})
+	return hex.EncodeToString(exp.Sum(nil)[:16])
+}
+
+// keyFingerprint returns a short fingerprint of a derived key, which is safe
+// to disclose.
+func keyFingerprint(key []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("wanonpcap key fingerprint"))
+	return hex.EncodeToString(m.Sum(nil)[:4])
+}
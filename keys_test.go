@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestHKDFKey(t *testing.T) {
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	for _, c := range []struct {
+		name string
+		key  []byte
+		salt string
+		info string
+		want string
+	}{
+		// RFC 5869 test case 1, the first 16 bytes of the OKM
+		{"rfc 5869", ikm, string(salt), string(info),
+			"3cb25f25faacd57a90434f64d0362f2a"},
+		// RFC 5869 test case 3, with no salt or info
+		{"rfc 5869 empty", ikm, "", "", "8da4e775a563c18f715f802a063c5a31"},
+	} {
+		if got := hkdfKey(c.key, c.salt, c.info); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	key := deriveKey("test")
+	other := deriveKey("other")
+	for _, c := range []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"subkey deterministic", deriveSubkey(key, "mac"),
+			deriveSubkey(key, "mac"), true},
+		{"subkey classes", deriveSubkey(key, "mac"),
+			deriveSubkey(key, "ipv4"), false},
+		{"subkey keys", deriveSubkey(key, "mac"),
+			deriveSubkey(other, "mac"), false},
+		{"window deterministic", deriveWindowKey(key, 3600),
+			deriveWindowKey(key, 3600), true},
+		{"windows", deriveWindowKey(key, 0), deriveWindowKey(key, 3600), false},
+		{"request deterministic", deriveRequestKey(key, "n"),
+			deriveRequestKey(key, "n"), true},
+		{"requests", deriveRequestKey(key, "a"), deriveRequestKey(key, "b"),
+			false},
+		// the same info for different uses must not give the same key
+		{"uses", deriveSubkey(key, "0"), deriveWindowKey(key, 0), false},
+		{"fingerprint deterministic", keyFingerprint(key),
+			keyFingerprint(deriveKey("test")), true},
+		{"fingerprints", keyFingerprint(key), keyFingerprint(other), false},
+	} {
+		if (c.a == c.b) != c.same {
+			t.Errorf("%s: %s and %s, want same %t", c.name, c.a, c.b, c.same)
+		}
+	}
+	if n := len(keyFingerprint(key)); n != 8 {
+		t.Errorf("fingerprint length %d, want 8", n)
+	}
+	if n := len(deriveSubkey(key, "mac")); n != 32 {
+		t.Errorf("subkey length %d, want 32", n)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+var wrappedKeyPath = flag.String("wrapped-key", "",
+	"file with the key wrapped by the key of -kms-key-id or -pkcs11-uri, in "+
+		"binary or base64")
+
+var kmsKeyID = flag.String("kms-key-id", "",
+	"AWS KMS key to unwrap -wrapped-key with (requires the kms build tag)")
+
+var pkcs11URI = flag.String("pkcs11-uri", "",
+	"PKCS#11 URI of the RSA private key to unwrap -wrapped-key with, using "+
+		"RSA-OAEP with SHA-256 (requires the pkcs11 build tag)")
+
+// KeyUnwrappers unwrap keys with a key held in a KMS or HSM, by the build tag
+// that adds them. Each is given the ID of the unwrapping key, as given on the
+// command line, and the wrapped key, and returns the key, which is used as
+// the passphrase given with -key would be.
+var KeyUnwrappers = map[string]func(id string, wrapped []byte) ([]byte,
+	error){}
+
+// unwrapKeyFlags returns the key unwrapped with -kms-key-id or -pkcs11-uri,
+// or nil if neither was given, so long-running services needn't keep the key
+// in their configuration.
+func unwrapKeyFlags() (key []byte, err error) {
+	var flg, tag, id string
+	for _, u := range []struct {
+		flag, tag, id string
+	}{
+		{"kms-key-id", "kms", *kmsKeyID},
+		{"pkcs11-uri", "pkcs11", *pkcs11URI},
+	} {
+		if u.id == "" {
+			continue
+		}
+		if flg != "" {
+			err = fmt.Errorf("-%s and -%s are mutually exclusive", flg, u.flag)
+			return
+		}
+		flg, tag, id = u.flag, u.tag, u.id
+	}
+	if flg == "" {
+		if *wrappedKeyPath != "" {
+			err = fmt.Errorf("-wrapped-key requires -kms-key-id or -pkcs11-uri")
+		}
+		return
+	}
+	if *wrappedKeyPath == "" {
+		err = fmt.Errorf("-%s requires -wrapped-key", flg)
+		return
+	}
+	unwrap, ok := KeyUnwrappers[tag]
+	if !ok {
+		err = fmt.Errorf("-%s unsupported (build with -tags %s)", flg, tag)
+		return
+	}
+	var w []byte
+	if w, err = ioutil.ReadFile(*wrappedKeyPath); err != nil {
+		return
+	}
+	if d, derr := base64.StdEncoding.DecodeString(
+		string(bytes.TrimSpace(w))); derr == nil {
+		w = d
+	}
+	if key, err = unwrap(id, w); err != nil {
+		err = fmt.Errorf("error unwrapping key: %s", err)
+		return
+	}
+	if len(key) == 0 {
+		err = fmt.Errorf("unwrapped key is empty")
+	}
+	return
+}
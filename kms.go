@@ -0,0 +1,35 @@
+//go:build kms
+// +build kms
+
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+func init() {
+	KeyUnwrappers["kms"] = unwrapKMS
+}
+
+// unwrapKMS decrypts the wrapped key with the AWS KMS key id, which may be a
+// key ID, ARN or alias, using the credentials and region found by the AWS
+// SDK, such as from the environment or an instance role.
+func unwrapKMS(id string, wrapped []byte) ([]byte, error) {
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := kms.NewFromConfig(cfg).Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: wrapped,
+		KeyId:          aws.String(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+)
+
+var leakScanStr = flag.String("leak-scan", "none",
+	"with -no-truncate, scan kept payloads for addresses anonymized in "+
+		"headers- none, warn or abort")
+
+// LeakAction is what's done when a LeakScanner finds a possible leak.
+type LeakAction int
+
+const (
+	// LeakNone means don't scan for leaks.
+	LeakNone LeakAction = iota
+
+	// LeakWarn means log each possible leak.
+	LeakWarn
+
+	// LeakAbort means stop with an error at the first possible leak.
+	LeakAbort
+)
+
+func parseLeakAction(s string) (a LeakAction, err error) {
+	switch s {
+	case "none":
+		a = LeakNone
+	case "warn":
+		a = LeakWarn
+	case "abort":
+		a = LeakAbort
+	default:
+		err = fmt.Errorf("unknown leak scan action: %s", s)
+	}
+	return
+}
+
+// leak is a possible unanonymized address in a packet.
+type leak struct {
+	class  string
+	offset int
+}
+
+// LeakScanner wraps an Anonymizer and remembers the original MAC, IPv4 and
+// IPv6 addresses it changes, so packets can be scanned for them afterwards.
+// With -no-truncate, this catches addresses in tunnels and application data
+// that aren't parsed. Addresses are found in binary form, and for IPv4 and
+// MAC addresses, also as text. It's a heuristic, as short binary patterns
+// may match by chance, and addresses in other forms aren't found.
+type LeakScanner struct {
+	Anonymizer
+	Action LeakAction
+
+	// Found is the number of possible leaks found.
+	Found uint64
+
+	macs  map[[6]byte]bool
+	ipv4s map[[4]byte]bool
+	ipv6s map[[16]byte]bool
+}
+
+// NewLeakScanner returns a new leak scanner wrapping a.
+func NewLeakScanner(a Anonymizer, action LeakAction) *LeakScanner {
+	return &LeakScanner{
+		Anonymizer: a,
+		Action:     action,
+		macs:       make(map[[6]byte]bool),
+		ipv4s:      make(map[[4]byte]bool),
+		ipv6s:      make(map[[16]byte]bool),
+	}
+}
+
+// MAC anonymizes a MAC address, remembering it if changed.
+func (l *LeakScanner) MAC(b []byte) {
+	var o [6]byte
+	copy(o[:], b)
+	l.Anonymizer.MAC(b)
+	if !bytes.Equal(o[:], b) {
+		l.macs[o] = true
+	}
+}
+
+// IPv4 anonymizes an IPv4 address, remembering it if changed.
+func (l *LeakScanner) IPv4(b []byte, r Role) {
+	var o [4]byte
+	copy(o[:], b)
+	l.Anonymizer.IPv4(b, r)
+	if !bytes.Equal(o[:], b) {
+		l.ipv4s[o] = true
+	}
+}
+
+// IPv6 anonymizes an IPv6 address, remembering it if changed.
+func (l *LeakScanner) IPv6(b []byte, r Role) {
+	var o [16]byte
+	copy(o[:], b)
+	l.Anonymizer.IPv6(b, r)
+	if !bytes.Equal(o[:], b) {
+		l.ipv6s[o] = true
+	}
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (l *LeakScanner) Stats() (s AnonymizerStats) {
+	if sa, ok := l.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (l *LeakScanner) Err() (err error) {
+	if ea, ok := l.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// scan returns the possible leaks of remembered addresses in the anonymized
+// packet b.
+func (l *LeakScanner) scan(b []byte) (leaks []leak) {
+	for i := range b {
+		if i+6 <= len(b) && l.macs[*(*[6]byte)(b[i:])] {
+			leaks = append(leaks, leak{"MAC address", i})
+		}
+		if i+4 <= len(b) && l.ipv4s[*(*[4]byte)(b[i:])] {
+			leaks = append(leaks, leak{"IPv4 address", i})
+		}
+		if i+16 <= len(b) && l.ipv6s[*(*[16]byte)(b[i:])] {
+			leaks = append(leaks, leak{"IPv6 address", i})
+		}
+		if a, ok := textIPv4(b, i); ok && l.ipv4s[a] {
+			leaks = append(leaks, leak{"IPv4 address text", i})
+		}
+		if a, ok := textMAC(b, i); ok && l.macs[a] {
+			leaks = append(leaks, leak{"MAC address text", i})
+		}
+	}
+	l.Found += uint64(len(leaks))
+	return
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// textIPv4 parses a dotted decimal IPv4 address starting at b[i], if one
+// starts there.
+func textIPv4(b []byte, i int) (a [4]byte, ok bool) {
+	if !isDigit(b[i]) || i > 0 && (isDigit(b[i-1]) || b[i-1] == '.') {
+		return
+	}
+	for j := 0; j < 4; j++ {
+		if j > 0 {
+			if i >= len(b) || b[i] != '.' {
+				return
+			}
+			i++
+		}
+		v, n := 0, 0
+		for ; i < len(b) && isDigit(b[i]) && n < 3; i++ {
+			v = v*10 + int(b[i]-'0')
+			n++
+		}
+		if n == 0 || v > 255 {
+			return
+		}
+		a[j] = byte(v)
+	}
+	ok = i == len(b) || !isDigit(b[i]) &&
+		!(b[i] == '.' && i+1 < len(b) && isDigit(b[i+1]))
+	return
+}
+
+// hexNibble returns the value of hex digit c, or -1 if it isn't one.
+func hexNibble(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+// textMAC parses a MAC address with colon or hyphen separators starting at
+// b[i], if one starts there.
+func textMAC(b []byte, i int) (a [6]byte, ok bool) {
+	if i+17 > len(b) || i > 0 && hexNibble(b[i-1]) >= 0 {
+		return
+	}
+	sep := b[i+2]
+	if sep != ':' && sep != '-' {
+		return
+	}
+	for j := 0; j < 6; j++ {
+		p := i + j*3
+		if j > 0 && b[p-1] != sep {
+			return
+		}
+		h, l := hexNibble(b[p]), hexNibble(b[p+1])
+		if h < 0 || l < 0 {
+			return
+		}
+		a[j] = byte(h<<4 | l)
+	}
+	ok = i+17 == len(b) || hexNibble(b[i+17]) < 0 && b[i+17] != sep
+	return
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var listenAddr = flag.String("listen", "",
+	"TCP address to accept a capture stream from instead of stdin (e.g. :5000 "+
+		"for tcpdump -w - | nc host 5000)")
+
+var listenCert = flag.String("listen-cert", "",
+	"with -listen or -grpc-addr, PEM certificate file to require TLS with")
+
+var listenKey = flag.String("listen-key", "",
+	"with -listen-cert, PEM private key file for the certificate")
+
+var listenClientCA = flag.String("listen-client-ca", "",
+	"with -listen-cert, PEM file of CA certificates that must have signed "+
+		"the sender's client certificate")
+
+// tlsServerAddrs are the address flags of the servers other than -listen that
+// use -listen-cert, such as -grpc-addr.
+var tlsServerAddrs []*string
+
+// listenTLSUsed returns true if -listen, or a server in tlsServerAddrs, is
+// used.
+func listenTLSUsed() bool {
+	if *listenAddr != "" {
+		return true
+	}
+	for _, a := range tlsServerAddrs {
+		if *a != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listenTLSConfig returns the TLS config for -listen-cert, or nil if TLS
+// isn't used.
+func listenTLSConfig() (*tls.Config, error) {
+	if *listenCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*listenCert, *listenKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *listenClientCA != "" {
+		b, err := ioutil.ReadFile(*listenClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no certificates found", *listenClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// acceptInput listens on addr, or the socket named input passed by systemd
+// socket activation, and returns the first connection, so a remote capture
+// box can stream a capture to be anonymized without storing it. With tc, the
+// connection uses TLS, and its handshake is completed before it's returned.
+// Only one capture is accepted per run, so the listener is closed once it
+// connects.
+func acceptInput(addr string, tc *tls.Config) (c net.Conn, err error) {
+	var l net.Listener
+	if l, err = listen("input", addr, true); err != nil {
+		return
+	}
+	defer l.Close()
+	if tc != nil {
+		l = tls.NewListener(l, tc)
+	}
+	printf("waiting for a capture on %s", l.Addr())
+	if c, err = l.Accept(); err != nil {
+		return
+	}
+	if t, ok := c.(*tls.Conn); ok {
+		if err = t.Handshake(); err != nil {
+			c.Close()
+			err = fmt.Errorf("TLS handshake with %s: %s", c.RemoteAddr(), err)
+			return
+		}
+	}
+	printf("receiving capture from %s", c.RemoteAddr())
+	return
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var logFormat = flag.String("log-format", "text",
+	"format of diagnostics on stderr- text or json")
+
+// Level is a diagnostic message level.
+type Level int
+
+const (
+	// LevelError is for errors, which are always printed.
+	LevelError Level = iota
+
+	// LevelInfo is for startup messages and summaries.
+	LevelInfo
+
+	// LevelVerbose is for periodic statistics.
+	LevelVerbose
+
+	// LevelDebug is for per-packet decisions.
+	LevelDebug
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelInfo:
+		return "info"
+	case LevelVerbose:
+		return "verbose"
+	case LevelDebug:
+		return "debug"
+	}
+	return strconv.Itoa(int(l))
+}
+
+// verbosity is the highest level printed.
+var verbosity = LevelInfo
+
+func init() {
+	flag.Var((*verbosityFlag)(&verbosity), "v",
+		"verbose output (periodic stats), repeat for debug (per-packet)")
+	flag.Var((*quietFlag)(&verbosity), "q", "quiet, print errors only")
+}
+
+// verbosityFlag increments the verbosity each time it's given.
+type verbosityFlag Level
+
+func (v *verbosityFlag) String() string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosityFlag) Set(s string) (err error) {
+	var b bool
+	if b, err = strconv.ParseBool(s); err == nil && b {
+		*v++
+	}
+	return
+}
+
+func (v *verbosityFlag) IsBoolFlag() bool { return true }
+
+// quietFlag sets the verbosity to errors only.
+type quietFlag Level
+
+func (q *quietFlag) String() string { return "false" }
+
+func (q *quietFlag) Set(s string) (err error) {
+	var b bool
+	if b, err = strconv.ParseBool(s); err == nil && b {
+		*q = quietFlag(LevelError)
+	}
+	return
+}
+
+func (q *quietFlag) IsBoolFlag() bool { return true }
+
+// checkLogFormat returns an error if the -log-format flag is unknown.
+func checkLogFormat() error {
+	switch *logFormat {
+	case "text", "json":
+		return nil
+	}
+	err := fmt.Errorf("unknown log format: %s", *logFormat)
+	*logFormat = "text"
+	return err
+}
+
+// logEntry is a diagnostic message, printed as one line of JSON with
+// -log-format json.
+type logEntry struct {
+	Level    string  `json:"level"`
+	Message  string  `json:"msg"`
+	Packet   uint64  `json:"packet,omitempty"`
+	LinkType *uint32 `json:"link_type,omitempty"`
+}
+
+// output prints the entry to stderr.
+func (e *logEntry) output() {
+	if *logFormat != "json" {
+		fmt.Fprintln(os.Stderr, e.Message)
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, e.Message)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(b))
+}
+
+// logf prints a message to stderr if l is enabled.
+func logf(l Level, format string, args ...interface{}) {
+	if l > verbosity {
+		return
+	}
+	e := logEntry{Level: l.String(), Message: fmt.Sprintf(format, args...)}
+	e.output()
+}
+
+// logPacketf prints a message about the given packet index (counting from 1,
+// or 0 for none) in a capture of the given link type, if l is enabled.
+func logPacketf(l Level, link uint32, packet uint64, format string,
+	args ...interface{}) {
+	if l > verbosity {
+		return
+	}
+	e := logEntry{
+		Level:    l.String(),
+		Message:  fmt.Sprintf(format, args...),
+		Packet:   packet,
+		LinkType: &link,
+	}
+	e.output()
+}
+
+// logRaw prints a line that is already in the -log-format, such as JSON
+// progress, if l is enabled.
+func logRaw(l Level, s string) {
+	if l > verbosity {
+		return
+	}
+	fmt.Fprintln(os.Stderr, s)
+}
+
+func errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+func printf(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+func println(s string) {
+	logf(LevelInfo, "%s", s)
+}
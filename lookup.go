@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// lookupPart is a part of a value looked up in maps, such as the OUI of a
+// MAC address, by its class and value as written in the maps.
+type lookupPart struct {
+	class string
+	value string
+}
+
+// lookupValue is a value looked up in maps, made of one or more parts.
+type lookupValue struct {
+	parts []lookupPart
+
+	// format returns the value with the given part values.
+	format func(values []string) string
+}
+
+// parseLookupValue parses a value to look up: an IPv4 or IPv6 address, a MAC
+// address or EUI-64, a class and value as written in the maps (e.g.
+// vlan,10), or a DNS name, whose labels are mapped separately.
+func parseLookupValue(s string) (v lookupValue, err error) {
+	hexParts := func(class []string, b [][]byte) {
+		for i, c := range class {
+			v.parts = append(v.parts, lookupPart{c, hex.EncodeToString(b[i])})
+		}
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			hexParts([]string{"ipv4"}, [][]byte{ip4})
+		} else {
+			hexParts([]string{"ipv6"}, [][]byte{ip})
+		}
+		v.format = func(vs []string) string {
+			b, _ := hex.DecodeString(vs[0])
+			return net.IP(b).String()
+		}
+		return
+	}
+	if hw, herr := net.ParseMAC(s); herr == nil &&
+		(len(hw) == 6 || len(hw) == 8) {
+		nic := "mac-nic"
+		if len(hw) == 8 {
+			nic = "eui64-ext"
+		}
+		hexParts([]string{"mac-oui", nic}, [][]byte{hw[:3], hw[3:]})
+		v.format = func(vs []string) string {
+			b, _ := hex.DecodeString(vs[0] + vs[1])
+			return net.HardwareAddr(b).String()
+		}
+		return
+	}
+	if f := strings.SplitN(s, ",", 2); len(f) == 2 {
+		v.parts = []lookupPart{{f[0], strings.ToLower(f[1])}}
+		v.format = func(vs []string) string {
+			return f[0] + "," + vs[0]
+		}
+		return
+	}
+	if strings.Contains(s, ".") {
+		// names are mapped by label
+		for _, l := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+			hexParts([]string{"name"}, [][]byte{[]byte(strings.ToLower(l))})
+		}
+		v.format = func(vs []string) string {
+			ls := make([]string, len(vs))
+			for i, h := range vs {
+				b, _ := hex.DecodeString(h)
+				ls[i] = string(b)
+			}
+			return strings.Join(ls, ".")
+		}
+		return
+	}
+	err = fmt.Errorf("unrecognized address: %s", s)
+	return
+}
+
+// readLookupMaps reads the maps to look values up in, from exported maps
+// authenticated with mapKey, or a state file authenticated with key.
+func readLookupMaps(path string, key, mapKey []byte, unsigned bool) (
+	recs []mapRecord, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if b, _ := br.Peek(1); len(b) == 0 || b[0] != '{' {
+		return readMapRecords(br, mapKey, unsigned)
+	}
+	var s anonState
+	if s, err = readState(br, key); err != nil {
+		return
+	}
+	sc := bufio.NewScanner(strings.NewReader(s.Maps))
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || line == 1 && strings.HasPrefix(t, mapsHeader) {
+			continue
+		}
+		var rec mapRecord
+		if rec, err = parseMapRecord(t); err != nil {
+			return
+		}
+		recs = append(recs, rec)
+	}
+	err = sc.Err()
+	return
+}
+
+// lookup writes the pseudonym of each value in values, or with reverse, the
+// originals of each pseudonym, found in recs. It's an error if any part of a
+// value isn't found. Pseudonyms that more than one original got, such as
+// sequence number offsets, give each original.
+func lookup(w io.Writer, recs []mapRecord, values []string,
+	reverse bool) (err error) {
+	idx := make(map[string][]string)
+	for _, r := range recs {
+		from, to := r.orig, r.pseudo
+		if reverse {
+			from, to = to, from
+		}
+		k := r.class + "," + from
+		idx[k] = append(idx[k], to)
+	}
+	for _, s := range values {
+		var v lookupValue
+		if v, err = parseLookupValue(s); err != nil {
+			return
+		}
+		// every combination of the values found for each part
+		found := [][]string{nil}
+		for _, p := range v.parts {
+			ts, ok := idx[p.class+","+p.value]
+			if !ok {
+				return fmt.Errorf("%s: no mapping for %s %s", s, p.class,
+					p.value)
+			}
+			var next [][]string
+			for _, f := range found {
+				for _, t := range ts {
+					next = append(next, append(f[:len(f):len(f)], t))
+				}
+			}
+			found = next
+		}
+		var out bytes.Buffer
+		for _, f := range found {
+			fmt.Fprintf(&out, "%s -> %s\n", s, v.format(f))
+		}
+		if _, err = w.Write(out.Bytes()); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LoRaWAN message types
+const (
+	loraJoinRequest = 0
+	loraJoinAccept  = 1
+	loraDataUp      = 2
+	loraDataDown    = 3
+	loraConfUp      = 4
+	loraConfDown    = 5
+	loraRejoin      = 6
+)
+
+// LoRaTapHandler anonymizes LoRaTap packets carrying LoRaWAN frames. The
+// DevAddr in data frames, and the JoinEUI and DevEUI in join and rejoin
+// requests are anonymized, while encrypted payloads and MICs are truncated.
+type LoRaTapHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *LoRaTapHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 4 {
+		err = fmt.Errorf("short LoRaTap header (increase snaplen)")
+		return
+	}
+	if b[0] > 1 {
+		err = fmt.Errorf("unknown LoRaTap version: %d", b[0])
+		return
+	}
+	n = int(binary.BigEndian.Uint16(b[2:]))
+	if n < 4 || n > len(b) {
+		err = fmt.Errorf("invalid LoRaTap header length: %d", n)
+		return
+	}
+	return handleLoRaWAN(b, n, anon)
+}
+
+// handleLoRaWAN anonymizes the LoRaWAN frame at offset n in b, returning the
+// offset after the headers that are understood.
+func handleLoRaWAN(b []byte, n int, anon Anonymizer) (int, error) {
+	slurp := func(x int) error {
+		if n+x > len(b) {
+			return fmt.Errorf(
+				"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
+				x, n)
+		}
+		return nil
+	}
+
+	// MHDR, with only major version 1 (LoRaWAN R1) understood
+	if err := slurp(1); err != nil {
+		return n, err
+	}
+	mtype, major := b[n]>>5, b[n]&0x3
+	if major != 0 {
+		return n, ErrUnknown
+	}
+	n++
+
+	switch mtype {
+	case loraJoinRequest:
+		// JoinEUI, DevEUI and DevNonce
+		if err := slurp(18); err != nil {
+			return n, err
+		}
+		eui64LE(b[n:n+8], anon)
+		eui64LE(b[n+8:n+16], anon)
+		n += 18
+	case loraJoinAccept:
+		// encrypted
+	case loraDataUp, loraDataDown, loraConfUp, loraConfDown:
+		// DevAddr, FCtrl, FCnt and FOpts, then any FPort
+		if err := slurp(7); err != nil {
+			return n, err
+		}
+		reverse(b[n : n+4])
+		anon.DevAddr(b[n : n+4])
+		reverse(b[n : n+4])
+		l := 7 + int(b[n+4]&0xf)
+		if err := slurp(l); err != nil {
+			return n, err
+		}
+		n += l
+		if n+4 < len(b) {
+			n++
+		}
+	case loraRejoin:
+		// type 1 has the JoinEUI and DevEUI, and types 0 and 2 the NetID and
+		// DevEUI, followed by RJcount
+		if err := slurp(1); err != nil {
+			return n, err
+		}
+		t := b[n]
+		n++
+		if t > 2 {
+			return n, ErrUnknown
+		}
+		if t == 1 {
+			if err := slurp(8); err != nil {
+				return n, err
+			}
+			eui64LE(b[n:n+8], anon)
+			n += 8
+		} else {
+			if err := slurp(3); err != nil {
+				return n, err
+			}
+			n += 3
+		}
+		if err := slurp(10); err != nil {
+			return n, err
+		}
+		eui64LE(b[n:n+8], anon)
+		n += 10
+	default:
+		return n, ErrUnknown
+	}
+	return n, nil
+}
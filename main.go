@@ -2,37 +2,36 @@ package main
 
 import (
 	"bufio"
-	"crypto/aes"
+	"bytes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Version is the wanonpcap version.
+const Version = "0.2.0"
+
 const noop = false
 
 var iv = []byte{0x64, 0x5d, 0x6e, 0xb3, 0xaf, 0xb7, 0xb9, 0xe4,
 	0xcc, 0x50, 0x78, 0x87, 0xec, 0xf3, 0xa6, 0x29}
 
-// AnonMethod is the anonymization method.
-type AnonMethod int
-
-const (
-	// Encrypt means to encrypt the output using the key.
-	Encrypt AnonMethod = iota
-
-	// Pseudonym means to create an alias for the data so that subsequent
-	// data of the same type with the same value has the same alias.
-	Pseudonym
-
-	// Leave means leave the original data untouched.
-	Leave
-)
-
 // todo:
 // - implement lookup tables
 //   - add -ip4-subnets option with list of IPv4 subnets to pseudonym
@@ -48,110 +47,287 @@ var KeyLen = 16
 // Handlers are the packet handlers (map of pcap link types to handlers).
 // https://www.tcpdump.org/linktypes.html
 var Handlers = map[uint32]Handler{
+	0:   &NullHandler{},
 	1:   &EthHandler{},
+	101: &RawHandler{},
+	104: &CiscoHDLCHandler{},
+	107: &FrameRelayHandler{},
 	127: &Radiotap80211Handler{},
+	143: &DOCSISHandler{},
+	195: &IEEE802154Handler{fcs: true},
+	197: &ERFHandler{},
+	201: &BluetoothH4Handler{},
+	227: &CANHandler{},
+	230: &IEEE802154Handler{},
+	239: &NFLOGHandler{},
+	253: &NetlinkHandler{},
+	254: &BluetoothMonitorHandler{},
+	258: &PktapHandler{},
+	270: &LoRaTapHandler{},
 }
 
-// MagicLE is the little-endian magic value.
-const MagicLE Magic = 0xd4c3b2a1
+// Role is the role of an address in a packet.
+type Role int
 
-// MagicBE is the big-endian magic value.
-const MagicBE Magic = 0xa1b2c3d4
+const (
+	// Src is a source (or sender) address.
+	Src Role = iota
 
-// Magic is the magic value.
-type Magic uint32
+	// Dst is a destination (or target) address.
+	Dst
+)
 
-func (m *Magic) Read(r io.Reader) (err error) {
-	if err = binary.Read(r, binary.BigEndian, m); err != nil {
-		return
-	}
-	if *m != MagicLE && *m != MagicBE {
-		err = fmt.Errorf("bad magic: 0x%x", *m)
-	}
-	return
-}
+// Anonymizer anonymizes MAC and IP addresses.
+type Anonymizer interface {
+	MAC(b []byte)
 
-// ByteOrder gets the byte order of the magic value.
-func (m *Magic) ByteOrder() binary.ByteOrder {
-	if *m == MagicLE {
-		return binary.LittleEndian
-	}
-	if *m == MagicBE {
-		return binary.BigEndian
-	}
-	panic(fmt.Sprintf("invalid magic: 0x%x", *m))
-}
+	// EUI64 anonymizes a 64-bit extended unique identifier, such as an IEEE
+	// 802.15.4 extended address, in canonical (big-endian) order.
+	EUI64(b []byte)
 
-func (m *Magic) Write(w io.Writer) error {
-	return binary.Write(w, m.ByteOrder(), MagicBE)
-}
+	// DevAddr anonymizes a 4-byte LoRaWAN device address, in big-endian
+	// order.
+	DevAddr(b []byte)
 
-// GlobalHeader is a pcap global header (magic read separately).
-type GlobalHeader struct {
-	VersionMajor uint16
-	VersionMinor uint16
-	ThisZone     int32
-	Sigfigs      uint32
-	Snaplen      uint32
-	LinkLayer    uint32
-}
+	IPv4(b []byte, r Role)
 
-func (h *GlobalHeader) Read(r io.Reader, order binary.ByteOrder) error {
-	return binary.Read(r, order, h)
-}
+	IPv6(b []byte, r Role)
 
-func (h *GlobalHeader) Write(w io.Writer, order binary.ByteOrder) error {
-	return binary.Write(w, order, h)
-}
+	// VLAN anonymizes the VLAN ID in a 2-byte 802.1Q TCI.
+	VLAN(b []byte)
 
-// PacketHeader is a pcap packet header.
-type PacketHeader struct {
-	TimestampSec  uint32
-	TimestampUsec uint32
-	Len           uint32
-	OrigLen       uint32
-}
+	// Sequence anonymizes the sequence number in a 2-byte 802.11 sequence
+	// control field, for the transmitter address ta, and anonTA, the same
+	// address after MAC anonymization.
+	Sequence(b []byte, ta, anonTA []byte)
 
-// Anonymizer anonymizes MAC and IP addresses.
-type Anonymizer interface {
-	MAC(b []byte)
+	// CANID anonymizes the identifier in a 4-byte SocketCAN CAN ID, in
+	// big-endian order.
+	CANID(b []byte)
+
+	// CANData anonymizes the data in a CAN frame.
+	CANData(b []byte)
+
+	// Port anonymizes a 2-byte TCP or UDP port, in big-endian order.
+	Port(b []byte)
+
+	// Name anonymizes a name, such as a host, domain or user name, in place.
+	Name(b []byte)
+
+	// ID anonymizes an opaque identifier of any length, such as a DHCP client
+	// ID or RADIUS session ID.
+	ID(b []byte)
 
-	IPv4(b []byte)
+	// Timestamp anonymizes a hardware timestamp, such as the 64-bit radiotap
+	// TSFT, which can fingerprint a device by its uptime, or an 802.11 FTM
+	// TOD or TOA.
+	Timestamp(b []byte)
 
-	IPv6(b []byte)
+	// BeaconTimestamp anonymizes the 64-bit timestamp in an 802.11 beacon or
+	// probe response from transmitter address ta, which reveals AP uptime.
+	BeaconTimestamp(b []byte, ta []byte)
+
+	// Country anonymizes the data in an 802.11 country IE, which can locate
+	// an AP.
+	Country(b []byte)
+
+	// VendorData anonymizes opaque vendor data, such as in a radiotap vendor
+	// namespace, for the vendor with the given 3-byte OUI.
+	VendorData(b []byte, oui []byte)
+
+	// Text anonymizes free text, such as an NFLOG prefix, which can name
+	// hosts, networks or firewall rules.
+	Text(b []byte)
+
+	// Changed returns the number of fields changed so far.
+	Changed() uint64
+
+	// Pseudonyms returns the number of pseudonyms currently mapped.
+	Pseudonyms() int
+}
+
+// Streams are the key streams used for each class of field. They may all be
+// the same stream, or use separate keys so that one can be disclosed without
+// the others.
+type Streams struct {
+	MAC  cipher.Stream
+	IPv4 cipher.Stream
+	IPv6 cipher.Stream
+	VLAN cipher.Stream
 }
 
 // DefaultAnonymizer anonymizes MAC and IP addresses.
 type DefaultAnonymizer struct {
-	macOUI  AnonMethod
-	macNIC  AnonMethod
-	ipv4    AnonMethod
-	ipv6    AnonMethod
-	scipher cipher.Stream
+	policy  Policy
+	streams Streams
 
 	ouiMap  map[[3]byte][3]byte
 	nicMap  map[[3]byte][3]byte
 	ipv4Map map[[4]byte][4]byte
 	ipv6Map map[[16]byte][16]byte
+	vlanMap map[uint16]uint16
+	vlanSet map[uint16]bool
+	seqMap  map[[6]byte]uint16
+	tsMap   map[[6]byte]uint64
+	extMap  map[[5]byte][5]byte
+	devMap  map[[4]byte][4]byte
+	canMap  map[uint32]uint32
+	canSet  map[uint32]bool
+	portMap map[uint16]uint16
+	portSet map[uint16]bool
+	nameMap map[string][]byte
+	idMap   map[string][]byte
+	store   PseudonymStore
+	mapper  AddressMapper
+	vendors AddressMapper
+	shift   *TimeShift
+	errMu   sync.Mutex
+	err     error
 	nmac    uint64
 	nipv4   uint64
 	nipv6   uint64
+	nvlan   uint64
+	nchg    uint64
 }
 
-// NewDefaultAnonymizer returns a new default anonymizer.
-func NewDefaultAnonymizer(macOUI AnonMethod, macNIC AnonMethod,
-	ipv4 AnonMethod, ipv6 AnonMethod, scipher cipher.Stream) *DefaultAnonymizer {
+// NewDefaultAnonymizer returns a new default anonymizer. If the policy is to
+// decrypt, encrypted fields are decrypted, and pseudonymed fields are left
+// alone but consume the same key stream as when they were created, so the
+// methods must be the same as those used to encrypt.
+func NewDefaultAnonymizer(policy Policy, streams Streams) *DefaultAnonymizer {
 	return &DefaultAnonymizer{
-		macOUI:  macOUI,
-		macNIC:  macNIC,
-		ipv4:    ipv4,
-		ipv6:    ipv6,
-		scipher: scipher,
+		policy:  policy,
+		streams: streams,
 		ouiMap:  make(map[[3]byte][3]byte),
 		nicMap:  make(map[[3]byte][3]byte),
 		ipv4Map: make(map[[4]byte][4]byte),
 		ipv6Map: make(map[[16]byte][16]byte),
+		vlanMap: make(map[uint16]uint16),
+		vlanSet: make(map[uint16]bool),
+		seqMap:  make(map[[6]byte]uint16),
+		tsMap:   make(map[[6]byte]uint64),
+		extMap:  make(map[[5]byte][5]byte),
+		devMap:  make(map[[4]byte][4]byte),
+		canMap:  make(map[uint32]uint32),
+		canSet:  make(map[uint32]bool),
+		portMap: make(map[uint16]uint16),
+		portSet: make(map[uint16]bool),
+		nameMap: make(map[string][]byte),
+		idMap:   make(map[string][]byte),
+	}
+}
+
+// SetPolicy replaces the policy, keeping the maps, so pseudonyms already
+// created stay the same.
+func (a *DefaultAnonymizer) SetPolicy(p Policy) {
+	a.policy = p
+}
+
+// SetStore sets an external store for address pseudonyms, which is used
+// instead of the maps for them, except when decrypting. Pseudonyms in the
+// store aren't counted, exported or saved with the state.
+func (a *DefaultAnonymizer) SetStore(s PseudonymStore) {
+	a.store = s
+}
+
+// SetAddressMapper sets a mapper for new IPv4 and IPv6 address pseudonyms.
+func (a *DefaultAnonymizer) SetAddressMapper(m AddressMapper) {
+	a.mapper = m
+}
+
+// SetOUIMapper sets a mapper for new MAC OUI pseudonyms.
+func (a *DefaultAnonymizer) SetOUIMapper(m AddressMapper) {
+	a.vendors = m
+}
+
+// SetTimeShift sets the time shift saved and loaded with the state.
+func (a *DefaultAnonymizer) SetTimeShift(t *TimeShift) {
+	a.shift = t
+}
+
+// Rekey replaces the key streams and clears the pseudonym mappings, including
+// those of the address and OUI mappers, so the anonymizer starts over as a new one
+// would, but keeps its statistics.
+func (a *DefaultAnonymizer) Rekey(s Streams) {
+	a.streams = s
+	a.ClearMaps()
+	if a.mapper != nil {
+		a.mapper.Reset()
+	}
+	if a.vendors != nil {
+		a.vendors.Reset()
+	}
+}
+
+// Err returns the first error, such as from the pseudonym store, if any.
+func (a *DefaultAnonymizer) Err() error {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+	return a.err
+}
+
+// fail records err, if it's the first error.
+func (a *DefaultAnonymizer) fail(err error) {
+	a.errMu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.errMu.Unlock()
+}
+
+// stored anonymizes b with its pseudonym from the store, calling gen to
+// anonymize it in place if there's none yet. On errors, b is zeroed.
+func (a *DefaultAnonymizer) stored(class string, b []byte, gen func()) {
+	p, err := a.store.Get(class, b)
+	if err == nil && p == nil {
+		o := append([]byte(nil), b...)
+		gen()
+		p, err = a.store.Put(class, o, b)
+	}
+	if err == nil && len(p) != len(b) {
+		err = fmt.Errorf("stored %s pseudonym has length %d", class, len(p))
+	}
+	if err != nil {
+		zero(b)
+		a.fail(fmt.Errorf("pseudonym store: %s", err))
+		return
+	}
+	copy(b, p)
+}
+
+// pseudoIP replaces the IP address b with a new pseudonym from key stream s,
+// chosen by the address mapper if there is one.
+func (a *DefaultAnonymizer) pseudoIP(b []byte, s cipher.Stream) {
+	if a.mapper == nil {
+		s.XORKeyStream(b, b)
+		return
+	}
+	o := append([]byte(nil), b...)
+	s.XORKeyStream(b, b)
+	a.mapper.Map(o, b)
+}
+
+// pseudoOUI replaces the OUI b with a new pseudonym from the MAC key stream,
+// chosen by the OUI mapper if there is one.
+func (a *DefaultAnonymizer) pseudoOUI(b []byte) {
+	if a.vendors == nil {
+		a.streams.MAC.XORKeyStream(b, b)
+		return
 	}
+	o := append([]byte(nil), b...)
+	a.streams.MAC.XORKeyStream(b, b)
+	a.vendors.Map(o, b)
+}
+
+// changes returns true if method m changes fields.
+func (a *DefaultAnonymizer) changes(m AnonMethod) bool {
+	return m == Encrypt || m == Pseudonym && !a.policy.Decrypt
+}
+
+// skip discards n bytes of key stream s.
+func skip(s cipher.Stream, n int) {
+	b := make([]byte, n)
+	s.XORKeyStream(b, b)
 }
 
 // MAC anonymizes a MAC address.
@@ -160,256 +336,2671 @@ func (a *DefaultAnonymizer) MAC(b []byte) {
 		return
 	}
 
-	switch a.macOUI {
+	a.oui(b[:3])
+	switch a.policy.MACNIC {
 	case Encrypt:
-		a.scipher.XORKeyStream(b[:3], b[:3])
+		a.streams.MAC.XORKeyStream(b[3:], b[3:])
 	case Pseudonym:
-		ba := toArray3(b[:3])
-		if pa, ok := a.ouiMap[ba]; ok {
-			toSlice3(b[:3], pa)
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("mac-nic", b[3:], func() {
+				a.streams.MAC.XORKeyStream(b[3:], b[3:])
+			})
+			break
+		}
+		ba := toArray3(b[3:])
+		if pa, ok := a.nicMap[ba]; ok {
+			toSlice3(b[3:], pa)
+		} else if a.policy.Decrypt {
+			skip(a.streams.MAC, len(b[3:]))
+			a.nicMap[ba] = ba
 		} else {
-			a.scipher.XORKeyStream(b[:3], b[:3])
-			a.ouiMap[ba] = toArray3(b[:3])
+			a.streams.MAC.XORKeyStream(b[3:], b[3:])
+			a.nicMap[ba] = toArray3(b[3:])
 		}
 	}
+	if a.changes(a.policy.MACOUI) || a.changes(a.policy.MACNIC) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+	a.nmac++
+}
+
+// EUI64 anonymizes an EUI-64. The OUI is anonymized as for MAC addresses, so
+// it shares their pseudonyms, and the 40-bit extension identifier according
+// to the MAC NIC method. EUI-64s are counted as MAC addresses.
+func (a *DefaultAnonymizer) EUI64(b []byte) {
+	if noop {
+		return
+	}
 
-	switch a.macNIC {
+	a.oui(b[:3])
+	switch a.policy.MACNIC {
 	case Encrypt:
-		a.scipher.XORKeyStream(b[3:], b[3:])
+		a.streams.MAC.XORKeyStream(b[3:], b[3:])
 	case Pseudonym:
-		ba := toArray3(b[3:])
-		if pa, ok := a.nicMap[ba]; ok {
-			toSlice3(b[3:], pa)
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("eui64-ext", b[3:], func() {
+				a.streams.MAC.XORKeyStream(b[3:], b[3:])
+			})
+			break
+		}
+		var ba [5]byte
+		copy(ba[:], b[3:])
+		if pa, ok := a.extMap[ba]; ok {
+			copy(b[3:], pa[:])
+		} else if a.policy.Decrypt {
+			skip(a.streams.MAC, len(b[3:]))
+			a.extMap[ba] = ba
 		} else {
-			a.scipher.XORKeyStream(b[3:], b[3:])
-			a.nicMap[ba] = toArray3(b[3:])
+			a.streams.MAC.XORKeyStream(b[3:], b[3:])
+			var pa [5]byte
+			copy(pa[:], b[3:])
+			a.extMap[ba] = pa
+		}
+	}
+	if a.changes(a.policy.MACOUI) || a.changes(a.policy.MACNIC) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+	a.nmac++
+}
+
+// DevAddr anonymizes a LoRaWAN DevAddr according to the MAC NIC method,
+// leaving the first 7 bits, which hold the address type prefix and all or
+// part of the network ID, so the operator stays known. DevAddrs are counted
+// as MAC addresses.
+func (a *DefaultAnonymizer) DevAddr(b []byte) {
+	if noop {
+		return
+	}
+
+	xor := func() {
+		k := make([]byte, 4)
+		a.streams.MAC.XORKeyStream(k, k)
+		k[0] &= 0x01
+		for i := range b {
+			b[i] ^= k[i]
+		}
+	}
+	switch a.policy.MACNIC {
+	case Encrypt:
+		xor()
+	case Pseudonym:
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("devaddr", b, xor)
+			break
+		}
+		ba := toArray4(b)
+		if pa, ok := a.devMap[ba]; ok {
+			toSlice4(b, pa)
+		} else if a.policy.Decrypt {
+			skip(a.streams.MAC, len(b))
+			a.devMap[ba] = ba
+		} else {
+			xor()
+			a.devMap[ba] = toArray4(b)
 		}
 	}
+	if a.changes(a.policy.MACNIC) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
 	a.nmac++
 }
 
+// oui anonymizes the 3-byte OUI of a MAC address or EUI-64.
+func (a *DefaultAnonymizer) oui(b []byte) {
+	switch a.policy.MACOUI {
+	case Encrypt:
+		a.streams.MAC.XORKeyStream(b, b)
+	case Pseudonym:
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("mac-oui", b, func() {
+				a.pseudoOUI(b)
+			})
+			break
+		}
+		ba := toArray3(b)
+		if pa, ok := a.ouiMap[ba]; ok {
+			toSlice3(b, pa)
+		} else if a.policy.Decrypt {
+			skip(a.streams.MAC, len(b))
+			a.ouiMap[ba] = ba
+		} else {
+			a.pseudoOUI(b)
+			a.ouiMap[ba] = toArray3(b)
+		}
+	}
+}
+
 // IPv4 anonymizes an IPv4 address.
-func (a *DefaultAnonymizer) IPv4(b []byte) {
+func (a *DefaultAnonymizer) IPv4(b []byte, r Role) {
 	if noop {
 		return
 	}
 
-	switch a.ipv4 {
+	m := a.policy.IPv4Src
+	if r == Dst {
+		m = a.policy.IPv4Dst
+	}
+	switch m {
 	case Encrypt:
-		a.scipher.XORKeyStream(b, b)
+		a.streams.IPv4.XORKeyStream(b, b)
 	case Pseudonym:
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("ipv4", b, func() {
+				a.pseudoIP(b, a.streams.IPv4)
+			})
+			break
+		}
 		ba := toArray4(b)
 		if pa, ok := a.ipv4Map[ba]; ok {
 			toSlice4(b, pa)
+		} else if a.policy.Decrypt {
+			skip(a.streams.IPv4, len(b))
+			a.ipv4Map[ba] = ba
 		} else {
-			a.scipher.XORKeyStream(b, b)
+			a.pseudoIP(b, a.streams.IPv4)
 			a.ipv4Map[ba] = toArray4(b)
 		}
 	}
+	if a.changes(m) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
 	a.nipv4++
 }
 
 // IPv6 anonymizes an IPv6 address.
-func (a *DefaultAnonymizer) IPv6(b []byte) {
+func (a *DefaultAnonymizer) IPv6(b []byte, r Role) {
 	if noop {
 		return
 	}
 
-	switch a.ipv6 {
+	m := a.policy.IPv6Src
+	if r == Dst {
+		m = a.policy.IPv6Dst
+	}
+	switch m {
 	case Encrypt:
-		a.scipher.XORKeyStream(b, b)
+		a.streams.IPv6.XORKeyStream(b, b)
 	case Pseudonym:
+		if a.store != nil && !a.policy.Decrypt {
+			a.stored("ipv6", b, func() {
+				a.pseudoIP(b, a.streams.IPv6)
+			})
+			break
+		}
 		ba := toArray16(b)
 		if pa, ok := a.ipv6Map[ba]; ok {
 			toSlice16(b, pa)
+		} else if a.policy.Decrypt {
+			skip(a.streams.IPv6, len(b))
+			a.ipv6Map[ba] = ba
 		} else {
-			a.scipher.XORKeyStream(b, b)
+			a.pseudoIP(b, a.streams.IPv6)
 			a.ipv6Map[ba] = toArray16(b)
 		}
 	}
+	if a.changes(m) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
 	a.nipv6++
 }
 
-// Handler anonymizes a packet.
-type Handler interface {
-	Handle(b []byte, a Anonymizer) (int, error)
-}
+// VLAN anonymizes the 12-bit VLAN ID in a TCI, preserving the PCP and DEI
+// bits. IDs 0 (priority tag) and 0xfff (reserved) are left untouched, and
+// pseudonyms are unique so distinct VLANs stay distinct.
+func (a *DefaultAnonymizer) VLAN(b []byte) {
+	tci := binary.BigEndian.Uint16(b)
+	id := tci & 0x0fff
+	if noop || id == 0 || id == 0xfff {
+		return
+	}
 
-func printf(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, fmt.Sprintf("%s\n", format), args...)
+	switch a.policy.VLAN {
+	case VLANPseudonym:
+		if p, ok := a.vlanMap[id]; ok {
+			id = p
+			break
+		}
+		if len(a.vlanSet) >= 0xffe {
+			binary.BigEndian.PutUint16(b, tci&0xf000)
+			a.fail(errors.New("VLAN pseudonym space exhausted"))
+			return
+		}
+		var p uint16
+		k := make([]byte, 2)
+		for p == 0 || p == 0xfff || a.vlanSet[p] {
+			a.streams.VLAN.XORKeyStream(k, k)
+			p = binary.BigEndian.Uint16(k) & 0xfff
+		}
+		a.vlanSet[p] = true
+		if a.policy.Decrypt {
+			p = id
+		}
+		a.vlanMap[id] = p
+		id = p
+	case VLANZero:
+		id = 0
+	}
+	if a.policy.VLAN == VLANZero || a.policy.VLAN == VLANPseudonym && !a.policy.Decrypt {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+	binary.BigEndian.PutUint16(b, tci&0xf000|id)
+	a.nvlan++
 }
 
-func println(s string) {
-	fmt.Fprintln(os.Stderr, s)
+// CANID anonymizes the 11-bit or 29-bit identifier in a CAN ID, preserving
+// the flags. Pseudonyms are unique within each identifier space, so distinct
+// IDs stay distinct. CAN IDs use the VLAN key stream, as both are small
+// identifiers.
+func (a *DefaultAnonymizer) CANID(b []byte) {
+	if noop || a.policy.CANID == Leave {
+		return
+	}
+	v := binary.BigEndian.Uint32(b)
+	mask := uint32(canSFFMask)
+	if v&canEFF != 0 {
+		mask = canEFFMask
+	}
+	id := v & mask
+	k := make([]byte, 4)
+	switch a.policy.CANID {
+	case Encrypt:
+		a.streams.VLAN.XORKeyStream(k, k)
+		id ^= binary.BigEndian.Uint32(k) & mask
+	case Pseudonym:
+		// the map keys and pseudonyms keep the EFF flag, to separate the
+		// identifier spaces
+		o := v & (canEFF | mask)
+		if p, ok := a.canMap[o]; ok {
+			id = p & mask
+			break
+		}
+		var p uint32
+		for {
+			a.streams.VLAN.XORKeyStream(k, k)
+			p = binary.BigEndian.Uint32(k)&mask | v&canEFF
+			if !a.canSet[p] {
+				break
+			}
+		}
+		a.canSet[p] = true
+		if a.policy.Decrypt {
+			p = o
+		}
+		a.canMap[o] = p
+		id = p & mask
+	}
+	if a.changes(a.policy.CANID) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+	binary.BigEndian.PutUint32(b, v&^mask|id)
 }
 
-func run(anon Anonymizer, truncate bool) (packets uint64, err error) {
-	r := bufio.NewReader(os.Stdin)
-	w := bufio.NewWriter(os.Stdout)
-	defer func() {
-		w.Flush()
-	}()
-
-	// magic
-	var magic Magic
-	if err = magic.Read(r); err != nil {
+// CANData zeroes CAN frame data if the policy is to do so.
+func (a *DefaultAnonymizer) CANData(b []byte) {
+	if noop || !a.policy.ZeroCANData {
 		return
 	}
-	if err = magic.Write(w); err != nil {
+	zero(b)
+	atomic.AddUint64(&a.nchg, 1)
+}
+
+// Port anonymizes a port according to the port method. Pseudonyms are unique,
+// so distinct ports stay distinct. Ports use the VLAN key stream, as small
+// identifiers.
+func (a *DefaultAnonymizer) Port(b []byte) {
+	if noop || a.policy.Port == Leave {
 		return
 	}
-	order := magic.ByteOrder()
+	switch a.policy.Port {
+	case Encrypt:
+		a.streams.VLAN.XORKeyStream(b[:2], b[:2])
+	case Pseudonym:
+		v := binary.BigEndian.Uint16(b)
+		p, ok := a.portMap[v]
+		if !ok {
+			k := make([]byte, 2)
+			for {
+				a.streams.VLAN.XORKeyStream(k, k)
+				p = binary.BigEndian.Uint16(k)
+				if !a.portSet[p] {
+					break
+				}
+			}
+			a.portSet[p] = true
+			if a.policy.Decrypt {
+				p = v
+			}
+			a.portMap[v] = p
+		}
+		binary.BigEndian.PutUint16(b, p)
+	}
+	if a.changes(a.policy.Port) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+}
+
+// nameChars are the characters in name pseudonyms.
+const nameChars = "abcdefghijklmnopqrstuvwxyz0123456789"
 
-	// global header
-	var gh GlobalHeader
-	if err = gh.Read(r, order); err != nil {
+// Name pseudonyms a name if the policy is to do so. Pseudonyms have the same
+// length, with any dots kept, so domain names keep their structure, and the
+// other characters replaced by lower case letters and digits from the MAC key
+// stream. Names are mapped case insensitively, as for DNS. Short names may
+// share pseudonyms.
+func (a *DefaultAnonymizer) Name(b []byte) {
+	if noop || a.policy.Name == Leave || len(b) == 0 {
 		return
 	}
-	printf("detected %s, pcap version %d.%d, snaplen %d", order.String(),
-		gh.VersionMajor, gh.VersionMinor, gh.Snaplen)
-	h, ok := Handlers[gh.LinkLayer]
+	o := string(bytes.ToLower(b))
+	p, ok := a.nameMap[o]
 	if !ok {
-		err = fmt.Errorf(
-			"unsupported link layer: %d (https://www.tcpdump.org/linktypes.html)",
-			gh.LinkLayer)
-		return
+		p = make([]byte, len(b))
+		a.streams.MAC.XORKeyStream(p, p)
+		for i, c := range b {
+			if c == '.' {
+				p[i] = c
+			} else {
+				p[i] = nameChars[int(p[i])%len(nameChars)]
+			}
+		}
+		if a.policy.Decrypt {
+			p = []byte(o)
+		}
+		a.nameMap[o] = p
 	}
-	if err = gh.Write(w, order); err != nil {
+	if a.policy.Decrypt {
 		return
 	}
+	copy(b, p)
+	atomic.AddUint64(&a.nchg, 1)
+}
 
-	// packets
-	for {
-		// read packet header
-		var ph PacketHeader
-		if err = binary.Read(r, order, &ph); err != nil {
-			return
-		}
-		if ph.Len > MaxPacketLen {
-			err = fmt.Errorf("max packet len exceeded: %d", ph.Len)
-			return
-		}
-
-		// read packet
-		b := make([]byte, ph.Len)
-		if _, err = io.ReadFull(r, b); err != nil {
-			return
+// ID anonymizes an opaque identifier according to the ID method, using the
+// MAC key stream.
+func (a *DefaultAnonymizer) ID(b []byte) {
+	if noop || a.policy.ID == Leave || len(b) == 0 {
+		return
+	}
+	switch a.policy.ID {
+	case Encrypt:
+		a.streams.MAC.XORKeyStream(b, b)
+	case Pseudonym:
+		if p, ok := a.idMap[string(b)]; ok {
+			copy(b, p)
+		} else if a.policy.Decrypt {
+			skip(a.streams.MAC, len(b))
+			a.idMap[string(b)] = append([]byte(nil), b...)
+		} else {
+			o := string(b)
+			a.streams.MAC.XORKeyStream(b, b)
+			a.idMap[o] = append([]byte(nil), b...)
 		}
+	}
+	if a.changes(a.policy.ID) {
+		atomic.AddUint64(&a.nchg, 1)
+	}
+}
 
-		// anonymize packet
-		var n int
-		if n, err = h.Handle(b, anon); err != nil {
-			return
-		}
-		if truncate {
-			b = b[:n]
-			ph.Len = uint32(n)
+// Sequence anonymizes the 12-bit sequence number in a sequence control field,
+// preserving the fragment number. When resequencing, each transmitter's
+// sequence numbers are offset by a non-zero amount from the key stream, so
+// they can't be correlated with other transmitters, but retries and
+// duplicates are preserved. When decrypting, the offsets are found by the
+// decrypted transmitter address.
+func (a *DefaultAnonymizer) Sequence(b []byte, ta, anonTA []byte) {
+	if noop || a.policy.Seq == SeqLeave {
+		return
+	}
+	sc := binary.LittleEndian.Uint16(b)
+	seq := sc >> 4
+	switch a.policy.Seq {
+	case SeqResequence:
+		t := toArray6(ta)
+		if a.policy.Decrypt {
+			t = toArray6(anonTA)
 		}
-
-		// write header and packet
-		if err = binary.Write(w, order, &ph); err != nil {
-			return
+		off, ok := a.seqMap[t]
+		if !ok {
+			k := make([]byte, 2)
+			for off == 0 {
+				a.streams.MAC.XORKeyStream(k, k)
+				off = binary.LittleEndian.Uint16(k) & 0xfff
+			}
+			a.seqMap[t] = off
 		}
-		if _, err = w.Write(b); err != nil {
-			return
+		if a.policy.Decrypt {
+			off = 0x1000 - off
 		}
-
-		packets++
+		seq = (seq + off) & 0xfff
+	case SeqZero:
+		seq = 0
 	}
+	binary.LittleEndian.PutUint16(b, seq<<4|sc&0xf)
+	atomic.AddUint64(&a.nchg, 1)
 }
 
-func parseAnonMethod(s string) (m AnonMethod, err error) {
-	switch s {
-	case "encrypt":
-		m = Encrypt
-	case "pseudonym":
-		m = Pseudonym
-	case "leave":
-		m = Leave
-	default:
-		err = fmt.Errorf("unknown anonymization method: %s", s)
+// Timestamp zeroes a hardware timestamp if the policy is to do so.
+func (a *DefaultAnonymizer) Timestamp(b []byte) {
+	if noop || !a.policy.ZeroTimestamps {
+		return
 	}
-	return
+	zero(b)
+	atomic.AddUint64(&a.nchg, 1)
 }
 
-func main() {
-	var keyStr = flag.String("key", "", "key for anonymization")
-	var macOUIStr = flag.String("mac-oui", "pseudonym",
-		"MAC OUI (vendor) anonymization method- encrypt, pseudonym or leave")
-	var macNICStr = flag.String("mac-nic", "pseudonym",
-		"MAC NIC (id) anonymization method- encrypt, pseudonym or leave")
-	var ipv4Str = flag.String("ipv4", "pseudonym",
-		"IPv4 address anonymization method- encrypt, pseudonym or leave")
-	var ipv6Str = flag.String("ipv6", "pseudonym",
-		"IPv6 address anonymization method- encrypt, pseudonym or leave")
-	var noTruncate = flag.Bool("no-truncate", false,
-		"do not truncate unknown portions of packets (caution: will expose addresses)")
-
-	flag.Parse()
-
-	macOUI, err := parseAnonMethod(*macOUIStr)
-	if err != nil {
-		printf("%s", err)
-		os.Exit(1)
-	}
-	macNIC, err := parseAnonMethod(*macNICStr)
-	if err != nil {
-		printf("%s", err)
-		os.Exit(1)
+// BeaconTimestamp rebases or zeroes a beacon timestamp according to the
+// policy. Rebasing uses the first timestamp seen from each transmitter, which
+// becomes zero.
+func (a *DefaultAnonymizer) BeaconTimestamp(b []byte, ta []byte) {
+	if noop || a.policy.BeaconTimestamps == TimestampLeave {
+		return
 	}
-	ipv4, err := parseAnonMethod(*ipv4Str)
-	if err != nil {
-		printf("%s", err)
-		os.Exit(1)
+	switch a.policy.BeaconTimestamps {
+	case TimestampRebase:
+		t := toArray6(ta)
+		ts := binary.LittleEndian.Uint64(b)
+		base, ok := a.tsMap[t]
+		if !ok {
+			base = ts
+			a.tsMap[t] = base
+		}
+		binary.LittleEndian.PutUint64(b, ts-base)
+	case TimestampZero:
+		zero(b)
 	}
-	ipv6, err := parseAnonMethod(*ipv6Str)
-	if err != nil {
-		printf("%s", err)
-		os.Exit(1)
+	atomic.AddUint64(&a.nchg, 1)
+}
+
+// Country zeroes a country IE if the policy is to do so.
+func (a *DefaultAnonymizer) Country(b []byte) {
+	if noop || !a.policy.ZeroCountry {
+		return
 	}
+	zero(b)
+	atomic.AddUint64(&a.nchg, 1)
+}
 
-	// init key
-	if *keyStr == "" {
-		b := make([]byte, KeyLen*8)
-		k := make([]byte, KeyLen)
+// Text zeroes free text.
+func (a *DefaultAnonymizer) Text(b []byte) {
+	if noop {
+		return
+	}
+	zero(b)
+	atomic.AddUint64(&a.nchg, 1)
+}
 
-		for bi, ki := len(b), 0; ki < KeyLen; bi++ {
-			if bi >= len(b) {
-				_, err := rand.Read(b)
-				if err != nil {
-					println(err.Error())
-					os.Exit(1)
-				}
-				bi = 0
-			}
-			if (b[bi] >= 0x30 && b[bi] <= 0x39) || (b[bi] >= 0x41 && b[bi] <= 0x5a) ||
-				(b[bi] >= 0x61 && b[bi] <= 0x7a) {
-				k[ki] = b[bi]
-				ki++
-			}
-		}
-		*keyStr = string(k)
-		printf("auto-generated key: %s", *keyStr)
+// VendorData zeroes vendor data if the policy is to do so for the OUI.
+func (a *DefaultAnonymizer) VendorData(b []byte, oui []byte) {
+	if noop || !a.policy.ZeroVendor ||
+		a.policy.ZeroVendorOUIs != "" && !a.policy.zeroVendorOUI(oui) {
+		return
 	}
+	zero(b)
+	atomic.AddUint64(&a.nchg, 1)
+}
 
-	ph := sha256.New()
-	ph.Write([]byte(*keyStr))
-	key := ph.Sum(nil)
+// Changed returns the number of fields changed so far.
+func (a *DefaultAnonymizer) Changed() uint64 {
+	return atomic.LoadUint64(&a.nchg)
+}
 
-	bc, err := aes.NewCipher(key)
-	if err != nil {
-		printf("%s", err)
-		os.Exit(1)
-	}
+// AnonymizerStats are the numbers of fields handled and changed, and of
+// pseudonyms mapped.
+type AnonymizerStats struct {
+	// MACs is the number of MAC addresses, EUI-64s and DevAddrs handled,
+	// whether or not the policy changed them.
+	MACs uint64
 
-	// It's not ideal either to use SHA256 for a password hash, or to use a
-	// fixed IV, but we'll at least warn to use new keys each time in the doc.
-	a := NewDefaultAnonymizer(macOUI, macNIC, ipv4, ipv6, cipher.NewCTR(bc, iv))
+	// IPv4s and IPv6s are the numbers of IP addresses handled.
+	IPv4s uint64
+	IPv6s uint64
 
-	n, err := run(a, !*noTruncate)
+	// VLANs is the number of VLAN IDs handled.
+	VLANs uint64
+
+	// Changed is the number of fields changed, of any type.
+	Changed uint64
+
+	// Pseudonyms are the numbers of pseudonyms mapped, by the classes in
+	// WriteMaps.
+	Pseudonyms map[string]int
+}
+
+// Stats returns the anonymizer's statistics.
+func (a *DefaultAnonymizer) Stats() AnonymizerStats {
+	return AnonymizerStats{
+		MACs:    a.nmac,
+		IPv4s:   a.nipv4,
+		IPv6s:   a.nipv6,
+		VLANs:   a.nvlan,
+		Changed: a.Changed(),
+		Pseudonyms: map[string]int{
+			"mac-oui":   len(a.ouiMap),
+			"mac-nic":   len(a.nicMap),
+			"eui64-ext": len(a.extMap),
+			"devaddr":   len(a.devMap),
+			"ipv4":      len(a.ipv4Map),
+			"ipv6":      len(a.ipv6Map),
+			"vlan":      len(a.vlanMap),
+			"can-id":    len(a.canMap),
+			"port":      len(a.portMap),
+			"name":      len(a.nameMap),
+			"id":        len(a.idMap),
+			"seq":       len(a.seqMap),
+			"beacon-ts": len(a.tsMap),
+		},
+	}
+}
+
+// Pseudonyms returns the number of pseudonyms currently mapped.
+func (a *DefaultAnonymizer) Pseudonyms() int {
+	return len(a.ouiMap) + len(a.nicMap) + len(a.ipv4Map) + len(a.ipv6Map) +
+		len(a.vlanMap) + len(a.seqMap) + len(a.extMap) + len(a.devMap) +
+		len(a.canMap) + len(a.portMap) + len(a.nameMap) + len(a.idMap)
+}
+
+// mapsHeader is the header of exported maps, and mapsRolesHeader the fields
+// added to it by MapRoles.
+const (
+	mapsHeader      = "class,original,pseudonym"
+	mapsRolesHeader = ",roles,first,last,seen"
+)
+
+// WriteMaps writes the pseudonym mappings as CSV, sorted by class and
+// original value.
+func (a *DefaultAnonymizer) WriteMaps(w io.Writer) error {
+	return a.writeMaps(w, nil)
+}
+
+// writeMaps writes the pseudonym mappings as WriteMaps does, adding the
+// fields recorded by roles if it's not nil.
+func (a *DefaultAnonymizer) writeMaps(w io.Writer, roles *MapRoles) (
+	err error) {
+	var recs []string
+	add := func(class string, orig, pseudo []byte) {
+		recs = append(recs, fmt.Sprintf("%s,%s,%s", class,
+			hex.EncodeToString(orig), hex.EncodeToString(pseudo)))
+	}
+	for o, p := range a.ouiMap {
+		add("mac-oui", o[:], p[:])
+	}
+	for o, p := range a.nicMap {
+		add("mac-nic", o[:], p[:])
+	}
+	for o, p := range a.extMap {
+		add("eui64-ext", o[:], p[:])
+	}
+	for o, p := range a.devMap {
+		add("devaddr", o[:], p[:])
+	}
+	for o, p := range a.ipv4Map {
+		add("ipv4", o[:], p[:])
+	}
+	for o, p := range a.ipv6Map {
+		add("ipv6", o[:], p[:])
+	}
+	for o, p := range a.vlanMap {
+		recs = append(recs, fmt.Sprintf("vlan,%d,%d", o, p))
+	}
+	for o, p := range a.canMap {
+		recs = append(recs, fmt.Sprintf("can-id,%08x,%08x", o, p))
+	}
+	for o, p := range a.portMap {
+		recs = append(recs, fmt.Sprintf("port,%d,%d", o, p))
+	}
+	for o, p := range a.nameMap {
+		add("name", []byte(o), p)
+	}
+	for o, p := range a.idMap {
+		add("id", []byte(o), p)
+	}
+	for t, o := range a.seqMap {
+		recs = append(recs, fmt.Sprintf("seq,%s,%d", hex.EncodeToString(t[:]),
+			o))
+	}
+	for t, b := range a.tsMap {
+		recs = append(recs, fmt.Sprintf("beacon-ts,%s,%d",
+			hex.EncodeToString(t[:]), b))
+	}
+	sort.Strings(recs)
+	hdr := mapsHeader
+	if roles != nil {
+		hdr += mapsRolesHeader
+		for i, r := range recs {
+			recs[i] = r + "," + roles.fields(r)
+		}
+	}
+	if _, err = fmt.Fprintln(w, hdr); err != nil {
+		return
+	}
+	for _, r := range recs {
+		if _, err = fmt.Fprintln(w, r); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadMaps reads pseudonym mappings in the CSV format written by WriteMaps,
+// with or without the fields added by MapRoles, adding them to the current
+// mappings.
+func (a *DefaultAnonymizer) ReadMaps(r io.Reader) (err error) {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || line == 1 && strings.HasPrefix(t, mapsHeader) {
+			continue
+		}
+		if err = a.readMap(t); err != nil {
+			err = fmt.Errorf("map line %d: %s", line, err)
+			return
+		}
+	}
+	err = sc.Err()
+	return
+}
+
+// readMap adds one CSV mapping record.
+func (a *DefaultAnonymizer) readMap(rec string) (err error) {
+	f := strings.Split(rec, ",")
+	// the fields added with -map-roles are ignored
+	if len(f) != 3 && len(f) != 6 && len(f) != 7 {
+		return fmt.Errorf("expected 3 fields: %s", rec)
+	}
+	if f[0] == "seq" {
+		var t []byte
+		var o uint16
+		if t, err = hex.DecodeString(f[1]); err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(f[2], "%d", &o); err != nil {
+			return
+		}
+		if len(t) != 6 || o == 0 || o > 0xfff {
+			return fmt.Errorf("invalid sequence offset: %s", rec)
+		}
+		a.seqMap[toArray6(t)] = o
+		return
+	}
+	if f[0] == "beacon-ts" {
+		var t []byte
+		var b uint64
+		if t, err = hex.DecodeString(f[1]); err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(f[2], "%d", &b); err != nil {
+			return
+		}
+		if len(t) != 6 {
+			return fmt.Errorf("invalid beacon timestamp base: %s", rec)
+		}
+		a.tsMap[toArray6(t)] = b
+		return
+	}
+	if f[0] == "can-id" {
+		var o, p uint32
+		if _, err = fmt.Sscanf(f[1]+" "+f[2], "%x %x", &o, &p); err != nil {
+			return
+		}
+		mask := uint32(canSFFMask)
+		if o&canEFF != 0 {
+			mask = canEFFMask
+		}
+		if o&^(canEFF|mask) != 0 || p&^(canEFF|mask) != 0 ||
+			o&canEFF != p&canEFF {
+			return fmt.Errorf("invalid CAN ID: %s", rec)
+		}
+		a.canMap[o] = p
+		a.canSet[p] = true
+		return
+	}
+	if f[0] == "port" {
+		var o, p uint16
+		if _, err = fmt.Sscanf(f[1]+" "+f[2], "%d %d", &o, &p); err != nil {
+			return
+		}
+		a.portMap[o] = p
+		a.portSet[p] = true
+		return
+	}
+	if f[0] == "vlan" {
+		var o, p uint16
+		if _, err = fmt.Sscanf(f[1]+" "+f[2], "%d %d", &o, &p); err != nil {
+			return
+		}
+		if o == 0 || o >= 0xfff || p == 0 || p >= 0xfff {
+			return fmt.Errorf("invalid VLAN ID: %s", rec)
+		}
+		a.vlanMap[o] = p
+		a.vlanSet[p] = true
+		return
+	}
+	var o, p []byte
+	if o, err = hex.DecodeString(f[1]); err != nil {
+		return
+	}
+	if p, err = hex.DecodeString(f[2]); err != nil {
+		return
+	}
+	if f[0] == "name" || f[0] == "id" {
+		if len(o) == 0 || len(o) != len(p) {
+			return fmt.Errorf("%s values must be the same length: %s", f[0],
+				rec)
+		}
+		if f[0] == "name" {
+			a.nameMap[string(o)] = p
+		} else {
+			a.idMap[string(o)] = p
+		}
+		return
+	}
+	n := map[string]int{"mac-oui": 3, "mac-nic": 3, "eui64-ext": 5,
+		"devaddr": 4, "ipv4": 4, "ipv6": 16}
+	l, ok := n[f[0]]
+	if !ok {
+		return fmt.Errorf("unknown class: %s", f[0])
+	}
+	if len(o) != l || len(p) != l {
+		return fmt.Errorf("%s values must be %d bytes: %s", f[0], l, rec)
+	}
+	switch f[0] {
+	case "mac-oui":
+		a.ouiMap[toArray3(o)] = toArray3(p)
+	case "mac-nic":
+		a.nicMap[toArray3(o)] = toArray3(p)
+	case "eui64-ext":
+		var oa, pa [5]byte
+		copy(oa[:], o)
+		copy(pa[:], p)
+		a.extMap[oa] = pa
+	case "devaddr":
+		a.devMap[toArray4(o)] = toArray4(p)
+	case "ipv4":
+		a.ipv4Map[toArray4(o)] = toArray4(p)
+	case "ipv6":
+		a.ipv6Map[toArray16(o)] = toArray16(p)
+	}
+	return
+}
+
+// ClearMaps clears the pseudonym mappings.
+func (a *DefaultAnonymizer) ClearMaps() {
+	a.ouiMap = make(map[[3]byte][3]byte)
+	a.nicMap = make(map[[3]byte][3]byte)
+	a.ipv4Map = make(map[[4]byte][4]byte)
+	a.ipv6Map = make(map[[16]byte][16]byte)
+	a.vlanMap = make(map[uint16]uint16)
+	a.vlanSet = make(map[uint16]bool)
+	a.seqMap = make(map[[6]byte]uint16)
+	a.tsMap = make(map[[6]byte]uint64)
+	a.extMap = make(map[[5]byte][5]byte)
+	a.devMap = make(map[[4]byte][4]byte)
+	a.canMap = make(map[uint32]uint32)
+	a.canSet = make(map[uint32]bool)
+	a.portMap = make(map[uint16]uint16)
+	a.portSet = make(map[uint16]bool)
+	a.nameMap = make(map[string][]byte)
+	a.idMap = make(map[string][]byte)
+}
+
+// Servers are optional long-running server modes. Each returns true if it was
+// enabled and ran.
+var Servers []func(p Policy, k *Keys, cfg *Config) (bool, error)
+
+// FallbackHandler, if not nil, returns a handler for link types not in
+// Handlers, or nil if it can't handle the link type either.
+var FallbackHandler func(link uint32) Handler
+
+// ErrUnknown is returned by handlers, along with the number of bytes that were
+// handled, when a packet's structure is not understood.
+var ErrUnknown = errors.New("unknown packet structure")
+
+// UnknownError is an ErrUnknown for a protocol that isn't supported, such as
+// an EtherType or 802.11 subtype, which runs tally so users know what's being
+// truncated.
+type UnknownError struct {
+	// Protocol identifies the protocol, e.g. "EtherType 0x88cc".
+	Protocol string
+}
+
+// unknownProtocol returns an UnknownError for the protocol described by
+// format and args.
+func unknownProtocol(format string, args ...interface{}) error {
+	return &UnknownError{fmt.Sprintf(format, args...)}
+}
+
+func (e *UnknownError) Error() string {
+	return fmt.Sprintf("%s (%s)", ErrUnknown, e.Protocol)
+}
+
+// Is reports if target is ErrUnknown, so errors.Is matches UnknownErrors.
+func (e *UnknownError) Is(target error) bool {
+	return target == ErrUnknown
+}
+
+// Handler anonymizes a packet.
+type Handler interface {
+	Handle(b []byte, a Anonymizer) (int, error)
+}
+
+// TrailerHandler is implemented by handlers for frames with a trailer, such as
+// an FCS, which must be updated after the packet is anonymized.
+type TrailerHandler interface {
+	// Trailer updates the trailer of packet b, which was truncated if
+	// truncated is true, returning the packet's new length.
+	Trailer(b []byte, truncated bool) int
+
+	// TrailerLen returns the length of the trailer in original packet b, and
+	// the offset of any byte with a flag for it, or -1.
+	TrailerLen(b []byte) (n int, flag int)
+}
+
+// updateTrailer updates any trailer of complete packet b for handler h,
+// returning the packet.
+func updateTrailer(h Handler, b []byte, truncated bool) []byte {
+	if th, ok := h.(TrailerHandler); ok {
+		return b[:th.Trailer(b, truncated)]
+	}
+	return b
+}
+
+// FilterHandler is implemented by handlers that can filter out packets
+// before they're anonymized.
+type FilterHandler interface {
+	// Keep returns true if packet b should be kept.
+	Keep(b []byte) bool
+}
+
+// Direction is the direction of a packet relative to the capturing interface.
+// Its values are those of the direction bits of pcapng packet flags.
+type Direction int
+
+const (
+	// DirUnknown means the capture doesn't record the direction.
+	DirUnknown Direction = iota
+
+	// DirInbound means the packet was received.
+	DirInbound
+
+	// DirOutbound means the packet was sent.
+	DirOutbound
+)
+
+// PacketContext is the metadata for a packet from its capture file.
+type PacketContext struct {
+	// Timestamp is the capture time, or zero if unknown.
+	Timestamp time.Time
+
+	// OrigLen is the packet's length on the wire, before any snaplen.
+	OrigLen uint32
+
+	// LinkType is the capture's link type.
+	LinkType uint32
+
+	// Interface is the pcapng interface, or nil for other formats.
+	Interface *Interface
+
+	// Direction is the packet's direction, if known.
+	Direction Direction
+}
+
+// ContextHandler is implemented by handlers that use the packet's metadata,
+// such as for per-interface or time-dependent policies. Its HandleContext
+// method is called instead of Handle when the metadata is available.
+type ContextHandler interface {
+	HandleContext(c *PacketContext, b []byte, a Anonymizer) (int, error)
+}
+
+// handle anonymizes packet b with handler h, passing it the packet's metadata
+// c if it's a ContextHandler. A panic in the handler, such as on malformed
+// input it doesn't check for, is returned as an error for the packet, so it
+// doesn't stop the run.
+func handle(h Handler, c *PacketContext, b []byte, a Anonymizer) (n int,
+	err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, fmt.Errorf("handler failed: %v", r)
+		}
+	}()
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.HandleContext(c, b, a)
+	}
+	return h.Handle(b, a)
+}
+
+// ProcessFunc is called with each anonymized packet, its metadata and header,
+// for applications that use the packets directly rather than as a capture.
+// The packet is only valid until ProcessFunc returns. Returning an error
+// stops the run with that error.
+type ProcessFunc func(c *PacketContext, ph *PacketHeader, b []byte) error
+
+// funcWriter is a PacketWriter that passes packets to a ProcessFunc.
+type funcWriter struct {
+	fn  ProcessFunc
+	src *PcapReader
+}
+
+// WriteHeader does nothing, as the metadata is passed with each packet.
+func (f *funcWriter) WriteHeader(gh *GlobalHeader) error {
+	return nil
+}
+
+// WritePacket calls the ProcessFunc, ignoring any comment.
+func (f *funcWriter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) error {
+	return f.fn(f.src.context(ph), ph, b)
+}
+
+// CommentMode selects which comments are added to pcapng output.
+type CommentMode int
+
+const (
+	// NoComment means add no comments.
+	NoComment CommentMode = iota
+
+	// FileComment means add one comment to the section header.
+	FileComment
+
+	// PacketComment means add a comment to each modified packet.
+	PacketComment
+)
+
+// Config is the configuration for a run.
+type Config struct {
+	// Truncate truncates unknown portions of packets.
+	Truncate bool
+
+	// DropUnknown drops packets with unknown structure.
+	DropUnknown bool
+
+	// MaxErrors is the number of packets that fail to be handled, other than
+	// for unknown structure, to drop before stopping with the error. If
+	// negative, there's no limit.
+	MaxErrors int
+
+	// RewriteOrigLen sets the original length of each packet written to its
+	// captured length, so truncation doesn't reveal the original sizes.
+	RewriteOrigLen bool
+
+	// Padding, if not nil, pads each packet written, setting its original
+	// length to its padded length.
+	Padding *Padder
+
+	// TimeShift, if not nil, shifts the timestamp of each packet written.
+	TimeShift *TimeShift
+
+	// FlowLog, if not nil, summarizes the flows of the packets written.
+	FlowLog *FlowLog
+
+	// MapRoles, if not nil, records the roles and packets of the addresses
+	// anonymized.
+	MapRoles *MapRoles
+
+	// Index, if not nil, indexes the packets written to the output, which
+	// must not be rotated or split.
+	Index *Index
+
+	// Split, if not nil, writes output to a file per group of packets
+	// instead.
+	Split *Splitter
+
+	// Input, if not nil, is read instead of the input given to run, such as
+	// to merge captures.
+	Input *PcapReader
+
+	// OnlyModified writes only the packets with at least one field changed.
+	OnlyModified bool
+
+	// Limiter, if not nil, drops the packets read beyond its limits.
+	Limiter *Limiter
+
+	// Checkpoint, if not nil, periodically saves checkpoints of the run, and
+	// resumes it from a checkpoint. The input must be pcap, and the output
+	// pcap written to the checkpointer's partial file.
+	Checkpoint *Checkpointer
+
+	// Strict, if not nil, validates each packet read.
+	Strict *Validator
+
+	// Dedup, if not nil, drops duplicates of recent packets before they're
+	// anonymized.
+	Dedup *Deduplicator
+
+	// Flows, if not nil, drops the packets not to or from its hosts and
+	// networks before they're anonymized.
+	Flows *FlowFilter
+
+	// PcapNG writes pcapng output instead of pcap.
+	PcapNG bool
+
+	// CommentMode selects the comments added to pcapng output.
+	CommentMode CommentMode
+
+	// Comment is the anonymization profile comment for pcapng output.
+	Comment string
+
+	// StripMetadata omits the user application and comments from pcapng
+	// output.
+	StripMetadata bool
+
+	// Audit, if not nil, records modified fields.
+	Audit *AuditAnonymizer
+
+	// LeakScan, if not nil, scans each packet for addresses it remembers.
+	LeakScan *LeakScanner
+
+	// Reassembly, if not nil, reassembles TCP streams to anonymize the
+	// messages of application protocols.
+	Reassembly *TCPReassembly
+
+	// Embedded, if not nil, finds captures in the payloads kept when not
+	// truncating.
+	Embedded *EmbeddedScanner
+
+	// Metrics, if not nil, are updated as packets are processed.
+	Metrics *Metrics
+
+	// Rotate, if not nil, writes output to rotated files instead.
+	Rotate *Rotator
+
+	// AsyncWrite writes output from a separate goroutine.
+	AsyncWrite bool
+
+	// Progress, if not nil, is updated as input is read.
+	Progress *Progress
+
+	// BSSIDReport, if not nil, collects the BSSIDs in radiotap + 802.11
+	// captures.
+	BSSIDReport *BSSIDReport
+
+	// StationReport, if not nil, summarizes the stations in radiotap +
+	// 802.11 captures.
+	StationReport *StationReport
+
+	// ERF reads and writes ERF records instead of pcap.
+	ERF bool
+
+	// InterfacePolicies, if not nil, selects the policy for each packet by
+	// its pcapng interface.
+	InterfacePolicies *InterfacePolicies
+
+	// KeyRotation, if not nil, rotates the anonymizer's keys by capture time,
+	// commenting the first packet of each window in pcapng output.
+	KeyRotation *KeyRotator
+
+	// Process, if not nil, is called with each anonymized packet instead of
+	// writing it to the output, which may then be ioutil.Discard.
+	Process ProcessFunc
+
+	// MapKey is the key for the HMAC of mappings exported by servers.
+	MapKey []byte
+}
+
+// RunStats are the results of a run.
+type RunStats struct {
+	// Packets is the number of packets read.
+	Packets uint64
+
+	// Unknown is the number of packets with unknown structure.
+	Unknown uint64
+
+	// Dropped is the number of packets dropped for unknown structure.
+	Dropped uint64
+
+	// Errors is the number of packets dropped as they failed to be handled.
+	Errors uint64
+
+	// Unsupported is the number of packets with unknown structure by
+	// unsupported protocol, for handlers that identify it.
+	Unsupported map[string]uint64
+
+	// Unmodified is the number of packets omitted with OnlyModified.
+	Unmodified uint64
+
+	// Duplicates is the number of duplicate packets dropped with Dedup.
+	Duplicates uint64
+
+	// OtherFlows is the number of packets dropped by Flows.
+	OtherFlows uint64
+
+	// Filtered is the number of packets removed by the handler's filter.
+	Filtered uint64
+
+	// Anonymizer are the anonymizer's statistics, if it has them.
+	Anonymizer AnonymizerStats
+}
+
+// run anonymizes the capture read from in, writing the results to out. If ctx
+// is done, run stops before the next packet, flushing the output written so
+// far and returning the stats for the packets handled, with ctx.Err(). A read
+// that's blocked isn't interrupted, so callers reading from a network or pipe
+// should also close in when ctx is done.
+func run(ctx context.Context, in io.Reader, out io.Writer, anon Anonymizer,
+	cfg *Config) (s RunStats, err error) {
+	defer func() {
+		if sa, ok := anon.(interface{ Stats() AnonymizerStats }); ok {
+			s.Anonymizer = sa.Stats()
+		}
+	}()
+	if cfg.Metrics != nil {
+		out = cfg.Metrics.begin(out)
+		defer func() {
+			cfg.Metrics.end(err)
+		}()
+	}
+	// pos returns the offset in the input after the last packet read
+	var r io.Reader = in
+	var pos func() int64
+	if buf, ok := in.(memReader); ok {
+		l := buf.Len()
+		pos = func() int64 { return int64(l - buf.Len()) }
+	} else {
+		cr := &countingReader{r: in}
+		br := bufio.NewReader(cr)
+		pos = func() int64 { return cr.n - int64(br.Buffered()) }
+		r = br
+	}
+	var w io.Writer
+	var bw *bufio.Writer
+	if cfg.AsyncWrite && cfg.Checkpoint == nil {
+		aw := newAsyncWriter(out, asyncBufSize)
+		defer func() {
+			if cerr := aw.Close(); cerr != nil && (err == nil || err == io.EOF) {
+				err = cerr
+			}
+		}()
+		w = aw
+	} else {
+		bw = bufio.NewWriter(out)
+		defer func() {
+			bw.Flush()
+		}()
+		w = bw
+	}
+
+	// headers
+	var pr *PcapReader
+	if cfg.Input != nil {
+		pr = cfg.Input
+	} else if cfg.ERF {
+		pr = NewERFReader(r)
+	} else if pr, err = NewCaptureReader(r); err != nil {
+		return
+	}
+	order := pr.order
+	gh := pr.header
+	logPacketf(LevelVerbose, gh.LinkLayer, 0,
+		"detected %s, pcap version %d.%d, snaplen %d", order.String(),
+		gh.VersionMajor, gh.VersionMinor, gh.Snaplen)
+	h, ok := Handlers[gh.LinkLayer]
+	if !ok && FallbackHandler != nil {
+		h = FallbackHandler(gh.LinkLayer)
+		ok = h != nil
+	}
+	if !ok {
+		err = fmt.Errorf(
+			"unsupported link layer: %d (https://www.tcpdump.org/linktypes.html)",
+			gh.LinkLayer)
+		return
+	}
+	newWriter := func(w io.Writer) PacketWriter {
+		if cfg.PcapNG {
+			ngw := &PcapNGWriter{w: w, order: order,
+				strip: cfg.StripMetadata, src: pr}
+			if cfg.CommentMode == FileComment {
+				ngw.comment = cfg.Comment
+			}
+			return ngw
+		}
+		if cfg.ERF {
+			return &ERFWriter{w}
+		}
+		return &PcapWriter{w: w, order: order, magic: pr.magic}
+	}
+	var pw PacketWriter
+	if cfg.Index != nil {
+		pw = cfg.Index.packetWriter(newWriter(cfg.Index.writer(w)))
+	} else {
+		pw = newWriter(w)
+	}
+	if cfg.Process != nil {
+		pw = &funcWriter{cfg.Process, pr}
+	} else if cfg.Rotate != nil {
+		cfg.Rotate.newWriter = newWriter
+		if cfg.Metrics != nil {
+			cfg.Rotate.counter = &cfg.Metrics.bytes
+		}
+		pw = cfg.Rotate
+	} else if cfg.Split != nil {
+		cfg.Split.newWriter = newWriter
+		if cfg.Metrics != nil {
+			cfg.Split.counter = &cfg.Metrics.bytes
+		}
+		pw = cfg.Split
+	}
+	if cfg.Reassembly != nil {
+		pw = cfg.Reassembly.packetWriter(pw, h)
+		defer func() {
+			if cerr := cfg.Reassembly.Close(); cerr != nil &&
+				(err == nil || err == io.EOF) {
+				err = cerr
+			}
+		}()
+	}
+	if cfg.Padding != nil && gh.Snaplen < uint32(cfg.Padding.Max()) {
+		gh.Snaplen = uint32(cfg.Padding.Max())
+	}
+	if cp := cfg.Checkpoint; cp != nil {
+		if pr.read != nil {
+			err = fmt.Errorf("checkpoints require pcap input")
+			return
+		}
+		if cp.Resumed {
+			// the output has the header, and the packets before the offset
+			if err = skipInput(r, cp.input-pos()); err != nil {
+				return
+			}
+			s = cp.stats
+		}
+	}
+	if cfg.Checkpoint == nil || !cfg.Checkpoint.Resumed {
+		if err = pw.WriteHeader(&gh); err != nil {
+			return
+		}
+	}
+
+	// packets
+	report, stations := cfg.BSSIDReport, cfg.StationReport
+	if gh.LinkLayer != 127 {
+		report, stations = nil, nil
+	}
+	var orig []byte
+	var window string
+	fh, _ := h.(FilterHandler)
+	ea, _ := anon.(interface{ Err() error })
+	var busy time.Time
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if cfg.Checkpoint != nil && cfg.Checkpoint.due() {
+			if err = bw.Flush(); err != nil {
+				return
+			}
+			if err = cfg.Checkpoint.save(pos(), s); err != nil {
+				return
+			}
+		}
+		var spent time.Duration
+		if !busy.IsZero() {
+			spent = time.Since(busy)
+		}
+		var ph PacketHeader
+		var b []byte
+		if ph, b, err = pr.ReadPacket(); err != nil {
+			return
+		}
+		if cfg.Limiter != nil {
+			busy = time.Now()
+			if !cfg.Limiter.admit(len(b), spent) {
+				s.Packets++
+				continue
+			}
+		}
+		if verbosity >= LevelVerbose && s.Packets > 0 && s.Packets%1000 == 0 {
+			logPacketf(LevelVerbose, gh.LinkLayer, s.Packets,
+				"%d packets, %d unknown, %d dropped, %d changes, %d pseudonyms",
+				s.Packets, s.Unknown, s.Dropped, anon.Changed(),
+				anon.Pseudonyms())
+		}
+		if cfg.Progress != nil {
+			cfg.Progress.add(16 + len(b))
+		}
+		if cfg.Strict != nil {
+			var drop bool
+			if drop, err = cfg.Strict.validate(h, pr, &ph, b,
+				s.Packets+1); err != nil {
+				return
+			}
+			if drop {
+				s.Packets++
+				continue
+			}
+		}
+		if cfg.Dedup != nil && cfg.Dedup.duplicate(ph.OrigLen, b) {
+			s.Packets++
+			s.Duplicates++
+			continue
+		}
+		if cfg.Flows != nil && !cfg.Flows.keep(h, pr.context(&ph), b) {
+			s.Packets++
+			s.OtherFlows++
+			continue
+		}
+		if cfg.InterfacePolicies != nil {
+			cfg.InterfacePolicies.apply(pr.iface, pr.dir)
+		}
+		if cfg.Split != nil {
+			cfg.Split.classify(h, pr.context(&ph), b)
+		}
+		if fh != nil && !fh.Keep(b) {
+			s.Packets++
+			s.Filtered++
+			continue
+		}
+
+		if cfg.KeyRotation != nil {
+			var w string
+			if w, err = cfg.KeyRotation.rotate(ph.TimestampSec); err != nil {
+				return
+			}
+			if w != "" {
+				logPacketf(LevelInfo, gh.LinkLayer, s.Packets+1, "packet %d: %s",
+					s.Packets+1, w)
+				window = w
+			}
+		}
+
+		// anonymize packet
+		var n int
+		c := anon.Changed()
+		np := anon.Pseudonyms()
+		if cfg.Audit != nil {
+			cfg.Audit.Begin(b)
+		}
+		if cfg.FlowLog != nil {
+			cfg.FlowLog.Begin(b)
+		}
+		if cfg.Reassembly != nil {
+			cfg.Reassembly.Begin(b)
+		}
+		if cfg.MapRoles != nil {
+			cfg.MapRoles.Begin(s.Packets+1, pr.context(&ph).Timestamp)
+		}
+		if report != nil || stations != nil {
+			orig = append(orig[:0], b...)
+		}
+		drop, unknown := false, false
+		n, err = handle(h, pr.context(&ph), b, anon)
+		if ea != nil {
+			if aerr := ea.Err(); aerr != nil {
+				err = aerr
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, ErrUnknown) {
+				if cfg.MaxErrors >= 0 && s.Errors >= uint64(cfg.MaxErrors) {
+					err = fmt.Errorf("packet %d: %s", s.Packets+1, err)
+					return
+				}
+				logPacketf(LevelInfo, gh.LinkLayer, s.Packets+1,
+					"packet %d: dropped: %s", s.Packets+1, err)
+				err = nil
+				if cfg.Metrics != nil {
+					cfg.Metrics.packet(np, anon.Pseudonyms(), true)
+				}
+				s.Packets++
+				s.Errors++
+				continue
+			}
+			var ue *UnknownError
+			if errors.As(err, &ue) {
+				if s.Unsupported == nil {
+					s.Unsupported = make(map[string]uint64)
+				}
+				s.Unsupported[ue.Protocol]++
+			}
+			err = nil
+			drop = cfg.DropUnknown
+			unknown = true
+			s.Unknown++
+			if cfg.Metrics != nil {
+				cfg.Metrics.unknown()
+			}
+		}
+		embedded := false
+		if cfg.Embedded != nil && !cfg.Truncate && !drop {
+			embedded = cfg.Embedded.scan(h, pr.context(&ph), b, n, anon)
+		}
+		if cfg.Metrics != nil {
+			cfg.Metrics.packet(np, anon.Pseudonyms(), drop || embedded)
+		}
+		omit := !drop && !embedded && cfg.OnlyModified && anon.Changed() == c
+		if report != nil && !unknown {
+			report.add(orig, b)
+		}
+		if stations != nil && !unknown {
+			stations.add(orig, b, pr.context(&ph))
+		}
+		if cfg.Audit != nil {
+			an := len(b)
+			if drop || embedded || omit {
+				an = 0
+			} else if cfg.Truncate {
+				an = n
+			}
+			if err = cfg.Audit.End(s.Packets+1, an); err != nil {
+				return
+			}
+		}
+		if verbosity >= LevelDebug {
+			a := "kept"
+			if drop || embedded {
+				a = "dropped"
+			} else if omit {
+				a = "omitted as unmodified"
+			} else if cfg.Truncate && n < len(b) {
+				a = fmt.Sprintf("truncated to %d", n)
+			}
+			logPacketf(LevelDebug, gh.LinkLayer, s.Packets+1,
+				"packet %d: %d bytes, %d handled, unknown %t, %d changes, %s",
+				s.Packets+1, len(b), n, unknown, anon.Changed()-c, a)
+		}
+		if drop {
+			s.Packets++
+			s.Dropped++
+			continue
+		}
+		if embedded {
+			s.Packets++
+			continue
+		}
+		if omit {
+			s.Packets++
+			s.Unmodified++
+			continue
+		}
+		complete := ph.Len == ph.OrigLen
+		truncated := cfg.Truncate && n < len(b)
+		if truncated {
+			b = b[:n]
+			ph.Len = uint32(n)
+		}
+		if complete {
+			b = updateTrailer(h, b, truncated)
+			ph.Len = uint32(len(b))
+		}
+		if cfg.Padding != nil {
+			b = cfg.Padding.pad(b)
+			ph.Len = uint32(len(b))
+		}
+		if cfg.RewriteOrigLen || cfg.Padding != nil {
+			ph.OrigLen = ph.Len
+		}
+		if cfg.TimeShift != nil {
+			if err = cfg.TimeShift.apply(&ph, pr); err != nil {
+				return
+			}
+		}
+		if cfg.FlowLog != nil {
+			cfg.FlowLog.add(&ph)
+		}
+		if cfg.LeakScan != nil {
+			for _, l := range cfg.LeakScan.scan(b) {
+				if cfg.LeakScan.Action == LeakAbort {
+					err = fmt.Errorf(
+						"possible unanonymized %s at offset %d of packet %d",
+						l.class, l.offset, s.Packets+1)
+					return
+				}
+				logPacketf(LevelInfo, gh.LinkLayer, s.Packets+1,
+					"packet %d: possible unanonymized %s at offset %d",
+					s.Packets+1, l.class, l.offset)
+			}
+		}
+
+		// write header and packet
+		var comment string
+		if cfg.CommentMode == PacketComment && anon.Changed() != c {
+			comment = cfg.Comment
+		}
+		if window != "" {
+			if comment != "" {
+				comment = window + "\n" + comment
+			} else {
+				comment = window
+			}
+			window = ""
+		}
+		if cfg.Reassembly != nil {
+			cfg.Reassembly.trailer = complete
+		}
+		if err = pw.WritePacket(&ph, b, comment); err != nil {
+			return
+		}
+
+		s.Packets++
+	}
+}
+
+// skipInput skips n bytes of input r, without copying them if it's a
+// bytes.Buffer.
+func skipInput(r io.Reader, n int64) (err error) {
+	if n < 0 {
+		return fmt.Errorf("invalid input offset")
+	}
+	if buf, ok := r.(*bytes.Buffer); ok {
+		if int64(buf.Len()) < n {
+			return io.ErrUnexpectedEOF
+		}
+		buf.Next(int(n))
+		return
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, n); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// countingReader counts the bytes read from a Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (n int, err error) {
+	n, err = c.r.Read(b)
+	c.n += int64(n)
+	return
+}
+
+// unsupportedProtocols returns the protocols in u, by descending count.
+func unsupportedProtocols(u map[string]uint64) (p []string) {
+	for k := range u {
+		p = append(p, k)
+	}
+	sort.Slice(p, func(i, j int) bool {
+		if u[p[i]] != u[p[j]] {
+			return u[p[i]] > u[p[j]]
+		}
+		return p[i] < p[j]
+	})
+	return
+}
+
+func parseCommentMode(s string) (m CommentMode, err error) {
+	switch s {
+	case "none":
+		m = NoComment
+	case "file":
+		m = FileComment
+	case "packet":
+		m = PacketComment
+	default:
+		err = fmt.Errorf("unknown comment mode: %s", s)
+	}
+	return
+}
+
+// profileComment returns the pcapng comment recording the anonymization
+// profile.
+func profileComment(p Policy, cfg *Config, fp string) string {
+	return fmt.Sprintf("anonymized by wanonpcap %s, %s truncate=%t, "+
+		"key fingerprint %s", Version, p, cfg.Truncate, fp)
+}
+
+var keyStr = flag.String("key", "", "key for anonymization")
+var expectFP = flag.String("key-fingerprint", "",
+	"exit with an error unless the key has this fingerprint")
+var macKeyStr = flag.String("mac-key", "",
+	"separate key for MAC addresses, also used for EUI-64s, DevAddrs, "+
+		"names, IDs and 802.11 sequence numbers")
+var ipv4KeyStr = flag.String("ipv4-key", "",
+	"separate key for IPv4 addresses")
+var ipv6KeyStr = flag.String("ipv6-key", "",
+	"separate key for IPv6 addresses")
+var vlanKeyStr = flag.String("vlan-key", "",
+	"separate key for VLAN IDs, also used for CAN IDs and ports")
+var subkeys = flag.Bool("subkeys", false,
+	"derive separate keys for each field class from -key")
+var showSubkeys = flag.Bool("show-subkeys", false,
+	"print derived subkeys, which may be disclosed with -<class>-key")
+var macOUIStr = flag.String("mac-oui", "pseudonym",
+	"MAC OUI (vendor) anonymization method- encrypt, pseudonym or leave")
+var macNICStr = flag.String("mac-nic", "pseudonym",
+	"MAC NIC (id) anonymization method- encrypt, pseudonym or leave")
+var ipv4Str = flag.String("ipv4", "pseudonym",
+	"IPv4 address anonymization method- encrypt, pseudonym or leave")
+var ipv6Str = flag.String("ipv6", "pseudonym",
+	"IPv6 address anonymization method- encrypt, pseudonym or leave")
+var ipv4SrcStr = flag.String("ipv4-src", "",
+	"IPv4 source address anonymization method (default from -ipv4)")
+var ipv4DstStr = flag.String("ipv4-dst", "",
+	"IPv4 destination address anonymization method (default from -ipv4)")
+var ipv6SrcStr = flag.String("ipv6-src", "",
+	"IPv6 source address anonymization method (default from -ipv6)")
+var ipv6DstStr = flag.String("ipv6-dst", "",
+	"IPv6 destination address anonymization method (default from -ipv6)")
+var vlanStr = flag.String("vlan", "leave",
+	"VLAN ID anonymization method- leave, pseudonym or zero")
+var seqStr = flag.String("seq", "leave",
+	"802.11 sequence number anonymization method- leave, resequence or zero")
+var canIDStr = flag.String("can-id", "leave",
+	"CAN ID anonymization method- encrypt, pseudonym or leave")
+var portStr = flag.String("port", "leave",
+	"TCP and UDP port anonymization method- encrypt, pseudonym or leave")
+var nameStr = flag.String("name", "pseudonym",
+	"host, domain and user name anonymization method- pseudonym or leave")
+var idStr = flag.String("id", "pseudonym",
+	"opaque identifier anonymization method- encrypt, pseudonym or leave")
+var zeroCANData = flag.Bool("zero-can-data", false,
+	"with -no-truncate, zero CAN frame data")
+var zeroTimestamps = flag.Bool("zero-timestamps", false,
+	"zero radiotap TSFT and timestamp fields, and 802.11 FTM TOD and TOA")
+var beaconTimestampsStr = flag.String("beacon-timestamps", "rebase",
+	"802.11 beacon timestamp anonymization method- leave, rebase or zero")
+var zeroCountry = flag.Bool("zero-country", false,
+	"with -no-truncate, zero 802.11 country IEs")
+var zeroVendor = flag.Bool("zero-vendor", false,
+	"zero radiotap vendor namespace data, and with -no-truncate, "+
+		"802.11 vendor specific IEs")
+var zeroVendorOUIs = flag.String("zero-vendor-ouis", "",
+	"with -zero-vendor, only zero vendor data with these OUIs "+
+		"(comma separated, e.g. 00:11:22,aabbcc)")
+var noTruncate = flag.Bool("no-truncate", false,
+	"do not truncate unknown portions of packets (caution: will expose addresses)")
+var rewriteOrigLen = flag.Bool("rewrite-origlen", false,
+	"set the original length of each packet to its captured length, "+
+		"instead of keeping the length on the wire")
+var dropUnknown = flag.Bool("drop-unknown", false,
+	"drop packets with unknown structure instead of truncating them")
+var maxErrors = flag.Int("max-errors", 0,
+	"drop up to this many packets that fail to be handled, such as "+
+		"malformed ones, before stopping with an error (-1 for no limit)")
+var onlyModified = flag.Bool("only-modified", false,
+	"write only packets with at least one field anonymized")
+var dryRun = flag.Bool("dry-run", false,
+	"report what would be anonymized and truncated, without writing output")
+var auditLog = flag.String("audit-log", "",
+	"file to record modified fields per packet (types and offsets only)")
+var outStr = flag.String("out", "-",
+	"output file, - for stdout, or s3://, gs:// or azure:// object URL")
+var syncWrite = flag.Bool("sync-write", false,
+	"write output inline with processing instead of from a separate goroutine")
+var pcapng = flag.Bool("pcapng", false, "write pcapng output")
+var commentStr = flag.String("comment", "none",
+	"pcapng anonymization profile comment- none, file or packet")
+var stripMetadata = flag.Bool("strip-metadata", false,
+	"omit the user application and all comments from pcapng output")
+
+var decrypt = flag.Bool("decrypt", false,
+	"decrypt a capture encrypted with the same key and methods")
+var diff = flag.Bool("diff", false,
+	"compare original and anonymized captures given as arguments")
+
+var selftest = flag.Bool("selftest", false,
+	"run built-in self tests and exit")
+
+// checkFlags returns an error if the given flags, command, comment mode and
+// leak action can't be used together.
+func checkFlags(cmd Command, cm CommentMode, la LeakAction) error {
+	if *listenAddr != "" && (*inPlace || *checkpointPath != "" ||
+		cmd == CmdMerge || cmd == CmdStats) {
+		return fmt.Errorf("-listen may not be used with -in-place, " +
+			"-checkpoint, merge or stats")
+	}
+	if *remoteHost != "" && (*listenAddr != "" || *inPlace ||
+		*checkpointPath != "" || cmd == CmdMerge || cmd == CmdStats) {
+		return fmt.Errorf("-remote may not be used with -listen, -in-place, " +
+			"-checkpoint, merge or stats")
+	}
+	if (*remoteInterface != "" || *remoteFilter != "") && *remoteHost == "" {
+		return fmt.Errorf("-i and -remote-filter require -remote")
+	}
+	if (*listenCert != "" || *listenClientCA != "") && !listenTLSUsed() {
+		return fmt.Errorf("-listen-cert and -listen-client-ca require " +
+			"-listen or -grpc-addr")
+	}
+	if (*listenCert == "") != (*listenKey == "") ||
+		*listenClientCA != "" && *listenCert == "" {
+		return fmt.Errorf("-listen-cert and -listen-key must be used " +
+			"together, and -listen-client-ca requires them")
+	}
+	if cmd == CmdMerge && (flag.NArg() < 1 || *erfFormat) {
+		return fmt.Errorf("usage: wanonpcap merge a.pcap b.pcap ... > " +
+			"out.pcap (ERF unsupported)")
+	}
+
+	if cmd == CmdMapImport && flag.NArg() != 1 {
+		return fmt.Errorf("usage: wanonpcap map import maps.csv < in.pcap > " +
+			"out.pcap")
+	}
+
+	if cmd == CmdMapPrune && (*pruneSince == "" || flag.NArg() != 0) {
+		return fmt.Errorf("usage: wanonpcap map prune -since 2024-01-01 < " +
+			"maps.csv > pruned.csv")
+	}
+	if (cmd == CmdMapLookup || cmd == CmdMapRLookup) && flag.NArg() < 2 {
+		return fmt.Errorf("usage: wanonpcap map lookup|rlookup maps.csv " +
+			"address ...")
+	}
+	if cmd == CmdMapMerge && flag.NArg() < 1 {
+		return fmt.Errorf("usage: wanonpcap map merge a.csv b.csv ... > " +
+			"maps.csv")
+	}
+
+	if *inPlace && (flag.NArg() != 1 || *outStr != "-" ||
+		cmd != CmdAnonymize && cmd != CmdDeanonymize) {
+		return fmt.Errorf("usage: wanonpcap [deanonymize] -in-place [-shred] " +
+			"file.pcap")
+	}
+	if *dryRun && (*inPlace || cmd == CmdMapExport) {
+		return fmt.Errorf("-dry-run may not be used with -in-place or map " +
+			"export")
+	}
+	if *shred && runtime.GOOS == "windows" {
+		return fmt.Errorf("-shred is unsupported on Windows, where open " +
+			"files can't be replaced")
+	}
+	if *shred && !*inPlace {
+		return fmt.Errorf("-shred requires -in-place")
+	}
+	if *checkpointPath != "" {
+		if *outStr == "-" || strings.Contains(*outStr, "://") {
+			return fmt.Errorf("-checkpoint requires -out with a file name")
+		}
+		if cmd != CmdAnonymize && cmd != CmdDeanonymize {
+			return fmt.Errorf("-checkpoint may only be used to anonymize or " +
+				"deanonymize")
+		}
+		if *inPlace || *dryRun || *pcapng || *erfFormat || *indexPath != "" ||
+			*rotateSize != 0 || *rotateSeconds != 0 || *splitBy != "" ||
+			*stateFile != "" || *pseudonymStoreURL != "" || *keyRotate != 0 {
+			return fmt.Errorf("-checkpoint may not be used with -in-place, " +
+				"-dry-run, -pcapng, -erf, -index, -C, -G, -split-by, state " +
+				"files, pseudonym stores or -key-rotate")
+		}
+	}
+
+	if *stripMetadata && cm != NoComment {
+		return fmt.Errorf("-strip-metadata and -comment are mutually " +
+			"exclusive")
+	}
+	if la != LeakNone && !*noTruncate {
+		return fmt.Errorf("-leak-scan requires -no-truncate")
+	}
+	if *tcpReassembly {
+		if !*noTruncate {
+			return fmt.Errorf("-tcp-reassembly requires -no-truncate")
+		}
+		if *decrypt || la != LeakNone || *onlyModified ||
+			*checkpointPath != "" || *padTo != "" {
+			return fmt.Errorf("-tcp-reassembly may not be used with " +
+				"-decrypt, -leak-scan, -only-modified, -checkpoint or -pad-to")
+		}
+		if *tcpReassemblyMax <= 0 {
+			return fmt.Errorf("-tcp-reassembly-max must be positive")
+		}
+	}
+	if (*asReportPath == "") != (*routesPath == "") {
+		return fmt.Errorf("-as-report and -routes must be used together")
+	}
+	if *indexPath != "" && (*rotateSize != 0 || *rotateSeconds != 0 ||
+		*splitBy != "" || *dryRun) {
+		return fmt.Errorf("-index may not be used with -C, -G, -split-by or " +
+			"-dry-run")
+	}
+	if *splitBy != "" && (*rotateSize != 0 || *rotateSeconds != 0 ||
+		*inPlace) {
+		return fmt.Errorf("-split-by may not be used with -C, -G or -in-place")
+	}
+	if *flowsFormat != "csv" && *flowsFormat != "json" {
+		return fmt.Errorf("unknown flows format: %s", *flowsFormat)
+	}
+	if *preservePrefixLen < 0 || *preservePrefixLen > 32 ||
+		*preservePrefixLen6 < 0 || *preservePrefixLen6 > 128 {
+		return fmt.Errorf("invalid prefix length for -preserve-prefix-len or " +
+			"-preserve-prefix-len6")
+	}
+	if *keyRotate != 0 && (*stateFile != "" || *pseudonymStoreURL != "" ||
+		cmd == CmdMapExport || cmd == CmdMapImport) {
+		return fmt.Errorf("-key-rotate may not be used with state files, " +
+			"pseudonym stores or map import and export")
+	}
+	if *mapRoles && cmd != CmdMapExport {
+		return fmt.Errorf("-map-roles may only be used with map export")
+	}
+	switch *mapFormat {
+	case "csv":
+	case "tcprewrite":
+		if cmd != CmdMapExport {
+			return fmt.Errorf("-map-format tcprewrite may only be used with " +
+				"map export")
+		}
+		if *mapRoles {
+			return fmt.Errorf("-map-roles may not be used with -map-format " +
+				"tcprewrite")
+		}
+	default:
+		return fmt.Errorf("invalid map format: %s", *mapFormat)
+	}
+	if *geoIPFile != "" && (*preservePrefixLen > 0 || *preservePrefixLen6 > 0) {
+		return fmt.Errorf("-geoip and -preserve-prefix-len are mutually " +
+			"exclusive")
+	}
+	return nil
+}
+
+// stopProfile stops profiling, if started, and writes the profiles.
+var stopProfile = func() {}
+
+// exitf removes partial output, stops profiling, logs an error and exits with
+// status 1.
+func exitf(format string, args ...interface{}) {
+	temps.removeAll()
+	stopProfile()
+	errorf(format, args...)
+	os.Exit(1)
+}
+
+func main() {
+	cmd, args, err := parseCommand(os.Args)
+	if err != nil {
+		errorf("%s", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Args = args
+	switch cmd {
+	case CmdDeanonymize:
+		*decrypt = true
+	case CmdVerify:
+		*diff = true
+	case CmdSelfTest:
+		*selftest = true
+	case CmdBench:
+		benchMode = true
+	case CmdServe:
+		serveMode = true
+	}
+	flag.Parse()
+	if err := checkLogFormat(); err != nil {
+		exitf("%s", err)
+	}
+	if err := parseFCSMethod(); err != nil {
+		exitf("%s", err)
+	}
+	if err := parseWLANTypes(); err != nil {
+		exitf("%s", err)
+	}
+	if err := parsePortMap(); err != nil {
+		exitf("%s", err)
+	}
+	enableUSB()
+	stopProfile = startProfile()
+	defer stopProfile()
+
+	if extcapQuery(os.Stdout) {
+		return
+	}
+
+	if *selftest {
+		if f := runSelfTest(os.Stdout); f > 0 {
+			exitf("self test failed (%d failures)", f)
+		}
+		println("self test passed")
+		return
+	}
+
+	if benchMode {
+		if err := runBench(os.Stdout); err != nil {
+			exitf("%s", err)
+		}
+		return
+	}
+
+	if *diff {
+		if flag.NArg() != 2 {
+			exitf("usage: wanonpcap verify original.pcap anonymized.pcap")
+		}
+		var pad *Padder
+		if *padTo != "" {
+			var err error
+			if pad, err = ParsePadder(*padTo); err != nil {
+				exitf("%s", err)
+			}
+		}
+		s, err := runDiff(flag.Arg(0), flag.Arg(1), pad, os.Stdout)
+		if err != nil {
+			exitf("%s", err)
+		}
+		printf("compared %d packets, dropped %d, %d fields changed, "+
+			"%d unchanged, %d unexpected changes", s.Packets, s.Dropped,
+			s.Changed, s.Unchanged, s.Unexpected)
+		if s.Retries != nil {
+			printf("%d duplicate relationships broken", s.Retries.Broken)
+			if err := s.Retries.Write(os.Stdout); err != nil {
+				exitf("%s", err)
+			}
+		}
+		if s.Unexpected > 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	cm, err := parseCommentMode(*commentStr)
+	if err != nil {
+		exitf("%s", err)
+	}
+	la, err := parseLeakAction(*leakScanStr)
+	if err != nil {
+		exitf("%s", err)
+	}
+	if err := checkFlags(cmd, cm, la); err != nil {
+		exitf("%s", err)
+	}
+	listenTLS, err := listenTLSConfig()
+	if err != nil {
+		exitf("%s", err)
+	}
+
+	if cmd == CmdStats {
+		if err := runStats(os.Stdin, os.Stdout); err != nil {
+			exitf("%s", err)
+		}
+		return
+	}
+
+	var p Policy
+	opts := []policyOption{
+		{"mac-oui", *macOUIStr},
+		{"mac-nic", *macNICStr},
+		{"ipv4", *ipv4Str},
+		{"ipv6", *ipv6Str},
+		{"ipv4-src", *ipv4SrcStr},
+		{"ipv4-dst", *ipv4DstStr},
+		{"ipv6-src", *ipv6SrcStr},
+		{"ipv6-dst", *ipv6DstStr},
+		{"vlan", *vlanStr},
+		{"seq", *seqStr},
+		{"can-id", *canIDStr},
+		{"zero-can-data", fmt.Sprint(*zeroCANData)},
+		{"port", *portStr},
+		{"name", *nameStr},
+		{"id", *idStr},
+		{"zero-timestamps", fmt.Sprint(*zeroTimestamps)},
+		{"beacon-timestamps", *beaconTimestampsStr},
+		{"zero-country", fmt.Sprint(*zeroCountry)},
+		{"zero-vendor", fmt.Sprint(*zeroVendor)},
+		{"zero-vendor-ouis", *zeroVendorOUIs},
+		{"decrypt", fmt.Sprint(*decrypt)},
+	}
+	if *importPolicyPath != "" {
+		// imported options replace the defaults, and flags given override them
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		imp, notes, err := loadImportPolicy(*importPolicyPath)
+		if err != nil {
+			exitf("%s: %s", *importPolicyPath, err)
+		}
+		for _, n := range notes {
+			printf("policy import: %s", n)
+		}
+		for _, o := range opts {
+			if given[o.name] {
+				imp = append(imp, o)
+			}
+		}
+		opts = append(opts, imp...)
+	}
+	for _, o := range opts {
+		if o.value == "" {
+			continue
+		}
+		if err := p.Set(o.name, o.value); err != nil {
+			exitf("%s", err)
+		}
+	}
+	if *importPolicyPath != "" {
+		printf("policy: %s", p)
+	}
+
+	// init key
+	uk, err := unwrapKeyFlags()
+	if err != nil {
+		exitf("%s", err)
+	}
+	if uk != nil {
+		if *keyStr != "" {
+			exitf("-key may not be used with a wrapped key")
+		}
+		*keyStr = string(uk)
+	}
+	if err := checkDeterministic(*keyStr); err != nil {
+		exitf("%s", err)
+	}
+	if *keyStr == "" {
+		b := make([]byte, KeyLen*8)
+		k := make([]byte, KeyLen)
+
+		for bi, ki := len(b), 0; ki < KeyLen; bi++ {
+			if bi >= len(b) {
+				_, err := rand.Read(b)
+				if err != nil {
+					exitf("%s", err)
+				}
+				bi = 0
+			}
+			if (b[bi] >= 0x30 && b[bi] <= 0x39) || (b[bi] >= 0x41 && b[bi] <= 0x5a) ||
+				(b[bi] >= 0x61 && b[bi] <= 0x7a) {
+				k[ki] = b[bi]
+				ki++
+			}
+		}
+		*keyStr = string(k)
+		printf("auto-generated key: %s", *keyStr)
+	}
+
+	key := deriveKey(*keyStr)
+	fp := keyFingerprint(key)
+	printf("key fingerprint: %s", fp)
+	if *expectFP != "" && !strings.EqualFold(*expectFP, fp) {
+		exitf("key fingerprint mismatch: expected %s, got %s", *expectFP, fp)
+	}
+
+	mapKey := key
+	if *mapKeyStr != "" {
+		mapKey = deriveKey(*mapKeyStr)
+	}
+	if cmd == CmdMapLookup || cmd == CmdMapRLookup {
+		recs, err := readLookupMaps(flag.Arg(0), key, mapKey, *unsignedMaps)
+		if err != nil {
+			exitf("%s: %s", flag.Arg(0), err)
+		}
+		if err = lookup(os.Stdout, recs, flag.Args()[1:],
+			cmd == CmdMapRLookup); err != nil {
+			exitf("%s", err)
+		}
+		return
+	}
+	if cmd == CmdMapPrune || cmd == CmdMapMerge {
+		out, err := OpenOutput(*outStr, 0600)
+		if err != nil {
+			exitf("%s", err)
+		}
+		if err = runMapTool(cmd, flag.Args(), out, mapKey,
+			*unsignedMaps); err != nil {
+			exitf("%s", err)
+		}
+		return
+	}
+
+	// per-class keys, which may be given explicitly, derived as subkeys, or
+	// default to the single key stream
+	keys := &Keys{Main: key}
+	for _, c := range []struct {
+		class string
+		pass  string
+		key   *[]byte
+	}{
+		{"mac", *macKeyStr, &keys.MAC},
+		{"ipv4", *ipv4KeyStr, &keys.IPv4},
+		{"ipv6", *ipv6KeyStr, &keys.IPv6},
+		{"vlan", *vlanKeyStr, &keys.VLAN},
+	} {
+		if c.pass == "" && *subkeys {
+			c.pass = deriveSubkey(key, c.class)
+			if *showSubkeys {
+				printf("%s subkey: %s", c.class, c.pass)
+			}
+		}
+		if c.pass == "" {
+			continue
+		}
+		*c.key = deriveKey(c.pass)
+		printf("%s key fingerprint: %s", c.class, keyFingerprint(*c.key))
+	}
+
+	cfg := &Config{
+		Truncate:       !*noTruncate,
+		DropUnknown:    *dropUnknown,
+		MaxErrors:      *maxErrors,
+		RewriteOrigLen: *rewriteOrigLen,
+		OnlyModified:   *onlyModified,
+		PcapNG:         *pcapng,
+		CommentMode:    cm,
+		StripMetadata:  *stripMetadata,
+		AsyncWrite:     !*syncWrite,
+		ERF:            *erfFormat,
+	}
+	cfg.Comment = profileComment(p, cfg, fp)
+	if *embeddedStr != "none" {
+		ea, err := parseEmbeddedAction(*embeddedStr)
+		if err != nil {
+			exitf("%s", err)
+		}
+		if !*noTruncate {
+			exitf("-embedded-captures requires -no-truncate")
+		}
+		cfg.Embedded = NewEmbeddedScanner(ea)
+	}
+	if *strictFlag {
+		sa, err := parseStrictAction(*strictActionStr)
+		if err != nil {
+			exitf("%s", err)
+		}
+		cfg.Strict = NewValidator(sa)
+	}
+	if *dedupFlag {
+		cfg.Dedup = NewDeduplicator(*dedupWindow)
+	}
+	if cfg.Limiter, err = NewLimiter(*rateLimitStr, *maxCPU); err != nil {
+		exitf("%s", err)
+	}
+	if *padTo != "" {
+		if cfg.ERF {
+			exitf("-pad-to may not be used with -erf")
+		}
+		if cfg.Padding, err = ParsePadder(*padTo); err != nil {
+			exitf("%s", err)
+		}
+	}
+	if cfg.Flows, err = flowFilterFlags(); err != nil {
+		exitf("%s", err)
+	}
+	if *metricsAddr != "" {
+		cfg.Metrics = &Metrics{}
+		l, err := listen("metrics", *metricsAddr, false)
+		if err != nil {
+			exitf("%s", err)
+		}
+		go func() {
+			printf("serving metrics on %s", l.Addr())
+			if err := http.Serve(l, cfg.Metrics); err != nil {
+				errorf("metrics server error: %s", err)
+			}
+		}()
+	}
+	cfg.MapKey = mapKey
+	for _, srv := range Servers {
+		ok, err := srv(p, keys, cfg)
+		if err != nil {
+			exitf("%s", err)
+		}
+		if ok {
+			return
+		}
+	}
+
+	streams, err := keys.Streams()
+	if err != nil {
+		exitf("%s", err)
+	}
+	a := NewDefaultAnonymizer(p, streams)
+	var store PseudonymStore
+	if *pseudonymStoreURL != "" {
+		if store, err = openPseudonymStore(*pseudonymStoreURL); err != nil {
+			exitf("%s", err)
+		}
+		a.SetStore(store)
+	}
+	if *geoIPFile != "" {
+		var g *GeoMapper
+		if g, err = openGeoMapper(*geoIPFile); err != nil {
+			exitf("%s", err)
+		}
+		a.SetAddressMapper(g)
+	}
+	if *ouiFile != "" || *ouiCategories != "" {
+		if *ouiFile == "" || *ouiCategories == "" {
+			exitf("-oui-file and -oui-categories must be used together")
+		}
+		ob, err := openOUIBuckets(*ouiFile, *ouiCategories)
+		if err != nil {
+			exitf("%s", err)
+		}
+		printf("read %d OUI categories", ob.Categories())
+		a.SetOUIMapper(ob)
+	}
+	if *preservePrefixLen > 0 || *preservePrefixLen6 > 0 {
+		a.SetAddressMapper(NewPrefixMapper(*preservePrefixLen,
+			*preservePrefixLen6))
+	}
+	if *timeBase != "" {
+		if cfg.ERF {
+			exitf("-time-base may not be used with -erf")
+		}
+		if cfg.TimeShift, err = ParseTimeShift(*timeBase); err != nil {
+			exitf("%s", err)
+		}
+		a.SetTimeShift(cfg.TimeShift)
+	}
+	if *keyRotate != 0 {
+		if cfg.KeyRotation, err = NewKeyRotator(a, keys,
+			*keyRotate); err != nil {
+			exitf("%s", err)
+		}
+	}
+	if cmd == CmdMapImport {
+		var mf *os.File
+		if mf, err = os.Open(flag.Arg(0)); err != nil {
+			exitf("%s", err)
+		}
+		err = a.ReadSignedMaps(mf, mapKey, *unsignedMaps)
+		mf.Close()
+		if err != nil {
+			exitf("%s", err)
+		}
+		printf("imported %d pseudonyms", a.Pseudonyms())
+	}
+	if *stateFile != "" {
+		loaded, err := loadStateFile(a, *stateFile, key)
+		if err != nil {
+			exitf("%s", err)
+		}
+		if loaded {
+			printf("loaded state with %d pseudonyms", a.Pseudonyms())
+		}
+	}
+
+	if *interfacePoliciesPath != "" {
+		if cfg.InterfacePolicies, err = loadInterfacePolicies(
+			*interfacePoliciesPath, a); err != nil {
+			exitf("%s", err)
+		}
+	}
+
+	var anon Anonymizer = a
+	var auditFile *fileOutput
+	var auditW *bufio.Writer
+	if *auditLog != "" {
+		if auditFile, err = createFile(*auditLog, false, 0666); err != nil {
+			exitf("%s", err)
+		}
+		auditW = bufio.NewWriter(auditFile)
+		if cfg.Audit, err = NewAuditAnonymizer(a, auditW); err != nil {
+			exitf("%s", err)
+		}
+		anon = cfg.Audit
+	}
+	if *dryRun && cfg.Audit == nil {
+		// the audit totals are the dry run's report
+		cfg.Audit, _ = NewAuditAnonymizer(a, ioutil.Discard)
+		anon = cfg.Audit
+	}
+	if la != LeakNone {
+		cfg.LeakScan = NewLeakScanner(anon, la)
+		anon = cfg.LeakScan
+	}
+	var asReport *ASReport
+	var asReportFile *fileOutput
+	if *asReportPath != "" {
+		var rt *RoutingTable
+		if rt, err = loadRoutingTable(*routesPath); err != nil {
+			exitf("%s", err)
+		}
+		if asReportFile, err = createFile(*asReportPath, false,
+			0666); err != nil {
+			exitf("%s", err)
+		}
+		asReport = NewASReport(anon, rt)
+		anon = asReport
+	}
+	var flowsFile *fileOutput
+	if *flowsOut != "" {
+		if flowsFile, err = createFile(*flowsOut, false, 0666); err != nil {
+			exitf("%s", err)
+		}
+		cfg.FlowLog = NewFlowLog(anon, a)
+		anon = cfg.FlowLog
+	}
+	if *tcpReassembly {
+		cfg.Reassembly = NewTCPReassembly(anon, a, *tcpReassemblyMax)
+		anon = cfg.Reassembly
+	}
+	if *mapRoles {
+		// handlers only give roles to the outermost anonymizer
+		cfg.MapRoles = NewMapRoles(anon)
+		anon = cfg.MapRoles
+	}
+	var rewriteMap *TCPRewriteMap
+	if *mapFormat == "tcprewrite" {
+		rewriteMap = NewTCPRewriteMap(anon)
+		anon = rewriteMap
+	}
+	var indexFile *fileOutput
+	var indexW *bufio.Writer
+	if *indexPath != "" {
+		if indexFile, err = createFile(*indexPath, false, 0666); err != nil {
+			exitf("%s", err)
+		}
+		indexW = bufio.NewWriter(indexFile)
+		if cfg.Index, err = NewIndex(indexW); err != nil {
+			exitf("%s", err)
+		}
+	}
+
+	var reportFile *fileOutput
+	if *bssidReportPath != "" {
+		if reportFile, err = createFile(*bssidReportPath, false,
+			0666); err != nil {
+			exitf("%s", err)
+		}
+		cfg.BSSIDReport = NewBSSIDReport()
+	}
+	var stationFile *fileOutput
+	if *stationReportPath != "" {
+		if stationFile, err = createFile(*stationReportPath, false,
+			0666); err != nil {
+			exitf("%s", err)
+		}
+		cfg.StationReport = NewStationReport(cfg.TimeShift)
+	}
+
+	if cmd != CmdMapExport && !*dryRun {
+		if cfg.Rotate, err = NewRotator(*outStr); err != nil {
+			exitf("%s", err)
+		}
+		if cfg.Split, err = NewSplitter(*outStr); err != nil {
+			exitf("%s", err)
+		}
+	}
+	var out Output = stdoutOutput{}
+	inFile := os.Stdin
+	if *inPlace {
+		if inFile, out, err = openInPlace(flag.Arg(0)); err != nil {
+			exitf("%s", err)
+		}
+	} else if *dryRun {
+		out = discardOutput{}
+	} else if *checkpointPath != "" {
+		if cfg.Checkpoint, err = NewCheckpointer(*checkpointPath,
+			*checkpointInterval, a, key, *outStr); err != nil {
+			exitf("%s", err)
+		}
+		if cfg.Checkpoint.Resumed {
+			printf("resuming from checkpoint after %d packets",
+				cfg.Checkpoint.stats.Packets)
+		}
+		out = cfg.Checkpoint.Output()
+	} else if cfg.Rotate == nil && cfg.Split == nil {
+		// mappings reveal the originals, so only the owner may read them
+		perm := os.FileMode(0666)
+		if cmd == CmdMapExport {
+			perm = 0600
+		}
+		if out, err = OpenOutput(*outStr, perm); err != nil {
+			exitf("%s", err)
+		}
+	}
+	var mergeFiles []*os.File
+	if cmd == CmdMerge {
+		var readers []*PcapReader
+		for _, path := range flag.Args() {
+			var f *os.File
+			if f, err = os.Open(path); err != nil {
+				exitf("%s", err)
+			}
+			mergeFiles = append(mergeFiles, f)
+			var r *PcapReader
+			if r, err = NewCaptureReader(bufio.NewReader(f)); err != nil {
+				exitf("%s: %s", path, err)
+			}
+			readers = append(readers, r)
+		}
+		if cfg.Input, err = NewMergeReader(readers); err != nil {
+			exitf("%s", err)
+		}
+	}
+	var in io.Reader = inFile
+	var unmap func() error
+	var conn net.Conn
+	var remote *RemoteCapture
+	if *remoteHost != "" {
+		if remote, err = StartRemoteCapture(*remoteHost, *remoteInterface,
+			*remoteFilter); err != nil {
+			exitf("%s", err)
+		}
+		in = remote
+	} else if *listenAddr != "" {
+		if conn, err = acceptInput(*listenAddr, listenTLS); err != nil {
+			exitf("%s", err)
+		}
+		in = conn
+	} else if cmd != CmdMerge {
+		var mr io.Reader
+		if mr, unmap, err = mapFile(inFile); err != nil {
+			exitf("%s", err)
+		}
+		if mr != nil {
+			in = mr
+		}
+		if cfg.Progress, err = NewProgress(inFile); err != nil {
+			exitf("%s", err)
+		}
+	}
+	if cfg.Progress != nil {
+		cfg.Progress.Start()
+	}
+	// map export discards the capture, and writes the mappings to the output
+	var capOut io.Writer = out
+	if cmd == CmdMapExport {
+		capOut = discardOutput{}
+	}
+	rs, err := run(context.Background(), in, capOut, anon, cfg)
+	n, d := rs.Packets, rs.Dropped
+	if cmd == CmdMapExport && err == io.EOF {
+		var werr error
+		if rewriteMap != nil {
+			if werr = rewriteMap.Write(out); werr == nil &&
+				rewriteMap.Inconsistent > 0 {
+				printf("omitted %d values without a consistent mapping",
+					rewriteMap.Inconsistent)
+			}
+		} else {
+			werr = a.WriteSignedMaps(out, mapKey, cfg.MapRoles)
+		}
+		if werr != nil {
+			err = werr
+		}
+	}
+	if store != nil {
+		if cerr := store.Close(); cerr != nil && (err == nil || err == io.EOF) {
+			err = cerr
+		}
+	}
+	if cfg.Progress != nil {
+		cfg.Progress.Stop()
+	}
+	if unmap != nil {
+		unmap()
+	}
+	for _, f := range mergeFiles {
+		f.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if remote != nil {
+		// a capture that ends on its own is complete only if it ended cleanly
+		if rerr := remote.Close(err != io.EOF); rerr != nil {
+			err = rerr
+		}
+	}
+	if *inPlace && !*shred {
+		// closed before it's replaced, as Windows can't replace open files
+		inFile.Close()
+	}
+	if cfg.Rotate != nil {
+		if err != nil && err != io.EOF {
+			cfg.Rotate.Abort()
+		} else if cerr := cfg.Rotate.Close(); cerr != nil {
+			err = cerr
+		}
+	} else if cfg.Split != nil {
+		if err != nil && err != io.EOF {
+			cfg.Split.Abort()
+		} else if cerr := cfg.Split.Close(); cerr != nil {
+			err = cerr
+		}
+	} else if err != nil && err != io.EOF {
+		out.Abort()
+	} else if cerr := out.Close(); cerr != nil {
+		err = cerr
+	} else if *shred {
+		// the original is replaced, but its blocks remain through inFile
+		if serr := shredFile(inFile); serr != nil {
+			err = fmt.Errorf("output written, but shredding original failed: %s",
+				serr)
+		}
+	}
+	if *shred {
+		inFile.Close()
+	}
+	if auditW != nil {
+		if err != nil && err != io.EOF {
+			auditFile.Abort()
+		} else if ferr := auditW.Flush(); ferr != nil {
+			errorf("error writing audit log: %s", ferr)
+			auditFile.Abort()
+		} else if ferr = auditFile.Close(); ferr != nil {
+			errorf("error writing audit log: %s", ferr)
+		}
+	}
+	if reportFile != nil {
+		if err != nil && err != io.EOF {
+			reportFile.Abort()
+		} else if ferr := cfg.BSSIDReport.Write(reportFile); ferr != nil {
+			errorf("error writing BSSID report: %s", ferr)
+			reportFile.Abort()
+		} else if ferr = reportFile.Close(); ferr != nil {
+			errorf("error writing BSSID report: %s", ferr)
+		}
+	}
+	if stationFile != nil {
+		if err != nil && err != io.EOF {
+			stationFile.Abort()
+		} else if ferr := cfg.StationReport.Write(stationFile); ferr != nil {
+			errorf("error writing station report: %s", ferr)
+			stationFile.Abort()
+		} else if ferr = stationFile.Close(); ferr != nil {
+			errorf("error writing station report: %s", ferr)
+		}
+	}
+	if asReportFile != nil {
+		if err != nil && err != io.EOF {
+			asReportFile.Abort()
+		} else if ferr := asReport.Write(asReportFile); ferr != nil {
+			errorf("error writing AS report: %s", ferr)
+			asReportFile.Abort()
+		} else if ferr = asReportFile.Close(); ferr != nil {
+			errorf("error writing AS report: %s", ferr)
+		}
+	}
+	if indexW != nil {
+		if err != nil && err != io.EOF {
+			indexFile.Abort()
+		} else if ferr := indexW.Flush(); ferr != nil {
+			errorf("error writing index: %s", ferr)
+			indexFile.Abort()
+		} else if ferr = indexFile.Close(); ferr != nil {
+			errorf("error writing index: %s", ferr)
+		}
+	}
+	if flowsFile != nil {
+		if err != nil && err != io.EOF {
+			flowsFile.Abort()
+		} else if ferr := cfg.FlowLog.Write(flowsFile,
+			*flowsFormat); ferr != nil {
+			errorf("error writing flows: %s", ferr)
+			flowsFile.Abort()
+		} else if ferr = flowsFile.Close(); ferr != nil {
+			errorf("error writing flows: %s", ferr)
+		}
+	}
+	if cfg.Checkpoint != nil && (err == nil || err == io.EOF) {
+		if cerr := cfg.Checkpoint.Remove(); cerr != nil {
+			err = fmt.Errorf("error removing checkpoint: %s", cerr)
+		}
+	}
+	if *stateFile != "" && !*dryRun && (err == nil || err == io.EOF) {
+		if serr := saveStateFile(a, *stateFile, key); serr != nil {
+			err = fmt.Errorf("error saving state: %s", serr)
+		}
+	}
 	if err != nil && err != io.EOF {
-		printf("error after %d packets: %s", n, err)
-		os.Exit(1)
+		exitf("error after %d packets: %s", n, err)
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d packets, %d unknown structure, "+
+			"%d would be dropped\n", n, rs.Unknown, d)
+		if err = cfg.Audit.WriteTotals(os.Stdout); err != nil {
+			exitf("%s", err)
+		}
+		for _, p := range unsupportedProtocols(rs.Unsupported) {
+			fmt.Printf("unsupported %s: %d packets\n", p, rs.Unsupported[p])
+		}
+	} else {
+		v := "truncated"
+		if cfg.DropUnknown {
+			v = "dropped"
+		}
+		for _, p := range unsupportedProtocols(rs.Unsupported) {
+			printf("%s unsupported %s in %d packets", v, p,
+				rs.Unsupported[p])
+		}
+	}
+	if rs.Filtered > 0 {
+		printf("filtered %d packets by type", rs.Filtered)
+	}
+	if cfg.LeakScan != nil && cfg.LeakScan.Found > 0 {
+		printf("found %d possible unanonymized addresses",
+			cfg.LeakScan.Found)
+	}
+	if asReport != nil {
+		printf("reported origin ASes of %d addresses, %d without a route",
+			asReport.Addresses(), asReport.NoRoute)
+	}
+	if cfg.FlowLog != nil {
+		printf("logged %d flows", cfg.FlowLog.Flows())
+	}
+	if cfg.Reassembly != nil {
+		printf("rewrote %d messages in TCP streams, abandoned %d streams",
+			cfg.Reassembly.Rewritten, cfg.Reassembly.Abandoned)
+	}
+	if cfg.Split != nil {
+		printf("split output into %d files", cfg.Split.Groups())
+	}
+	if e := cfg.Embedded; e != nil && e.Found > 0 {
+		if e.Action == EmbeddedDrop {
+			printf("found %d embedded captures, dropped %d packets", e.Found,
+				e.Dropped)
+		} else {
+			printf("found and anonymized %d embedded captures, zeroed %d "+
+				"continuing packets", e.Found, e.Continued)
+		}
+	}
+	if cfg.Strict != nil && cfg.Strict.Invalid > 0 {
+		if cfg.Strict.Action == StrictDrop {
+			printf("dropped %d inconsistent packets", cfg.Strict.Invalid)
+		} else {
+			printf("found %d inconsistent packets", cfg.Strict.Invalid)
+		}
+	}
+	if cfg.Limiter != nil && cfg.Limiter.Dropped > 0 {
+		printf("dropped %d packets beyond the rate limit or CPU budget",
+			cfg.Limiter.Dropped)
+	}
+	if rs.Duplicates > 0 {
+		printf("dropped %d duplicate packets", rs.Duplicates)
+	}
+	if cfg.Flows != nil {
+		printf("dropped %d packets of other flows", rs.OtherFlows)
+	}
+	if rs.Unmodified > 0 {
+		printf("omitted %d unmodified packets", rs.Unmodified)
+	}
+	if rs.Errors > 0 {
+		printf("dropped %d packets with errors", rs.Errors)
 	}
-	printf("processed %d packets", n)
+	as := rs.Anonymizer
+	printf("handled %d MAC, %d IPv4 and %d IPv6 addresses and %d VLAN IDs, "+
+		"with %d fields changed and %d pseudonyms", as.MACs, as.IPv4s,
+		as.IPv6s, as.VLANs, as.Changed, a.Pseudonyms())
+	printf("processed %d packets, dropped %d unknown, key fingerprint %s", n,
+		d, fp)
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pruneSince = flag.String("since", "",
+	"with map prune, the date (e.g. 2024-01-01) or RFC 3339 time before "+
+		"which mappings last seen are removed")
+
+// mapRecord is a record of exported maps.
+type mapRecord struct {
+	class  string
+	orig   string
+	pseudo string
+
+	// roles, first, last and seen are the fields added by MapRoles, if
+	// extended is true. first and last are 0, and seen is zero, if the
+	// value wasn't seen.
+	extended bool
+	roles    []string
+	first    uint64
+	last     uint64
+	seen     time.Time
+}
+
+// key returns the class and original value of the record.
+func (r *mapRecord) key() string {
+	return r.class + "," + r.orig
+}
+
+// String returns the record as CSV.
+func (r *mapRecord) String() string {
+	s := r.class + "," + r.orig + "," + r.pseudo
+	if !r.extended {
+		return s
+	}
+	if r.last == 0 {
+		return s + "," + strings.Join(r.roles, " ") + ",,,"
+	}
+	var seen string
+	if !r.seen.IsZero() {
+		seen = r.seen.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s,%s,%d,%d,%s", s, strings.Join(r.roles, " "),
+		r.first, r.last, seen)
+}
+
+// parseMapRecord parses a record of exported maps. Records with the fields
+// added by MapRoles before the seen time was recorded have no seen time.
+func parseMapRecord(rec string) (r mapRecord, err error) {
+	f := strings.Split(rec, ",")
+	if len(f) != 3 && len(f) != 6 && len(f) != 7 {
+		err = fmt.Errorf("expected 3 fields: %s", rec)
+		return
+	}
+	r.class, r.orig, r.pseudo = f[0], f[1], f[2]
+	if len(f) == 3 {
+		return
+	}
+	r.extended = true
+	if f[3] != "" {
+		r.roles = strings.Split(f[3], " ")
+	}
+	if f[4] != "" {
+		if r.first, err = strconv.ParseUint(f[4], 10, 64); err != nil {
+			return
+		}
+	}
+	if f[5] != "" {
+		if r.last, err = strconv.ParseUint(f[5], 10, 64); err != nil {
+			return
+		}
+	}
+	if len(f) == 7 && f[6] != "" {
+		r.seen, err = time.Parse(time.RFC3339, f[6])
+	}
+	return
+}
+
+// readMapRecords reads the records of maps written by WriteSignedMaps,
+// verifying their HMAC with key, unless they have none and unsigned is
+// true.
+func readMapRecords(r io.Reader, key []byte, unsigned bool) (
+	recs []mapRecord, err error) {
+	var b []byte
+	if b, err = readSignedMaps(r, key, unsigned); err != nil {
+		return
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || line == 1 && strings.HasPrefix(t, mapsHeader) {
+			continue
+		}
+		var rec mapRecord
+		if rec, err = parseMapRecord(t); err != nil {
+			err = fmt.Errorf("map line %d: %s", line, err)
+			return
+		}
+		recs = append(recs, rec)
+	}
+	err = sc.Err()
+	return
+}
+
+// writeMapRecords writes records as exported maps, followed by their HMAC
+// using key. The fields added by MapRoles are written if any record has
+// them.
+func writeMapRecords(w io.Writer, recs []mapRecord, key []byte) error {
+	ext := false
+	for _, r := range recs {
+		ext = ext || r.extended
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].String() < recs[j].String()
+	})
+	var b bytes.Buffer
+	if ext {
+		fmt.Fprintln(&b, mapsHeader+mapsRolesHeader)
+	} else {
+		fmt.Fprintln(&b, mapsHeader)
+	}
+	for _, r := range recs {
+		r.extended = ext
+		fmt.Fprintln(&b, r.String())
+	}
+	return writeSignedMaps(w, b.Bytes(), key)
+}
+
+// pruneMaps removes the records last seen before since. Records without a
+// seen time, such as those exported without -map-roles, are kept, as it's
+// not known when they were last seen.
+func pruneMaps(recs []mapRecord, since time.Time) (kept []mapRecord,
+	pruned, undated int) {
+	for _, r := range recs {
+		switch {
+		case r.seen.IsZero():
+			undated++
+		case r.seen.Before(since):
+			pruned++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return
+}
+
+// uniquePseudonyms returns true if the pseudonyms of class must be unique,
+// which is all but the per-transmitter offsets and bases.
+func uniquePseudonyms(class string) bool {
+	return class != "seq" && class != "beacon-ts"
+}
+
+// mergeMaps combines the records of maps from several runs, so the same
+// original gets one pseudonym, and each pseudonym stays unique in its class.
+// Conflicts, where runs gave an original different pseudonyms, are resolved
+// the same regardless of the order of the maps: originals are taken in
+// sorted order, and each gets its pseudonym seen most recently, or the least
+// of those seen at the same time, that no earlier original got. Originals
+// for which none remain are dropped, so they get new pseudonyms when the
+// maps are imported. The records of the pseudonym chosen are combined, with
+// the union of their roles, the least first packet and the greatest last
+// packet and seen time.
+func mergeMaps(sets [][]mapRecord) (recs []mapRecord, conflicts,
+	dropped int) {
+	cands := make(map[string]map[string]*mapRecord)
+	for _, set := range sets {
+		for _, r := range set {
+			k := r.key()
+			if cands[k] == nil {
+				cands[k] = make(map[string]*mapRecord)
+			}
+			c, ok := cands[k][r.pseudo]
+			if !ok {
+				rc := r
+				cands[k][r.pseudo] = &rc
+				continue
+			}
+			combineMapRecords(c, &r)
+		}
+	}
+	keys := make([]string, 0, len(cands))
+	for k := range cands {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	used := make(map[string]bool)
+	for _, k := range keys {
+		var cs []*mapRecord
+		for _, c := range cands[k] {
+			cs = append(cs, c)
+		}
+		sort.Slice(cs, func(i, j int) bool {
+			if !cs[i].seen.Equal(cs[j].seen) {
+				return cs[i].seen.After(cs[j].seen)
+			}
+			return cs[i].pseudo < cs[j].pseudo
+		})
+		if len(cs) > 1 {
+			conflicts++
+		}
+		var r *mapRecord
+		for _, c := range cs {
+			u := c.class + "," + c.pseudo
+			if !uniquePseudonyms(c.class) || !used[u] {
+				used[u] = true
+				r = c
+				break
+			}
+		}
+		if r == nil {
+			dropped++
+			continue
+		}
+		recs = append(recs, *r)
+	}
+	return
+}
+
+// combineMapRecords combines record o, with the same original and
+// pseudonym, into r.
+func combineMapRecords(r, o *mapRecord) {
+	r.extended = r.extended || o.extended
+	roles := make(map[string]bool)
+	for _, s := range append(r.roles, o.roles...) {
+		roles[s] = true
+	}
+	r.roles = r.roles[:0]
+	for s := range roles {
+		r.roles = append(r.roles, s)
+	}
+	sort.Strings(r.roles)
+	if o.first != 0 && (r.first == 0 || o.first < r.first) {
+		r.first = o.first
+	}
+	if o.last > r.last {
+		r.last = o.last
+	}
+	if o.seen.After(r.seen) {
+		r.seen = o.seen
+	}
+}
+
+// parseSince parses the time given with -since, a date or RFC 3339 time.
+func parseSince(s string) (t time.Time, err error) {
+	if t, err = time.Parse("2006-01-02", s); err == nil {
+		return
+	}
+	if t, err = time.Parse(time.RFC3339, s); err != nil {
+		err = fmt.Errorf("invalid time for -since: %s", s)
+	}
+	return
+}
+
+// runMapTool runs map prune or merge, reading maps from stdin or the files in
+// args, and writing the result to out, with maps authenticated by key.
+func runMapTool(cmd Command, args []string, out Output, key []byte,
+	unsigned bool) (err error) {
+	defer func() {
+		if err != nil {
+			out.Abort()
+		}
+	}()
+	var recs []mapRecord
+	switch cmd {
+	case CmdMapPrune:
+		var since time.Time
+		if since, err = parseSince(*pruneSince); err != nil {
+			return
+		}
+		if recs, err = readMapRecords(os.Stdin, key, unsigned); err != nil {
+			return
+		}
+		var pruned, undated int
+		recs, pruned, undated = pruneMaps(recs, since)
+		printf("pruned %d mappings, kept %d, %d without a seen time", pruned,
+			len(recs), undated)
+	case CmdMapMerge:
+		var sets [][]mapRecord
+		for _, path := range args {
+			var f *os.File
+			if f, err = os.Open(path); err != nil {
+				return
+			}
+			var rs []mapRecord
+			rs, err = readMapRecords(f, key, unsigned)
+			f.Close()
+			if err != nil {
+				err = fmt.Errorf("%s: %s", path, err)
+				return
+			}
+			sets = append(sets, rs)
+		}
+		var conflicts, dropped int
+		recs, conflicts, dropped = mergeMaps(sets)
+		printf("merged %d mappings, %d conflicts, dropped %d", len(recs),
+			conflicts, dropped)
+	}
+	if err = writeMapRecords(out, recs, key); err != nil {
+		return
+	}
+	return out.Close()
+}
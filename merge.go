@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// mergeInput is an input of a merge, with its next packet.
+type mergeInput struct {
+	r     *PcapReader
+	ph    PacketHeader
+	b     []byte
+	iface *Interface
+	ts    uint64
+	dir   Direction
+	eof   bool
+}
+
+// next reads the input's next packet.
+func (m *mergeInput) next() (err error) {
+	if m.ph, m.b, err = m.r.ReadPacket(); err == io.EOF {
+		m.eof = true
+		err = nil
+	}
+	m.iface, m.ts, m.dir = m.r.iface, m.r.ts, m.r.dir
+	return
+}
+
+// before reports if the input's next packet is earlier than that of n.
+func (m *mergeInput) before(n *mergeInput) bool {
+	if m.ph.TimestampSec != n.ph.TimestampSec {
+		return m.ph.TimestampSec < n.ph.TimestampSec
+	}
+	return m.ph.TimestampUsec < n.ph.TimestampUsec
+}
+
+// NewMergeReader returns a reader that merges the packets of the given
+// readers in chronological order, like mergecap, so captures from several
+// vantage points may be anonymized as one, sharing pseudonyms. Packets with
+// the same timestamp are read in the order of the readers. All inputs must
+// have the same link type. The header is that of the first input, with the
+// largest snaplen, and the interfaces of pcapng inputs are kept, so pcapng
+// output has those of all inputs.
+func NewMergeReader(readers []*PcapReader) (p *PcapReader, err error) {
+	if len(readers) == 0 {
+		err = fmt.Errorf("no captures to merge")
+		return
+	}
+	f := readers[0]
+	p = &PcapReader{
+		order:  f.order,
+		magic:  f.magic,
+		header: f.header,
+		iface:  f.iface,
+	}
+	var ins []*mergeInput
+	for _, r := range readers {
+		if r.header.LinkLayer != f.header.LinkLayer {
+			err = fmt.Errorf("captures with different link types (%d and %d) "+
+				"can't be merged", f.header.LinkLayer, r.header.LinkLayer)
+			return
+		}
+		if r.header.Snaplen > p.header.Snaplen {
+			p.header.Snaplen = r.header.Snaplen
+		}
+		ins = append(ins, &mergeInput{r: r})
+	}
+	var last *mergeInput
+	for _, in := range ins {
+		if err = in.next(); err != nil {
+			return
+		}
+	}
+	p.read = func() (ph PacketHeader, b []byte, err error) {
+		if last != nil {
+			if err = last.next(); err != nil {
+				return
+			}
+		}
+		last = nil
+		for _, in := range ins {
+			if !in.eof && (last == nil || in.before(last)) {
+				last = in
+			}
+		}
+		if last == nil {
+			err = io.EOF
+			return
+		}
+		p.iface, p.ts, p.dir = last.iface, last.ts, last.dir
+		return last.ph, last.b, nil
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+var metricsAddr = flag.String("metrics-addr", "",
+	"address to serve Prometheus metrics on (http://addr/metrics)")
+
+// Metrics are counters for long-running modes, served in the Prometheus text
+// format. They may be shared by concurrent runs.
+type Metrics struct {
+	packets    uint64
+	bytes      uint64
+	unknowns   uint64
+	drops      uint64
+	pseudonyms uint64
+	errors     uint64
+	jobs       int64
+}
+
+// begin starts a run, returning out wrapped to count bytes written.
+func (m *Metrics) begin(out io.Writer) io.Writer {
+	atomic.AddInt64(&m.jobs, 1)
+	return &countingWriter{out, &m.bytes}
+}
+
+// end ends a run that returned err.
+func (m *Metrics) end(err error) {
+	atomic.AddInt64(&m.jobs, -1)
+	if err != nil && err != io.EOF {
+		atomic.AddUint64(&m.errors, 1)
+	}
+}
+
+// packet records a packet, and the pseudonyms mapped before and after it (a
+// decrease means the mappings were cleared).
+func (m *Metrics) packet(before, after int, dropped bool) {
+	atomic.AddUint64(&m.packets, 1)
+	if dropped {
+		atomic.AddUint64(&m.drops, 1)
+	}
+	if after < before {
+		before = 0
+	}
+	atomic.AddUint64(&m.pseudonyms, uint64(after-before))
+}
+
+// unknown records a packet with unknown structure.
+func (m *Metrics) unknown() {
+	atomic.AddUint64(&m.unknowns, 1)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, x := range []struct {
+		name string
+		typ  string
+		help string
+		v    interface{}
+	}{
+		{"packets_total", "counter", "Packets processed.",
+			atomic.LoadUint64(&m.packets)},
+		{"bytes_written_total", "counter", "Bytes of capture output written.",
+			atomic.LoadUint64(&m.bytes)},
+		{"unknown_packets_total", "counter",
+			"Packets with structure not understood by the handler.",
+			atomic.LoadUint64(&m.unknowns)},
+		{"dropped_packets_total", "counter", "Packets dropped from output.",
+			atomic.LoadUint64(&m.drops)},
+		{"pseudonyms_total", "counter",
+			"Unique addresses and IDs for which pseudonyms were created.",
+			atomic.LoadUint64(&m.pseudonyms)},
+		{"errors_total", "counter", "Runs that ended in an error.",
+			atomic.LoadUint64(&m.errors)},
+		{"jobs_in_progress", "gauge", "Captures currently being processed.",
+			atomic.LoadInt64(&m.jobs)},
+	} {
+		fmt.Fprintf(w, "# HELP wanonpcap_%s %s\n", x.name, x.help)
+		fmt.Fprintf(w, "# TYPE wanonpcap_%s %s\n", x.name, x.typ)
+		fmt.Fprintf(w, "wanonpcap_%s %d\n", x.name, x.v)
+	}
+}
+
+// countingWriter counts the bytes written to a Writer.
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	atomic.AddUint64(c.n, uint64(n))
+	return
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile returns nil, as memory mapping is not supported on this platform.
+func mapFile(f *os.File) (r io.Reader, unmap func() error, err error) {
+	return
+}
@@ -0,0 +1,81 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// MappedReader reads a file memory mapped read-only. Next copies the data
+// into a buffer reused by the next call, so packets may be anonymized in place
+// without modifying the file, and without the mapping's pages becoming
+// private copies, which would grow the resident size to the size of the file.
+type MappedReader struct {
+	b   []byte
+	off int
+	buf []byte
+}
+
+// Read reads from the file.
+func (m *MappedReader) Read(p []byte) (n int, err error) {
+	if m.off == len(m.b) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.b[m.off:])
+	m.off += n
+	return
+}
+
+// Len returns the number of unread bytes.
+func (m *MappedReader) Len() int {
+	return len(m.b) - m.off
+}
+
+// Bytes returns the unread bytes, which must not be modified.
+func (m *MappedReader) Bytes() []byte {
+	return m.b[m.off:]
+}
+
+// Next returns a copy of the next n bytes, or fewer at the end, which is
+// valid until the next call.
+func (m *MappedReader) Next(n int) []byte {
+	if n > m.Len() {
+		n = m.Len()
+	}
+	if cap(m.buf) < n {
+		m.buf = make([]byte, n)
+	}
+	m.buf = m.buf[:n]
+	copy(m.buf, m.b[m.off:])
+	m.off += n
+	return m.buf
+}
+
+// mapFile memory maps f read-only if it's a non-empty regular file, returning
+// a MappedReader for it. It returns nil if not, so the caller falls back to
+// streaming.
+func mapFile(f *os.File) (r io.Reader, unmap func() error, err error) {
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	sz := fi.Size()
+	if !fi.Mode().IsRegular() || sz == 0 || int64(int(sz)) != sz {
+		return
+	}
+	var b []byte
+	if b, err = syscall.Mmap(int(f.Fd()), 0, int(sz), syscall.PROT_READ,
+		syscall.MAP_SHARED); err != nil {
+		// e.g. unsupported by the file system, so stream instead
+		err = nil
+		return
+	}
+	r = &MappedReader{b: b}
+	unmap = func() error {
+		return syscall.Munmap(b)
+	}
+	return
+}
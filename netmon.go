@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// netmonMagic is the magic at the start of NetMon 2.x files.
+var netmonMagic = []byte("GMBU")
+
+// netmonLinkTypes maps NetMon media types to pcap link types.
+var netmonLinkTypes = map[uint16]uint32{
+	1: 1, // Ethernet
+}
+
+// newNetmonReader returns a reader for a Microsoft Network Monitor 2.x file,
+// converting its frames to pcap. The whole file is read first, as the frames
+// are found from a table that's usually at the end.
+func newNetmonReader(r io.Reader) (p *PcapReader, err error) {
+	var f []byte
+	if buf, ok := r.(memReader); ok {
+		f = buf.Next(buf.Len())
+	} else if f, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	if len(f) < 40 {
+		err = fmt.Errorf("short NetMon header")
+		return
+	}
+	le := binary.LittleEndian
+	if f[5] != 2 {
+		err = fmt.Errorf("unsupported NetMon version: %d.%d", f[5], f[4])
+		return
+	}
+	mt := le.Uint16(f[6:])
+	link, ok := netmonLinkTypes[mt]
+	if !ok {
+		err = fmt.Errorf("unsupported NetMon media type: %d", mt)
+		return
+	}
+
+	// capture start, as a Windows SYSTEMTIME in UTC
+	st := func(i int) int { return int(le.Uint16(f[8+2*i:])) }
+	start := time.Date(st(0), time.Month(st(1)), st(3), st(4), st(5), st(6),
+		st(7)*int(time.Millisecond), time.UTC)
+
+	// frame table, of offsets to each frame
+	tOff, tLen := le.Uint32(f[24:]), le.Uint32(f[28:])
+	if uint64(tOff)+uint64(tLen) > uint64(len(f)) || tLen%4 != 0 {
+		err = fmt.Errorf("invalid NetMon frame table")
+		return
+	}
+	table := f[tOff : tOff+tLen]
+
+	p = &PcapReader{
+		r:      r,
+		order:  binary.LittleEndian,
+		magic:  MagicLE,
+		header: GlobalHeader{2, 4, 0, 0, uint32(MaxPacketLen), link},
+	}
+	p.read = func() (ph PacketHeader, b []byte, err error) {
+		if len(table) == 0 {
+			err = io.EOF
+			return
+		}
+		off := uint64(le.Uint32(table))
+		table = table[4:]
+
+		// offset from the start in microseconds, original and captured length
+		if off+16 > uint64(len(f)) {
+			err = fmt.Errorf("invalid NetMon frame offset: %d", off)
+			return
+		}
+		h := f[off : off+16]
+		ts := start.Add(time.Duration(le.Uint64(h)) * time.Microsecond)
+		ph.TimestampSec = uint32(ts.Unix())
+		ph.TimestampUsec = uint32(ts.Nanosecond() / 1000)
+		ph.OrigLen = le.Uint32(h[8:])
+		ph.Len = le.Uint32(h[12:])
+		if ph.Len > MaxPacketLen || off+16+uint64(ph.Len) > uint64(len(f)) {
+			err = fmt.Errorf("invalid NetMon frame length: %d", ph.Len)
+			return
+		}
+		b = f[off+16 : off+16+uint64(ph.Len)]
+		return
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// NFLOG attribute types (linux/netfilter/nfnetlink_log.h)
+const (
+	nfulaPacketHdr       = 1
+	nfulaMark            = 2
+	nfulaTimestamp       = 3
+	nfulaIfindexIndev    = 4
+	nfulaIfindexOutdev   = 5
+	nfulaIfindexPhyIndev = 6
+	nfulaIfindexPhyOut   = 7
+	nfulaHWAddr          = 8
+	nfulaPayload         = 9
+	nfulaPrefix          = 10
+	nfulaUID             = 11
+	nfulaSeq             = 12
+	nfulaSeqGlobal       = 13
+	nfulaGID             = 14
+	nfulaHWType          = 15
+	nfulaHWHeader        = 16
+	nfulaHWLen           = 17
+	nfulaCTInfo          = 19
+)
+
+// nfulaKeep are the NFLOG attributes that are kept as they are.
+var nfulaKeep = map[uint16]bool{
+	nfulaPacketHdr:       true,
+	nfulaMark:            true,
+	nfulaTimestamp:       true,
+	nfulaIfindexIndev:    true,
+	nfulaIfindexOutdev:   true,
+	nfulaIfindexPhyIndev: true,
+	nfulaIfindexPhyOut:   true,
+	nfulaUID:             true,
+	nfulaSeq:             true,
+	nfulaSeqGlobal:       true,
+	nfulaGID:             true,
+	nfulaHWLen:           true,
+	nfulaCTInfo:          true,
+}
+
+// address families of NFLOG payloads
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// arphrdEther is the ARP hardware type for Ethernet.
+const arphrdEther = 1
+
+// nlaTypeMask masks the nested and byte order flags from an attribute type.
+const nlaTypeMask = 0x3fff
+
+// nflogMsgPacket is the netlink message type for an NFLOG packet, from the
+// ULOG subsystem.
+const nflogMsgPacket = 0x0400
+
+// NFLOGHandler anonymizes Linux NFLOG packets.
+type NFLOGHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *NFLOGHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	return handleNFLOG(b, 0, anon)
+}
+
+// NetlinkHandler anonymizes Linux netlink messages, as captured from an nlmon
+// device. Only NFLOG packet messages are understood past the netlink header.
+type NetlinkHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *NetlinkHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 16 {
+		err = fmt.Errorf("short netlink header (increase snaplen)")
+		return
+	}
+	order := hostOrder(b, 16)
+	n = 16
+	if order.Uint16(b[4:]) != nflogMsgPacket {
+		err = ErrUnknown
+		return
+	}
+	return handleNFLOG(b, n, anon)
+}
+
+// hostOrder returns the byte order of a netlink length at the start of b,
+// which is in the capturing host's order, by whether it's valid as little
+// endian, with minimum min.
+func hostOrder(b []byte, min int) binary.ByteOrder {
+	if l := int(binary.LittleEndian.Uint16(b)); l >= min && l <= len(b) {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// handleNFLOG anonymizes the NFLOG header and attributes at offset n in b,
+// returning the offset after the payload's IP header. The MACs in the hardware
+// address and header are anonymized, along with the payload's IP addresses,
+// and the log prefix is scrubbed. It's unknown structure if an attribute
+// isn't understood, such as conntrack information, which has addresses.
+func handleNFLOG(b []byte, n int, anon Anonymizer) (int, error) {
+	if n+4 > len(b) {
+		return n, fmt.Errorf("short NFLOG header (increase snaplen)")
+	}
+	family := b[n]
+	n += 4
+	if n+4 > len(b) {
+		return n, nil
+	}
+	order := hostOrder(b[n:], 4)
+	hwType := -1
+	for n+4 <= len(b) {
+		l := int(order.Uint16(b[n:]))
+		t := order.Uint16(b[n+2:]) & nlaTypeMask
+		if l < 4 {
+			return n, ErrUnknown
+		}
+
+		// the payload may be cut short by the snaplen, and is last
+		if t == nfulaPayload {
+			switch family {
+			case afInet:
+				return handleIPv4(b, n+4, anon)
+			case afInet6:
+				return handleIPv6(b, n+4, anon)
+			}
+			return n + 4, unknownProtocol("address family %d", family)
+		}
+		if n+l > len(b) {
+			return n, fmt.Errorf("short NFLOG attribute at pos %d "+
+				"(increase snaplen)", n)
+		}
+		d := b[n+4 : n+l]
+		switch {
+		case nfulaKeep[t]:
+		case t == nfulaHWType:
+			if len(d) < 2 {
+				return n, ErrUnknown
+			}
+			hwType = int(binary.BigEndian.Uint16(d))
+		case t == nfulaHWAddr:
+			if len(d) < 4 {
+				return n, ErrUnknown
+			}
+			if binary.BigEndian.Uint16(d) == 6 && len(d) >= 10 {
+				anon.MAC(d[4:10])
+			}
+		case t == nfulaHWHeader:
+			if hwType != arphrdEther || len(d) < 12 {
+				return n, ErrUnknown
+			}
+			anon.MAC(d[0:6])
+			anon.MAC(d[6:12])
+		case t == nfulaPrefix:
+			anon.Text(d)
+		default:
+			return n, ErrUnknown
+		}
+		n += (l + 3) &^ 3
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	return n, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ouiFile = flag.String("oui-file", "",
+	"IEEE OUI registry (oui.csv) for MAC OUI pseudonyms from vendors of the "+
+		"same category, with -oui-categories")
+
+var ouiCategories = flag.String("oui-categories", "",
+	"file of vendor categories for -oui-file, with a category and a pattern "+
+		"matching organization names on each line (e.g. phone,Apple)")
+
+// OUIBuckets chooses MAC OUI pseudonyms from the OUIs of vendors in the same
+// category as the original, such as phone or infrastructure vendors, so
+// coarse vendor statistics are kept without exposing exact manufacturers.
+// Vendors are categorized by matching the organization names in the IEEE
+// registry against patterns. Each OUI gets a random, unused OUI of its
+// category, other than itself, or a random one once all are used, and OUIs
+// of vendors in no category keep their random pseudonym. The multicast and
+// locally administered bits of the original are kept. The OUIs used are kept
+// in state files.
+type OUIBuckets struct {
+	category map[[3]byte]string
+	ouis     map[string][][3]byte
+
+	mu   sync.Mutex
+	used map[[3]byte]bool
+}
+
+// ouiPattern is a category and the pattern for the names of its vendors.
+type ouiPattern struct {
+	category string
+	pattern  string
+}
+
+// NewOUIBuckets returns new buckets from an IEEE OUI registry in CSV and
+// categories, each with a category and a case-insensitive substring of the
+// organization names of its vendors. The first category matching a vendor
+// is used.
+func NewOUIBuckets(registry, categories io.Reader) (*OUIBuckets, error) {
+	var pats []ouiPattern
+	s := bufio.NewScanner(categories)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		f := strings.SplitN(l, ",", 2)
+		if len(f) != 2 || strings.TrimSpace(f[0]) == "" ||
+			strings.TrimSpace(f[1]) == "" {
+			return nil, fmt.Errorf("invalid OUI category: %s", l)
+		}
+		pats = append(pats, ouiPattern{strings.TrimSpace(f[0]),
+			strings.ToLower(strings.TrimSpace(f[1]))})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	b := &OUIBuckets{
+		category: make(map[[3]byte]string),
+		ouis:     make(map[string][][3]byte),
+		used:     make(map[[3]byte]bool),
+	}
+	r := csv.NewReader(registry)
+	r.FieldsPerRecord = -1
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid OUI registry: %s", err)
+		}
+		if len(rec) < 3 || rec[0] == "Registry" {
+			continue
+		}
+		a, err := hex.DecodeString(rec[1])
+		if err != nil || len(a) != 3 {
+			return nil, fmt.Errorf("invalid OUI in registry: %s", rec[1])
+		}
+		name := strings.ToLower(rec[2])
+		for _, p := range pats {
+			if strings.Contains(name, p.pattern) {
+				o := toArray3(a)
+				if _, ok := b.category[o]; !ok {
+					b.category[o] = p.category
+					b.ouis[p.category] = append(b.ouis[p.category], o)
+				}
+				break
+			}
+		}
+	}
+	return b, nil
+}
+
+// openOUIBuckets returns the buckets for the registry and categories files.
+func openOUIBuckets(registry, categories string) (*OUIBuckets, error) {
+	rf, err := os.Open(registry)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	cf, err := os.Open(categories)
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+	return NewOUIBuckets(bufio.NewReader(rf), cf)
+}
+
+// Categories returns the number of categories with vendors in the registry.
+func (b *OUIBuckets) Categories() int {
+	return len(b.ouis)
+}
+
+// Map replaces p with an unused OUI of o's category.
+func (b *OUIBuckets) Map(o, p []byte) {
+	oa := toArray3(o)
+	// the category is that of the universally administered OUI
+	oa[0] &^= 0x03
+	c, ok := b.category[oa]
+	if !ok {
+		return
+	}
+	ouis := b.ouis[c]
+	i := int(uint32(p[0])<<16|uint32(p[1])<<8|uint32(p[2])) % len(ouis)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var q [3]byte
+	found := false
+	for j := 0; j < len(ouis); j++ {
+		q = ouis[(i+j)%len(ouis)]
+		if q != oa && !b.used[q] {
+			found = true
+			break
+		}
+	}
+	if !found {
+		q = ouis[i]
+	}
+	b.used[q] = true
+	copy(p, q[:])
+	p[0] = p[0]&^0x03 | o[0]&0x03
+}
+
+// Reset forgets the pseudonyms chosen.
+func (b *OUIBuckets) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = make(map[[3]byte]bool)
+}
+
+// ouiBucketsState is the state of OUIBuckets in a state file.
+type ouiBucketsState struct {
+	Used []string `json:"used"`
+}
+
+// mapperState returns the OUIs used, in hex.
+func (b *OUIBuckets) mapperState() interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := ouiBucketsState{Used: make([]string, 0, len(b.used))}
+	for q := range b.used {
+		s.Used = append(s.Used, hex.EncodeToString(q[:]))
+	}
+	sort.Strings(s.Used)
+	return s
+}
+
+// loadMapperState restores the OUIs used.
+func (b *OUIBuckets) loadMapperState(j []byte) (err error) {
+	var s ouiBucketsState
+	if err = json.Unmarshal(j, &s); err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, u := range s.Used {
+		var q [3]byte
+		if err = decodeHexKey(u, q[:]); err != nil {
+			return
+		}
+		b.used[q] = true
+	}
+	return
+}
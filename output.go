@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var forceOutput = flag.Bool("force", false, "overwrite existing output files")
+
+// Output is a destination for an anonymized capture.
+type Output interface {
+	io.Writer
+
+	// Close commits the output.
+	Close() error
+
+	// Abort discards the output after an error, as far as possible.
+	Abort() error
+}
+
+// OpenOutput opens the output named by s, which may be empty or "-" for
+// stdout, a file name, created with permissions perm, or an object storage
+// URL- s3://bucket/key, gs://bucket/key or azure://account/container/blob.
+func OpenOutput(s string, perm os.FileMode) (Output, error) {
+	if s == "" || s == "-" {
+		return stdoutOutput{}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return createFile(s, false, perm)
+	}
+	var o objectStore
+	switch u.Scheme {
+	case "s3":
+		o, err = newS3Store(u, "AWS")
+	case "gs":
+		o, err = newS3Store(u, "GCS")
+	case "azure":
+		o, err = newAzureStore(u)
+	default:
+		err = fmt.Errorf("unsupported output scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMultipartOutput(o)
+}
+
+// stdoutOutput writes to stdout.
+type stdoutOutput struct{}
+
+func (stdoutOutput) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+
+func (stdoutOutput) Close() error { return nil }
+
+func (stdoutOutput) Abort() error { return nil }
+
+// discardOutput discards the output.
+type discardOutput struct{}
+
+func (discardOutput) Write(b []byte) (int, error) { return len(b), nil }
+
+func (discardOutput) Close() error { return nil }
+
+func (discardOutput) Abort() error { return nil }
+
+// fileOutput writes to a temporary file, which is renamed to the output path
+// on Close, or removed on Abort, so a failed run never leaves partial output.
+type fileOutput struct {
+	*os.File
+	path string
+}
+
+// createFile creates a fileOutput for path with permissions perm (before the
+// umask). Unless -force is given or overwrite is true, it's an error if path
+// already exists.
+func createFile(path string, overwrite bool, perm os.FileMode) (
+	f *fileOutput, err error) {
+	if !*forceOutput && !overwrite {
+		if _, err = os.Lstat(path); err == nil {
+			err = fmt.Errorf("%s exists (use -force to overwrite)", path)
+			return
+		} else if !os.IsNotExist(err) {
+			return
+		}
+	}
+	var t *os.File
+	tmp := fmt.Sprintf("%s.tmp%d", path, os.Getpid())
+	if t, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL,
+		perm); err != nil {
+		return
+	}
+	f = &fileOutput{t, path}
+	temps.add(tmp)
+	return
+}
+
+// Close syncs and closes the temporary file, renames it to the output path,
+// and syncs the directory, so the output is on disk before Close returns, and
+// before any original it replaces is shredded.
+func (f *fileOutput) Close() (err error) {
+	defer temps.remove(f.Name())
+	if err = f.File.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return
+	}
+	if err = f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err = os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// syncDir syncs directory dir, so renames in it are on disk. Windows can't
+// sync directories, but its renames are written through.
+func syncDir(dir string) (err error) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	var d *os.File
+	if d, err = os.Open(dir); err != nil {
+		return
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return
+	}
+	return d.Close()
+}
+
+// Abort closes and removes the temporary file.
+func (f *fileOutput) Abort() error {
+	defer temps.remove(f.Name())
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// tempFiles are the temporary files and uploads of outputs in progress, which
+// are removed or aborted if the process is interrupted.
+type tempFiles struct {
+	sync.Mutex
+	names   map[string]bool
+	uploads map[*multipartOutput]bool
+	notify  sync.Once
+}
+
+var temps = &tempFiles{names: make(map[string]bool),
+	uploads: make(map[*multipartOutput]bool)}
+
+// watch removes all temporary files and aborts all uploads on an interrupt,
+// the first time it's called.
+func (t *tempFiles) watch() {
+	t.notify.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			s := <-c
+			t.removeAll()
+			errorf("%s, partial output removed", s)
+			os.Exit(1)
+		}()
+	})
+}
+
+func (t *tempFiles) add(name string) {
+	t.watch()
+	t.Lock()
+	defer t.Unlock()
+	t.names[name] = true
+}
+
+func (t *tempFiles) remove(name string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.names, name)
+}
+
+func (t *tempFiles) addUpload(m *multipartOutput) {
+	t.watch()
+	t.Lock()
+	defer t.Unlock()
+	t.uploads[m] = true
+}
+
+func (t *tempFiles) removeUpload(m *multipartOutput) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.uploads, m)
+}
+
+// removeAll removes all temporary files and aborts all uploads, for use
+// before exiting after an error.
+func (t *tempFiles) removeAll() {
+	t.Lock()
+	defer t.Unlock()
+	for n := range t.names {
+		os.Remove(n)
+		delete(t.names, n)
+	}
+	for m := range t.uploads {
+		m.store.abort()
+		delete(t.uploads, m)
+	}
+}
+
+// objectStore uploads one object in parts.
+type objectStore interface {
+	begin() error
+
+	part(n int, b []byte) error
+
+	complete() error
+
+	abort() error
+}
+
+// Uploaded parts start at minPartSize (S3 requires at least 5 MiB), and
+// double every partsPerSize parts, up to maxPartSize, so an object may grow
+// to terabytes within the limit of 10000 parts.
+const (
+	minPartSize  = 8 * 1024 * 1024
+	maxPartSize  = 1024 * 1024 * 1024
+	partsPerSize = 1000
+)
+
+// Failed requests are retried up to uploadRetries times, waiting
+// uploadBackoff, then twice as long each time.
+const (
+	uploadRetries = 5
+	uploadBackoff = 500 * time.Millisecond
+)
+
+// multipartOutput buffers output and uploads it in parts, so the anonymized
+// capture is never staged on local disk. The upload is aborted if any
+// request fails, or the process is interrupted.
+type multipartOutput struct {
+	store   objectStore
+	buf     []byte
+	n       int
+	aborted bool
+}
+
+func newMultipartOutput(s objectStore) (*multipartOutput, error) {
+	if err := retry(s.begin); err != nil {
+		return nil, err
+	}
+	m := &multipartOutput{store: s, buf: make([]byte, 0, minPartSize)}
+	temps.addUpload(m)
+	return m, nil
+}
+
+// partSize returns the size of the next part.
+func (m *multipartOutput) partSize() int {
+	s := minPartSize
+	for i := m.n / partsPerSize; i > 0 && s < maxPartSize; i-- {
+		s *= 2
+	}
+	return s
+}
+
+func (m *multipartOutput) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		ps := m.partSize()
+		c := ps - len(m.buf)
+		if c > len(b) {
+			c = len(b)
+		}
+		m.buf = append(m.buf, b[:c]...)
+		b = b[c:]
+		n += c
+		if len(m.buf) == ps {
+			if err = m.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// flush uploads the buffered part.
+func (m *multipartOutput) flush() (err error) {
+	m.n++
+	if err = retry(func() error {
+		return m.store.part(m.n, m.buf)
+	}); err != nil {
+		return
+	}
+	m.buf = m.buf[:0]
+	return
+}
+
+// Close uploads the last part and completes the upload.
+func (m *multipartOutput) Close() (err error) {
+	if len(m.buf) > 0 || m.n == 0 {
+		if err = m.flush(); err != nil {
+			m.Abort()
+			return
+		}
+	}
+	if err = retry(m.store.complete); err != nil {
+		m.Abort()
+		return
+	}
+	temps.removeUpload(m)
+	return
+}
+
+// Abort aborts the upload, so no partial object is left.
+func (m *multipartOutput) Abort() error {
+	if m.aborted {
+		return nil
+	}
+	m.aborted = true
+	temps.removeUpload(m)
+	return retry(m.store.abort)
+}
+
+// retry calls fn until it succeeds, up to uploadRetries more times, with
+// exponential backoff, returning the last error.
+func retry(fn func() error) (err error) {
+	d := uploadBackoff
+	for i := 0; ; i++ {
+		if err = fn(); err == nil || i == uploadRetries {
+			return
+		}
+		time.Sleep(d)
+		d *= 2
+	}
+}
+
+// do performs an HTTP request, returning the response if the status is 2xx.
+func do(req *http.Request) (resp *http.Response, err error) {
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		err = fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path,
+			resp.Status, strings.TrimSpace(string(b)))
+	}
+	return
+}
+
+// s3Store uploads to S3, or any service with an S3 compatible multipart API,
+// using AWS Signature Version 4.
+type s3Store struct {
+	base     string
+	path     string
+	region   string
+	key      string
+	secret   string
+	token    string
+	uploadID string
+	etags    []string
+}
+
+// newS3Store returns an S3 store for u, with credentials from the environment
+// variables with the given prefix (e.g. AWS_ACCESS_KEY_ID). For GCS, the XML
+// API is used with HMAC keys. AWS_ENDPOINT_URL selects an S3 compatible
+// endpoint, using path-style URLs.
+func newS3Store(u *url.URL, prefix string) (s *s3Store, err error) {
+	s = &s3Store{
+		key:    os.Getenv(prefix + "_ACCESS_KEY_ID"),
+		secret: os.Getenv(prefix + "_SECRET_ACCESS_KEY"),
+		token:  os.Getenv(prefix + "_SESSION_TOKEN"),
+		region: os.Getenv(prefix + "_REGION"),
+	}
+	if s.key == "" || s.secret == "" {
+		err = fmt.Errorf("%s_ACCESS_KEY_ID and %s_SECRET_ACCESS_KEY must be set",
+			prefix, prefix)
+		return
+	}
+	k := strings.TrimPrefix(u.Path, "/")
+	if k == "" {
+		err = fmt.Errorf("no object key in %s", u)
+		return
+	}
+	switch {
+	case prefix == "GCS":
+		s.base = "https://storage.googleapis.com"
+		s.path = "/" + u.Host + "/" + k
+		s.region = "auto"
+	case os.Getenv("AWS_ENDPOINT_URL") != "":
+		s.base = strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/")
+		s.path = "/" + u.Host + "/" + k
+	default:
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		s.base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", u.Host,
+			s.region)
+		s.path = "/" + k
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return
+}
+
+// request returns a new signed request.
+func (s *s3Store) request(method string, query url.Values,
+	body []byte) (req *http.Request, err error) {
+	u := s.base + uriEncode(s.path, false)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	if req, err = http.NewRequest(method, u, bytes.NewReader(body)); err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	ph := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(ph[:])
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.token != "" {
+		req.Header.Set("x-amz-security-token", s.token)
+	}
+
+	// canonical request
+	var names []string
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + hdrs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	cr := strings.Join([]string{method, uriEncode(s.path, false),
+		canonicalQuery(query), ch.String(), signed, payloadHash}, "\n")
+
+	// signature
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	crh := sha256.Sum256([]byte(cr))
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(crh[:])
+	k := hmacSHA256([]byte("AWS4"+s.secret), date)
+	for _, x := range []string{s.region, "s3", "aws4_request"} {
+		k = hmacSHA256(k, x)
+	}
+	sig := hex.EncodeToString(hmacSHA256(k, sts))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.key, scope, signed, sig))
+	return
+}
+
+func (s *s3Store) begin() (err error) {
+	var req *http.Request
+	if req, err = s.request("POST", url.Values{"uploads": {""}}, nil); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var r struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return
+	}
+	s.uploadID = r.UploadID
+	return
+}
+
+func (s *s3Store) part(n int, b []byte) (err error) {
+	var req *http.Request
+	if req, err = s.request("PUT", url.Values{
+		"partNumber": {fmt.Sprint(n)},
+		"uploadId":   {s.uploadID},
+	}, b); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = do(req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	s.etags = append(s.etags, resp.Header.Get("ETag"))
+	return
+}
+
+func (s *s3Store) complete() (err error) {
+	b := &bytes.Buffer{}
+	b.WriteString("<CompleteMultipartUpload>")
+	for i, e := range s.etags {
+		fmt.Fprintf(b, "<Part><PartNumber>%d</PartNumber><ETag>", i+1)
+		xml.EscapeText(b, []byte(e))
+		b.WriteString("</ETag></Part>")
+	}
+	b.WriteString("</CompleteMultipartUpload>")
+	var req *http.Request
+	if req, err = s.request("POST", url.Values{"uploadId": {s.uploadID}},
+		b.Bytes()); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = do(req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (s *s3Store) abort() (err error) {
+	var req *http.Request
+	if req, err = s.request("DELETE", url.Values{"uploadId": {s.uploadID}},
+		nil); err != nil {
+		return
+	}
+	var resp *http.Response
+	if resp, err = do(req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// azureStore uploads block blobs to Azure, authorized with a SAS token from
+// AZURE_STORAGE_SAS_TOKEN.
+type azureStore struct {
+	url    string
+	sas    string
+	blocks []string
+}
+
+func newAzureStore(u *url.URL) (*azureStore, error) {
+	sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	if sas == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN must be set")
+	}
+	if strings.Count(strings.Trim(u.Path, "/"), "/") < 1 {
+		return nil, fmt.Errorf("expected azure://account/container/blob")
+	}
+	return &azureStore{
+		url: fmt.Sprintf("https://%s.blob.core.windows.net%s", u.Host,
+			uriEncode(u.Path, false)),
+		sas: sas,
+	}, nil
+}
+
+func (a *azureStore) put(query string, body []byte) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequest("PUT", a.url+"?"+query+"&"+a.sas,
+		bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("x-ms-version", "2020-10-02")
+	var resp *http.Response
+	if resp, err = do(req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (a *azureStore) begin() error { return nil }
+
+func (a *azureStore) part(n int, b []byte) (err error) {
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n)))
+	if err = a.put("comp=block&blockid="+url.QueryEscape(id), b); err != nil {
+		return
+	}
+	a.blocks = append(a.blocks, id)
+	return
+}
+
+func (a *azureStore) complete() error {
+	b := &bytes.Buffer{}
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range a.blocks {
+		fmt.Fprintf(b, "<Latest>%s</Latest>", id)
+	}
+	b.WriteString("</BlockList>")
+	return a.put("comp=blocklist", b.Bytes())
+}
+
+// abort does nothing, as uncommitted blocks are discarded by Azure.
+func (a *azureStore) abort() error { return nil }
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// uriEncode encodes s per SigV4, leaving slashes unless encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' ||
+			c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns the SigV4 canonical query string.
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var p []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			p = append(p, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(p, "&")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var padTo = flag.String("pad-to", "",
+	"zero-pad each packet to the least of these sizes that holds it (comma "+
+		"separated, e.g. 128,512,1514), hiding packet lengths")
+
+// Padder pads packets with zeros to the least of a set of sizes that holds
+// them, for traffic-analysis resistance where even packet lengths must be
+// blunted. Packets longer than the largest size are padded to a multiple of
+// it, so a single size pads every packet to a multiple of that size, up to
+// MaxPacketLen.
+type Padder struct {
+	sizes []int
+}
+
+// ParsePadder returns a padder for sizes, a comma separated list of packet
+// sizes.
+func ParsePadder(sizes string) (p *Padder, err error) {
+	p = &Padder{}
+	for _, s := range strings.Split(sizes, ",") {
+		var n int
+		if n, err = strconv.Atoi(strings.TrimSpace(s)); err != nil ||
+			n < 1 || n > int(MaxPacketLen) {
+			err = fmt.Errorf("invalid padding size: %s", s)
+			return
+		}
+		p.sizes = append(p.sizes, n)
+	}
+	sort.Ints(p.sizes)
+	return
+}
+
+// Max returns the largest size.
+func (p *Padder) Max() int {
+	return p.sizes[len(p.sizes)-1]
+}
+
+// size returns the padded size of a packet of length n.
+func (p *Padder) size(n int) int {
+	for _, s := range p.sizes {
+		if n <= s {
+			return s
+		}
+	}
+	m := p.Max()
+	if s := (n + m - 1) / m * m; s < int(MaxPacketLen) {
+		return s
+	}
+	return int(MaxPacketLen)
+}
+
+// pad returns packet b padded with zeros. The packet is copied if it's
+// padded, as it may share its buffer with the input.
+func (p *Padder) pad(b []byte) []byte {
+	n := p.size(len(b))
+	if n == len(b) {
+		return b
+	}
+	return append(b[:len(b):len(b)], make([]byte, n-len(b))...)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MagicLE is the little-endian magic value.
+const MagicLE Magic = 0xd4c3b2a1
+
+// MagicBE is the big-endian magic value.
+const MagicBE Magic = 0xa1b2c3d4
+
+// Magic is the magic value.
+type Magic uint32
+
+func (m *Magic) Read(r io.Reader) (err error) {
+	if err = binary.Read(r, binary.BigEndian, m); err != nil {
+		return
+	}
+	if *m != MagicLE && *m != MagicBE {
+		err = fmt.Errorf("bad magic: 0x%x", *m)
+	}
+	return
+}
+
+// ByteOrder gets the byte order of the magic value, or an error if it isn't
+// valid.
+func (m *Magic) ByteOrder() (binary.ByteOrder, error) {
+	switch *m {
+	case MagicLE:
+		return binary.LittleEndian, nil
+	case MagicBE:
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("invalid magic: 0x%x", *m)
+}
+
+func (m *Magic) Write(w io.Writer) error {
+	o, err := m.ByteOrder()
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, o, MagicBE)
+}
+
+// GlobalHeader is a pcap global header (magic read separately).
+type GlobalHeader struct {
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone     int32
+	Sigfigs      uint32
+	Snaplen      uint32
+	LinkLayer    uint32
+}
+
+func (h *GlobalHeader) Read(r io.Reader, order binary.ByteOrder) error {
+	return binary.Read(r, order, h)
+}
+
+func (h *GlobalHeader) Write(w io.Writer, order binary.ByteOrder) error {
+	return binary.Write(w, order, h)
+}
+
+// PacketHeader is a pcap packet header.
+type PacketHeader struct {
+	TimestampSec  uint32
+	TimestampUsec uint32
+	Len           uint32
+	OrigLen       uint32
+}
+
+// PacketWriter writes a capture file.
+type PacketWriter interface {
+	WriteHeader(gh *GlobalHeader) error
+
+	// WritePacket writes a packet, with a comment if non-empty and supported.
+	WritePacket(ph *PacketHeader, b []byte, comment string) error
+}
+
+// PcapWriter writes pcap files.
+type PcapWriter struct {
+	w     io.Writer
+	order binary.ByteOrder
+	magic Magic
+}
+
+// WriteHeader writes the magic and global header.
+func (p *PcapWriter) WriteHeader(gh *GlobalHeader) (err error) {
+	if err = p.magic.Write(p.w); err != nil {
+		return
+	}
+	return gh.Write(p.w, p.order)
+}
+
+// WritePacket writes a packet header and packet (comments are unsupported).
+func (p *PcapWriter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	if err = binary.Write(p.w, p.order, ph); err != nil {
+		return
+	}
+	_, err = p.w.Write(b)
+	return
+}
+
+// PcapReader reads pcap files.
+type PcapReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	magic  Magic
+	header GlobalHeader
+
+	// read, if not nil, reads packets from other formats.
+	read func() (PacketHeader, []byte, error)
+
+	// iface is the interface of the last packet read, for pcapng files, or
+	// the first interface before any are read.
+	iface *Interface
+
+	// ts is the timestamp of the last packet read from a pcapng file, in the
+	// units of its interface.
+	ts uint64
+
+	// dir is the direction of the last packet read from a pcapng file, from
+	// its flags.
+	dir Direction
+}
+
+// NewPcapReader returns a new pcap reader, after reading the magic and global
+// header.
+func NewPcapReader(r io.Reader) (p *PcapReader, err error) {
+	p = &PcapReader{r: r}
+	if err = p.magic.Read(r); err != nil {
+		return
+	}
+	if p.order, err = p.magic.ByteOrder(); err != nil {
+		return
+	}
+	err = p.header.Read(r, p.order)
+	return
+}
+
+// memReader is implemented by inputs held in memory, such as bytes.Buffer and
+// MappedReader. Next returns the next n bytes, or fewer at the end, which may
+// be modified, Bytes returns the unread bytes, and Len their number.
+type memReader interface {
+	io.Reader
+	Len() int
+	Bytes() []byte
+	Next(n int) []byte
+}
+
+// NewCaptureReader returns a reader for r, which may be a pcap file, or a
+// pcapng, snoop or NetMon file, converted to pcap. If r is a memReader or
+// bufio.Reader, the format is detected from its magic, otherwise it must be
+// pcap.
+func NewCaptureReader(r io.Reader) (p *PcapReader, err error) {
+	var m []byte
+	switch br := r.(type) {
+	case memReader:
+		m = br.Bytes()
+	case *bufio.Reader:
+		m, _ = br.Peek(8)
+	}
+	switch {
+	case bytes.HasPrefix(m, ngMagic):
+		return newPcapNGReader(r)
+	case bytes.HasPrefix(m, snoopMagic):
+		return newSnoopReader(r)
+	case bytes.HasPrefix(m, netmonMagic):
+		return newNetmonReader(r)
+	}
+	return NewPcapReader(r)
+}
+
+// context returns the metadata for the last packet read, with header ph.
+func (p *PcapReader) context(ph *PacketHeader) *PacketContext {
+	return &PacketContext{
+		Timestamp: time.Unix(int64(ph.TimestampSec),
+			int64(ph.TimestampUsec)*1000),
+		OrigLen:   ph.OrigLen,
+		LinkType:  p.header.LinkLayer,
+		Interface: p.iface,
+		Direction: p.dir,
+	}
+}
+
+// ReadPacket reads the next packet header and packet. If reading from a
+// memReader, the packet is not read, but taken from its Next.
+func (p *PcapReader) ReadPacket() (ph PacketHeader, b []byte, err error) {
+	if p.read != nil {
+		return p.read()
+	}
+	var h [16]byte
+	if _, err = io.ReadFull(p.r, h[:]); err != nil {
+		return
+	}
+	ph.TimestampSec = p.order.Uint32(h[0:4])
+	ph.TimestampUsec = p.order.Uint32(h[4:8])
+	ph.Len = p.order.Uint32(h[8:12])
+	ph.OrigLen = p.order.Uint32(h[12:16])
+	if ph.Len > MaxPacketLen {
+		err = fmt.Errorf("max packet len exceeded: %d", ph.Len)
+		return
+	}
+	if buf, ok := p.r.(memReader); ok {
+		if buf.Len() < int(ph.Len) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		b = buf.Next(int(ph.Len))
+		return
+	}
+	b = make([]byte, ph.Len)
+	_, err = io.ReadFull(p.r, b)
+	return
+}
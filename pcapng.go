@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// pcapng block types and option codes
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html
+const (
+	ngSectionHeader     uint32 = 0x0a0d0d0a
+	ngInterfaceDesc            = 0x00000001
+	ngPacket                   = 0x00000002
+	ngSimplePacket             = 0x00000003
+	ngNameResolution           = 0x00000004
+	ngEnhancedPacket           = 0x00000006
+	ngByteOrderMagic           = 0x1a2b3c4d
+	ngOptEndOfOpt       uint16 = 0
+	ngOptComment               = 1
+	ngOptSHBUserAppl           = 4
+	ngOptIfName                = 2
+	ngOptIfDescription         = 3
+	ngOptIfTsResolution        = 9
+	ngOptIfTsOffset            = 14
+	ngOptEPBFlags              = 2
+)
+
+// ngMagic is the block type at the start of pcapng files.
+var ngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// ngMaxOptionsLen is the maximum length of the options in a block read,
+// beyond MaxPacketLen.
+const ngMaxOptionsLen = 64 * 1024
+
+// PcapNGWriter writes pcapng files with a single section. Only the options
+// written here appear in the output, as none are copied from the input,
+// except the direction bits of packet flags. If strip is true, the user
+// application and all comments are omitted too.
+type PcapNGWriter struct {
+	w       io.Writer
+	order   binary.ByteOrder
+	comment string
+	strip   bool
+
+	// src, if not nil, is the reader of the input. For pcapng input, an
+	// interface is written for each input interface, with its timestamp
+	// resolution and offset, and packets keep their original timestamps.
+	// Otherwise, a single interface with microsecond timestamps is written.
+	src     *PcapReader
+	link    uint32
+	snaplen uint32
+	ifaces  map[*Interface]uint32
+}
+
+// WriteHeader writes the section header block, and the interface description
+// block for the interface of the input's first or current packet.
+func (p *PcapNGWriter) WriteHeader(gh *GlobalHeader) (err error) {
+	// section header
+	b := &bytes.Buffer{}
+	binary.Write(b, p.order, uint32(ngByteOrderMagic))
+	binary.Write(b, p.order, uint16(1))
+	binary.Write(b, p.order, uint16(0))
+	binary.Write(b, p.order, int64(-1))
+	if !p.strip {
+		if p.comment != "" {
+			p.writeOption(b, ngOptComment, []byte(p.comment))
+		}
+		p.writeOption(b, ngOptSHBUserAppl, []byte("wanonpcap "+Version))
+	}
+	p.writeOption(b, ngOptEndOfOpt, nil)
+	if err = p.writeBlock(ngSectionHeader, b.Bytes()); err != nil {
+		return
+	}
+
+	// interface description
+	p.link, p.snaplen = gh.LinkLayer, gh.Snaplen
+	p.ifaces = make(map[*Interface]uint32)
+	if i := p.iface(); i != nil {
+		_, err = p.interfaceID(i)
+		return
+	}
+	return p.writeInterface(6, 0)
+}
+
+// iface returns the input interface of the current packet, or nil if the
+// input isn't pcapng.
+func (p *PcapNGWriter) iface() *Interface {
+	if p.src == nil {
+		return nil
+	}
+	return p.src.iface
+}
+
+// interfaceID returns the output interface ID for input interface i, writing
+// its interface description block if it's new.
+func (p *PcapNGWriter) interfaceID(i *Interface) (id uint32, err error) {
+	id, ok := p.ifaces[i]
+	if ok {
+		return
+	}
+	id = uint32(len(p.ifaces))
+	if err = p.writeInterface(i.tsresol, i.offset); err != nil {
+		return
+	}
+	p.ifaces[i] = id
+	return
+}
+
+// writeInterface writes an interface description block with the given
+// timestamp resolution and offset.
+func (p *PcapNGWriter) writeInterface(tsresol byte, offset int64) error {
+	b := &bytes.Buffer{}
+	binary.Write(b, p.order, uint16(p.link))
+	binary.Write(b, p.order, uint16(0))
+	binary.Write(b, p.order, p.snaplen)
+	p.writeOption(b, ngOptIfTsResolution, []byte{tsresol})
+	if offset != 0 {
+		o := make([]byte, 8)
+		p.order.PutUint64(o, uint64(offset))
+		p.writeOption(b, ngOptIfTsOffset, o)
+	}
+	p.writeOption(b, ngOptEndOfOpt, nil)
+	return p.writeBlock(ngInterfaceDesc, b.Bytes())
+}
+
+// WritePacket writes an enhanced packet block.
+func (p *PcapNGWriter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	var id uint32
+	ts := uint64(ph.TimestampSec)*1000000 + uint64(ph.TimestampUsec)
+	if i := p.iface(); i != nil {
+		if id, err = p.interfaceID(i); err != nil {
+			return
+		}
+		ts = p.src.ts
+	}
+	bb := &bytes.Buffer{}
+	binary.Write(bb, p.order, id)
+	binary.Write(bb, p.order, uint32(ts>>32))
+	binary.Write(bb, p.order, uint32(ts))
+	binary.Write(bb, p.order, ph.Len)
+	binary.Write(bb, p.order, ph.OrigLen)
+	bb.Write(b)
+	bb.Write(make([]byte, pad4(len(b))))
+	var opts bool
+	if comment != "" && !p.strip {
+		p.writeOption(bb, ngOptComment, []byte(comment))
+		opts = true
+	}
+	if p.src != nil && p.src.dir != DirUnknown {
+		f := make([]byte, 4)
+		p.order.PutUint32(f, uint32(p.src.dir))
+		p.writeOption(bb, ngOptEPBFlags, f)
+		opts = true
+	}
+	if opts {
+		p.writeOption(bb, ngOptEndOfOpt, nil)
+	}
+	return p.writeBlock(ngEnhancedPacket, bb.Bytes())
+}
+
+// writeOption appends an option to a block body.
+func (p *PcapNGWriter) writeOption(b *bytes.Buffer, code uint16, v []byte) {
+	binary.Write(b, p.order, code)
+	binary.Write(b, p.order, uint16(len(v)))
+	b.Write(v)
+	b.Write(make([]byte, pad4(len(v))))
+}
+
+// writeBlock writes a block with the given type and (padded) body.
+func (p *PcapNGWriter) writeBlock(typ uint32, body []byte) (err error) {
+	l := uint32(len(body) + 12)
+	if err = binary.Write(p.w, p.order, typ); err != nil {
+		return
+	}
+	if err = binary.Write(p.w, p.order, l); err != nil {
+		return
+	}
+	if _, err = p.w.Write(body); err != nil {
+		return
+	}
+	return binary.Write(p.w, p.order, l)
+}
+
+// pad4 returns the padding needed to align n to 32 bits.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// Interface is a capture interface, from a pcapng interface description block.
+type Interface struct {
+	// Index is the interface ID within its section.
+	Index int
+
+	// Name and Description are the if_name and if_description options.
+	Name        string
+	Description string
+
+	link    uint32
+	snaplen uint32
+	tsresol byte
+	units   uint64
+	offset  int64
+}
+
+// timestamp converts a pcapng timestamp to seconds and microseconds.
+func (i *Interface) timestamp(ts uint64) (sec, usec uint32) {
+	sec = uint32(int64(ts/i.units) + i.offset)
+	hi, lo := bits.Mul64(ts%i.units, 1000000)
+	u, _ := bits.Div64(hi, lo, i.units)
+	usec = uint32(u)
+	return
+}
+
+// ngReader reads pcapng files, converting their packets to pcap. All
+// interfaces must have the link type of the first one. Blocks other than
+// packets are dropped, including name resolution blocks, which map addresses
+// to host names and would undo their anonymization.
+type ngReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	link   uint32
+	ifaces []*Interface
+	nrbs   bool
+
+	// dir is the direction of the last packet read, from its flags.
+	dir Direction
+}
+
+// newPcapNGReader returns a reader for a pcapng file, taking the byte order of
+// the first section, and the link type and snaplen of its first interface.
+func newPcapNGReader(r io.Reader) (p *PcapReader, err error) {
+	n := &ngReader{r: r, order: binary.BigEndian}
+	var typ uint32
+	var body []byte
+	if typ, body, err = n.readBlock(); err != nil {
+		return
+	}
+	if typ != ngSectionHeader {
+		err = fmt.Errorf("bad pcapng section header: 0x%x", typ)
+		return
+	}
+	if err = n.section(body); err != nil {
+		return
+	}
+	order := n.order
+	for len(n.ifaces) == 0 {
+		if typ, body, err = n.readBlock(); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("no interfaces in pcapng file")
+			}
+			return
+		}
+		switch typ {
+		case ngSectionHeader:
+			err = n.section(body)
+		case ngInterfaceDesc:
+			err = n.interfaceDesc(body)
+		case ngPacket, ngSimplePacket, ngEnhancedPacket:
+			err = fmt.Errorf("pcapng packet before interface description")
+		}
+		if err != nil {
+			return
+		}
+	}
+	n.link = n.ifaces[0].link
+	snaplen := n.ifaces[0].snaplen
+	if snaplen == 0 {
+		snaplen = MaxPacketLen
+	}
+	p = &PcapReader{
+		r:      r,
+		order:  order,
+		magic:  MagicBE,
+		header: GlobalHeader{2, 4, 0, 0, snaplen, n.link},
+	}
+	if order == binary.LittleEndian {
+		p.magic = MagicLE
+	}
+	p.iface = n.ifaces[0]
+	p.read = func() (ph PacketHeader, b []byte, err error) {
+		ph, b, p.iface, p.ts, err = n.readPacket()
+		p.dir = n.dir
+		return
+	}
+	return
+}
+
+// readBlock reads the next block, returning its type, and its body without
+// the trailing length. Section headers set the byte order for the blocks that
+// follow. If reading from a memReader, the body is taken from its Next.
+func (n *ngReader) readBlock() (typ uint32, body []byte, err error) {
+	var h [12]byte
+	if _, err = io.ReadFull(n.r, h[:8]); err != nil {
+		return
+	}
+	hl := 8
+	if binary.BigEndian.Uint32(h[:]) == ngSectionHeader {
+		if _, err = io.ReadFull(n.r, h[8:]); err != nil {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		switch binary.BigEndian.Uint32(h[8:]) {
+		case ngByteOrderMagic:
+			n.order = binary.BigEndian
+		case 0x4d3c2b1a:
+			n.order = binary.LittleEndian
+		default:
+			err = fmt.Errorf("bad pcapng byte-order magic: 0x%x",
+				binary.BigEndian.Uint32(h[8:]))
+			return
+		}
+		hl = 12
+	}
+	typ = n.order.Uint32(h[:])
+	l := n.order.Uint32(h[4:])
+	if l < uint32(hl)+4 || l%4 != 0 || l > MaxPacketLen+ngMaxOptionsLen {
+		err = fmt.Errorf("invalid pcapng block length: %d", l)
+		return
+	}
+	var rest []byte
+	if buf, ok := n.r.(memReader); ok {
+		if buf.Len() < int(l)-hl {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		rest = buf.Next(int(l) - hl)
+	} else {
+		rest = make([]byte, int(l)-hl)
+		if _, err = io.ReadFull(n.r, rest); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	if t := n.order.Uint32(rest[len(rest)-4:]); t != l {
+		err = fmt.Errorf("pcapng block lengths differ: %d and %d", l, t)
+		return
+	}
+	body = rest[:len(rest)-4]
+	if hl == 12 {
+		body = append(h[8:12:12], body...)
+	}
+	return
+}
+
+// section starts a new section, whose interfaces replace those before it.
+func (n *ngReader) section(body []byte) error {
+	if len(body) < 16 {
+		return fmt.Errorf("short pcapng section header")
+	}
+	if v := n.order.Uint16(body[4:]); v != 1 {
+		return fmt.Errorf("unsupported pcapng major version: %d", v)
+	}
+	n.ifaces = nil
+	return nil
+}
+
+// interfaceDesc adds an interface from an interface description block.
+func (n *ngReader) interfaceDesc(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("short pcapng interface description")
+	}
+	i := &Interface{
+		Index:   len(n.ifaces),
+		link:    uint32(n.order.Uint16(body)),
+		snaplen: n.order.Uint32(body[4:]),
+		tsresol: 6,
+		units:   1000000,
+	}
+	var err error
+	ngOptions(body[8:], n.order, func(code uint16, v []byte) {
+		switch code {
+		case ngOptIfName:
+			i.Name = string(v)
+		case ngOptIfDescription:
+			i.Description = string(v)
+		case ngOptIfTsResolution:
+			if len(v) < 1 {
+				break
+			}
+			i.tsresol = v[0]
+			r := v[0] & 0x7f
+			if v[0]&0x80 != 0 && r < 64 {
+				i.units = 1 << r
+			} else if v[0]&0x80 == 0 && r < 20 {
+				i.units = 1
+				for ; r > 0; r-- {
+					i.units *= 10
+				}
+			} else {
+				err = fmt.Errorf("unsupported pcapng timestamp resolution: 0x%x",
+					v[0])
+			}
+		case ngOptIfTsOffset:
+			if len(v) >= 8 {
+				i.offset = int64(n.order.Uint64(v))
+			}
+		}
+	})
+	n.ifaces = append(n.ifaces, i)
+	return err
+}
+
+// readPacket reads blocks until the next packet, returning it with its
+// interface and original timestamp, and setting its direction.
+func (n *ngReader) readPacket() (ph PacketHeader, b []byte, iface *Interface,
+	ts uint64, err error) {
+	n.dir = DirUnknown
+	for {
+		var typ uint32
+		var body []byte
+		if typ, body, err = n.readBlock(); err != nil {
+			return
+		}
+		switch typ {
+		case ngSectionHeader:
+			err = n.section(body)
+		case ngInterfaceDesc:
+			if err = n.interfaceDesc(body); err != nil {
+				break
+			}
+			if l := n.ifaces[len(n.ifaces)-1].link; l != n.link {
+				err = fmt.Errorf(
+					"pcapng interfaces with different link types (%d and %d) "+
+						"are unsupported", n.link, l)
+			}
+		case ngEnhancedPacket:
+			return n.packet(body, 4, n.order.Uint32(body), 20)
+		case ngPacket:
+			return n.packet(body, 4, uint32(n.order.Uint16(body)), 20)
+		case ngSimplePacket:
+			return n.simplePacket(body)
+		case ngNameResolution:
+			if !n.nrbs {
+				printf("dropping pcapng name resolution blocks")
+				n.nrbs = true
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// packet returns the packet from an enhanced or obsolete packet block body,
+// with the interface ID id, and the timestamp and lengths at offset o, and
+// the packet data at offset data. The direction is taken from the flags
+// option that follows the data, if present.
+func (n *ngReader) packet(body []byte, o int, id uint32, data int) (
+	ph PacketHeader, b []byte, iface *Interface, ts uint64, err error) {
+	if len(body) < data {
+		err = fmt.Errorf("short pcapng packet block")
+		return
+	}
+	if id >= uint32(len(n.ifaces)) {
+		err = fmt.Errorf("pcapng packet for unknown interface: %d", id)
+		return
+	}
+	iface = n.ifaces[id]
+	ts = uint64(n.order.Uint32(body[o:]))<<32 |
+		uint64(n.order.Uint32(body[o+4:]))
+	ph.TimestampSec, ph.TimestampUsec = iface.timestamp(ts)
+	ph.Len = n.order.Uint32(body[o+8:])
+	ph.OrigLen = n.order.Uint32(body[o+12:])
+	if ph.Len > MaxPacketLen || int(ph.Len) > len(body)-data {
+		err = fmt.Errorf("invalid pcapng packet length: %d", ph.Len)
+		return
+	}
+	b = body[data : data+int(ph.Len)]
+	if o := data + int(ph.Len) + pad4(int(ph.Len)); o < len(body) {
+		ngOptions(body[o:], n.order, func(code uint16, v []byte) {
+			if code == ngOptEPBFlags && len(v) >= 4 {
+				switch n.order.Uint32(v) & 3 {
+				case 1:
+					n.dir = DirInbound
+				case 2:
+					n.dir = DirOutbound
+				}
+			}
+		})
+	}
+	return
+}
+
+// simplePacket returns the packet from a simple packet block body, which is
+// from the first interface and has no timestamp. Its captured length is the
+// least of its original length and the interface's snaplen.
+func (n *ngReader) simplePacket(body []byte) (ph PacketHeader, b []byte,
+	iface *Interface, ts uint64, err error) {
+	if len(body) < 4 {
+		err = fmt.Errorf("short pcapng simple packet block")
+		return
+	}
+	if len(n.ifaces) == 0 {
+		err = fmt.Errorf("pcapng packet for unknown interface: 0")
+		return
+	}
+	iface = n.ifaces[0]
+	ph.OrigLen = n.order.Uint32(body)
+	ph.Len = ph.OrigLen
+	if iface.snaplen != 0 && ph.Len > iface.snaplen {
+		ph.Len = iface.snaplen
+	}
+	if int(ph.Len) > len(body)-4 {
+		ph.Len = uint32(len(body) - 4)
+	}
+	if ph.Len > MaxPacketLen {
+		err = fmt.Errorf("invalid pcapng packet length: %d", ph.Len)
+		return
+	}
+	b = body[4 : 4+ph.Len]
+	return
+}
+
+// ngOptions calls f with the code and value of each option in b, the options
+// of a block body.
+func ngOptions(b []byte, order binary.ByteOrder, f func(uint16, []byte)) {
+	for len(b) >= 4 {
+		code, l := order.Uint16(b), int(order.Uint16(b[2:]))
+		if code == ngOptEndOfOpt || 4+l > len(b) {
+			return
+		}
+		f(code, b[4:4+l])
+		if 4+l+pad4(l) >= len(b) {
+			return
+		}
+		b = b[4+l+pad4(l):]
+	}
+}
@@ -0,0 +1,150 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+func init() {
+	KeyUnwrappers["pkcs11"] = unwrapPKCS11
+}
+
+// parsePKCS11URI returns the path and query attributes of a PKCS#11 URI
+// (RFC 7512).
+func parsePKCS11URI(uri string) (attrs map[string]string, err error) {
+	if !strings.HasPrefix(uri, "pkcs11:") {
+		err = fmt.Errorf("not a PKCS#11 URI: %s", uri)
+		return
+	}
+	attrs = make(map[string]string)
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "pkcs11:"), "?")
+	for _, l := range []struct {
+		s, sep string
+	}{{path, ";"}, {query, "&"}} {
+		for _, a := range strings.Split(l.s, l.sep) {
+			if a == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(a, "=")
+			if !ok {
+				err = fmt.Errorf("expected name=value in PKCS#11 URI: %s", a)
+				return
+			}
+			if attrs[name], err = url.PathUnescape(value); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// unwrapPKCS11 decrypts the wrapped key with RSA-OAEP and SHA-256, using the
+// private key identified by a PKCS#11 URI. The URI must give the module-path
+// of the PKCS#11 library, and may select the token by its label, the key by
+// its object label or id, and give the user PIN with pin-value or
+// pin-source.
+func unwrapPKCS11(uri string, wrapped []byte) (key []byte, err error) {
+	attrs, err := parsePKCS11URI(uri)
+	if err != nil {
+		return
+	}
+	if attrs["module-path"] == "" {
+		err = fmt.Errorf("PKCS#11 URI has no module-path")
+		return
+	}
+	pin := attrs["pin-value"]
+	if src := attrs["pin-source"]; src != "" && pin == "" {
+		var b []byte
+		b, err = ioutil.ReadFile(strings.TrimPrefix(src, "file:"))
+		if err != nil {
+			return
+		}
+		pin = strings.TrimSpace(string(b))
+	}
+	p := pkcs11.New(attrs["module-path"])
+	if p == nil {
+		err = fmt.Errorf("can't load PKCS#11 module %s", attrs["module-path"])
+		return
+	}
+	defer p.Destroy()
+	if err = p.Initialize(); err != nil {
+		return
+	}
+	defer p.Finalize()
+
+	// token
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return
+	}
+	slot, found := uint(0), false
+	for _, s := range slots {
+		var ti pkcs11.TokenInfo
+		if ti, err = p.GetTokenInfo(s); err != nil {
+			return
+		}
+		t := attrs["token"]
+		if t == "" || strings.TrimRight(ti.Label, " ") == t {
+			slot, found = s, true
+			break
+		}
+	}
+	if !found {
+		err = fmt.Errorf("no PKCS#11 token found for %s", uri)
+		return
+	}
+	sh, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return
+	}
+	defer p.CloseSession(sh)
+	if pin != "" {
+		if err = p.Login(sh, pkcs11.CKU_USER, pin); err != nil {
+			return
+		}
+		defer p.Logout(sh)
+	}
+
+	// private key
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if o := attrs["object"]; o != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, o))
+	}
+	if id := attrs["id"]; id != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)))
+	}
+	if err = p.FindObjectsInit(sh, tmpl); err != nil {
+		return
+	}
+	objs, _, err := p.FindObjects(sh, 2)
+	if ferr := p.FindObjectsFinal(sh); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return
+	}
+	if len(objs) != 1 {
+		err = fmt.Errorf("%d PKCS#11 private keys found for %s, expected 1",
+			len(objs), uri)
+		return
+	}
+
+	// unwrap
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256,
+		pkcs11.CKZ_DATA_SPECIFIED, nil)
+	if err = p.DecryptInit(sh, []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)},
+		objs[0]); err != nil {
+		return
+	}
+	return p.Decrypt(sh, wrapped)
+}
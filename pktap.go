@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// offsets in the PKTAP header, which is little endian
+const (
+	pktapDLT   = 8
+	pktapComm  = 56
+	pktapEComm = 88
+	pktapMin   = 108
+)
+
+// pktapLinkType is the pcap link type for PKTAP.
+const pktapLinkType = 258
+
+// pktapCommLen is the length of the command name fields.
+const pktapCommLen = 20
+
+// pktapDLTs maps the DLTs of PKTAP's inner packets to pcap link types, where
+// they differ.
+var pktapDLTs = map[uint32]uint32{
+	12: 101, // DLT_RAW
+}
+
+// PktapHandler anonymizes Apple PKTAP packets, as captured with
+// tcpdump -i pktap on macOS and iOS. The process command names are scrubbed,
+// and the inner packet is anonymized by the handler for its link type.
+type PktapHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *PktapHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < pktapMin {
+		err = fmt.Errorf("short PKTAP header (increase snaplen)")
+		return
+	}
+	hl := int(binary.LittleEndian.Uint32(b))
+	if hl < pktapMin || hl > len(b) {
+		err = fmt.Errorf("invalid PKTAP header length: %d", hl)
+		return
+	}
+	anon.Text(b[pktapComm : pktapComm+pktapCommLen])
+	anon.Text(b[pktapEComm : pktapEComm+pktapCommLen])
+	n = hl
+
+	dlt := binary.LittleEndian.Uint32(b[pktapDLT:])
+	link := dlt
+	if l, ok := pktapDLTs[dlt]; ok {
+		link = l
+	}
+	ih, ok := Handlers[link]
+	if !ok || link == pktapLinkType {
+		err = unknownProtocol("PKTAP DLT %d", dlt)
+		return
+	}
+	var m int
+	m, err = ih.Handle(b[n:], anon)
+	n += m
+	return
+}
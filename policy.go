@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AnonMethod is the anonymization method.
+type AnonMethod int
+
+const (
+	// Encrypt means to encrypt the output using the key.
+	Encrypt AnonMethod = iota
+
+	// Pseudonym means to create an alias for the data so that subsequent
+	// data of the same type with the same value has the same alias.
+	Pseudonym
+
+	// Leave means leave the original data untouched.
+	Leave
+)
+
+func (m AnonMethod) String() string {
+	switch m {
+	case Encrypt:
+		return "encrypt"
+	case Pseudonym:
+		return "pseudonym"
+	case Leave:
+		return "leave"
+	}
+	return fmt.Sprintf("AnonMethod(%d)", int(m))
+}
+
+// VLANMethod is the VLAN ID anonymization method.
+type VLANMethod int
+
+const (
+	// VLANLeave means leave VLAN IDs untouched.
+	VLANLeave VLANMethod = iota
+
+	// VLANPseudonym means to remap each VLAN ID to a consistent alias.
+	VLANPseudonym
+
+	// VLANZero means to set all VLAN IDs to zero.
+	VLANZero
+)
+
+func (m VLANMethod) String() string {
+	switch m {
+	case VLANLeave:
+		return "leave"
+	case VLANPseudonym:
+		return "pseudonym"
+	case VLANZero:
+		return "zero"
+	}
+	return fmt.Sprintf("VLANMethod(%d)", int(m))
+}
+
+// SeqMethod is the 802.11 sequence number anonymization method.
+type SeqMethod int
+
+const (
+	// SeqLeave means leave sequence numbers untouched.
+	SeqLeave SeqMethod = iota
+
+	// SeqResequence means to offset the sequence numbers of each transmitter
+	// by a random amount, preserving retries and duplicates.
+	SeqResequence
+
+	// SeqZero means to set all sequence numbers to zero.
+	SeqZero
+)
+
+func (m SeqMethod) String() string {
+	switch m {
+	case SeqLeave:
+		return "leave"
+	case SeqResequence:
+		return "resequence"
+	case SeqZero:
+		return "zero"
+	}
+	return fmt.Sprintf("SeqMethod(%d)", int(m))
+}
+
+// TimestampMethod is the 802.11 beacon timestamp anonymization method.
+type TimestampMethod int
+
+const (
+	// TimestampLeave means leave beacon timestamps untouched.
+	TimestampLeave TimestampMethod = iota
+
+	// TimestampRebase means to subtract the first timestamp seen from each
+	// transmitter, hiding its uptime but keeping the beacon intervals.
+	TimestampRebase
+
+	// TimestampZero means to set all beacon timestamps to zero.
+	TimestampZero
+)
+
+func (m TimestampMethod) String() string {
+	switch m {
+	case TimestampLeave:
+		return "leave"
+	case TimestampRebase:
+		return "rebase"
+	case TimestampZero:
+		return "zero"
+	}
+	return fmt.Sprintf("TimestampMethod(%d)", int(m))
+}
+
+// Policy is an anonymization policy.
+type Policy struct {
+	MACOUI  AnonMethod
+	MACNIC  AnonMethod
+	IPv4Src AnonMethod
+	IPv4Dst AnonMethod
+	IPv6Src AnonMethod
+	IPv6Dst AnonMethod
+	VLAN    VLANMethod
+	Seq     SeqMethod
+
+	// CANID is the method for CAN identifiers.
+	CANID AnonMethod
+
+	// ZeroCANData zeroes CAN frame data.
+	ZeroCANData bool
+
+	// Port is the method for TCP and UDP ports.
+	Port AnonMethod
+
+	// Name is the method for names, which may not be Encrypt.
+	Name AnonMethod
+
+	// ID is the method for opaque identifiers.
+	ID AnonMethod
+
+	// ZeroTimestamps zeroes hardware timestamps.
+	ZeroTimestamps bool
+
+	// BeaconTimestamps is the method for 802.11 beacon and probe response
+	// timestamps.
+	BeaconTimestamps TimestampMethod
+
+	// ZeroCountry zeroes 802.11 country IEs.
+	ZeroCountry bool
+
+	// ZeroVendor zeroes vendor data.
+	ZeroVendor bool
+
+	// ZeroVendorOUIs, if not empty, limits ZeroVendor to the vendors with
+	// these OUIs, a comma separated list in hex.
+	ZeroVendorOUIs string
+
+	Decrypt bool
+}
+
+// Set sets a policy option by the name of its command line flag. The ipv4 and
+// ipv6 options set both the source and destination methods.
+func (p *Policy) Set(name, value string) (err error) {
+	switch name {
+	case "mac-oui":
+		p.MACOUI, err = parseAnonMethod(value)
+	case "mac-nic":
+		p.MACNIC, err = parseAnonMethod(value)
+	case "ipv4":
+		p.IPv4Src, err = parseAnonMethod(value)
+		p.IPv4Dst = p.IPv4Src
+	case "ipv4-src":
+		p.IPv4Src, err = parseAnonMethod(value)
+	case "ipv4-dst":
+		p.IPv4Dst, err = parseAnonMethod(value)
+	case "ipv6":
+		p.IPv6Src, err = parseAnonMethod(value)
+		p.IPv6Dst = p.IPv6Src
+	case "ipv6-src":
+		p.IPv6Src, err = parseAnonMethod(value)
+	case "ipv6-dst":
+		p.IPv6Dst, err = parseAnonMethod(value)
+	case "vlan":
+		p.VLAN, err = parseVLANMethod(value)
+	case "seq":
+		p.Seq, err = parseSeqMethod(value)
+	case "can-id":
+		p.CANID, err = parseAnonMethod(value)
+	case "zero-can-data":
+		p.ZeroCANData, err = strconv.ParseBool(value)
+	case "port":
+		p.Port, err = parseAnonMethod(value)
+	case "name":
+		if p.Name, err = parseAnonMethod(value); err == nil &&
+			p.Name == Encrypt {
+			err = fmt.Errorf("names may only be pseudonymed or left")
+		}
+	case "id":
+		p.ID, err = parseAnonMethod(value)
+	case "zero-timestamps":
+		p.ZeroTimestamps, err = strconv.ParseBool(value)
+	case "beacon-timestamps":
+		p.BeaconTimestamps, err = parseTimestampMethod(value)
+	case "zero-country":
+		p.ZeroCountry, err = strconv.ParseBool(value)
+	case "zero-vendor":
+		p.ZeroVendor, err = strconv.ParseBool(value)
+	case "zero-vendor-ouis":
+		p.ZeroVendorOUIs, err = parseOUIs(value)
+	case "decrypt":
+		p.Decrypt, err = strconv.ParseBool(value)
+	default:
+		err = fmt.Errorf("unknown policy option: %s", name)
+	}
+	return
+}
+
+// zeroVendorOUI returns true if oui is in ZeroVendorOUIs.
+func (p Policy) zeroVendorOUI(oui []byte) bool {
+	for _, o := range strings.Split(p.ZeroVendorOUIs, ",") {
+		if o == hex.EncodeToString(oui) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) String() string {
+	if p.ZeroVendorOUIs != "" {
+		return fmt.Sprintf("%s zero-vendor-ouis=%s", p.string(),
+			p.ZeroVendorOUIs)
+	}
+	return p.string()
+}
+
+func (p Policy) string() string {
+	return fmt.Sprintf("mac-oui=%s mac-nic=%s ipv4-src=%s ipv4-dst=%s "+
+		"ipv6-src=%s ipv6-dst=%s vlan=%s seq=%s can-id=%s zero-can-data=%t "+
+		"port=%s name=%s id=%s zero-timestamps=%t beacon-timestamps=%s "+
+		"zero-country=%t zero-vendor=%t decrypt=%t",
+		p.MACOUI, p.MACNIC, p.IPv4Src, p.IPv4Dst, p.IPv6Src, p.IPv6Dst, p.VLAN,
+		p.Seq, p.CANID, p.ZeroCANData, p.Port, p.Name, p.ID, p.ZeroTimestamps,
+		p.BeaconTimestamps, p.ZeroCountry, p.ZeroVendor, p.Decrypt)
+}
+
+// parseOUIs parses a comma separated list of OUIs in hex, with optional colon
+// or dash separators, returning it normalized to lower case without
+// separators.
+func parseOUIs(s string) (string, error) {
+	var ouis []string
+	for _, o := range strings.Split(s, ",") {
+		o = strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(o))
+		if o == "" {
+			continue
+		}
+		b, err := hex.DecodeString(o)
+		if err != nil || len(b) != 3 {
+			return "", fmt.Errorf("invalid OUI: %s", o)
+		}
+		ouis = append(ouis, hex.EncodeToString(b))
+	}
+	return strings.Join(ouis, ","), nil
+}
+
+func parseAnonMethod(s string) (m AnonMethod, err error) {
+	switch s {
+	case "encrypt":
+		m = Encrypt
+	case "pseudonym":
+		m = Pseudonym
+	case "leave":
+		m = Leave
+	default:
+		err = fmt.Errorf("unknown anonymization method: %s", s)
+	}
+	return
+}
+
+func parseVLANMethod(s string) (m VLANMethod, err error) {
+	switch s {
+	case "leave":
+		m = VLANLeave
+	case "pseudonym":
+		m = VLANPseudonym
+	case "zero":
+		m = VLANZero
+	default:
+		err = fmt.Errorf("unknown VLAN anonymization method: %s", s)
+	}
+	return
+}
+
+func parseSeqMethod(s string) (m SeqMethod, err error) {
+	switch s {
+	case "leave":
+		m = SeqLeave
+	case "resequence":
+		m = SeqResequence
+	case "zero":
+		m = SeqZero
+	default:
+		err = fmt.Errorf("unknown sequence number anonymization method: %s", s)
+	}
+	return
+}
+
+func parseTimestampMethod(s string) (m TimestampMethod, err error) {
+	switch s {
+	case "leave":
+		m = TimestampLeave
+	case "rebase":
+		m = TimestampRebase
+	case "zero":
+		m = TimestampZero
+	default:
+		err = fmt.Errorf("unknown timestamp anonymization method: %s", s)
+	}
+	return
+}
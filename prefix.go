@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var preservePrefixLen = flag.Int("preserve-prefix-len", 0,
+	"renumber the IPv4 addresses in each prefix of this length into a common "+
+		"pseudonym prefix (e.g. 24, 0 for none)")
+
+var preservePrefixLen6 = flag.Int("preserve-prefix-len6", 0,
+	"renumber the IPv6 addresses in each prefix of this length into a common "+
+		"pseudonym prefix (e.g. 64, 0 for none)")
+
+// PrefixMapper is an AddressMapper that renumbers the addresses in each
+// prefix of a given length into a common pseudonym prefix, for subnet
+// grouping without full prefix preservation. Each prefix gets a random,
+// unused pseudonym prefix, and each address a random, unused host part in
+// it. Addresses get their random pseudonym instead once all pseudonym
+// prefixes, or all host parts of their prefix, are used. Its state is kept in
+// state files, but as for a GeoMapper, pseudonyms from a pseudonym store
+// aren't known to the mapper.
+type PrefixMapper struct {
+	ipv4Len int
+	ipv6Len int
+
+	mu       sync.Mutex
+	prefixes map[[16]byte][16]byte
+	usedPfx  map[[16]byte]bool
+	used     map[[16]byte]bool
+}
+
+// NewPrefixMapper returns a new mapper for the given IPv4 and IPv6 prefix
+// lengths, where 0 leaves the pseudonyms of that family alone.
+func NewPrefixMapper(ipv4Len, ipv6Len int) *PrefixMapper {
+	return &PrefixMapper{
+		ipv4Len:  ipv4Len,
+		ipv6Len:  ipv6Len,
+		prefixes: make(map[[16]byte][16]byte),
+		usedPfx:  make(map[[16]byte]bool),
+		used:     make(map[[16]byte]bool),
+	}
+}
+
+// Map replaces p with an unused address in the pseudonym prefix of o.
+func (m *PrefixMapper) Map(o, p []byte) {
+	l := m.ipv6Len
+	if len(o) == net.IPv4len {
+		l = m.ipv4Len
+	}
+	if l == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op := to16(maskBits(o, l))
+	pp, ok := m.prefixes[op]
+	if !ok {
+		b := maskBits(p, l)
+		if !claim(b, 0, l, m.usedPfx) {
+			return
+		}
+		pp = to16(b)
+		m.prefixes[op] = pp
+	}
+	h := maskBits(p, l)
+	b := make([]byte, len(p))
+	for i := range b {
+		b[i] = pp[16-len(p)+i] | p[i]&^h[i]
+	}
+	if claim(b, l, len(b)*8, m.used) {
+		copy(p, b)
+	}
+}
+
+// Reset forgets the pseudonym prefixes and addresses chosen.
+func (m *PrefixMapper) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefixes = make(map[[16]byte][16]byte)
+	m.usedPfx = make(map[[16]byte]bool)
+	m.used = make(map[[16]byte]bool)
+}
+
+// prefixMapperState is the state of a PrefixMapper in a state file, with
+// addresses in hex in their 16 byte form.
+type prefixMapperState struct {
+	IPv4Len  int               `json:"ipv4_len"`
+	IPv6Len  int               `json:"ipv6_len"`
+	Prefixes map[string]string `json:"prefixes"`
+	Used     []string          `json:"used"`
+}
+
+// mapperState returns the pseudonym prefixes and addresses chosen.
+func (m *PrefixMapper) mapperState() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := prefixMapperState{
+		IPv4Len:  m.ipv4Len,
+		IPv6Len:  m.ipv6Len,
+		Prefixes: make(map[string]string),
+		Used:     hexKeys(m.used),
+	}
+	for o, p := range m.prefixes {
+		s.Prefixes[hex.EncodeToString(o[:])] = hex.EncodeToString(p[:])
+	}
+	return s
+}
+
+// loadMapperState restores the pseudonym prefixes and addresses chosen. It's
+// an error if the prefix lengths differ.
+func (m *PrefixMapper) loadMapperState(b []byte) (err error) {
+	var s prefixMapperState
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	if s.IPv4Len != m.ipv4Len || s.IPv6Len != m.ipv6Len {
+		return fmt.Errorf("state file prefix lengths differ: %d and %d",
+			s.IPv4Len, s.IPv6Len)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for o, p := range s.Prefixes {
+		var ok, pk [16]byte
+		if err = decodeHexKey(o, ok[:]); err != nil {
+			return
+		}
+		if err = decodeHexKey(p, pk[:]); err != nil {
+			return
+		}
+		m.prefixes[ok] = pk
+		m.usedPfx[pk] = true
+	}
+	for _, u := range s.Used {
+		var k [16]byte
+		if err = decodeHexKey(u, k[:]); err != nil {
+			return
+		}
+		m.used[k] = true
+	}
+	return
+}
+
+// maskBits returns a copy of b with all but the first l bits cleared.
+func maskBits(b []byte, l int) []byte {
+	m := make([]byte, len(b))
+	for i := range m {
+		switch n := l - i*8; {
+		case n >= 8:
+			m[i] = b[i]
+		case n > 0:
+			m[i] = b[i] & byte(0xff<<(8-n))
+		}
+	}
+	return m
+}
+
+// incBits increments the number in bits from through to-1 of b, wrapping to
+// zero.
+func incBits(b []byte, from, to int) {
+	for i := to - 1; i >= from; i-- {
+		m := byte(0x80 >> (i % 8))
+		if b[i/8] ^= m; b[i/8]&m != 0 {
+			return
+		}
+	}
+}
+
+// claim marks b used, after incrementing its bits from through to-1 until
+// it's unused. It returns false if all values of those bits are used.
+func claim(b []byte, from, to int, used map[[16]byte]bool) bool {
+	for s := to16(b); ; {
+		if k := to16(b); !used[k] {
+			used[k] = true
+			return true
+		}
+		if incBits(b, from, to); to16(b) == s {
+			return false
+		}
+	}
+}
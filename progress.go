@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var progressStr = flag.String("progress", "text",
+	"progress reporting for file inputs- none, text or json")
+
+// progressInterval is the interval between progress reports.
+const progressInterval = 10 * time.Second
+
+// Progress periodically reports progress through an input of known size.
+type Progress struct {
+	total int64
+	pos   int64
+	json  bool
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewProgress returns a Progress for the -progress flag and input f, or nil if
+// disabled or the input size is unknown.
+func NewProgress(f *os.File) (p *Progress, err error) {
+	var js bool
+	switch *progressStr {
+	case "none":
+		return
+	case "text":
+	case "json":
+		js = true
+	default:
+		err = fmt.Errorf("unknown progress format: %s", *progressStr)
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return
+	}
+	p = &Progress{
+		total: fi.Size(),
+		pos:   24, // pcap global header
+		json:  js,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	return
+}
+
+// Start starts reporting.
+func (p *Progress) Start() {
+	p.start = time.Now()
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reporting.
+func (p *Progress) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// add records n bytes of input processed.
+func (p *Progress) add(n int) {
+	atomic.AddInt64(&p.pos, int64(n))
+}
+
+// report prints the current progress.
+func (p *Progress) report() {
+	pos := atomic.LoadInt64(&p.pos)
+	el := time.Since(p.start)
+	pct := 100 * float64(pos) / float64(p.total)
+	rate := float64(pos) / el.Seconds()
+	var eta time.Duration
+	if rate > 0 {
+		eta = time.Duration(float64(p.total-pos) / rate * float64(time.Second))
+	}
+	if p.json {
+		b, _ := json.Marshal(struct {
+			Percent    float64 `json:"percent"`
+			Bytes      int64   `json:"bytes"`
+			Total      int64   `json:"total"`
+			Rate       float64 `json:"bytes_per_sec"`
+			ETASeconds float64 `json:"eta_seconds"`
+		}{pct, pos, p.total, rate, eta.Seconds()})
+		logRaw(LevelInfo, string(b))
+		return
+	}
+	printf("progress %.1f%%, %.1f MB/sec, ETA %s", pct, rate/1000000,
+		eta.Truncate(time.Second))
+}
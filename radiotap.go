@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// radiotap present bits (https://www.radiotap.org/fields/defined)
+const (
+	rtTSFT      = 0
+	rtFlags     = 1
+	rtChannel   = 3
+	rtSignal    = 5
+	rtTimestamp = 22
+	rtTLV       = 28
+	rtRadiotap  = 29
+	rtVendor    = 30
+	rtExt       = 31
+)
+
+// rtS1G is the S1G field's bit in the second present word.
+const rtS1G = 0
+
+// phyFamily is the 802.11 PHY family a frame was captured on, for the frame
+// formats that are specific to it.
+type phyFamily int
+
+const (
+	phyOther phyFamily = iota
+	phyS1G             // 802.11ah, below 1 GHz
+	phyDMG             // 802.11ad, 60 GHz
+)
+
+// rtFlagFCS is the radiotap flag for a frame that includes the FCS.
+const rtFlagFCS = 0x10
+
+// radiotapField is the alignment and size of a radiotap field.
+type radiotapField struct {
+	align int
+	size  int
+}
+
+// radiotapFields are the fields in the default namespace, by present bit.
+var radiotapFields = []radiotapField{
+	{8, 8},  // TSFT
+	{1, 1},  // flags
+	{1, 1},  // rate
+	{2, 4},  // channel
+	{1, 2},  // FHSS
+	{1, 1},  // antenna signal (dBm)
+	{1, 1},  // antenna noise (dBm)
+	{2, 2},  // lock quality
+	{2, 2},  // TX attenuation
+	{2, 2},  // TX attenuation (dB)
+	{1, 1},  // TX power (dBm)
+	{1, 1},  // antenna
+	{1, 1},  // antenna signal (dB)
+	{1, 1},  // antenna noise (dB)
+	{2, 2},  // RX flags
+	{2, 2},  // TX flags
+	{1, 1},  // RTS retries
+	{1, 1},  // data retries
+	{4, 8},  // XChannel
+	{1, 3},  // MCS
+	{4, 8},  // A-MPDU status
+	{2, 12}, // VHT
+	{8, 12}, // timestamp
+	{2, 12}, // HE
+	{2, 12}, // HE-MU
+	{2, 6},  // HE-MU-other-user
+	{1, 1},  // 0-length PSDU
+	{2, 4},  // L-SIG
+}
+
+// walk calls fn for each field in radiotap header b, which is truncated to
+// its length, with the field's present bit and data. For vendor namespaces, fn
+// is called once with bit rtVendor and the namespace's 6-byte header (OUI,
+// sub namespace and skip length) followed by its data. Walking stops without
+// error at the first field whose size isn't known, but it's an error if a
+// field exceeds the header length.
+func (h *RadiotapHeader) walk(b []byte, fn func(bit int, f []byte)) error {
+	off := 4 + 4*len(h.Present)
+	field := func(align, size int) ([]byte, error) {
+		off = (off + align - 1) &^ (align - 1)
+		if off+size > len(b) {
+			return nil, fmt.Errorf("radiotap field at %d exceeds header "+
+				"length %d", off, len(b))
+		}
+		f := b[off : off+size]
+		off += size
+		return f, nil
+	}
+	vendor := false
+	nsWord := 0
+	for _, w := range h.Present {
+		for bit := 0; bit < rtRadiotap; bit++ {
+			if w&(1<<uint(bit)) == 0 || vendor {
+				continue
+			}
+			if nsWord > 0 || bit == rtTLV {
+				return nil
+			}
+			rf := radiotapFields[bit]
+			f, err := field(rf.align, rf.size)
+			if err != nil {
+				return err
+			}
+			fn(bit, f)
+		}
+		switch {
+		case w&(1<<rtRadiotap) != 0:
+			vendor = false
+			nsWord = 0
+		case w&(1<<rtVendor) != 0:
+			vh, err := field(2, 6)
+			if err != nil {
+				return err
+			}
+			vl := int(binary.LittleEndian.Uint16(vh[4:]))
+			if _, err = field(1, vl); err != nil {
+				return err
+			}
+			fn(rtVendor, b[off-6-vl:off])
+			vendor = true
+			nsWord = 0
+		default:
+			nsWord++
+		}
+	}
+	return nil
+}
+
+// scrub passes the timestamps and vendor data in radiotap header b to the
+// anonymizer.
+func (h *RadiotapHeader) scrub(b []byte, anon Anonymizer) error {
+	return h.walk(b, func(bit int, f []byte) {
+		switch bit {
+		case rtTSFT:
+			anon.Timestamp(f)
+		case rtTimestamp:
+			anon.Timestamp(f[:8])
+		case rtVendor:
+			if len(f) > 6 {
+				anon.VendorData(f[6:], f[:3])
+			}
+		}
+	})
+}
+
+// flagsField returns the flags field in radiotap header b, or nil if it's not
+// present or the header can't be parsed.
+func (h *RadiotapHeader) flagsField(b []byte) (flags []byte) {
+	h.walk(b, func(bit int, f []byte) {
+		if bit == rtFlags {
+			flags = f
+		}
+	})
+	return
+}
+
+// fcs returns true if the flags in radiotap header b show the frame includes
+// the FCS.
+func (h *RadiotapHeader) fcs(b []byte) bool {
+	f := h.flagsField(b)
+	return f != nil && f[0]&rtFlagFCS != 0
+}
+
+// phy returns the PHY family shown by the S1G field or channel frequency in
+// radiotap header b, or phyOther if neither is present.
+func (h *RadiotapHeader) phy(b []byte) (p phyFamily) {
+	if len(h.Present) > 1 && h.Present[0]&(1<<rtVendor|1<<rtRadiotap) == 0 &&
+		h.Present[1]&(1<<rtS1G) != 0 {
+		return phyS1G
+	}
+	h.walk(b, func(bit int, f []byte) {
+		if bit != rtChannel {
+			return
+		}
+		switch mhz := binary.LittleEndian.Uint16(f); {
+		case mhz > 0 && mhz < 1000:
+			p = phyS1G
+		case mhz >= 57000:
+			p = phyDMG
+		}
+	})
+	return
+}
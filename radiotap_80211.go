@@ -3,19 +3,29 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"strings"
 )
 
 const (
-	typeMgmt     uint = 0
-	typeControl       = 1
-	typeData          = 2
-	typeReserved      = 3
+	typeMgmt      uint = 0
+	typeControl        = 1
+	typeData           = 2
+	typeExtension      = 3
 )
 
+// extension frame subtypes
 const (
-	cfWrapper     uint = 0x7
+	extDMGBeacon uint = 0x0
+	extS1GBeacon      = 0x1
+)
+
+const (
+	cfExtension   uint = 0x6
+	cfWrapper          = 0x7
 	cfBlockAckReq      = 0x8
 	cfBlockAck         = 0x9
 	cfPSPoll           = 0xa
@@ -29,27 +39,128 @@ const (
 // map of control frame subtypes to number of MACs
 // Wireshark: (wlan.fc.type eq 1) and (wlan.fc.subtype eq 8)
 var cfMACs = map[uint]int{
-	cfWrapper:     1, // haven't seen, expect 1
+	cfWrapper:     1, // RA, then the rest of the carried frame
 	cfBlockAckReq: 2, // ok
 	cfBlockAck:    2, // ok
-	cfPSPoll:      1, // haven't seen, expect 1
+	cfPSPoll:      2, // BSSID, TA
 	cfRTS:         2, // ok
 	cfCTS:         1, // ok
 	cfACK:         1, // ok
-	cfEnd:         1, // haven't seen, expect 1
-	cfEndAck:      2, // haven't seen, expect 2
+	cfEnd:         2, // RA, BSSID
+	cfEndAck:      2, // RA, BSSID
+}
+
+// map of DMG control frame extensions to number of MACs, all RA and TA
+var dmgMACs = map[uint]int{
+	0x2: 2, // Poll
+	0x3: 2, // SPR
+	0x4: 2, // Grant
+	0x5: 2, // DMG CTS
+	0x6: 2, // DMG DTS
+	0x7: 2, // Grant Ack
+	0x8: 2, // SSW
+	0x9: 2, // SSW-Feedback
+	0xa: 2, // SSW-Ack
 }
 
+// maxAID is the highest valid association ID.
+const maxAID = 2007
+
+const (
+	mgmtProbeResp   uint = 0x5
+	mgmtBeacon           = 0x8
+	mgmtAction           = 0xd
+	mgmtActionNoAck      = 0xe
+)
+
+// information element IDs
+const (
+	ieCountry = 7
+	ieVendor  = 221
+)
+
 const qosMask = 0x8
 
+const protectedMask = 0x40
+
+var fcsStr = flag.String("fcs", "leave",
+	"802.11 and 802.15.4 FCS handling with -no-truncate- leave, strip or "+
+		"recompute")
+
+// FCSMethod is the method for handling 802.11 and 802.15.4 FCSs in
+// untruncated packets.
+type FCSMethod int
+
+const (
+	// FCSLeave leaves the FCS as it was, which is invalid if fields changed.
+	FCSLeave FCSMethod = iota
+
+	// FCSStrip removes the FCS. 802.15.4 FCSs are left alone, as their link
+	// type includes them.
+	FCSStrip
+
+	// FCSRecompute recomputes the FCS after anonymization.
+	FCSRecompute
+)
+
+// fcsMethod is the FCS method, set from -fcs.
+var fcsMethod FCSMethod
+
+// parseFCSMethod sets fcsMethod from the -fcs flag.
+func parseFCSMethod() error {
+	switch *fcsStr {
+	case "leave":
+		fcsMethod = FCSLeave
+	case "strip":
+		fcsMethod = FCSStrip
+	case "recompute":
+		fcsMethod = FCSRecompute
+	default:
+		return fmt.Errorf("unknown FCS method: %s", *fcsStr)
+	}
+	return nil
+}
+
+var wlanTypesStr = flag.String("wlan-types", "",
+	"802.11 frame types to output, a comma separated list of mgmt, ctrl, "+
+		"data and ext (default all)")
+
+// wlanTypes is a mask of the 802.11 frame types to keep, by bit (1 << type),
+// set from -wlan-types. If zero, all types are kept.
+var wlanTypes uint
+
+// parseWLANTypes sets wlanTypes from the -wlan-types flag.
+func parseWLANTypes() error {
+	wlanTypes = 0
+	if *wlanTypesStr == "" {
+		return nil
+	}
+	for _, t := range strings.Split(*wlanTypesStr, ",") {
+		switch strings.TrimSpace(t) {
+		case "mgmt":
+			wlanTypes |= 1 << typeMgmt
+		case "ctrl":
+			wlanTypes |= 1 << typeControl
+		case "data":
+			wlanTypes |= 1 << typeData
+		case "ext":
+			wlanTypes |= 1 << typeExtension
+		default:
+			return fmt.Errorf("unknown 802.11 frame type: %s", t)
+		}
+	}
+	return nil
+}
+
 // Radiotap80211Handler anonymizes radiotap + 802.11 data.
 type Radiotap80211Handler struct {
 }
 
 // Handle anonymizes one packet.
 func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	end := len(b)
 	slurp := func(x int, inc bool) error {
-		if n+x > len(b) {
+		if n+x > end {
 			return fmt.Errorf(
 				"short packet trying to slurp %d bytes at pos %d (increase snaplen)",
 				x, n)
@@ -66,6 +177,43 @@ func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err err
 		return
 	}
 	n = int(rh.Len)
+	if n > len(b) {
+		err = fmt.Errorf("radiotap length %d exceeds packet length %d", n,
+			len(b))
+		return
+	}
+
+	// timestamps and vendor data
+	if err = rh.scrub(b[:n], anon); err != nil {
+		return
+	}
+
+	// the frame ends before any FCS
+	if rh.fcs(b[:n]) {
+		if end -= 4; end < n {
+			err = fmt.Errorf("short packet with FCS (increase snaplen)")
+			return
+		}
+	}
+
+	// S1G frames may have the short PV1 header, and DMG frames control frame
+	// extensions, which are only parsed for those PHYs
+	phy := rh.phy(b[:rh.Len])
+	if err = slurp(1, false); err != nil {
+		return
+	}
+	switch b[n] & 0x3 {
+	case 0:
+	case 1:
+		if phy != phyS1G {
+			err = unknownProtocol("802.11 PV1 outside of S1G")
+			return
+		}
+		return handlePV1(b[:end], n, anon)
+	default:
+		err = unknownProtocol("802.11 protocol version %d", b[n]&0x3)
+		return
+	}
 
 	// frame control and flags
 	r = bytes.NewBuffer(b[n:])
@@ -82,22 +230,19 @@ func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err err
 	n++
 	tods, fromds, order := parseFlags(flags)
 
-	// duration/ID
-	if err = slurp(2, true); err != nil {
+	// duration/ID, which is the AID in PS-Poll frames, with the two high bits
+	// set
+	if err = slurp(2, false); err != nil {
 		return
 	}
-
-	const (
-		cfWrapper     = 0x7
-		cfBlockAckReq = 0x8
-		cfBlockAck    = 0x9
-		cfPSPoll      = 0xa
-		cfRTS         = 0xb
-		cfCTS         = 0xc
-		cfACK         = 0xd
-		cfEnd         = 0xe
-		cfEndAck      = 0xf
-	)
+	if typ == typeControl && styp == cfPSPoll {
+		aid := binary.LittleEndian.Uint16(b[n:])
+		if aid&0xc000 != 0xc000 || aid&0x3fff == 0 || aid&0x3fff > maxAID {
+			err = ErrUnknown
+			return
+		}
+	}
+	n += 2
 
 	// macs
 	var nmacs int
@@ -106,30 +251,65 @@ func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err err
 		nmacs = 3
 	case typeControl:
 		nm, ok := cfMACs[styp]
+		if styp == cfExtension && phy == phyDMG {
+			nm, ok = dmgMACs[uint(flags&0xf)]
+		}
 		if !ok {
-			panic(fmt.Sprintf("invalid control frame subtype: 0x%x", styp))
+			err = unknownProtocol("802.11 control subtype %d", styp)
+			return
 		}
 		nmacs = nm
 	case typeData:
 		nmacs = 3
+	case typeExtension:
+		if styp != extDMGBeacon && styp != extS1GBeacon {
+			err = unknownProtocol("802.11 extension subtype %d", styp)
+			return
+		}
+		nmacs = 1
 	default:
-		panic("impossible 802.11 type reserved")
+		err = ErrUnknown
+		return
 	}
 
-	// up to first three macs
+	// up to first three macs, keeping the original transmitter address
+	var ta [6]byte
+	var anonTA []byte
+	// and the original BSSID, to tell the stations from it
+	bi, si := bssidIndex(typ, styp, tods, fromds)
+	var bssid []byte
+	if bi >= 0 && bi < nmacs && n+6*(bi+1) <= end {
+		bssid = append(bssid, b[n+6*bi:n+6*(bi+1)]...)
+	}
 	for i := 0; i < nmacs; i++ {
 		if err = slurp(6, false); err != nil {
 			return
 		}
+		if i == 1 || typ == typeExtension {
+			copy(ta[:], b[n:n+6])
+			anonTA = b[n : n+6]
+		}
+		if bssid != nil && b[n]&0x01 == 0 {
+			if i == bi {
+				annotate(anon, roleBSSID)
+			}
+			for _, j := range si {
+				if i == j && !bytes.Equal(b[n:n+6], bssid) {
+					annotate(anon, roleStation)
+				}
+			}
+		}
 		anon.MAC(b[n : n+6])
 		n += 6
 	}
 
 	// sequence control
-	if typ != typeControl {
-		if err = slurp(2, true); err != nil {
+	if typ == typeMgmt || typ == typeData {
+		if err = slurp(2, false); err != nil {
 			return
 		}
+		anon.Sequence(b[n:n+2], ta[:], anonTA)
+		n += 2
 	}
 
 	// fourth mac for tods && fromds
@@ -150,11 +330,21 @@ func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err err
 		}
 	}
 
-	// carried frame control
+	// carried frame control, which must be for a control frame other than
+	// another wrapper
+	var carriedMACs int
 	if typ == typeControl && styp == cfWrapper {
-		if err = slurp(2, true); err != nil {
+		if err = slurp(2, false); err != nil {
+			return
+		}
+		_, ctyp, cstyp := parseFC(b[n])
+		nm, ok := cfMACs[cstyp]
+		if ctyp != typeControl || cstyp == cfWrapper || !ok {
+			err = ErrUnknown
 			return
 		}
+		carriedMACs = nm - 1
+		n += 2
 	}
 
 	// ht control (https://mrncciew.com/2014/10/20/cwap-ht-control-field/)
@@ -165,19 +355,249 @@ func (h *Radiotap80211Handler) Handle(b []byte, anon Anonymizer) (n int, err err
 		}
 	}
 
+	// rest of the carried frame's macs, after the RA it shares with the wrapper
+	for i := 0; i < carriedMACs; i++ {
+		if err = slurp(6, false); err != nil {
+			return
+		}
+		anon.MAC(b[n : n+6])
+		n += 6
+	}
+
+	// DMG beacon timestamp, from the BSSID
+	if typ == typeExtension && styp == extDMGBeacon {
+		if err = slurp(8, false); err != nil {
+			return
+		}
+		anon.BeaconTimestamp(b[n:n+8], ta[:])
+		n += 8
+	}
+
+	// beacon and probe response fixed fields, then the information elements,
+	// which are scrubbed but not handled, so are kept only with -no-truncate
+	if typ == typeMgmt && (styp == mgmtBeacon || styp == mgmtProbeResp) {
+		if err = slurp(12, false); err != nil {
+			return
+		}
+		anon.BeaconTimestamp(b[n:n+8], ta[:])
+		n += 12
+		scrubIEs(b[n:end], anon)
+	}
+
+	// action frame fixed fields, unless the body is encrypted
+	if typ == typeMgmt && (styp == mgmtAction || styp == mgmtActionNoAck) &&
+		flags&protectedMask == 0 {
+		n, err = handleAction(b[:end], n, anon)
+	}
+
 	return
 }
 
+// handlePV1 anonymizes an S1G frame with the short PV1 MAC header at offset n
+// in b, which is truncated before any FCS. Only QoS data frames are
+// understood. One of the first two addresses is a 2-byte SID, holding the AID
+// of the non-AP station and flags for whether the third and fourth addresses
+// are present, and the other is a MAC.
+func handlePV1(b []byte, n int, anon Anonymizer) (int, error) {
+	const (
+		pv1QoSData  = 0
+		sidA3       = 0x2000
+		sidA4       = 0x4000
+		pv1FromDS   = 0x0200
+		pv1TypeMask = 0x7
+	)
+	if n+2 > len(b) {
+		return n, fmt.Errorf("short packet trying to slurp 2 bytes at pos %d "+
+			"(increase snaplen)", n)
+	}
+	fc := binary.LittleEndian.Uint16(b[n:])
+	if t := (fc >> 2) & pv1TypeMask; t != pv1QoSData {
+		return n, unknownProtocol("802.11 PV1 type %d", t)
+	}
+	if n+18 > len(b) {
+		return n, fmt.Errorf("short PV1 header at pos %d (increase snaplen)",
+			n)
+	}
+	n += 2
+
+	// A1 and A2, keeping the transmitter address, which is the SID when not
+	// from the DS
+	var sid uint16
+	var ta [6]byte
+	var anonTA []byte
+	if fc&pv1FromDS != 0 {
+		sid = binary.LittleEndian.Uint16(b[n:])
+		copy(ta[:], b[n+2:n+8])
+		anonTA = b[n+2 : n+8]
+		anon.MAC(b[n+2 : n+8])
+	} else {
+		anon.MAC(b[n : n+6])
+		sid = binary.LittleEndian.Uint16(b[n+6:])
+		copy(ta[:], b[n+6:n+8])
+		anonTA = ta[:]
+	}
+	n += 8
+
+	// sequence control
+	anon.Sequence(b[n:n+2], ta[:], anonTA)
+	n += 2
+
+	// A3 and A4, if present
+	for _, f := range []uint16{sidA3, sidA4} {
+		if sid&f == 0 {
+			continue
+		}
+		if n+6 > len(b) {
+			return n, fmt.Errorf("short packet trying to slurp 6 bytes at "+
+				"pos %d (increase snaplen)", n)
+		}
+		anon.MAC(b[n : n+6])
+		n += 6
+	}
+	return n, nil
+}
+
+// scrubIEs passes the country and vendor specific IEs in b to the anonymizer,
+// stopping at the first IE that exceeds b.
+func scrubIEs(b []byte, anon Anonymizer) {
+	for len(b) >= 2 {
+		id, l := b[0], int(b[1])
+		if 2+l > len(b) {
+			return
+		}
+		ie := b[2 : 2+l]
+		switch id {
+		case ieCountry:
+			anon.Country(ie)
+		case ieVendor:
+			if l > 3 {
+				anon.VendorData(ie[3:], ie[:3])
+			}
+		}
+		b = b[2+l:]
+	}
+}
+
+// Keep returns true if the 802.11 frame type is selected by -wlan-types. PV1
+// frames are classed by their equivalent PV0 type, and frames that can't be
+// parsed are kept, for Handle to report.
+func (h *Radiotap80211Handler) Keep(b []byte) bool {
+	if wlanTypes == 0 {
+		return true
+	}
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(b)) != nil || int(rh.Len) >= len(b) {
+		return true
+	}
+	fc := b[rh.Len]
+	var typ uint
+	switch fc & 0x3 {
+	case 0:
+		_, typ, _ = parseFC(fc)
+	case 1:
+		// PV1 types are QoS data, management and control
+		switch (fc >> 2) & 0x7 {
+		case 0:
+			typ = typeData
+		case 1:
+			typ = typeMgmt
+		case 2:
+			typ = typeControl
+		default:
+			return true
+		}
+	default:
+		return true
+	}
+	return wlanTypes&(1<<typ) != 0
+}
+
+// Trailer updates the FCS of a packet, if the radiotap flags show one is
+// present. If truncated, the FCS was removed, so the flag is cleared. If not,
+// it's left alone, stripped or recomputed according to -fcs.
+func (h *Radiotap80211Handler) Trailer(b []byte, truncated bool) int {
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(b)) != nil || int(rh.Len) > len(b) {
+		return len(b)
+	}
+	f := rh.flagsField(b[:rh.Len])
+	if f == nil || f[0]&rtFlagFCS == 0 {
+		return len(b)
+	}
+	if truncated {
+		f[0] &^= rtFlagFCS
+		return len(b)
+	}
+	if len(b)-4 < int(rh.Len) {
+		return len(b)
+	}
+	switch fcsMethod {
+	case FCSStrip:
+		f[0] &^= rtFlagFCS
+		return len(b) - 4
+	case FCSRecompute:
+		binary.LittleEndian.PutUint32(b[len(b)-4:],
+			crc32.ChecksumIEEE(b[rh.Len:len(b)-4]))
+	}
+	return len(b)
+}
+
+// TrailerLen returns 4 and the offset of the radiotap flags if the packet has
+// an FCS, or 0 and -1 if not.
+func (h *Radiotap80211Handler) TrailerLen(b []byte) (n int, flag int) {
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(b)) != nil || int(rh.Len) > len(b) ||
+		len(b)-4 < int(rh.Len) {
+		return 0, -1
+	}
+	f := rh.flagsField(b[:rh.Len])
+	if f == nil || f[0]&rtFlagFCS == 0 {
+		return 0, -1
+	}
+	return 4, cap(b) - cap(f)
+}
+
 // RadiotapHeader is a Radiotap header
 type RadiotapHeader struct {
 	Version uint8
 	Pad     uint8
 	Len     uint16
-	Present uint32
+
+	// Present is the chain of present words, each but the last with the EXT
+	// bit set.
+	Present []uint32
 }
 
-func (h *RadiotapHeader) Read(r io.Reader) error {
-	return binary.Read(r, binary.LittleEndian, h)
+// Read reads the header, including the full chain of present words. It's an
+// error if the version is unknown or the present words exceed the length.
+func (h *RadiotapHeader) Read(r io.Reader) (err error) {
+	var f struct {
+		Version uint8
+		Pad     uint8
+		Len     uint16
+	}
+	if err = binary.Read(r, binary.LittleEndian, &f); err != nil {
+		return
+	}
+	h.Version, h.Pad, h.Len = f.Version, f.Pad, f.Len
+	if h.Version != 0 {
+		return fmt.Errorf("unsupported radiotap version %d", h.Version)
+	}
+	h.Present = h.Present[:0]
+	for {
+		if 4+4*(len(h.Present)+1) > int(h.Len) {
+			return fmt.Errorf("radiotap present words exceed header length %d",
+				h.Len)
+		}
+		var w uint32
+		if err = binary.Read(r, binary.LittleEndian, &w); err != nil {
+			return
+		}
+		h.Present = append(h.Present, w)
+		if w&(1<<rtExt) == 0 {
+			return
+		}
+	}
 }
 
 func parseFC(fc uint8) (ver uint, typ uint, styp uint) {
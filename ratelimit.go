@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimitStr = flag.String("rate-limit", "",
+	"for live captures, drop packets beyond a rate in packets per second "+
+		"(e.g. 10000pps), bits per second (e.g. 100Mbit) or both, separated "+
+		"by a comma")
+
+var maxCPU = flag.Float64("max-cpu", 0,
+	"for live captures, drop packets while processing them would use more "+
+		"than this percent of one CPU (e.g. 50)")
+
+// rateUnits are the units of rate limits, in packets or bits per second.
+var rateUnits = []struct {
+	suffix string
+	bits   bool
+	scale  float64
+}{
+	{"pps", false, 1},
+	{"kbit", true, 1e3},
+	{"Mbit", true, 1e6},
+	{"Gbit", true, 1e9},
+	{"bit", true, 1},
+}
+
+// Limiter drops packets beyond a packet or bit rate, or a budget of
+// processing time, so a live capture arriving faster than it can be
+// anonymized, such as on a busy edge router, is cut back to what it can
+// handle rather than queued without bound. Each limit is a token bucket
+// holding up to one second of its rate, refilled by wall-clock time, so
+// short bursts are allowed. Processing time is the wall time between reading
+// a packet and starting to read the next, which for a single run
+// approximates the CPU time used. A Limiter may be shared by concurrent runs,
+// such as those of a server, which are then limited together.
+type Limiter struct {
+	// PacketRate is the packets per second allowed, or 0 for no limit.
+	PacketRate float64
+
+	// BitRate is the bits per second of captured data allowed, or 0 for no
+	// limit.
+	BitRate float64
+
+	// CPU is the fraction of one CPU that may be spent processing packets,
+	// or 0 for no limit.
+	CPU float64
+
+	// Dropped is the number of packets dropped.
+	Dropped uint64
+
+	mu      sync.Mutex
+	last    time.Time
+	packets float64
+	bits    float64
+	cpu     float64
+}
+
+// NewLimiter returns a new limiter for the rate limits s, as given with
+// -rate-limit, and a CPU budget in percent of one CPU, or nil if there are
+// no limits.
+func NewLimiter(s string, cpu float64) (l *Limiter, err error) {
+	if cpu < 0 {
+		err = fmt.Errorf("invalid CPU budget: %g", cpu)
+		return
+	}
+	m := &Limiter{CPU: cpu / 100}
+	if s != "" {
+		for _, r := range strings.Split(s, ",") {
+			if err = m.parseRate(strings.TrimSpace(r)); err != nil {
+				return
+			}
+		}
+	}
+	if m.PacketRate == 0 && m.BitRate == 0 && m.CPU == 0 {
+		return
+	}
+	m.packets, m.bits, m.cpu = m.PacketRate, m.BitRate, m.CPU
+	l = m
+	return
+}
+
+// parseRate sets the packet or bit rate from r, a number with a unit, or
+// packets per second without one.
+func (l *Limiter) parseRate(r string) (err error) {
+	v, bits, scale := r, false, 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(r, u.suffix) {
+			v, bits, scale = strings.TrimSuffix(r, u.suffix), u.bits, u.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		err = fmt.Errorf("invalid rate limit: %s", r)
+		return
+	}
+	if bits {
+		l.BitRate = f * scale
+	} else {
+		l.PacketRate = f
+	}
+	return
+}
+
+// admit reports if a packet of n captured bytes is within the limits, after
+// spent processing time was used for the previous packet, counting it as
+// dropped if not.
+func (l *Limiter) admit(n int, spent time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		e := now.Sub(l.last).Seconds()
+		l.packets = refill(l.packets, l.PacketRate, e)
+		l.bits = refill(l.bits, l.BitRate, e)
+		l.cpu = refill(l.cpu, l.CPU, e)
+	}
+	l.last = now
+	l.cpu -= spent.Seconds()
+	if l.PacketRate > 0 && l.packets < 1 ||
+		l.BitRate > 0 && l.bits < float64(8*n) ||
+		l.CPU > 0 && l.cpu <= 0 {
+		l.Dropped++
+		return false
+	}
+	l.packets--
+	l.bits -= float64(8 * n)
+	return true
+}
+
+// refill returns the tokens t in a bucket for rate after e seconds, up to
+// one second of the rate.
+func refill(t, rate, e float64) float64 {
+	if t += rate * e; t > rate {
+		t = rate
+	}
+	return t
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BSD address families for IPv6, which vary by OS
+var nullIPv6Families = map[uint32]bool{24: true, 28: true, 30: true}
+
+// NullHandler anonymizes BSD loopback packets, with a 4-byte address family
+// in the capturing host's byte order.
+type NullHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *NullHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 4 {
+		err = fmt.Errorf("short loopback header (increase snaplen)")
+		return
+	}
+	af := binary.LittleEndian.Uint32(b)
+	if af > 0xffff {
+		af = binary.BigEndian.Uint32(b)
+	}
+	switch {
+	case af == afInet:
+		return handleIPv4(b, 4, anon)
+	case nullIPv6Families[af]:
+		return handleIPv6(b, 4, anon)
+	}
+	return 4, unknownProtocol("address family %d", af)
+}
+
+// RawHandler anonymizes raw IPv4 and IPv6 packets.
+type RawHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *RawHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < 1 {
+		err = fmt.Errorf("short raw IP packet (increase snaplen)")
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return handleIPv4(b, 0, anon)
+	case 6:
+		return handleIPv6(b, 0, anon)
+	}
+	return 0, unknownProtocol("IP version %d", b[0]>>4)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"net"
+)
+
+var tcpReassembly = flag.Bool("tcp-reassembly", false,
+	"with -no-truncate, reassemble TCP streams to anonymize FTP, HTTP and "+
+		"SIP messages, including those spanning segments")
+
+var tcpReassemblyMax = flag.Int("tcp-reassembly-max", 4<<20,
+	"with -tcp-reassembly, the most bytes of packets held for incomplete "+
+		"messages, beyond which the oldest stream is released unchanged")
+
+// tcpProtocol is the IP protocol number of TCP.
+const tcpProtocol = 6
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+)
+
+// streamHistory is the most rewritten data kept for each stream, so
+// retransmissions of it are rewritten alike.
+const streamHistory = 16 * 1024
+
+// flowKey identifies a unidirectional flow by its anonymized 5-tuple, with
+// IPv4 addresses in their IPv4-mapped IPv6 form.
+type flowKey struct {
+	proto   uint8
+	src     [16]byte
+	dst     [16]byte
+	srcPort uint16
+	dstPort uint16
+}
+
+// StreamRewriter anonymizes the messages of an application protocol in a
+// reassembled TCP stream. A StreamRewriter is made for each stream, so it may
+// keep the state of the stream.
+type StreamRewriter interface {
+	// Rewrite anonymizes the message at the start of b in place, keeping its
+	// length, so the changes map back onto the segments that carried it. It
+	// returns the length of the message, which may be more than len(b) for
+	// a body that's left alone, 0 if the message isn't complete, or -1 if
+	// the stream can't be followed. Data sent by the server, from the port
+	// the rewriter is bound to, has fromServer set.
+	Rewrite(b []byte, fromServer bool, anon Anonymizer) int
+}
+
+// StreamRewriters make the rewriters for TCP streams by server port, and say
+// if they rewrite the data sent by the server too.
+var StreamRewriters = map[uint16]struct {
+	New    func() StreamRewriter
+	Server bool
+}{
+	21:   {newFTPRewriter, true},
+	80:   {newHTTPRewriter, false},
+	8080: {newHTTPRewriter, false},
+	5060: {newSIPRewriter, true},
+}
+
+// TCPReassembly reassembles the TCP streams of application protocols with a
+// StreamRewriter, so messages spanning segments can be anonymized. As an
+// Anonymizer, it wraps another to find the outer IP header of each packet
+// from the first address anonymized in it. As a PacketWriter, it wraps the
+// output, holding packets with segments of incomplete messages, and those
+// written after them, so the order is kept. Once a message is complete, it's
+// rewritten, the changes are copied back into the segments that carried it,
+// and the packets are released.
+//
+// Only in-order data is rewritten, and retransmissions of recent data are
+// rewritten alike. A stream with a gap, such as from a lost or truncated
+// segment, or a message that can't be parsed, is abandoned, releasing its
+// packets unchanged from then on. The stream holding the oldest packet is
+// abandoned too if more than max bytes are held. Incomplete messages at the
+// end of a stream or the input are released unchanged.
+type TCPReassembly struct {
+	Anonymizer
+
+	// Rewritten is the number of messages rewritten.
+	Rewritten uint64
+
+	// Abandoned is the number of streams abandoned.
+	Abandoned uint64
+
+	rewrite Anonymizer
+	max     int
+	pkt     []byte
+	hdr     int
+	streams map[flowKey]*tcpStream
+
+	// w and h are the output and handler of the current run, and trailer is
+	// set by run if the packet to be written has a trailer to update.
+	w       PacketWriter
+	h       Handler
+	trailer bool
+
+	queue []*heldPacket
+	held  int
+}
+
+// heldPacket is a packet written while packets are held.
+type heldPacket struct {
+	ph      PacketHeader
+	b       []byte
+	comment string
+	trailer bool
+	changed bool
+
+	// stream, if not nil, is the stream holding the packet.
+	stream *tcpStream
+}
+
+// tcpStream is one direction of a TCP connection with a StreamRewriter.
+type tcpStream struct {
+	newRewriter func() StreamRewriter
+	rewriter    StreamRewriter
+	fromServer  bool
+	started     bool
+	abandoned   bool
+
+	// seq is the sequence number of data, the stream data not yet rewritten,
+	// and segs are the segments of held packets that carry it.
+	seq  uint32
+	data []byte
+	segs []streamSeg
+
+	// skip is the length of a body left alone still to come.
+	skip int
+
+	// hist is the last rewritten data, before seq.
+	hist []byte
+}
+
+// streamSeg is the part of a TCP segment at offset off in a held packet,
+// that carries n bytes at offset at in its stream's data.
+type streamSeg struct {
+	p   *heldPacket
+	off int
+	at  int
+	n   int
+}
+
+// NewTCPReassembly returns a new TCPReassembly wrapping a, rewriting messages
+// with rewrite, which should not record fields, and holding at most max
+// bytes.
+func NewTCPReassembly(a, rewrite Anonymizer, max int) *TCPReassembly {
+	return &TCPReassembly{
+		Anonymizer: a,
+		rewrite:    rewrite,
+		max:        max,
+		streams:    make(map[flowKey]*tcpStream),
+	}
+}
+
+// Begin starts finding the IP header of packet b.
+func (t *TCPReassembly) Begin(b []byte) {
+	t.pkt = b
+	t.hdr = -1
+}
+
+// IPv4 anonymizes an IPv4 address, recording the IP header of the first
+// source address.
+func (t *TCPReassembly) IPv4(b []byte, role Role) {
+	t.Anonymizer.IPv4(b, role)
+	if t.hdr < 0 && role == Src {
+		t.hdr = ipHeader(t.pkt, b, 12, 4)
+	}
+}
+
+// IPv6 anonymizes an IPv6 address, recording the IP header of the first
+// source address.
+func (t *TCPReassembly) IPv6(b []byte, role Role) {
+	t.Anonymizer.IPv6(b, role)
+	if t.hdr < 0 && role == Src {
+		t.hdr = ipHeader(t.pkt, b, 8, 6)
+	}
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (t *TCPReassembly) Stats() (s AnonymizerStats) {
+	if sa, ok := t.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (t *TCPReassembly) Err() (err error) {
+	if ea, ok := t.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// packetWriter returns the PacketWriter for a run writing to w, with packets
+// handled by h.
+func (t *TCPReassembly) packetWriter(w PacketWriter, h Handler) PacketWriter {
+	t.w, t.h = w, h
+	return t
+}
+
+// WriteHeader writes the header to the output.
+func (t *TCPReassembly) WriteHeader(gh *GlobalHeader) error {
+	return t.w.WriteHeader(gh)
+}
+
+// WritePacket adds any TCP segment in the packet to its stream, writing the
+// packet if nothing is held, and otherwise holding it, and writing those
+// released.
+func (t *TCPReassembly) WritePacket(ph *PacketHeader, b []byte,
+	comment string) error {
+	p := &heldPacket{ph: *ph, b: b, comment: comment, trailer: t.trailer}
+	t.add(p)
+	if p.stream == nil && len(t.queue) == 0 {
+		return t.out(p)
+	}
+	// the packet may share its buffer with the input
+	p.b = append([]byte(nil), p.b...)
+	t.queue = append(t.queue, p)
+	t.held += len(p.b)
+	return t.flush()
+}
+
+// Close releases the packets held for all streams, and writes them.
+func (t *TCPReassembly) Close() error {
+	for k, s := range t.streams {
+		t.release(s)
+		delete(t.streams, k)
+	}
+	return t.flush()
+}
+
+// flush writes the packets at the front of the queue that aren't held,
+// abandoning the stream holding the oldest while more than max bytes are
+// held.
+func (t *TCPReassembly) flush() (err error) {
+	for len(t.queue) > 0 {
+		p := t.queue[0]
+		if p.stream != nil {
+			if t.held <= t.max {
+				return
+			}
+			t.abandon(p.stream)
+		}
+		t.queue[0] = nil
+		t.queue = t.queue[1:]
+		t.held -= len(p.b)
+		if err = t.out(p); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// out writes a packet, updating its trailer if it was rewritten.
+func (t *TCPReassembly) out(p *heldPacket) error {
+	if p.changed && p.trailer {
+		p.b = updateTrailer(t.h, p.b, false)
+		p.ph.Len = uint32(len(p.b))
+	}
+	return t.w.WritePacket(&p.ph, p.b, p.comment)
+}
+
+// add adds the TCP segment in packet p, if any, to its stream, if it has a
+// rewriter.
+func (t *TCPReassembly) add(p *heldPacket) {
+	k, seq, flags, start, end, ok := t.segment(p.b)
+	if !ok {
+		return
+	}
+	s := t.streams[k]
+	if s == nil {
+		r, ok := StreamRewriters[k.dstPort]
+		fromServer := false
+		if !ok {
+			if r, ok = StreamRewriters[k.srcPort]; !ok || !r.Server {
+				return
+			}
+			fromServer = true
+		}
+		s = &tcpStream{newRewriter: r.New, rewriter: r.New(),
+			fromServer: fromServer}
+		t.streams[k] = s
+	}
+	if flags&tcpSYN != 0 {
+		// a new connection, whose data starts after the SYN
+		t.release(s)
+		*s = tcpStream{newRewriter: s.newRewriter, rewriter: s.newRewriter(),
+			fromServer: s.fromServer, started: true, seq: seq + 1}
+		seq++
+	} else if !s.started {
+		s.seq, s.started = seq, true
+	}
+	if !s.abandoned && end > start {
+		t.data(s, p, seq, start, end-start)
+	}
+	if flags&(tcpFIN|tcpRST) != 0 {
+		t.release(s)
+		delete(t.streams, k)
+	}
+}
+
+// data adds the n bytes of stream data with sequence number seq, at offset off
+// in packet p, to stream s, and rewrites the messages completed.
+func (t *TCPReassembly) data(s *tcpStream, p *heldPacket, seq uint32, off,
+	n int) {
+	at := int(int32(seq - s.seq))
+	if at > len(s.data) {
+		// data is missing
+		t.abandon(s)
+		return
+	}
+	if at < 0 {
+		// a retransmission of data already rewritten
+		r := -at
+		if r > n {
+			r = n
+		}
+		t.retransmit(s, p, seq, off, r)
+		if r == n {
+			return
+		}
+		off, n, at = off+r, n-r, 0
+	}
+	if at+n > len(s.data) {
+		s.data = append(s.data, p.b[off+len(s.data)-at:off+n]...)
+	}
+	s.segs = append(s.segs, streamSeg{p, off, at, n})
+	p.stream = s
+	for len(s.data) > 0 {
+		var c int
+		if s.skip > 0 {
+			c = s.skip
+		} else {
+			c = s.rewriter.Rewrite(s.data, s.fromServer, t.rewrite)
+			if c < 0 {
+				t.abandon(s)
+				return
+			}
+			if c == 0 {
+				return
+			}
+			t.Rewritten++
+		}
+		s.skip = 0
+		if c > len(s.data) {
+			s.skip = c - len(s.data)
+			c = len(s.data)
+		}
+		t.consume(s, c)
+	}
+}
+
+// consume copies the first c bytes of stream data, once rewritten, into the
+// segments that carry them, releasing the packets with no more data held.
+func (t *TCPReassembly) consume(s *tcpStream, c int) {
+	segs := s.segs[:0]
+	for _, g := range s.segs {
+		if g.at < c {
+			e := g.at + g.n
+			if e > c {
+				e = c
+			}
+			copy(g.p.b[g.off:], s.data[g.at:e])
+			g.p.changed = true
+			if g.at+g.n <= c {
+				g.p.stream = nil
+				continue
+			}
+			g.off += c - g.at
+			g.n -= c - g.at
+			g.at = c
+		}
+		g.at -= c
+		segs = append(segs, g)
+	}
+	s.segs = segs
+	s.hist = append(s.hist, s.data[:c]...)
+	if len(s.hist) > streamHistory {
+		s.hist = append(s.hist[:0], s.hist[len(s.hist)-streamHistory:]...)
+	}
+	s.data = append(s.data[:0], s.data[c:]...)
+	s.seq += uint32(c)
+}
+
+// retransmit rewrites the n bytes of retransmitted stream data with sequence
+// number seq, at offset off in packet p, as they were before, as far as they
+// are in the stream's history.
+func (t *TCPReassembly) retransmit(s *tcpStream, p *heldPacket, seq uint32,
+	off, n int) {
+	i := len(s.hist) + int(int32(seq-s.seq))
+	lo, hi := 0, n
+	if i < 0 {
+		lo = -i
+	}
+	if i+hi > len(s.hist) {
+		hi = len(s.hist) - i
+	}
+	if lo < hi {
+		copy(p.b[off+lo:off+hi], s.hist[i+lo:i+hi])
+		p.changed = true
+	}
+}
+
+// release releases the packets held for stream s unchanged.
+func (t *TCPReassembly) release(s *tcpStream) {
+	for _, g := range s.segs {
+		g.p.stream = nil
+	}
+	s.segs = nil
+	s.data = nil
+}
+
+// abandon releases the packets held for stream s unchanged, and stops
+// rewriting it.
+func (t *TCPReassembly) abandon(s *tcpStream) {
+	t.release(s)
+	s.hist = nil
+	s.abandoned = true
+	t.Abandoned++
+}
+
+// segment returns the stream, sequence number, flags and payload bounds of
+// the TCP segment in packet b, after the outer IP header found, if it has
+// one and it's complete.
+func (t *TCPReassembly) segment(b []byte) (k flowKey, seq uint32,
+	flags uint8, start, end int, ok bool) {
+	h := t.hdr
+	if h < 0 || h >= len(b) {
+		return
+	}
+	k.proto = tcpProtocol
+	var n int
+	if b[h]>>4 == 4 {
+		ihl := int(b[h]&0xf) * 4
+		if ihl < 20 || h+ihl > len(b) || b[h+9] != tcpProtocol ||
+			binary.BigEndian.Uint16(b[h+6:])&ipv4FragMask != 0 {
+			return
+		}
+		copy(k.src[:], net.IP(b[h+12:h+16]).To16())
+		copy(k.dst[:], net.IP(b[h+16:h+20]).To16())
+		n, end = h+ihl, h+int(binary.BigEndian.Uint16(b[h+2:]))
+	} else {
+		if h+40 > len(b) || b[h+6] != tcpProtocol {
+			return
+		}
+		copy(k.src[:], b[h+8:h+24])
+		copy(k.dst[:], b[h+24:h+40])
+		n, end = h+40, h+40+int(binary.BigEndian.Uint16(b[h+4:]))
+	}
+	if n+20 > end || end > len(b) {
+		return
+	}
+	start = n + int(b[n+12]>>4)*4
+	if start < n+20 || start > end {
+		return
+	}
+	k.srcPort = binary.BigEndian.Uint16(b[n:])
+	k.dstPort = binary.BigEndian.Uint16(b[n+2:])
+	seq = binary.BigEndian.Uint32(b[n+4:])
+	flags = b[n+13]
+	ok = true
+	return
+}
+
+// ipHeader returns the offset in packet pkt of the IP header of version v
+// that has address b, a subslice of pkt, at offset o, or -1 if b isn't in
+// one.
+func ipHeader(pkt, b []byte, o int, v byte) int {
+	h := cap(pkt) - cap(b) - o
+	if h >= 0 && h < len(pkt) && pkt[h]>>4 == v {
+		return h
+	}
+	return -1
+}
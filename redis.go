@@ -0,0 +1,69 @@
+//go:build redis
+// +build redis
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	PseudonymStores["redis"] = openRedisStore
+	PseudonymStores["rediss"] = openRedisStore
+}
+
+// RedisStore is a PseudonymStore in Redis, so that anonymizers on many hosts
+// may share pseudonyms. Keys are "wanonpcap:" followed by the class and the
+// original value in hex, separated by a colon, and pseudonyms never expire.
+type RedisStore struct {
+	c *redis.Client
+}
+
+// openRedisStore opens the store for a redis:// or rediss:// URL, checking
+// that the server is reachable.
+func openRedisStore(url string) (PseudonymStore, error) {
+	o, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	c := redis.NewClient(o)
+	if err = c.Ping(context.Background()).Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &RedisStore{c}, nil
+}
+
+// key returns the Redis key for orig in class.
+func (s *RedisStore) key(class string, orig []byte) string {
+	return "wanonpcap:" + class + ":" + hex.EncodeToString(orig)
+}
+
+// Get returns the pseudonym for orig.
+func (s *RedisStore) Get(class string, orig []byte) ([]byte, error) {
+	p, err := s.c.Get(context.Background(), s.key(class, orig)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return p, err
+}
+
+// Put stores pseudo as the pseudonym for orig, unless one was stored first,
+// such as by another host.
+func (s *RedisStore) Put(class string, orig, pseudo []byte) ([]byte, error) {
+	ctx := context.Background()
+	k := s.key(class, orig)
+	ok, err := s.c.SetNX(ctx, k, pseudo, 0).Result()
+	if err != nil || ok {
+		return pseudo, err
+	}
+	return s.c.Get(ctx, k).Bytes()
+}
+
+// Close closes the connection.
+func (s *RedisStore) Close() error {
+	return s.c.Close()
+}
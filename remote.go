@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var remoteHost = flag.String("remote", "",
+	"SSH destination (e.g. user@router) to capture from with tcpdump, "+
+		"instead of reading stdin")
+
+var remoteInterface = flag.String("i", "",
+	"with -remote, the interface to capture from (tcpdump's default if empty)")
+
+var remoteFilter = flag.String("remote-filter", "",
+	"with -remote, a capture filter expression")
+
+var remoteSSH = flag.String("remote-ssh", "ssh",
+	"with -remote, the ssh command and any options (e.g. \"ssh -p 2222\")")
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteCommand returns the shell command run on the remote host, which
+// captures from iface with filter, writing a pcap to stdout. It's tcpdump, or
+// -capture-command followed by the interface and filter, as in extcap mode.
+// The SSH connection carrying the capture is excluded by the filter, using
+// the addresses and ports in SSH_CLIENT, as otherwise capturing on the
+// interface it uses would feed the capture back into itself.
+func remoteCommand(iface, filter string) string {
+	var args []string
+	if *captureCommand != "" {
+		for _, a := range strings.Fields(*captureCommand) {
+			args = append(args, shellQuote(a))
+		}
+		if iface != "" {
+			args = append(args, shellQuote(iface))
+		}
+	} else {
+		args = []string{"tcpdump", "-U", "-w", "-"}
+		if iface != "" {
+			args = append(args, "-i", shellQuote(iface))
+		}
+	}
+	f := `"not (host $1 and tcp port $2 and tcp port $3)"`
+	if filter != "" {
+		f += shellQuote(" and (" + filter + ")")
+	}
+	args = append(args, f)
+	return "set -- $SSH_CLIENT; exec " + strings.Join(args, " ")
+}
+
+// RemoteCapture is a capture pulled from a remote device over SSH, and
+// anonymized as it arrives, so raw packets are never stored locally or on
+// the device.
+type RemoteCapture struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+// StartRemoteCapture starts capturing from iface, with filter, on the SSH
+// destination host.
+func StartRemoteCapture(host, iface, filter string) (r *RemoteCapture,
+	err error) {
+	ssh := strings.Fields(*remoteSSH)
+	if len(ssh) == 0 {
+		err = fmt.Errorf("no ssh command given")
+		return
+	}
+	args := append(ssh[1:], "-T", "--", host, remoteCommand(iface, filter))
+	r = &RemoteCapture{cmd: exec.Command(ssh[0], args...)}
+	r.cmd.Stderr = os.Stderr
+	if r.stdout, err = r.cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = r.cmd.Start(); err != nil {
+		return
+	}
+	printf("capturing from %s", host)
+	return
+}
+
+// Read reads the capture.
+func (r *RemoteCapture) Read(p []byte) (int, error) {
+	return r.stdout.Read(p)
+}
+
+// Close stops the capture, returning an error if it ended on its own with
+// one, such as when tcpdump wasn't found or the connection failed, or nil if
+// it ended cleanly or was stopped.
+func (r *RemoteCapture) Close(stop bool) error {
+	if stop {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+		return nil
+	}
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("remote capture: %s", err)
+	}
+	return nil
+}
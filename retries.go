@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// retryFlag is the 802.11 frame control flag for a retransmitted frame.
+const retryFlag = 0x08
+
+// RetryCheck checks, when verifying radiotap + 802.11 captures, that
+// anonymization kept what receivers use to detect retries and duplicates: a
+// frame whose sequence number and fragment number equal those of the last
+// frame from its transmitter. Each frame must match its transmitter's last
+// frame in the anonymized capture exactly when it did in the original, which
+// holds if MAC addresses stay distinct and sequence numbers are left or
+// resequenced, but not if they're zeroed. Retry rates are kept for each
+// anonymized transmitter.
+type RetryCheck struct {
+	// Broken is the number of frames whose duplicate relationship wasn't
+	// kept.
+	Broken uint64
+
+	orig     map[[6]byte]uint16
+	anon     map[[6]byte]uint16
+	stations map[[6]byte]*retryStation
+}
+
+type retryStation struct {
+	frames     uint64
+	retries    uint64
+	duplicates uint64
+}
+
+// NewRetryCheck returns a new RetryCheck.
+func NewRetryCheck() *RetryCheck {
+	return &RetryCheck{
+		orig:     make(map[[6]byte]uint16),
+		anon:     make(map[[6]byte]uint16),
+		stations: make(map[[6]byte]*retryStation),
+	}
+}
+
+// seqFrame returns the transmitter address, sequence control field and retry
+// flag of a radiotap + 802.11 management or data frame, or false if b isn't
+// one or is too short.
+func seqFrame(b []byte) (ta []byte, sc uint16, retry bool, ok bool) {
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(b)) != nil {
+		return
+	}
+	off := int(rh.Len)
+	if off+24 > len(b) || b[off]&0x3 != 0 {
+		return
+	}
+	if _, typ, _ := parseFC(b[off]); typ != typeMgmt && typ != typeData {
+		return
+	}
+	return b[off+10 : off+16], binary.LittleEndian.Uint16(b[off+22:]),
+		b[off+1]&retryFlag != 0, true
+}
+
+// add checks an original frame and its anonymized counterpart, returning a
+// note for the packet's report if the duplicate relationship wasn't kept.
+func (c *RetryCheck) add(ob, ab []byte) string {
+	ota, osc, retry, ok := seqFrame(ob)
+	if !ok {
+		return ""
+	}
+	ata, asc, _, ok := seqFrame(ab)
+	if !ok {
+		return ""
+	}
+	ok6, ak := toArray6(ota), toArray6(ata)
+	last, seen := c.orig[ok6]
+	odup := seen && last == osc
+	last, seen = c.anon[ak]
+	adup := seen && last == asc
+	c.orig[ok6], c.anon[ak] = osc, asc
+
+	st, ok := c.stations[ak]
+	if !ok {
+		st = &retryStation{}
+		c.stations[ak] = st
+	}
+	st.frames++
+	if retry {
+		st.retries++
+		if odup {
+			st.duplicates++
+		}
+	}
+	if odup == adup {
+		return ""
+	}
+	c.Broken++
+	if odup {
+		return "duplicate of last frame from TA no longer detected!"
+	}
+	return "falsely detected as duplicate of last frame from TA!"
+}
+
+// Write writes the retry rates of each anonymized transmitter as a table to
+// w, by descending frame count. Retries are frames with the retry flag, and
+// duplicates the retries with the same sequence and fragment number as the
+// transmitter's last frame.
+func (c *RetryCheck) Write(w io.Writer) (err error) {
+	var ks [][6]byte
+	for k := range c.stations {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		fi, fj := c.stations[ks[i]].frames, c.stations[ks[j]].frames
+		if fi != fj {
+			return fi > fj
+		}
+		return bytes.Compare(ks[i][:], ks[j][:]) < 0
+	})
+	if _, err = fmt.Fprintf(w, "%-17s %10s %10s %7s %10s\n", "transmitter",
+		"frames", "retries", "rate", "duplicates"); err != nil {
+		return
+	}
+	for _, k := range ks {
+		st := c.stations[k]
+		if _, err = fmt.Fprintf(w, "%-17s %10d %10d %6.1f%% %10d\n",
+			net.HardwareAddr(k[:]), st.frames, st.retries,
+			100*float64(st.retries)/float64(st.frames),
+			st.duplicates); err != nil {
+			return
+		}
+	}
+	return
+}
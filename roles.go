@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var mapRoles = flag.Bool("map-roles", false,
+	"with map export, add the roles each address was seen in, the first "+
+		"and last packets it was seen in, and when it was last seen, to each "+
+		"mapping")
+
+// Address roles given by handlers, beyond the source and destination of IP
+// headers.
+const (
+	roleSrc       = "src"
+	roleDst       = "dst"
+	roleARPSender = "arp-sender"
+	roleARPTarget = "arp-target"
+	roleBSSID     = "bssid"
+	roleStation   = "station"
+)
+
+// annotate tells anon the role of the next address it anonymizes, for
+// anonymizers that record them.
+func annotate(anon Anonymizer, role string) {
+	if r, ok := anon.(interface{ annotate(string) }); ok {
+		r.annotate(role)
+	}
+}
+
+// MapRoles wraps an Anonymizer and records how each MAC, EUI-64, DevAddr,
+// IPv4 and IPv6 address and VLAN ID is seen, for mappings useful in later
+// incident correlation: the roles handlers give it, such as src and dst for
+// IP and Ethernet headers, arp-sender and arp-target, or bssid and station
+// for 802.11, the numbers of the first and last packets it's in, and the
+// capture time of the last, so long-lived maps may be pruned. Handlers
+// give roles with annotate, which only reaches the outermost anonymizer, so
+// MapRoles must wrap any others. The parts of MAC addresses and EUI-64s
+// mapped separately share the roles and packets of the whole address.
+type MapRoles struct {
+	Anonymizer
+	packet uint64
+	time   time.Time
+	role   string
+	notes  map[string]*mapNote
+}
+
+// mapNote is how an address is seen.
+type mapNote struct {
+	roles map[string]bool
+	first uint64
+	last  uint64
+	seen  time.Time
+}
+
+// NewMapRoles returns a new MapRoles wrapping a.
+func NewMapRoles(a Anonymizer) *MapRoles {
+	return &MapRoles{Anonymizer: a, notes: make(map[string]*mapNote)}
+}
+
+// Begin starts recording packet number i, captured at t.
+func (m *MapRoles) Begin(i uint64, t time.Time) {
+	m.packet = i
+	m.time = t
+	m.role = ""
+}
+
+func (m *MapRoles) annotate(role string) {
+	m.role = role
+}
+
+// take returns the role given for the current address, or def.
+func (m *MapRoles) take(def string) (r string) {
+	r, m.role = m.role, ""
+	if r == "" {
+		r = def
+	}
+	return
+}
+
+// record records that the original value o of a class was seen in role.
+func (m *MapRoles) record(class string, o []byte, role string) {
+	m.note(class+","+hex.EncodeToString(o), role)
+}
+
+// note records that the value with key k, its class and original value as in
+// the mappings, was seen in role.
+func (m *MapRoles) note(k string, role string) {
+	n, ok := m.notes[k]
+	if !ok {
+		n = &mapNote{roles: make(map[string]bool), first: m.packet}
+		m.notes[k] = n
+	}
+	if role != "" {
+		n.roles[role] = true
+	}
+	n.last = m.packet
+	if m.time.After(n.seen) {
+		n.seen = m.time
+	}
+}
+
+// MAC anonymizes a MAC address, recording its OUI and NIC.
+func (m *MapRoles) MAC(b []byte) {
+	o := append([]byte(nil), b...)
+	m.Anonymizer.MAC(b)
+	r := m.take("")
+	m.record("mac-oui", o[:3], r)
+	m.record("mac-nic", o[3:], r)
+}
+
+// EUI64 anonymizes an EUI-64, recording its OUI and extension identifier.
+func (m *MapRoles) EUI64(b []byte) {
+	o := append([]byte(nil), b...)
+	m.Anonymizer.EUI64(b)
+	r := m.take("")
+	m.record("mac-oui", o[:3], r)
+	m.record("eui64-ext", o[3:], r)
+}
+
+// DevAddr anonymizes and records a LoRaWAN DevAddr.
+func (m *MapRoles) DevAddr(b []byte) {
+	o := append([]byte(nil), b...)
+	m.Anonymizer.DevAddr(b)
+	m.record("devaddr", o, m.take(""))
+}
+
+// IPv4 anonymizes and records an IPv4 address.
+func (m *MapRoles) IPv4(b []byte, role Role) {
+	o := append([]byte(nil), b...)
+	m.Anonymizer.IPv4(b, role)
+	m.record("ipv4", o, m.take(ipRole(role)))
+}
+
+// IPv6 anonymizes and records an IPv6 address.
+func (m *MapRoles) IPv6(b []byte, role Role) {
+	o := append([]byte(nil), b...)
+	m.Anonymizer.IPv6(b, role)
+	m.record("ipv6", o, m.take(ipRole(role)))
+}
+
+// VLAN anonymizes a VLAN TCI, recording its ID.
+func (m *MapRoles) VLAN(b []byte) {
+	id := binary.BigEndian.Uint16(b) & 0x0fff
+	m.Anonymizer.VLAN(b)
+	m.note(fmt.Sprintf("vlan,%d", id), m.take(""))
+}
+
+// ipRole returns the name of IP address role r.
+func ipRole(r Role) string {
+	if r == Dst {
+		return roleDst
+	}
+	return roleSrc
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (m *MapRoles) Stats() (s AnonymizerStats) {
+	if sa, ok := m.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (m *MapRoles) Err() (err error) {
+	if ea, ok := m.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// fields returns the roles, first and last packet and last seen fields for
+// mapping record rec, empty if the value wasn't seen.
+func (m *MapRoles) fields(rec string) string {
+	f := strings.SplitN(rec, ",", 3)
+	n, ok := m.notes[f[0]+","+f[1]]
+	if !ok {
+		return ",,,"
+	}
+	var roles []string
+	for r := range n.roles {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return fmt.Sprintf("%s,%d,%d,%s", strings.Join(roles, " "), n.first,
+		n.last, n.seen.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+)
+
+var rotateCount = flag.Int("W", 0,
+	"with -C or -G, limit output to a ring buffer of this many files")
+var rotateSize = flag.Int("C", 0,
+	"rotate output files after this many megabytes (1,000,000 bytes)")
+var rotateSeconds = flag.Int("G", 0,
+	"rotate output files every this many seconds of capture time")
+
+// Rotator writes a series of capture files, named by appending a number to
+// Path, rotating them by size or capture time like tcpdump's -C, -G and -W
+// options. With Count > 0, the oldest file is reused after Count files.
+type Rotator struct {
+	// Path is the base path for output files.
+	Path string
+
+	// Count is the number of files in the ring buffer, or 0 for no limit.
+	Count int
+
+	// Size is the size in bytes after which to rotate, or 0 for no limit.
+	Size int64
+
+	// Interval is the capture time in seconds after which to rotate, or 0 for
+	// no limit.
+	Interval uint32
+
+	newWriter func(w io.Writer) PacketWriter
+	counter   *uint64
+	header    GlobalHeader
+	index     int
+	wrapped   bool
+	file      *fileOutput
+	buf       *bufio.Writer
+	pw        PacketWriter
+	written   uint64
+	packets   int
+	start     uint32
+}
+
+// NewRotator returns a Rotator for the rotation flags, or nil if rotation is
+// not enabled.
+func NewRotator(path string) (r *Rotator, err error) {
+	if *rotateSize == 0 && *rotateSeconds == 0 {
+		if *rotateCount != 0 {
+			err = fmt.Errorf("-W requires -C or -G")
+		}
+		return
+	}
+	if path == "" || path == "-" {
+		err = fmt.Errorf("-C and -G require -out with a file name")
+		return
+	}
+	r = &Rotator{
+		Path:     path,
+		Count:    *rotateCount,
+		Size:     int64(*rotateSize) * 1000000,
+		Interval: uint32(*rotateSeconds),
+	}
+	return
+}
+
+// name returns the file name for index i.
+func (r *Rotator) name(i int) string {
+	if r.Count > 0 {
+		return fmt.Sprintf("%s%0*d", r.Path, len(fmt.Sprint(r.Count-1)), i)
+	}
+	return fmt.Sprintf("%s%d", r.Path, i)
+}
+
+// open opens the next file and writes its header. Files from earlier in the
+// run are overwritten once the ring buffer wraps.
+func (r *Rotator) open() (err error) {
+	if r.file, err = createFile(r.name(r.index), r.wrapped, 0666); err != nil {
+		return
+	}
+	r.index++
+	if r.Count > 0 && r.index == r.Count {
+		r.index = 0
+		r.wrapped = true
+	}
+	r.written = 0
+	r.packets = 0
+	var w io.Writer = &countingWriter{r.file, &r.written}
+	if r.counter != nil {
+		w = &countingWriter{w, r.counter}
+	}
+	r.buf = bufio.NewWriter(w)
+	r.pw = r.newWriter(r.buf)
+	return r.pw.WriteHeader(&r.header)
+}
+
+// WriteHeader opens the first file.
+func (r *Rotator) WriteHeader(gh *GlobalHeader) error {
+	r.header = *gh
+	return r.open()
+}
+
+// WritePacket writes a packet, first rotating if the current file is full.
+func (r *Rotator) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	if r.packets > 0 {
+		full := r.Size > 0 && int64(r.written)+int64(r.buf.Buffered()) >= r.Size
+		expired := r.Interval > 0 && ph.TimestampSec-r.start >= r.Interval
+		if full || expired {
+			if err = r.Close(); err != nil {
+				return
+			}
+			if err = r.open(); err != nil {
+				return
+			}
+		}
+	}
+	if r.packets == 0 {
+		r.start = ph.TimestampSec
+	}
+	r.packets++
+	return r.pw.WritePacket(ph, b, comment)
+}
+
+// Close flushes the current file and moves it into place.
+func (r *Rotator) Close() (err error) {
+	if r.file == nil {
+		return
+	}
+	if err = r.buf.Flush(); err != nil {
+		r.file.Abort()
+	} else {
+		err = r.file.Close()
+	}
+	r.file = nil
+	return
+}
+
+// Abort removes the current, partially written file. Earlier files, which are
+// complete, are left in place.
+func (r *Rotator) Abort() (err error) {
+	if r.file == nil {
+		return
+	}
+	err = r.file.Abort()
+	r.file = nil
+	return
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// selfTest is a synthetic packet and its expected anonymization.
+type selfTest struct {
+	name   string
+	link   uint32
+	pkt    []byte
+	n      int
+	fields []string
+}
+
+var stMAC1 = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+var stMAC2 = []byte{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb}
+
+var stIPv4Hdr = cat([]byte{0x45, 0, 0, 28, 0, 1, 0, 0, 64, 17, 0, 0},
+	[]byte{10, 0, 0, 1}, []byte{192, 168, 1, 2})
+
+// stUDP is a UDP header for ports without a payload handler.
+var stUDP = []byte{0x04, 0xd2, 0x16, 0x2e, 0x00, 0x08, 0x00, 0x00}
+
+var stRadiotap = []byte{0, 0, 8, 0, 0, 0, 0, 0}
+
+var stNFLOG = cat([]byte{2, 0, 0, 0}, []byte{8, 0, 1, 0, 0x08, 0, 1, 0},
+	[]byte{16, 0, 8, 0, 0, 6, 0, 0}, stMAC1, []byte{0, 0},
+	[]byte{32, 0, 9, 0}, stIPv4Hdr, stUDP)
+
+// PKTAP header for an Ethernet packet on en0 from curl
+var stPktap = cat([]byte{108, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}, []byte("en0"),
+	make([]byte, 41), []byte("curl"), make([]byte, 28), []byte("curl"),
+	make([]byte, 16))
+
+// stEUI64 is an 802.15.4 extended address, least significant byte first.
+var stEUI64 = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x4b, 0x12, 0x00}
+
+// stIID is an IPv6 interface identifier formed from an EUI-64.
+var stIID = []byte{0x02, 0x12, 0x4b, 0x00, 0x01, 0x02, 0x03, 0x04}
+
+// stLoRaTap is a LoRaTap version 0 header, for 868.1 MHz, SF7 and the public
+// LoRaWAN sync word.
+var stLoRaTap = []byte{0, 0, 0, 15, 0x33, 0xbd, 0x1a, 0x20, 1, 7, 0x40, 0x40,
+	0x40, 0x20, 0x34}
+
+// stRadiotapDMG is a radiotap header with a channel field at 60480 MHz.
+var stRadiotapDMG = []byte{0, 0, 12, 0, 0x08, 0, 0, 0, 0x40, 0xec, 0, 0}
+
+// stRadiotapS1G is a radiotap header with a channel field at 915 MHz.
+var stRadiotapS1G = []byte{0, 0, 12, 0, 0x08, 0, 0, 0, 0x93, 0x03, 0, 0}
+
+// selfTests are the built-in self tests, one for each supported frame type.
+var selfTests = []selfTest{
+	{"ethernet ipv4", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x00}, stIPv4Hdr, stUDP),
+		34, []string{"mac@0", "mac@6", "ipv4@26", "ipv4@30"}},
+	{"ethernet ipv4 options", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x00, 0x46}, stIPv4Hdr[1:],
+			[]byte{1, 1, 1, 0}, stUDP),
+		38, []string{"mac@0", "mac@6", "ipv4@26", "ipv4@30"}},
+	{"ethernet ipv6", 1,
+		cat(stMAC2, stMAC1, []byte{0x86, 0xdd, 0x60, 0, 0, 0, 0, 8, 17, 64},
+			bytes.Repeat([]byte{0x20}, 16), bytes.Repeat([]byte{0x21}, 16),
+			stUDP),
+		54, []string{"mac@0", "mac@6", "ipv6@22", "ipv6@38"}},
+	{"ethernet ipv4 first fragment", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x00, 0x45, 0, 0, 28, 0, 1, 0x20, 0},
+			stIPv4Hdr[8:], []byte{0x04, 0xd2, 0x00, 0x35, 0, 16, 0, 0}),
+		34, []string{"mac@0", "mac@6", "ipv4@26", "ipv4@30"}},
+	{"ethernet ipv6 fragment", 1,
+		cat(stMAC2, stMAC1, []byte{0x86, 0xdd, 0x60, 0, 0, 0, 0, 16, 44, 64},
+			bytes.Repeat([]byte{0x20}, 16), bytes.Repeat([]byte{0x21}, 16),
+			[]byte{17, 0, 0, 1, 0, 0, 0, 1},
+			[]byte{0x04, 0xd2, 0x00, 0x35, 0, 16, 0, 0}),
+		62, []string{"mac@0", "mac@6", "ipv6@22", "ipv6@38"}},
+	{"ethernet arp", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x06, 0, 1, 0x08, 0, 6, 4, 0, 1},
+			stMAC1, []byte{10, 0, 0, 1}, make([]byte, 6),
+			[]byte{10, 0, 0, 2}),
+		42, []string{"mac@0", "mac@6", "mac@22", "ipv4@28", "ipv4@38"}},
+	{"ethernet vlan ipv4", 1,
+		cat(stMAC2, stMAC1, []byte{0x81, 0x00, 0x20, 0x64, 0x08, 0x00},
+			stIPv4Hdr, stUDP),
+		38, []string{"mac@0", "mac@6", "vlan@14", "ipv4@30", "ipv4@34"}},
+	{"ethernet unknown", 1,
+		cat(stMAC2, stMAC1, []byte{0x88, 0xcc}, stUDP),
+		14, []string{"mac@0", "mac@6"}},
+	{"ethernet dns response", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x00}, stIPv4Hdr,
+			[]byte{0x00, 0x35, 0x04, 0xd2, 0, 41, 0, 0},
+			[]byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0},
+			[]byte{0, 0, 1, 0, 1}, []byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60},
+			[]byte{0, 4, 10, 0, 0, 9}),
+		75, []string{"mac@0", "mac@6", "ipv4@26", "ipv4@30", "ipv4@71"}},
+	{"ethernet vxlan", 1,
+		cat(stMAC2, stMAC1, []byte{0x08, 0x00}, stIPv4Hdr,
+			[]byte{0x30, 0x39, 0x12, 0xb5, 0, 58, 0, 0},
+			[]byte{0x08, 0, 0, 0, 0, 0, 1, 0},
+			stMAC1, stMAC2, []byte{0x08, 0x00}, stIPv4Hdr, stUDP),
+		84, []string{"mac@0", "mac@6", "ipv4@26", "ipv4@30", "mac@50",
+			"mac@56", "ipv4@76", "ipv4@80"}},
+	{"802.11 beacon", 127,
+		cat(stRadiotap, []byte{0x80, 0, 0, 0}, bytes.Repeat([]byte{0xff}, 6),
+			stMAC1, stMAC1, []byte{0x10, 0}, []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			[]byte{0x64, 0, 0x11, 0x04}, []byte{7, 3, 'U', 'S', ' '},
+			[]byte{0xdd, 4, 0x00, 0x50, 0xf2, 1}),
+		44, []string{"mac@12", "mac@18", "mac@24", "seq@30", "timestamp@32"}},
+	{"802.11 addba request", 127,
+		cat(stRadiotap, []byte{0xd0, 0, 0, 0}, stMAC1, stMAC2, stMAC1,
+			[]byte{0x20, 0}, []byte{3, 0, 1, 0x02, 0x10, 0, 0, 0x10, 0}),
+		41, []string{"mac@12", "mac@18", "mac@24", "seq@30"}},
+	{"802.11 ft request", 127,
+		cat(stRadiotap, []byte{0xd0, 0, 0, 0}, stMAC1, stMAC2, stMAC1,
+			[]byte{0x20, 0}, []byte{6, 1}, stMAC2, stMAC1, []byte{48, 2}),
+		46, []string{"mac@12", "mac@18", "mac@24", "seq@30", "mac@34",
+			"mac@40"}},
+	{"802.11 data", 127,
+		cat(stRadiotap, []byte{0x08, 0x01, 0, 0}, stMAC1, stMAC2, stMAC1,
+			[]byte{0x20, 0}, stUDP),
+		32, []string{"mac@12", "mac@18", "mac@24", "seq@30"}},
+	{"802.11 data wds", 127,
+		cat(stRadiotap, []byte{0x08, 0x03, 0, 0}, stMAC1, stMAC2, stMAC1,
+			[]byte{0x20, 0}, stMAC2, stUDP),
+		38, []string{"mac@12", "mac@18", "mac@24", "seq@30", "mac@32"}},
+	{"802.11 qos data", 127,
+		cat(stRadiotap, []byte{0x88, 0x02, 0, 0}, stMAC2, stMAC1, stMAC1,
+			[]byte{0x30, 0, 0, 0}, stUDP),
+		34, []string{"mac@12", "mac@18", "mac@24", "seq@30"}},
+	{"802.11 rts", 127,
+		cat(stRadiotap, []byte{0xb4, 0, 0, 0}, stMAC2, stMAC1),
+		24, []string{"mac@12", "mac@18"}},
+	{"802.11 ack", 127,
+		cat(stRadiotap, []byte{0xd4, 0, 0, 0}, stMAC2),
+		18, []string{"mac@12"}},
+	{"802.11 ps-poll", 127,
+		cat(stRadiotap, []byte{0xa4, 0, 0x01, 0xc0}, stMAC1, stMAC2),
+		24, []string{"mac@12", "mac@18"}},
+	{"802.11 control wrapper", 127,
+		cat(stRadiotap, []byte{0x74, 0, 0, 0}, stMAC2, []byte{0xb4, 0},
+			make([]byte, 4), stMAC1),
+		30, []string{"mac@12", "mac@24"}},
+	{"802.11 dmg cts", 127,
+		cat(stRadiotapDMG, []byte{0x64, 0x05, 0, 0}, stMAC2, stMAC1),
+		28, []string{"mac@16", "mac@22"}},
+	{"802.11 dmg beacon", 127,
+		cat(stRadiotapDMG, []byte{0x0c, 0, 0, 0}, stMAC1,
+			[]byte{9, 10, 11, 12, 13, 14, 15, 16}, make([]byte, 12)),
+		30, []string{"mac@16", "timestamp@22"}},
+	{"802.11 s1g pv1 qos data", 127,
+		cat(stRadiotapS1G, []byte{0x01, 0}, stMAC1, []byte{0x05, 0x20},
+			[]byte{0x10, 0}, stMAC2, stUDP),
+		30, []string{"mac@14", "seq@22", "mac@24"}},
+	{"802.11 radiotap tsft", 127,
+		cat([]byte{0, 0, 17, 0, 0x03, 0, 0, 0}, []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			[]byte{0}, []byte{0xd4, 0, 0, 0}, stMAC2),
+		27, []string{"timestamp@8", "mac@21"}},
+	{"802.11 reserved control", 127,
+		cat(stRadiotap, []byte{0x14, 0, 0, 0}, stMAC2),
+		12, nil},
+	{"nflog ipv4", 239, stNFLOG,
+		52, []string{"mac@20", "ipv4@44", "ipv4@48"}},
+	{"netlink nflog ipv4", 253,
+		cat([]byte{76, 0, 0, 0, 0, 4, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, stNFLOG),
+		68, []string{"mac@36", "ipv4@60", "ipv4@64"}},
+	{"cisco hdlc ipv4", 104,
+		cat([]byte{0x0f, 0, 0x08, 0}, stIPv4Hdr, stUDP),
+		24, []string{"ipv4@16", "ipv4@20"}},
+	{"cisco hdlc slarp reply", 104,
+		cat([]byte{0x8f, 0, 0x80, 0x35, 0, 0, 0, 1}, []byte{10, 0, 0, 1},
+			[]byte{255, 255, 255, 252}, []byte{0xff, 0xff}),
+		16, []string{"ipv4@8"}},
+	{"frame relay rfc 2427 ipv4", 107,
+		cat([]byte{0x18, 0x41, 0x03, 0xcc}, stIPv4Hdr, stUDP),
+		24, []string{"ipv4@16", "ipv4@20"}},
+	{"frame relay cisco ipv4", 107,
+		cat([]byte{0x18, 0x41, 0x08, 0}, stIPv4Hdr, stUDP),
+		24, []string{"ipv4@16", "ipv4@20"}},
+	{"erf ipv4", 197,
+		cat(make([]byte, 8), []byte{22, 0x04, 0, 36, 0, 0, 0, 20}, stIPv4Hdr),
+		36, []string{"ipv4@28", "ipv4@32"}},
+	{"bsd loopback ipv4", 0,
+		cat([]byte{2, 0, 0, 0}, stIPv4Hdr, stUDP),
+		24, []string{"ipv4@16", "ipv4@20"}},
+	{"raw ipv4", 101,
+		cat(stIPv4Hdr, stUDP),
+		20, []string{"ipv4@12", "ipv4@16"}},
+	{"pktap ethernet ipv4", 258,
+		cat(stPktap, stMAC2, stMAC1, []byte{0x08, 0x00}, stIPv4Hdr, stUDP),
+		142, []string{"text@56", "text@88", "mac@108", "mac@114", "ipv4@134",
+			"ipv4@138"}},
+	{"docsis packet pdu", 143,
+		cat([]byte{0, 0, 0, 42, 0, 0}, stMAC2, stMAC1, []byte{0x08, 0x00},
+			stIPv4Hdr, stUDP),
+		40, []string{"mac@6", "mac@12", "ipv4@32", "ipv4@36"}},
+	{"docsis mac management", 143,
+		cat([]byte{0xc2, 0, 0, 26, 0, 0}, stMAC2, stMAC1,
+			[]byte{0, 8, 0, 0, 0x03, 1, 4, 0}, []byte{1, 2, 3, 4}),
+		26, []string{"mac@6", "mac@12"}},
+	{"802.15.4 iphc", 195,
+		cat([]byte{0x41, 0xdc, 1, 0x34, 0x12}, stEUI64, stEUI64,
+			[]byte{0x7b, 0x11, 58}, stIID, stIID, []byte{128, 0, 0, 0},
+			[]byte{0xaa, 0xbb}),
+		40, []string{"eui64@5", "eui64@13", "eui64@24", "eui64@32"}},
+	{"802.15.4 beacon", 195,
+		cat([]byte{0x00, 0xc0, 1, 0x34, 0x12}, stEUI64,
+			[]byte{0xff, 0xcf, 0, 0x10}, stEUI64, []byte{0, 0x22, 0x84},
+			[]byte{0xaa, 0xbb}),
+		25, []string{"eui64@5", "eui64@17"}},
+	{"6lowpan mesh", 195,
+		cat([]byte{0x41, 0x88, 1, 0x34, 0x12, 0x01, 0, 0x02, 0, 0x85},
+			stIID, stIID, []byte{lowpanIPv6, 0x60, 0, 0, 0, 0, 8, 17, 64},
+			bytes.Repeat([]byte{0x20}, 16), bytes.Repeat([]byte{0x21}, 16),
+			stUDP, []byte{0xaa, 0xbb}),
+		67, []string{"eui64@10", "eui64@18", "ipv6@35", "ipv6@51"}},
+	{"6lowpan frag1", 230,
+		cat([]byte{0x41, 0xdc, 1, 0x34, 0x12}, stEUI64, stEUI64,
+			[]byte{0xc0, 0x50, 0, 1, 0x7b, 0x00, 17},
+			bytes.Repeat([]byte{0x20}, 16), bytes.Repeat([]byte{0x21}, 16),
+			stUDP),
+		60, []string{"eui64@5", "eui64@13", "ipv6@28", "ipv6@44"}},
+	{"hci le create connection", 201,
+		cat([]byte{0, 0, 0, 0, h4Command, 0x0d, 0x20, 25},
+			[]byte{0x60, 0, 0x30, 0, 0, 0}, stMAC1, make([]byte, 13)),
+		33, []string{"mac@14"}},
+	{"hci connection complete", 201,
+		cat([]byte{0, 0, 0, 1, h4Event, 0x03, 11, 0, 0x01, 0}, stMAC2,
+			[]byte{1, 0}),
+		18, []string{"mac@10"}},
+	{"hci le advertising report", 201,
+		cat([]byte{0, 0, 0, 1, h4Event, evLEMeta, 12, leAdvReport, 1, 0, 0},
+			stMAC1, []byte{0, 0xc8}),
+		19, []string{"mac@11"}},
+	{"hci acl", 201,
+		cat([]byte{0, 0, 0, 0, h4ACL, 0x01, 0x20, 8, 0, 4, 0, 4, 0},
+			[]byte{1, 2, 3, 4}),
+		13, nil},
+	{"bluetooth monitor new index", 254,
+		cat([]byte{0, 0, 0, monNewIndex, 0, 1}, stMAC1,
+			[]byte("hci0\x00\x00\x00\x00")),
+		20, []string{"mac@6"}},
+	{"bluetooth monitor read bd_addr", 254,
+		cat([]byte{0, 0, 0, 3, evCommandComplete, 10, 1, 0x09, 0x10, 0}, stMAC2),
+		16, []string{"mac@10"}},
+	{"lorawan join request", 270,
+		cat(stLoRaTap, []byte{0x00}, stEUI64, stEUI64, []byte{1, 2},
+			[]byte{0xaa, 0xbb, 0xcc, 0xdd}),
+		34, []string{"eui64@16", "eui64@24"}},
+	{"lorawan data up", 270,
+		cat(stLoRaTap, []byte{0x40, 0x04, 0x03, 0x02, 0x26, 0x80, 1, 0, 1},
+			[]byte{1, 2, 3, 4}, []byte{0xaa, 0xbb, 0xcc, 0xdd}),
+		24, []string{"devaddr@16"}},
+	{"can standard id", 227,
+		cat([]byte{0, 0, 0x01, 0x23, 8, 0, 0, 0},
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8}),
+		8, []string{"can-id@0"}},
+	{"can extended id", 227,
+		cat([]byte{0x98, 0x76, 0x54, 0x32, 4, 0, 0, 0}, []byte{1, 2, 3, 4}),
+		8, []string{"can-id@0"}},
+}
+
+// cat concatenates byte slices.
+func cat(bs ...[]byte) (c []byte) {
+	for _, b := range bs {
+		c = append(c, b...)
+	}
+	return
+}
+
+// selfTestAnonymizer returns an anonymizer with a fixed key and the given
+// method for all but the MAC OUI, which is pseudonymed. VLAN IDs are only
+// pseudonymed, timestamps and vendor data zeroed, and beacon timestamps
+// rebased, along with the rest, as they can't be encrypted. Sequence numbers
+// are resequenced unless left.
+func selfTestAnonymizer(m AnonMethod, decrypt bool) Anonymizer {
+	s, err := newKeyStream(deriveKey("wanonpcap self test"))
+	if err != nil {
+		panic(err)
+	}
+	vm := VLANLeave
+	z := m == Pseudonym
+	if z {
+		vm = VLANPseudonym
+	}
+	sm := SeqLeave
+	if m != Leave {
+		sm = SeqResequence
+	}
+	tm := TimestampLeave
+	if z {
+		tm = TimestampRebase
+	}
+	return NewDefaultAnonymizer(Policy{
+		MACOUI:           Pseudonym,
+		MACNIC:           m,
+		IPv4Src:          m,
+		IPv4Dst:          m,
+		IPv6Src:          m,
+		IPv6Dst:          m,
+		VLAN:             vm,
+		Seq:              sm,
+		CANID:            m,
+		ZeroTimestamps:   z,
+		BeaconTimestamps: tm,
+		ZeroVendor:       z,
+		ZeroCountry:      z,
+		Decrypt:          decrypt,
+	}, Streams{s, s, s, s})
+}
+
+// selfTestPcap returns a pcap file with the given packets.
+func selfTestPcap(link uint32, pkts [][]byte) []byte {
+	b := &bytes.Buffer{}
+	pw := &PcapWriter{w: b, order: binary.LittleEndian, magic: MagicLE}
+	pw.WriteHeader(&GlobalHeader{2, 4, 0, 0, 65535, link})
+	for i, p := range pkts {
+		pw.WritePacket(&PacketHeader{uint32(i), 0, uint32(len(p)),
+			uint32(len(p))}, p, "")
+	}
+	return b.Bytes()
+}
+
+// selfTestPcapNG returns a pcapng file with the given Ethernet packets, in
+// an enhanced, obsolete and simple packet block in turn. Packets with a
+// timestamp have the time i+1 seconds and 2 microseconds, for index i.
+func selfTestPcapNG(pkts [][]byte) []byte {
+	b := &bytes.Buffer{}
+	le := binary.LittleEndian
+	pw := &PcapNGWriter{w: b, order: le}
+	pw.WriteHeader(&GlobalHeader{2, 4, 0, 0, 65535, 1})
+	for i, p := range pkts {
+		body := &bytes.Buffer{}
+		ts := uint64(i+1)*1000000 + 2
+		hdr := []uint32{uint32(ts >> 32), uint32(ts), uint32(len(p)),
+			uint32(len(p))}
+		typ := []uint32{ngEnhancedPacket, ngPacket, ngSimplePacket}[i%3]
+		switch typ {
+		case ngEnhancedPacket:
+			binary.Write(body, le, uint32(0))
+			binary.Write(body, le, hdr)
+		case ngPacket:
+			// interface ID and drops count
+			binary.Write(body, le, []uint16{0, 0})
+			binary.Write(body, le, hdr)
+		case ngSimplePacket:
+			binary.Write(body, le, uint32(len(p)))
+		}
+		body.Write(p)
+		body.Write(make([]byte, pad4(len(p))))
+		pw.writeBlock(typ, body.Bytes())
+	}
+	return b.Bytes()
+}
+
+// selfTestRun runs pkts through the pipeline, returning the output packets and
+// the fields recorded in the audit log for each.
+func selfTestRun(link uint32, pkts [][]byte, anon Anonymizer,
+	truncate bool) (out [][]byte, fields [][]string, err error) {
+	alog := &bytes.Buffer{}
+	cfg := &Config{Truncate: truncate}
+	if cfg.Audit, err = NewAuditAnonymizer(anon, alog); err != nil {
+		return
+	}
+	o := &bytes.Buffer{}
+	if _, err = run(context.Background(),
+		bytes.NewReader(selfTestPcap(link, pkts)), o, cfg.Audit,
+		cfg); err != io.EOF {
+		err = fmt.Errorf("run: %s", err)
+		return
+	}
+	var pr *PcapReader
+	if pr, err = NewPcapReader(o); err != nil {
+		return
+	}
+	for {
+		var b []byte
+		if _, b, err = pr.ReadPacket(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		out = append(out, b)
+	}
+	fields = make([][]string, len(pkts))
+	s := bufio.NewScanner(alog)
+	s.Scan()
+	for s.Scan() {
+		var i, off, l int
+		var f string
+		if _, err = fmt.Sscanf(strings.Replace(s.Text(), ",", " ", -1),
+			"%d %s %d %d", &i, &f, &off, &l); err != nil {
+			return
+		}
+		if f != "truncate" {
+			fields[i-1] = append(fields[i-1], fmt.Sprintf("%s@%d", f, off))
+		}
+	}
+	return
+}
+
+// runSelfTest runs the self tests, writing results to w, and returns the
+// number of failures.
+func runSelfTest(w io.Writer) (failed int) {
+	fail := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(w, "FAIL %s: %s\n", name, fmt.Sprintf(format, args...))
+		failed++
+	}
+
+	// payload handlers are enabled by -port-map, so enable all of them
+	var names []string
+	for name := range PayloadHandlers {
+		names = append(names, name)
+	}
+	ports := udpPorts
+	defer func() {
+		udpPorts = ports
+	}()
+	udpPorts, _ = portMap(strings.Join(names, " "))
+
+	for _, link := range []uint32{0, 1, 101, 104, 107, 127, 143, 195, 197,
+		201, 227, 230, 239, 253, 254, 258, 270} {
+		var tests []selfTest
+		var pkts [][]byte
+		for _, t := range selfTests {
+			if t.link == link {
+				tests = append(tests, t)
+				pkts = append(pkts, t.pkt)
+			}
+		}
+
+		// pseudonyms change exactly the expected fields
+		out, fields, err := selfTestRun(link, pkts,
+			selfTestAnonymizer(Pseudonym, false), true)
+		if err != nil {
+			fail(fmt.Sprintf("link type %d", link), "%s", err)
+			continue
+		}
+		if len(out) != len(tests) {
+			fail(fmt.Sprintf("link type %d", link), "got %d packets, want %d",
+				len(out), len(tests))
+			continue
+		}
+		for i, t := range tests {
+			o := out[i]
+			if len(o) != t.n {
+				fail(t.name, "truncated to %d, want %d", len(o), t.n)
+				continue
+			}
+			if g, e := strings.Join(fields[i], " "),
+				strings.Join(t.fields, " "); g != e {
+				fail(t.name, "got fields %q, want %q", g, e)
+				continue
+			}
+			changed := make([]bool, len(o))
+			for _, f := range t.fields {
+				var typ string
+				var off int
+				fmt.Sscanf(strings.Replace(f, "@", " ", 1), "%s %d", &typ, &off)
+				l := map[string]int{"mac": 6, "eui64": 8, "devaddr": 4, "ipv4": 4,
+					"ipv6": 16, "vlan": 2, "can-id": 4, "seq": 2, "timestamp": 8,
+					"text": pktapCommLen}[typ]
+				if bytes.Equal(o[off:off+l], t.pkt[off:off+l]) {
+					fail(t.name, "%s unchanged", f)
+				}
+				for j := off; j < off+l; j++ {
+					changed[j] = true
+				}
+			}
+			for j := range o {
+				if !changed[j] && o[j] != t.pkt[j] {
+					fail(t.name, "unexpected change at byte %d", j)
+					break
+				}
+			}
+		}
+
+		// pseudonyms are consistent
+		if link == 1 && !bytes.Equal(out[0][6:12], out[1][6:12]) {
+			fail("ethernet pseudonyms", "src MACs differ")
+		}
+
+		// output is reproducible with the same key
+		again, _, err := selfTestRun(link, pkts,
+			selfTestAnonymizer(Pseudonym, false), true)
+		if err != nil {
+			fail(fmt.Sprintf("link type %d", link), "%s", err)
+			continue
+		}
+		for i := range out {
+			if !bytes.Equal(out[i], again[i]) {
+				fail(tests[i].name, "output differs between runs")
+			}
+		}
+
+		// encryption is reversible, with pseudonymed OUIs left alone
+		enc, _, err := selfTestRun(link, pkts,
+			selfTestAnonymizer(Encrypt, false), false)
+		if err != nil {
+			fail(fmt.Sprintf("link type %d encrypt", link), "%s", err)
+			continue
+		}
+		dec, _, err := selfTestRun(link, enc, selfTestAnonymizer(Encrypt, true),
+			false)
+		if err != nil {
+			fail(fmt.Sprintf("link type %d decrypt", link), "%s", err)
+			continue
+		}
+		for i, t := range tests {
+			d := append([]byte(nil), dec[i]...)
+			for _, f := range t.fields {
+				var off int
+				if _, err := fmt.Sscanf(f, "mac@%d", &off); err == nil {
+					// BD_ADDRs are sent least significant byte first
+					if link == 201 || link == 254 {
+						off += 3
+					}
+					if bytes.Equal(d[off:off+3], t.pkt[off:off+3]) {
+						fail(t.name, "%s OUI restored from pseudonym", f)
+					}
+					copy(d[off:off+3], t.pkt[off:off+3])
+				}
+				// EUI-64 OUIs are pseudonymed, in either byte order
+				if _, err := fmt.Sscanf(f, "eui64@%d", &off); err == nil {
+					copy(d[off:off+8], t.pkt[off:off+8])
+				}
+				// free text is zeroed
+				if _, err := fmt.Sscanf(f, "text@%d", &off); err == nil {
+					copy(d[off:off+pktapCommLen], t.pkt[off:off+pktapCommLen])
+				}
+			}
+			if !bytes.Equal(d, t.pkt) {
+				fail(t.name, "decrypted packet differs from original")
+			}
+		}
+
+		if failed == 0 {
+			fmt.Fprintf(w, "ok   link type %d (%d frame types)\n", link,
+				len(tests))
+		}
+	}
+
+	// pcapng packets are read from each type of packet block
+	var pkts [][]byte
+	for _, t := range selfTests {
+		if t.link == 1 {
+			pkts = append(pkts, t.pkt)
+		}
+	}
+	pkts = pkts[:3]
+	f := failed
+	pr, err := NewCaptureReader(bytes.NewBuffer(selfTestPcapNG(pkts)))
+	if err != nil {
+		fail("pcapng", "%s", err)
+		return
+	}
+	for i, p := range pkts {
+		name := []string{"pcapng enhanced packet block",
+			"pcapng obsolete packet block", "pcapng simple packet block"}[i]
+		ph, b, err := pr.ReadPacket()
+		if err != nil {
+			fail(name, "%s", err)
+			return
+		}
+		if !bytes.Equal(b, p) {
+			fail(name, "packet differs from original")
+		}
+		// simple packet blocks have no timestamp
+		if i < 2 && (ph.TimestampSec != uint32(i+1) || ph.TimestampUsec != 2) {
+			fail(name, "got timestamp %d.%06d, want %d.000002",
+				ph.TimestampSec, ph.TimestampUsec, i+1)
+		}
+	}
+	if failed == f {
+		fmt.Fprintf(w, "ok   pcapng (%d packet block types)\n", len(pkts))
+	}
+	return
+}
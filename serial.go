@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// slarpProtocol is the Cisco HDLC protocol for SLARP, the serial line address
+// resolution protocol.
+const slarpProtocol = 0x8035
+
+// slarpReply is the SLARP code for an address reply.
+const slarpReply = 1
+
+// Frame Relay NLPIDs (RFC 2427)
+const (
+	nlpidSNAP = 0x80
+	nlpidIPv4 = 0xcc
+	nlpidIPv6 = 0x8e
+)
+
+// CiscoHDLCHandler anonymizes Cisco HDLC packets.
+type CiscoHDLCHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *CiscoHDLCHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	// address, control and protocol
+	if len(b) < 4 {
+		err = fmt.Errorf("short Cisco HDLC header (increase snaplen)")
+		return
+	}
+	p := binary.BigEndian.Uint16(b[2:])
+	n = 4
+	if p == slarpProtocol {
+		// code, then address and mask in replies
+		if n+4 > len(b) {
+			err = fmt.Errorf("short SLARP packet (increase snaplen)")
+			return
+		}
+		if binary.BigEndian.Uint32(b[n:]) != slarpReply {
+			n += 4
+			err = ErrUnknown
+			return
+		}
+		if n+12 > len(b) {
+			err = fmt.Errorf("short SLARP reply (increase snaplen)")
+			return
+		}
+		anon.IPv4(b[n+4:n+8], Src)
+		n += 12
+		return
+	}
+	return handleEtherType(b, n, p, anon)
+}
+
+// FrameRelayHandler anonymizes Frame Relay packets, with either RFC 2427 or
+// Cisco encapsulation.
+type FrameRelayHandler struct {
+}
+
+// Handle anonymizes one packet.
+func (h *FrameRelayHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	// Q.922 address, of 2 to 4 bytes, ending with the EA bit set
+	for {
+		if n >= len(b) || n == 4 {
+			err = fmt.Errorf("short or invalid Frame Relay address")
+			return
+		}
+		n++
+		if b[n-1]&0x01 != 0 {
+			break
+		}
+	}
+	if n < 2 {
+		err = ErrUnknown
+		return
+	}
+	if n >= len(b) {
+		err = fmt.Errorf("short Frame Relay packet (increase snaplen)")
+		return
+	}
+
+	// Cisco encapsulation has an EtherType after the address
+	if b[n] != 0x03 {
+		if n+2 > len(b) {
+			err = fmt.Errorf("short Frame Relay packet (increase snaplen)")
+			return
+		}
+		return handleEtherType(b, n+2, binary.BigEndian.Uint16(b[n:]), anon)
+	}
+
+	// RFC 2427 UI control, optional pad and NLPID
+	n++
+	if n < len(b) && b[n] == 0x00 {
+		n++
+	}
+	if n >= len(b) {
+		err = fmt.Errorf("short Frame Relay packet (increase snaplen)")
+		return
+	}
+	nlpid := b[n]
+	n++
+	switch nlpid {
+	case nlpidIPv4:
+		return handleIPv4(b, n, anon)
+	case nlpidIPv6:
+		return handleIPv6(b, n, anon)
+	case nlpidSNAP:
+		// OUI 0 with an EtherType for the PID
+		if n+5 > len(b) {
+			err = fmt.Errorf("short Frame Relay SNAP header (increase snaplen)")
+			return
+		}
+		if !isAllZeroes(b[n : n+3]) {
+			err = ErrUnknown
+			return
+		}
+		return handleEtherType(b, n+5, binary.BigEndian.Uint16(b[n+3:]), anon)
+	}
+	err = unknownProtocol("NLPID 0x%02x", nlpid)
+	return
+}
+
+// handleEtherType anonymizes the IPv4 or IPv6 header at offset n in b, given
+// its EtherType. Other EtherTypes are unknown structure.
+func handleEtherType(b []byte, n int, et uint16, anon Anonymizer) (int,
+	error) {
+	switch et {
+	case ipv4EtherType:
+		return handleIPv4(b, n, anon)
+	case ipv6EtherType:
+		return handleIPv6(b, n, anon)
+	}
+	return n, unknownProtocol("EtherType 0x%04x", et)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var httpAddr = flag.String("http-addr", "localhost:8080",
+	"address for the HTTP server started by the serve command")
+var httpMaxBody = flag.Int64("http-max-body", 1<<30,
+	"the largest capture in bytes that may be uploaded to the serve command")
+var httpTimeout = flag.Duration("http-timeout", 10*time.Minute,
+	"the longest time the serve command may take to read an upload")
+
+// httpHeaderTimeout is how long the serve command waits for request headers,
+// and httpIdleTimeout how long it keeps idle connections open.
+const (
+	httpHeaderTimeout = 10 * time.Second
+	httpIdleTimeout   = 2 * time.Minute
+)
+
+// serveMode is set by the serve command.
+var serveMode bool
+
+func init() {
+	Servers = append(Servers, serveHTTP)
+}
+
+// httpServer serves POST /anonymize, which anonymizes the uploaded pcap in
+// the request body and streams back the anonymized capture. Query parameters
+// named after the command line flags select the policy and output per
+// request (e.g. ?ipv4=encrypt&vlan=zero&pcapng=true), defaulting to those the
+// server was started with. Each request encrypts with its own key, derived
+// from the server's key and a random nonce that isn't disclosed, so no two
+// requests use the same key stream, and encrypting a capture the server
+// encrypted doesn't decrypt it. Decryption may not be requested.
+type httpServer struct {
+	policy Policy
+	keys   *Keys
+	cfg    *Config
+}
+
+// httpPolicyOptions are the policy options that may be given as query
+// parameters.
+var httpPolicyOptions = map[string]bool{
+	"mac-oui":           true,
+	"mac-nic":           true,
+	"ipv4":              true,
+	"ipv4-src":          true,
+	"ipv4-dst":          true,
+	"ipv6":              true,
+	"ipv6-src":          true,
+	"ipv6-dst":          true,
+	"vlan":              true,
+	"seq":               true,
+	"can-id":            true,
+	"zero-can-data":     true,
+	"port":              true,
+	"name":              true,
+	"id":                true,
+	"zero-timestamps":   true,
+	"beacon-timestamps": true,
+	"zero-country":      true,
+	"zero-vendor":       true,
+	"zero-vendor-ouis":  true,
+}
+
+func serveHTTP(p Policy, k *Keys, cfg *Config) (bool, error) {
+	if !serveMode {
+		return false, nil
+	}
+	if p.Decrypt {
+		return true, fmt.Errorf("serve may not be used to decrypt")
+	}
+	s := &httpServer{p, k, cfg}
+	mux := http.NewServeMux()
+	mux.Handle("/anonymize", s)
+	l, err := listen("http", *httpAddr, true)
+	if err != nil {
+		return true, err
+	}
+	hs := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: httpHeaderTimeout,
+		ReadTimeout:       *httpTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	printf("serving HTTP on %s", l.Addr())
+	notifyReady("serving HTTP on " + l.Addr().String())
+	return true, hs.Serve(l)
+}
+
+// config returns the policy and config for a request.
+func (s *httpServer) config(r *http.Request) (p Policy, cfg *Config,
+	err error) {
+	p = s.policy
+	c := *s.cfg
+	cfg = &c
+	// state kept across packets is made anew, so each request uses only its
+	// own, while the Padder is only read, and the Limiter and Metrics are
+	// shared by design
+	if s.cfg.Dedup != nil {
+		cfg.Dedup = NewDeduplicator(*dedupWindow)
+	}
+	if s.cfg.Strict != nil {
+		cfg.Strict = NewValidator(s.cfg.Strict.Action)
+	}
+	if s.cfg.Embedded != nil {
+		cfg.Embedded = NewEmbeddedScanner(s.cfg.Embedded.Action)
+	}
+	if s.cfg.Flows != nil {
+		f := *s.cfg.Flows
+		cfg.Flows = &f
+	}
+	for name, vs := range r.URL.Query() {
+		v := vs[len(vs)-1]
+		switch name {
+		case "truncate":
+			cfg.Truncate, err = strconv.ParseBool(v)
+		case "drop-unknown":
+			cfg.DropUnknown, err = strconv.ParseBool(v)
+		case "pcapng":
+			cfg.PcapNG, err = strconv.ParseBool(v)
+		case "comment":
+			cfg.CommentMode, err = parseCommentMode(v)
+		case "dedup":
+			var d bool
+			if d, err = strconv.ParseBool(v); err == nil {
+				cfg.Dedup = nil
+				if d {
+					cfg.Dedup = NewDeduplicator(*dedupWindow)
+				}
+			}
+		case "only-modified":
+			cfg.OnlyModified, err = strconv.ParseBool(v)
+		case "strip-metadata":
+			cfg.StripMetadata, err = strconv.ParseBool(v)
+		case "decrypt":
+			err = fmt.Errorf("decryption may not be requested")
+		default:
+			if httpPolicyOptions[name] {
+				err = p.Set(name, v)
+			} else {
+				err = fmt.Errorf("unknown option: %s", name)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// requestKeys returns the keys for a request, derived from the server's keys
+// with a random nonce.
+func (s *httpServer) requestKeys() (k *Keys, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(b)
+	derive := func(key []byte) []byte {
+		if key == nil {
+			return nil
+		}
+		return deriveKey(deriveRequestKey(key, nonce))
+	}
+	k = &Keys{
+		Main: derive(s.keys.Main),
+		MAC:  derive(s.keys.MAC),
+		IPv4: derive(s.keys.IPv4),
+		IPv6: derive(s.keys.IPv6),
+		VLAN: derive(s.keys.VLAN),
+	}
+	return
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a pcap file", http.StatusMethodNotAllowed)
+		return
+	}
+	p, cfg, err := s.config(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys, err := s.requestKeys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	streams, err := keys.Streams()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg.Comment = profileComment(p, cfg, keyFingerprint(keys.Main))
+	if cfg.PcapNG {
+		w.Header().Set("Content-Type", "application/x-pcapng")
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	}
+	ow := &httpOutput{w: w}
+	r.Body = http.MaxBytesReader(w, r.Body, *httpMaxBody)
+	// the request's context is done if the client goes away, stopping the run
+	rs, err := run(r.Context(), r.Body, ow, NewDefaultAnonymizer(p, streams),
+		cfg)
+	n, d := rs.Packets, rs.Dropped
+	if err != nil && err != io.EOF {
+		// errors after output has started can only be logged, and the
+		// response is cut short
+		errorf("%s: error after %d packets: %s", r.RemoteAddr, n, err)
+		if !ow.started {
+			code := http.StatusBadRequest
+			var me *http.MaxBytesError
+			if errors.As(err, &me) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), code)
+		}
+		return
+	}
+	printf("%s: processed %d packets, dropped %d unknown (%s)", r.RemoteAddr,
+		n, d, p)
+}
+
+// httpOutput is a ResponseWriter wrapper that records if output has started.
+type httpOutput struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (o *httpOutput) Write(b []byte) (int, error) {
+	o.started = true
+	return o.w.Write(b)
+}
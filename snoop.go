@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// snoopMagic is the magic at the start of snoop files.
+var snoopMagic = []byte("snoop\x00\x00\x00")
+
+// snoopLinkTypes maps snoop datalink types to pcap link types.
+var snoopLinkTypes = map[uint32]uint32{
+	0: 1, // IEEE 802.3
+	4: 1, // Ethernet
+}
+
+// newSnoopReader returns a reader for a snoop file (RFC 1761), converting its
+// packets to pcap.
+func newSnoopReader(r io.Reader) (p *PcapReader, err error) {
+	var h [16]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != 2 {
+		err = fmt.Errorf("unsupported snoop version: %d", v)
+		return
+	}
+	dl := binary.BigEndian.Uint32(h[12:])
+	link, ok := snoopLinkTypes[dl]
+	if !ok {
+		err = fmt.Errorf("unsupported snoop datalink type: %d", dl)
+		return
+	}
+	p = &PcapReader{
+		r:      r,
+		order:  binary.LittleEndian,
+		magic:  MagicLE,
+		header: GlobalHeader{2, 4, 0, 0, uint32(MaxPacketLen), link},
+	}
+	p.read = p.readSnoop
+	return
+}
+
+// readSnoop reads the next snoop packet record, which is padded to its record
+// length.
+func (p *PcapReader) readSnoop() (ph PacketHeader, b []byte, err error) {
+	var h [24]byte
+	if _, err = io.ReadFull(p.r, h[:]); err != nil {
+		return
+	}
+	ph.OrigLen = binary.BigEndian.Uint32(h[0:])
+	ph.Len = binary.BigEndian.Uint32(h[4:])
+	rlen := binary.BigEndian.Uint32(h[8:])
+	ph.TimestampSec = binary.BigEndian.Uint32(h[16:])
+	ph.TimestampUsec = binary.BigEndian.Uint32(h[20:])
+	if ph.Len > MaxPacketLen || rlen < 24+ph.Len ||
+		rlen-24-ph.Len > MaxPacketLen {
+		err = fmt.Errorf("invalid snoop record lengths: %d, %d", ph.Len, rlen)
+		return
+	}
+	if buf, ok := p.r.(memReader); ok {
+		if buf.Len() < int(rlen-24) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		b = buf.Next(int(rlen - 24))[:ph.Len]
+		return
+	}
+	b = make([]byte, rlen-24)
+	_, err = io.ReadFull(p.r, b)
+	b = b[:ph.Len]
+	return
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+var splitBy = flag.String("split-by", "",
+	"write a file per group of packets- vlan, interface or subnet, named by "+
+		"adding the group to the -out file name")
+
+var splitSubnets = flag.String("split-subnets", "",
+	"with -split-by subnet, the subnets to group packets by (comma separated "+
+		"prefixes)")
+
+// SplitMode selects the groups packets are split into.
+type SplitMode int
+
+const (
+	// SplitVLAN groups packets by their outer VLAN ID.
+	SplitVLAN SplitMode = iota
+
+	// SplitInterface groups packets by their pcapng interface.
+	SplitInterface
+
+	// SplitSubnet groups packets by the first subnet with one of their
+	// addresses.
+	SplitSubnet
+)
+
+// Splitter writes a capture file per group of packets, so each customer of a
+// shared link may be given only their own slice of a capture. Packets are
+// grouped by their original VLAN ID, interface or addresses, before they're
+// anonymized, and each file is named by adding the group to Path, before its
+// extension, such as anon-vlan100.pcap, anon-untagged.pcap or
+// anon-10.1.0.0_16.pcap. Packets with no subnet go to the group "other".
+// Files are opened as groups are seen, and all are kept open.
+type Splitter struct {
+	// Path is the base path for output files.
+	Path string
+
+	// Mode selects the groups.
+	Mode SplitMode
+
+	// Subnets are the subnets for SplitSubnet.
+	Subnets []*net.IPNet
+
+	newWriter func(w io.Writer) PacketWriter
+	counter   *uint64
+	header    GlobalHeader
+	files     map[string]*splitFile
+	group     string
+}
+
+// splitFile is the output file of a group.
+type splitFile struct {
+	file *fileOutput
+	buf  *bufio.Writer
+	pw   PacketWriter
+}
+
+// NewSplitter returns a Splitter for the split flags, or nil if splitting is
+// not enabled.
+func NewSplitter(path string) (s *Splitter, err error) {
+	if *splitSubnets != "" && *splitBy != "subnet" {
+		err = fmt.Errorf("-split-subnets requires -split-by subnet")
+		return
+	}
+	if *splitBy == "" {
+		return
+	}
+	if path == "" || path == "-" {
+		err = fmt.Errorf("-split-by requires -out with a file name")
+		return
+	}
+	s = &Splitter{Path: path, files: make(map[string]*splitFile)}
+	switch *splitBy {
+	case "vlan":
+		s.Mode = SplitVLAN
+	case "interface":
+		s.Mode = SplitInterface
+	case "subnet":
+		s.Mode = SplitSubnet
+	default:
+		err = fmt.Errorf("unknown split mode: %s", *splitBy)
+		return
+	}
+	if s.Mode == SplitSubnet {
+		if *splitSubnets == "" {
+			err = fmt.Errorf("-split-by subnet requires -split-subnets")
+			return
+		}
+		for _, p := range strings.Split(*splitSubnets, ",") {
+			var n *net.IPNet
+			if _, n, err = net.ParseCIDR(strings.TrimSpace(p)); err != nil {
+				err = fmt.Errorf("invalid subnet: %s", p)
+				return
+			}
+			s.Subnets = append(s.Subnets, n)
+		}
+	}
+	return
+}
+
+// classify selects the group of packet b, handled by h, before it's
+// anonymized.
+func (s *Splitter) classify(h Handler, c *PacketContext, b []byte) {
+	switch s.Mode {
+	case SplitInterface:
+		s.group = "if0"
+		if i := c.Interface; i != nil {
+			s.group = fmt.Sprintf("if%d", i.Index)
+			if i.Name != "" {
+				s.group = i.Name
+			}
+		}
+	default:
+		sc := &splitClassifier{}
+		handle(h, c, b, sc)
+		if s.Mode == SplitVLAN {
+			s.group = "untagged"
+			if sc.vlan != 0 {
+				s.group = fmt.Sprintf("vlan%d", sc.vlan)
+			}
+			break
+		}
+		s.group = "other"
+	subnets:
+		for _, n := range s.Subnets {
+			for _, a := range sc.addrs {
+				if n.Contains(a) {
+					l, _ := n.Mask.Size()
+					s.group = fmt.Sprintf("%s_%d", n.IP, l)
+					break subnets
+				}
+			}
+		}
+	}
+}
+
+// name returns the file name for group g.
+func (s *Splitter) name(g string) string {
+	g = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, g)
+	ext := filepath.Ext(s.Path)
+	return strings.TrimSuffix(s.Path, ext) + "-" + g + ext
+}
+
+// WriteHeader records the header for the files.
+func (s *Splitter) WriteHeader(gh *GlobalHeader) error {
+	s.header = *gh
+	return nil
+}
+
+// WritePacket writes a packet to the file of the group last classified,
+// opening it if needed.
+func (s *Splitter) WritePacket(ph *PacketHeader, b []byte,
+	comment string) (err error) {
+	f, ok := s.files[s.group]
+	if !ok {
+		f = &splitFile{}
+		if f.file, err = createFile(s.name(s.group), false, 0666); err != nil {
+			return
+		}
+		s.files[s.group] = f
+		var w io.Writer = f.file
+		if s.counter != nil {
+			w = &countingWriter{w, s.counter}
+		}
+		f.buf = bufio.NewWriter(w)
+		f.pw = s.newWriter(f.buf)
+		if err = f.pw.WriteHeader(&s.header); err != nil {
+			return
+		}
+	}
+	return f.pw.WritePacket(ph, b, comment)
+}
+
+// Close flushes the files and moves them into place.
+func (s *Splitter) Close() (err error) {
+	for _, f := range s.files {
+		var ferr error
+		if ferr = f.buf.Flush(); ferr != nil {
+			f.file.Abort()
+		} else {
+			ferr = f.file.Close()
+		}
+		if ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return
+}
+
+// Abort removes the partially written files.
+func (s *Splitter) Abort() {
+	for _, f := range s.files {
+		f.file.Abort()
+	}
+}
+
+// Groups returns the number of groups written.
+func (s *Splitter) Groups() int {
+	return len(s.files)
+}
+
+// splitClassifier is an Anonymizer that changes nothing, and records the
+// first VLAN ID and the IP addresses of a packet.
+type splitClassifier struct {
+	vlan  uint16
+	addrs []net.IP
+}
+
+func (c *splitClassifier) MAC(b []byte) {}
+
+func (c *splitClassifier) EUI64(b []byte) {}
+
+func (c *splitClassifier) DevAddr(b []byte) {}
+
+func (c *splitClassifier) IPv4(b []byte, r Role) {
+	c.addrs = append(c.addrs, net.IP(append([]byte(nil), b...)))
+}
+
+func (c *splitClassifier) IPv6(b []byte, r Role) {
+	c.addrs = append(c.addrs, net.IP(append([]byte(nil), b...)))
+}
+
+func (c *splitClassifier) VLAN(b []byte) {
+	if c.vlan == 0 {
+		c.vlan = binary.BigEndian.Uint16(b) & 0x0fff
+	}
+}
+
+func (c *splitClassifier) Sequence(b []byte, ta, anonTA []byte) {}
+
+func (c *splitClassifier) CANID(b []byte) {}
+
+func (c *splitClassifier) CANData(b []byte) {}
+
+func (c *splitClassifier) Port(b []byte) {}
+
+func (c *splitClassifier) Name(b []byte) {}
+
+func (c *splitClassifier) ID(b []byte) {}
+
+func (c *splitClassifier) Timestamp(b []byte) {}
+
+func (c *splitClassifier) BeaconTimestamp(b []byte, ta []byte) {}
+
+func (c *splitClassifier) Country(b []byte) {}
+
+func (c *splitClassifier) VendorData(b []byte, oui []byte) {}
+
+func (c *splitClassifier) Text(b []byte) {}
+
+func (c *splitClassifier) Changed() uint64 { return 0 }
+
+func (c *splitClassifier) Pseudonyms() int { return 0 }
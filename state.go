@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+var stateFile = flag.String("state-file", "",
+	"file to load anonymizer state from, and save it to after a successful run")
+
+var mapKeyStr = flag.String("map-key", "",
+	"passphrase for the HMAC of exported and imported maps, instead of -key, "+
+		"so maps may be shared without the key")
+
+var unsignedMaps = flag.Bool("unsigned-maps", false,
+	"import maps without an HMAC, such as from older versions")
+
+// stateVersion is the version of the state file format.
+const stateVersion = 1
+
+// anonState is the persistent state of a DefaultAnonymizer.
+type anonState struct {
+	Version     int               `json:"version"`
+	Fingerprint string            `json:"key_fingerprint"`
+	Policy      string            `json:"policy"`
+	Offsets     map[string]uint64 `json:"offsets"`
+	Counters    map[string]uint64 `json:"counters"`
+	Maps        string            `json:"maps"`
+	TimeShift   *int64            `json:"time_shift,omitempty"`
+
+	// Mappers are the states of the address and OUI mappers, by the names
+	// from mappers.
+	Mappers map[string]json.RawMessage `json:"mappers,omitempty"`
+}
+
+// statefulMapper is implemented by mappers whose state must be kept with the
+// mappings, so the pseudonyms they choose after it's loaded don't collide
+// with those chosen before.
+type statefulMapper interface {
+	// mapperState returns the state, to be marshaled as JSON.
+	mapperState() interface{}
+
+	// loadMapperState restores the state from its JSON.
+	loadMapperState(b []byte) error
+}
+
+// mappers returns the anonymizer's address and OUI mappers by their names
+// in state files.
+func (a *DefaultAnonymizer) mappers() map[string]AddressMapper {
+	return map[string]AddressMapper{
+		"address": a.mapper,
+		"oui":     a.vendors,
+	}
+}
+
+// hexKeys returns the keys of set s in hex, sorted.
+func hexKeys(s map[[16]byte]bool) []string {
+	h := make([]string, 0, len(s))
+	for k := range s {
+		h = append(h, hex.EncodeToString(k[:]))
+	}
+	sort.Strings(h)
+	return h
+}
+
+// decodeHexKey decodes the hex string s into k, which it must fill.
+func decodeHexKey(s string, k []byte) error {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(k) {
+		return fmt.Errorf("invalid mapper state key: %q", s)
+	}
+	copy(k, b)
+	return nil
+}
+
+// mapsMACPrefix starts the last record of exported maps, which holds their
+// HMAC.
+const mapsMACPrefix = "hmac,sha256,"
+
+// stateFileContent is the content of a state file, the state and its HMAC.
+type stateFileContent struct {
+	State json.RawMessage `json:"state"`
+	HMAC  string          `json:"hmac"`
+}
+
+// stateMAC returns the HMAC of state b, using key.
+func stateMAC(key, b []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("wanonpcap state"))
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// mapsMAC returns the HMAC of exported maps b, using key.
+func mapsMAC(key, b []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("wanonpcap maps"))
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// WriteSignedMaps writes the pseudonym mappings as CSV, like WriteMaps, with
+// the fields recorded by roles if it's not nil, followed by a record with
+// their HMAC using key, so they may be verified when imported.
+func (a *DefaultAnonymizer) WriteSignedMaps(w io.Writer, key []byte,
+	roles *MapRoles) (err error) {
+	var b bytes.Buffer
+	if err = a.writeMaps(&b, roles); err != nil {
+		return
+	}
+	return writeSignedMaps(w, b.Bytes(), key)
+}
+
+// writeSignedMaps writes maps b followed by a record with their HMAC using
+// key.
+func writeSignedMaps(w io.Writer, b, key []byte) (err error) {
+	if _, err = w.Write(b); err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", mapsMACPrefix,
+		hex.EncodeToString(mapsMAC(key, b)))
+	return
+}
+
+// ReadSignedMaps reads pseudonym mappings written by WriteSignedMaps, adding
+// them to the current mappings. No mappings are added if the HMAC doesn't
+// verify with key, or if there's no HMAC, unless unsigned is true.
+func (a *DefaultAnonymizer) ReadSignedMaps(r io.Reader, key []byte,
+	unsigned bool) (err error) {
+	var b []byte
+	if b, err = readSignedMaps(r, key, unsigned); err != nil {
+		return
+	}
+	return a.ReadMaps(bytes.NewReader(b))
+}
+
+// readSignedMaps reads maps written by WriteSignedMaps, returning them
+// without their HMAC record once it's verified with key. Maps without an HMAC
+// are returned only if unsigned is true.
+func readSignedMaps(r io.Reader, key []byte, unsigned bool) (b []byte,
+	err error) {
+	if b, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	i := bytes.LastIndex(b, []byte(mapsMACPrefix))
+	if i < 0 || i > 0 && b[i-1] != '\n' {
+		if !unsigned {
+			err = fmt.Errorf("maps have no HMAC " +
+				"(use -unsigned-maps to import anyway)")
+		}
+		return
+	}
+	var m []byte
+	if m, err = hex.DecodeString(strings.TrimSpace(
+		string(b[i+len(mapsMACPrefix):]))); err != nil ||
+		!hmac.Equal(m, mapsMAC(key, b[:i])) {
+		err = fmt.Errorf("map integrity check failed " +
+			"(modified, or wrong key or -map-key)")
+		return
+	}
+	b = b[:i]
+	return
+}
+
+// streamClasses returns the key streams for each class of field.
+func (a *DefaultAnonymizer) streamClasses() map[string]cipher.Stream {
+	return map[string]cipher.Stream{
+		"mac":  a.streams.MAC,
+		"ipv4": a.streams.IPv4,
+		"ipv6": a.streams.IPv6,
+		"vlan": a.streams.VLAN,
+	}
+}
+
+// SaveState writes the anonymizer's pseudonym mappings, counters, key stream
+// positions, mapper states and any time shift to w, authenticated with an
+// HMAC using key.
+func (a *DefaultAnonymizer) SaveState(w io.Writer, key []byte) (err error) {
+	s := anonState{
+		Version:     stateVersion,
+		Fingerprint: keyFingerprint(key),
+		Policy:      a.policy.String(),
+		Offsets:     make(map[string]uint64),
+		Counters: map[string]uint64{
+			"mac":     a.nmac,
+			"ipv4":    a.nipv4,
+			"ipv6":    a.nipv6,
+			"vlan":    a.nvlan,
+			"changed": a.nchg,
+		},
+	}
+	for c, ks := range a.streamClasses() {
+		if cs, ok := ks.(*countingStream); ok {
+			s.Offsets[c] = cs.n
+		}
+	}
+	var mb bytes.Buffer
+	if err = a.WriteMaps(&mb); err != nil {
+		return
+	}
+	s.Maps = mb.String()
+	if a.shift != nil && a.shift.set {
+		s.TimeShift = &a.shift.shift
+	}
+	var b []byte
+	for name, m := range a.mappers() {
+		sm, ok := m.(statefulMapper)
+		if !ok {
+			continue
+		}
+		if b, err = json.Marshal(sm.mapperState()); err != nil {
+			return
+		}
+		if s.Mappers == nil {
+			s.Mappers = make(map[string]json.RawMessage)
+		}
+		s.Mappers[name] = b
+	}
+	if b, err = json.Marshal(s); err != nil {
+		return
+	}
+	c := stateFileContent{b, hex.EncodeToString(stateMAC(key, b))}
+	if b, err = json.MarshalIndent(c, "", "  "); err != nil {
+		return
+	}
+	_, err = w.Write(append(b, '\n'))
+	return
+}
+
+// readState reads state written by SaveState. It's an error if the HMAC
+// doesn't verify with key.
+func readState(r io.Reader, key []byte) (s anonState, err error) {
+	var b []byte
+	if b, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	var c stateFileContent
+	if err = json.Unmarshal(b, &c); err != nil {
+		err = fmt.Errorf("invalid state file: %s", err)
+		return
+	}
+	// the state is indented in the file, but authenticated compacted
+	var sb bytes.Buffer
+	if err = json.Compact(&sb, c.State); err != nil {
+		err = fmt.Errorf("invalid state: %s", err)
+		return
+	}
+	var m []byte
+	if m, err = hex.DecodeString(c.HMAC); err != nil ||
+		!hmac.Equal(m, stateMAC(key, sb.Bytes())) {
+		err = fmt.Errorf("state file integrity check failed " +
+			"(modified, or written with a different key)")
+		return
+	}
+	if err = json.Unmarshal(sb.Bytes(), &s); err != nil {
+		err = fmt.Errorf("invalid state: %s", err)
+		return
+	}
+	if s.Version != stateVersion {
+		err = fmt.Errorf("unsupported state version: %d", s.Version)
+	}
+	return
+}
+
+// LoadState restores state written by SaveState to a new anonymizer. It's an
+// error if the HMAC doesn't verify with key, or the policy differs.
+func (a *DefaultAnonymizer) LoadState(r io.Reader, key []byte) (err error) {
+	var s anonState
+	if s, err = readState(r, key); err != nil {
+		return
+	}
+	if s.Policy != a.policy.String() {
+		return fmt.Errorf("state file policy differs: %s", s.Policy)
+	}
+
+	// restore stream positions, skipping shared streams only once
+	skipped := make(map[cipher.Stream]uint64)
+	for cl, ks := range a.streamClasses() {
+		n := s.Offsets[cl]
+		if sn, ok := skipped[ks]; ok {
+			if sn != n {
+				return fmt.Errorf("state file key streams differ " +
+					"(keys given differently)")
+			}
+			continue
+		}
+		skipped[ks] = n
+		for n > 0 {
+			l := uint64(64 * 1024)
+			if n < l {
+				l = n
+			}
+			skip(ks, int(l))
+			n -= l
+		}
+	}
+	a.nmac = s.Counters["mac"]
+	a.nipv4 = s.Counters["ipv4"]
+	a.nipv6 = s.Counters["ipv6"]
+	a.nvlan = s.Counters["vlan"]
+	a.nchg = s.Counters["changed"]
+	if s.TimeShift != nil {
+		if a.shift == nil {
+			return fmt.Errorf("state file has a time shift (use -time-base)")
+		}
+		a.shift.shift, a.shift.set = *s.TimeShift, true
+	}
+	for name, m := range a.mappers() {
+		sm, ok := m.(statefulMapper)
+		b, saved := s.Mappers[name]
+		if ok != saved {
+			// a mapper not knowing the pseudonyms before could reuse them
+			return fmt.Errorf("state file %s mapper differs (give the same "+
+				"-geoip, -preserve-prefix-len, -preserve-prefix-len6 and "+
+				"-oui-file flags)", name)
+		}
+		if ok {
+			if err = sm.loadMapperState(b); err != nil {
+				return
+			}
+		}
+	}
+	return a.ReadMaps(bytes.NewBufferString(s.Maps))
+}
+
+// loadStateFile loads the state in path into a, if the file exists.
+func loadStateFile(a *DefaultAnonymizer, path string, key []byte) (
+	loaded bool, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	if err = a.LoadState(f, key); err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+		return
+	}
+	loaded = true
+	return
+}
+
+// saveStateFile atomically replaces the state in path with that of a.
+func saveStateFile(a *DefaultAnonymizer, path string, key []byte) (err error) {
+	var f *fileOutput
+	if f, err = createFile(path, true, 0600); err != nil {
+		return
+	}
+	if err = a.SaveState(f, key); err != nil {
+		f.Abort()
+		return
+	}
+	return f.Close()
+}
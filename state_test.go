@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testAnonymizer returns a new pseudonyming anonymizer with a fixed key.
+func testAnonymizer(t *testing.T) *DefaultAnonymizer {
+	t.Helper()
+	return selfTestAnonymizer(Pseudonym, false).(*DefaultAnonymizer)
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	key := deriveKey("state")
+	a := testAnonymizer(t)
+	before := []byte{10, 0, 0, 1}
+	a.IPv4(before, Src)
+	var b bytes.Buffer
+	if err := a.SaveState(&b, key); err != nil {
+		t.Fatal(err)
+	}
+
+	l := testAnonymizer(t)
+	if err := l.LoadState(bytes.NewReader(b.Bytes()), key); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range [][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}} {
+		want := append([]byte(nil), ip...)
+		got := append([]byte(nil), ip...)
+		a.IPv4(want, Src)
+		l.IPv4(got, Src)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: loaded %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestReadState(t *testing.T) {
+	key := deriveKey("state")
+	var b bytes.Buffer
+	if err := testAnonymizer(t).SaveState(&b, key); err != nil {
+		t.Fatal(err)
+	}
+	saved := b.String()
+	var c stateFileContent
+	if err := json.Unmarshal(b.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		state string
+		key   []byte
+		err   string
+	}{
+		{"valid", saved, key, ""},
+		{"reindented", strings.Replace(saved, "  ", "\t", -1), key, ""},
+		{"wrong key", saved, deriveKey("other"), "integrity check failed"},
+		{"modified", strings.Replace(saved, `"version": 1`,
+			`"version": 2`, 1), key, "integrity check failed"},
+		{"bad hmac", strings.Replace(saved, c.HMAC, "zz", 1), key,
+			"integrity check failed"},
+		{"not json", "state", key, "invalid state file"},
+	} {
+		_, err := readState(strings.NewReader(tc.state), tc.key)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %s", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(),
+			tc.err)):
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestLoadStatePolicy(t *testing.T) {
+	key := deriveKey("state")
+	var b bytes.Buffer
+	if err := testAnonymizer(t).SaveState(&b, key); err != nil {
+		t.Fatal(err)
+	}
+	l := selfTestAnonymizer(Encrypt, false).(*DefaultAnonymizer)
+	err := l.LoadState(&b, key)
+	if err == nil || !strings.Contains(err.Error(), "policy differs") {
+		t.Errorf("got error %v, want policy differs", err)
+	}
+}
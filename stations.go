@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+var stationReportPath = flag.String("station-report", "",
+	"file to write a session summary of the anonymized stations in a "+
+		"radiotap + 802.11 capture to")
+
+// StationReport summarizes the sessions of the stations in a radiotap +
+// 802.11 capture, by anonymized address: when each was first and last seen,
+// the anonymized BSSIDs it was seen with, the frames and bytes it sent or
+// received, and the range of the radiotap antenna signal of the frames it
+// sent.
+type StationReport struct {
+	stations map[[6]byte]*stationEntry
+	shift    *TimeShift
+}
+
+type stationEntry struct {
+	first  time.Time
+	last   time.Time
+	frames uint64
+	bytes  uint64
+	bssids map[[6]byte]bool
+
+	// minSignal and maxSignal are the antenna signal range in dBm, if
+	// signal is true.
+	signal    bool
+	minSignal int8
+	maxSignal int8
+}
+
+// NewStationReport returns a new, empty station report. If shift is not nil,
+// times are reported shifted by it, as in the output.
+func NewStationReport(shift *TimeShift) *StationReport {
+	return &StationReport{
+		stations: make(map[[6]byte]*stationEntry),
+		shift:    shift,
+	}
+}
+
+// add adds a frame to the report, given its original and anonymized content
+// and context. As for BSSIDReport, the original is used to find the BSSID and
+// stations, so group addresses can be told apart after anonymization.
+func (r *StationReport) add(orig, anon []byte, ctx *PacketContext) {
+	var rh RadiotapHeader
+	if rh.Read(bytes.NewBuffer(orig)) != nil {
+		return
+	}
+	off := int(rh.Len)
+	if off+24 > len(orig) || len(anon) < len(orig) || orig[off]&0x3 != 0 {
+		return
+	}
+	_, typ, styp := parseFC(orig[off])
+	tods, fromds, _ := parseFlags(orig[off+1])
+	addr := func(i int) []byte {
+		return orig[off+4+6*i : off+10+6*i]
+	}
+	bi, si := bssidIndex(typ, styp, tods, fromds)
+	if bi < 0 || addr(bi)[0]&0x01 != 0 {
+		return
+	}
+	var signal []byte
+	rh.walk(orig[:off], func(bit int, f []byte) {
+		if bit == rtSignal && signal == nil {
+			signal = f
+		}
+	})
+	n := uint64(ctx.OrigLen)
+	if n == 0 {
+		n = uint64(len(orig))
+	}
+	for _, i := range si {
+		a := addr(i)
+		if a[0]&0x01 != 0 || bytes.Equal(a, addr(bi)) {
+			continue
+		}
+		e := r.entry(anon[off+4+6*i : off+10+6*i])
+		e.frames++
+		e.bytes += n
+		e.bssids[toArray6(anon[off+4+6*bi:off+10+6*bi])] = true
+		if t := ctx.Timestamp; !t.IsZero() {
+			if e.first.IsZero() || t.Before(e.first) {
+				e.first = t
+			}
+			if t.After(e.last) {
+				e.last = t
+			}
+		}
+		// the second address is the transmitter
+		if i == 1 && signal != nil {
+			s := int8(signal[0])
+			if !e.signal || s < e.minSignal {
+				e.minSignal = s
+			}
+			if !e.signal || s > e.maxSignal {
+				e.maxSignal = s
+			}
+			e.signal = true
+		}
+	}
+}
+
+// entry returns the entry for anonymized station address b, adding it if
+// needed.
+func (r *StationReport) entry(b []byte) *stationEntry {
+	k := toArray6(b)
+	e, ok := r.stations[k]
+	if !ok {
+		e = &stationEntry{bssids: make(map[[6]byte]bool)}
+		r.stations[k] = e
+	}
+	return e
+}
+
+// Write writes the report as a table to w, by descending frame count. Times
+// are in UTC, and the signal range is in dBm.
+func (r *StationReport) Write(w io.Writer) (err error) {
+	var ks [][6]byte
+	for k := range r.stations {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		fi, fj := r.stations[ks[i]].frames, r.stations[ks[j]].frames
+		if fi != fj {
+			return fi > fj
+		}
+		return bytes.Compare(ks[i][:], ks[j][:]) < 0
+	})
+	if _, err = fmt.Fprintf(w, "%-17s %-20s %-20s %10s %12s %9s  %s\n",
+		"station", "first", "last", "frames", "bytes", "signal",
+		"bssids"); err != nil {
+		return
+	}
+	seen := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return r.shift.time(t).UTC().Format("2006-01-02T15:04:05Z")
+	}
+	for _, k := range ks {
+		e := r.stations[k]
+		var bs [][6]byte
+		for b := range e.bssids {
+			bs = append(bs, b)
+		}
+		sort.Slice(bs, func(i, j int) bool {
+			return bytes.Compare(bs[i][:], bs[j][:]) < 0
+		})
+		var ss []string
+		for _, b := range bs {
+			ss = append(ss, net.HardwareAddr(b[:]).String())
+		}
+		sig := "-"
+		if e.signal {
+			sig = fmt.Sprintf("%d..%d", e.minSignal, e.maxSignal)
+		}
+		if _, err = fmt.Fprintf(w, "%-17s %-20s %-20s %10d %12d %9s  %s\n",
+			net.HardwareAddr(k[:]), seen(e.first), seen(e.last), e.frames,
+			e.bytes, sig, strings.Join(ss, ",")); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// fieldCounter is an Anonymizer that leaves all fields untouched, counting
+// the fields of each class and their distinct values.
+type fieldCounter struct {
+	fields   map[string]uint64
+	distinct map[string]map[string]bool
+}
+
+func newFieldCounter() *fieldCounter {
+	return &fieldCounter{
+		fields:   make(map[string]uint64),
+		distinct: make(map[string]map[string]bool),
+	}
+}
+
+func (c *fieldCounter) add(class string, b []byte) {
+	c.fields[class]++
+	d, ok := c.distinct[class]
+	if !ok {
+		d = make(map[string]bool)
+		c.distinct[class] = d
+	}
+	d[string(b)] = true
+}
+
+func (c *fieldCounter) MAC(b []byte) { c.add("mac", b) }
+
+func (c *fieldCounter) EUI64(b []byte) { c.add("eui64", b) }
+
+func (c *fieldCounter) DevAddr(b []byte) { c.add("devaddr", b) }
+
+func (c *fieldCounter) IPv4(b []byte, r Role) { c.add("ipv4", b) }
+
+func (c *fieldCounter) IPv6(b []byte, r Role) { c.add("ipv6", b) }
+
+func (c *fieldCounter) VLAN(b []byte) {
+	c.add("vlan", []byte{b[0] & 0x0f, b[1]})
+}
+
+func (c *fieldCounter) Sequence(b []byte, ta, anonTA []byte) {
+	c.fields["seq"]++
+}
+
+func (c *fieldCounter) CANID(b []byte) {
+	c.add("can-id", []byte{b[0] & 0x9f, b[1], b[2], b[3]})
+}
+
+func (c *fieldCounter) CANData(b []byte) { c.fields["can-data"]++ }
+
+func (c *fieldCounter) Port(b []byte) { c.add("port", b) }
+
+func (c *fieldCounter) Name(b []byte) { c.add("name", bytes.ToLower(b)) }
+
+func (c *fieldCounter) ID(b []byte) { c.add("id", b) }
+
+func (c *fieldCounter) Timestamp(b []byte) { c.fields["timestamp"]++ }
+
+func (c *fieldCounter) BeaconTimestamp(b []byte, ta []byte) {
+	c.fields["timestamp"]++
+}
+
+func (c *fieldCounter) Country(b []byte) { c.add("country", b) }
+
+func (c *fieldCounter) Text(b []byte) { c.add("text", b) }
+
+func (c *fieldCounter) VendorData(b []byte, oui []byte) {
+	c.fields["vendor"]++
+}
+
+func (c *fieldCounter) Changed() uint64 { return 0 }
+
+func (c *fieldCounter) Pseudonyms() int { return 0 }
+
+// runStats reads the capture from in and writes a report to w of its packets,
+// packets with unknown structure, and the fields found.
+func runStats(in io.Reader, w io.Writer) (err error) {
+	var pr *PcapReader
+	if *erfFormat {
+		pr = NewERFReader(bufio.NewReader(in))
+	} else if pr, err = NewCaptureReader(bufio.NewReader(in)); err != nil {
+		return
+	}
+	link := pr.header.LinkLayer
+	h, ok := Handlers[link]
+	if !ok && FallbackHandler != nil {
+		h = FallbackHandler(link)
+		ok = h != nil
+	}
+	if !ok {
+		err = fmt.Errorf("unsupported link layer: %d", link)
+		return
+	}
+	c := newFieldCounter()
+	var packets, unknowns, bytes uint64
+	for {
+		var ph PacketHeader
+		var b []byte
+		if ph, b, err = pr.ReadPacket(); err != nil {
+			if err != io.EOF {
+				return
+			}
+			err = nil
+			break
+		}
+		packets++
+		bytes += uint64(len(b))
+		if _, err = handle(h, pr.context(&ph), b, c); err != nil {
+			if !errors.Is(err, ErrUnknown) {
+				return
+			}
+			err = nil
+			unknowns++
+		}
+	}
+	fmt.Fprintf(w, "link type %d, %d packets, %d bytes, %d unknown structure\n",
+		link, packets, bytes, unknowns)
+	var classes []string
+	for class := range c.fields {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		if d, ok := c.distinct[class]; ok {
+			_, err = fmt.Fprintf(w, "%s: %d fields, %d distinct\n", class,
+				c.fields[class], len(d))
+		} else {
+			_, err = fmt.Fprintf(w, "%s: %d fields\n", class, c.fields[class])
+		}
+	}
+	return
+}
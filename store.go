@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var pseudonymStoreURL = flag.String("pseudonym-store", "",
+	"external store for address pseudonyms- bolt:file or redis://host:port "+
+		"(requires the bolt or redis build tag)")
+
+// PseudonymStore stores address pseudonyms outside of the anonymizer, so they
+// may be shared by processes, or kept on disk for captures with more
+// addresses than fit in memory. Pseudonyms are stored by map class (mac-oui,
+// mac-nic, eui64-ext, devaddr, ipv4 or ipv6), which fixes the length of the
+// original value and pseudonym. As pseudonyms aren't tied to a key, a store
+// should only be used with one key. Stores must be safe for concurrent use,
+// as a SyncAnonymizer uses them for different classes in parallel.
+type PseudonymStore interface {
+	// Get returns the pseudonym for orig, or nil if there's none.
+	Get(class string, orig []byte) ([]byte, error)
+
+	// Put stores pseudo as the pseudonym for orig, unless one was already
+	// stored, such as by another process, returning the stored pseudonym.
+	Put(class string, orig, pseudo []byte) ([]byte, error)
+
+	// Close closes the store.
+	Close() error
+}
+
+// PseudonymStores open stores by URL scheme, and are added by the builds that
+// support them.
+var PseudonymStores = map[string]func(url string) (PseudonymStore, error){}
+
+// openPseudonymStore opens the store for url, selected by its scheme.
+func openPseudonymStore(url string) (PseudonymStore, error) {
+	scheme, _, _ := strings.Cut(url, ":")
+	open, ok := PseudonymStores[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported pseudonym store: %s", url)
+	}
+	return open(url)
+}
+
+// MemoryStore is a PseudonymStore in memory. It's safe for concurrent use, so
+// anonymizers in one process, such as for each request to a server, may
+// share pseudonyms.
+type MemoryStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+// NewMemoryStore returns a new, empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{m: make(map[string][]byte)}
+}
+
+// Get returns the pseudonym for orig.
+func (s *MemoryStore) Get(class string, orig []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[class+","+string(orig)], nil
+}
+
+// Put stores pseudo as the pseudonym for orig, unless one was stored first.
+func (s *MemoryStore) Put(class string, orig, pseudo []byte) ([]byte,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := class + "," + string(orig)
+	if p, ok := s.m[k]; ok {
+		return p, nil
+	}
+	p := append([]byte(nil), pseudo...)
+	s.m[k] = p
+	return p, nil
+}
+
+// Close does nothing.
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var strictFlag = flag.Bool("strict", false,
+	"validate packet lengths and timestamps before anonymizing, to check "+
+		"capture integrity")
+
+var strictActionStr = flag.String("strict-action", "abort",
+	"with -strict, what to do with inconsistent packets- warn, drop or abort")
+
+// StrictAction is what's done with a packet that fails validation.
+type StrictAction int
+
+const (
+	// StrictWarn means log each problem and keep the packet.
+	StrictWarn StrictAction = iota
+
+	// StrictDrop means log each problem and drop the packet.
+	StrictDrop
+
+	// StrictAbort means stop with an error at the first problem.
+	StrictAbort
+)
+
+func parseStrictAction(s string) (a StrictAction, err error) {
+	switch s {
+	case "warn":
+		a = StrictWarn
+	case "drop":
+		a = StrictDrop
+	case "abort":
+		a = StrictAbort
+	default:
+		err = fmt.Errorf("unknown strict action: %s", s)
+	}
+	return
+}
+
+// minDot11Len is the length of the shortest 802.11 frame, an ACK without FCS.
+const minDot11Len = 10
+
+// Validator cross-checks each packet read against its header and the packets
+// before it, so inconsistent captures are caught before they're published.
+// It checks that the captured length is within the original length and
+// snaplen, that the total length of the outer IPv4 or IPv6 header fits in
+// the original length (and for complete packets, the captured data), that
+// the radiotap header fits in the packet, leaving room for an 802.11 frame,
+// and that timestamps don't go backwards. The IP header is found by running
+// the handler with the validator as an anonymizer that changes nothing.
+type Validator struct {
+	Action StrictAction
+
+	// Invalid is the number of packets that failed validation.
+	Invalid uint64
+
+	pkt     []byte
+	hdr     int
+	lastSec uint32
+	lastUs  uint32
+	started bool
+}
+
+// NewValidator returns a new validator that takes action on problems.
+func NewValidator(action StrictAction) *Validator {
+	return &Validator{Action: action}
+}
+
+// validate validates packet number i, taking the action for any problems. It
+// returns if the packet should be dropped, or an error to stop with.
+func (v *Validator) validate(h Handler, r *PcapReader, ph *PacketHeader,
+	b []byte, i uint64) (drop bool, err error) {
+	p := v.check(h, r, ph, b)
+	if len(p) == 0 {
+		return
+	}
+	v.Invalid++
+	if v.Action == StrictAbort {
+		err = fmt.Errorf("packet %d: %s", i, strings.Join(p, ", "))
+		return
+	}
+	for _, m := range p {
+		logPacketf(LevelInfo, r.header.LinkLayer, i, "packet %d: %s", i, m)
+	}
+	drop = v.Action == StrictDrop
+	return
+}
+
+// check validates packet b, with header ph, read by r and handled by h. It
+// returns the problems found.
+func (v *Validator) check(h Handler, r *PcapReader, ph *PacketHeader,
+	b []byte) (p []string) {
+	if ph.Len > ph.OrigLen {
+		p = append(p, fmt.Sprintf("captured length %d exceeds original "+
+			"length %d", ph.Len, ph.OrigLen))
+	}
+	snaplen := r.header.Snaplen
+	if r.iface != nil && r.iface.snaplen != 0 {
+		snaplen = r.iface.snaplen
+	}
+	if snaplen != 0 && ph.Len > snaplen {
+		p = append(p, fmt.Sprintf("captured length %d exceeds snaplen %d",
+			ph.Len, snaplen))
+	}
+	if int(ph.Len) != len(b) {
+		p = append(p, fmt.Sprintf("captured length %d doesn't match data "+
+			"length %d", ph.Len, len(b)))
+	}
+	complete := ph.Len == ph.OrigLen
+
+	// timestamps
+	if v.started && (ph.TimestampSec < v.lastSec ||
+		ph.TimestampSec == v.lastSec && ph.TimestampUsec < v.lastUs) {
+		p = append(p, fmt.Sprintf("timestamp %d.%06d before previous "+
+			"%d.%06d", ph.TimestampSec, ph.TimestampUsec, v.lastSec,
+			v.lastUs))
+	}
+	v.lastSec, v.lastUs, v.started = ph.TimestampSec, ph.TimestampUsec, true
+
+	// radiotap
+	if r.header.LinkLayer == 127 && len(b) >= 4 {
+		l := int(binary.LittleEndian.Uint16(b[2:]))
+		switch {
+		case l < 8:
+			p = append(p, fmt.Sprintf("radiotap length %d too short", l))
+		case l > len(b):
+			p = append(p, fmt.Sprintf("radiotap length %d exceeds captured "+
+				"length %d", l, len(b)))
+		case complete && len(b)-l < minDot11Len:
+			p = append(p, fmt.Sprintf("radiotap length %d leaves %d bytes for "+
+				"the 802.11 frame", l, len(b)-l))
+		}
+	}
+
+	// outer IP header
+	v.pkt, v.hdr = b, -1
+	handle(h, r.context(ph), b, v)
+	if v.hdr < 0 {
+		return
+	}
+	var hl, tl int
+	if o := v.hdr; b[o]>>4 == 4 {
+		hl = int(b[o]&0xf) * 4
+		if o+4 <= len(b) {
+			tl = int(binary.BigEndian.Uint16(b[o+2:]))
+		}
+	} else {
+		hl = 40
+		if o+6 <= len(b) {
+			tl = 40 + int(binary.BigEndian.Uint16(b[o+4:]))
+		}
+	}
+	switch {
+	case tl == 0:
+	case tl < hl:
+		p = append(p, fmt.Sprintf("IP total length %d shorter than header "+
+			"length %d", tl, hl))
+	case v.hdr+tl > int(ph.OrigLen):
+		p = append(p, fmt.Sprintf("IP total length %d exceeds original "+
+			"length %d at offset %d", tl, ph.OrigLen, v.hdr))
+	case complete && v.hdr+tl > len(b):
+		p = append(p, fmt.Sprintf("IP total length %d exceeds captured "+
+			"length %d at offset %d", tl, len(b), v.hdr))
+	}
+	return
+}
+
+// header records the offset of the IP header of version ver if b, at offset
+// o in the header, is the packet's first address.
+func (v *Validator) header(b []byte, o int, ver byte) {
+	if v.hdr >= 0 {
+		return
+	}
+	h := cap(v.pkt) - cap(b) - o
+	if h >= 0 && h < len(v.pkt) && v.pkt[h]>>4 == ver {
+		v.hdr = h
+	}
+}
+
+func (v *Validator) MAC(b []byte) {}
+
+func (v *Validator) EUI64(b []byte) {}
+
+func (v *Validator) DevAddr(b []byte) {}
+
+func (v *Validator) IPv4(b []byte, r Role) {
+	if r == Src {
+		v.header(b, 12, 4)
+	}
+}
+
+func (v *Validator) IPv6(b []byte, r Role) {
+	if r == Src {
+		v.header(b, 8, 6)
+	}
+}
+
+func (v *Validator) VLAN(b []byte) {}
+
+func (v *Validator) Sequence(b []byte, ta, anonTA []byte) {}
+
+func (v *Validator) CANID(b []byte) {}
+
+func (v *Validator) CANData(b []byte) {}
+
+func (v *Validator) Port(b []byte) {}
+
+func (v *Validator) Name(b []byte) {}
+
+func (v *Validator) ID(b []byte) {}
+
+func (v *Validator) Timestamp(b []byte) {}
+
+func (v *Validator) BeaconTimestamp(b []byte, ta []byte) {}
+
+func (v *Validator) Country(b []byte) {}
+
+func (v *Validator) VendorData(b []byte, oui []byte) {}
+
+func (v *Validator) Text(b []byte) {}
+
+func (v *Validator) Changed() uint64 { return 0 }
+
+func (v *Validator) Pseudonyms() int { return 0 }
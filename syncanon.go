@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/cipher"
+	"io"
+	"sync"
+)
+
+// SyncAnonymizer is a DefaultAnonymizer that's safe for concurrent use. Each
+// class of field is locked by the key stream it uses, so with separate keys
+// or subkeys, MAC addresses, IPv4 addresses, IPv6 addresses and VLAN IDs are
+// anonymized in parallel, while with a single key, all are serialized as
+// they share one stream. Results are the same as for a DefaultAnonymizer
+// given fields in the same order, but concurrent use makes that order vary,
+// so pseudonyms are only consistent within a run, and encrypted fields may not
+// be decrypted.
+type SyncAnonymizer struct {
+	a    *DefaultAnonymizer
+	mac  *sync.Mutex
+	ipv4 *sync.Mutex
+	ipv6 *sync.Mutex
+	vlan *sync.Mutex
+}
+
+// NewSyncAnonymizer returns a new concurrency-safe anonymizer.
+func NewSyncAnonymizer(policy Policy, streams Streams) *SyncAnonymizer {
+	locks := make(map[cipher.Stream]*sync.Mutex)
+	lock := func(s cipher.Stream) *sync.Mutex {
+		m, ok := locks[s]
+		if !ok {
+			m = &sync.Mutex{}
+			locks[s] = m
+		}
+		return m
+	}
+	return &SyncAnonymizer{
+		a:    NewDefaultAnonymizer(policy, streams),
+		mac:  lock(streams.MAC),
+		ipv4: lock(streams.IPv4),
+		ipv6: lock(streams.IPv6),
+		vlan: lock(streams.VLAN),
+	}
+}
+
+// SetStore sets an external store for address pseudonyms, before the
+// anonymizer is used.
+func (s *SyncAnonymizer) SetStore(st PseudonymStore) {
+	s.a.SetStore(st)
+}
+
+// SetAddressMapper sets a mapper for IP address pseudonyms, before the
+// anonymizer is used.
+func (s *SyncAnonymizer) SetAddressMapper(m AddressMapper) {
+	s.a.SetAddressMapper(m)
+}
+
+// lockAll locks all the distinct locks, returning a function to unlock them.
+func (s *SyncAnonymizer) lockAll() (unlock func()) {
+	var ms []*sync.Mutex
+	for _, m := range []*sync.Mutex{s.mac, s.ipv4, s.ipv6, s.vlan} {
+		dup := false
+		for _, l := range ms {
+			dup = dup || l == m
+		}
+		if !dup {
+			m.Lock()
+			ms = append(ms, m)
+		}
+	}
+	return func() {
+		for _, m := range ms {
+			m.Unlock()
+		}
+	}
+}
+
+func (s *SyncAnonymizer) MAC(b []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.MAC(b)
+}
+
+func (s *SyncAnonymizer) EUI64(b []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.EUI64(b)
+}
+
+func (s *SyncAnonymizer) DevAddr(b []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.DevAddr(b)
+}
+
+func (s *SyncAnonymizer) IPv4(b []byte, r Role) {
+	s.ipv4.Lock()
+	defer s.ipv4.Unlock()
+	s.a.IPv4(b, r)
+}
+
+func (s *SyncAnonymizer) IPv6(b []byte, r Role) {
+	s.ipv6.Lock()
+	defer s.ipv6.Unlock()
+	s.a.IPv6(b, r)
+}
+
+func (s *SyncAnonymizer) VLAN(b []byte) {
+	s.vlan.Lock()
+	defer s.vlan.Unlock()
+	s.a.VLAN(b)
+}
+
+// Sequence uses the MAC lock, as offsets come from the MAC key stream.
+func (s *SyncAnonymizer) Sequence(b []byte, ta, anonTA []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.Sequence(b, ta, anonTA)
+}
+
+func (s *SyncAnonymizer) CANID(b []byte) {
+	s.vlan.Lock()
+	defer s.vlan.Unlock()
+	s.a.CANID(b)
+}
+
+func (s *SyncAnonymizer) CANData(b []byte) {
+	s.a.CANData(b)
+}
+
+func (s *SyncAnonymizer) Port(b []byte) {
+	s.vlan.Lock()
+	defer s.vlan.Unlock()
+	s.a.Port(b)
+}
+
+func (s *SyncAnonymizer) Name(b []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.Name(b)
+}
+
+func (s *SyncAnonymizer) ID(b []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.ID(b)
+}
+
+func (s *SyncAnonymizer) Timestamp(b []byte) {
+	s.a.Timestamp(b)
+}
+
+// BeaconTimestamp uses the MAC lock, as bases are kept by transmitter.
+func (s *SyncAnonymizer) BeaconTimestamp(b []byte, ta []byte) {
+	s.mac.Lock()
+	defer s.mac.Unlock()
+	s.a.BeaconTimestamp(b, ta)
+}
+
+func (s *SyncAnonymizer) Country(b []byte) {
+	s.a.Country(b)
+}
+
+func (s *SyncAnonymizer) VendorData(b []byte, oui []byte) {
+	s.a.VendorData(b, oui)
+}
+
+func (s *SyncAnonymizer) Text(b []byte) {
+	s.a.Text(b)
+}
+
+func (s *SyncAnonymizer) Changed() uint64 {
+	return s.a.Changed()
+}
+
+func (s *SyncAnonymizer) Pseudonyms() int {
+	defer s.lockAll()()
+	return s.a.Pseudonyms()
+}
+
+// Stats returns the anonymizer's statistics.
+func (s *SyncAnonymizer) Stats() AnonymizerStats {
+	defer s.lockAll()()
+	return s.a.Stats()
+}
+
+// Err returns the first error from the pseudonym store, if any.
+func (s *SyncAnonymizer) Err() error {
+	return s.a.Err()
+}
+
+// WriteMaps writes the pseudonym mappings as CSV.
+func (s *SyncAnonymizer) WriteMaps(w io.Writer) error {
+	defer s.lockAll()()
+	return s.a.WriteMaps(w)
+}
+
+// ReadMaps reads pseudonym mappings written by WriteMaps.
+func (s *SyncAnonymizer) ReadMaps(r io.Reader) error {
+	defer s.lockAll()()
+	return s.a.ReadMaps(r)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const sdListenFdsStart = 3
+
+// activation holds the sockets passed by systemd socket activation, by the
+// names given with FileDescriptorName= in the socket unit.
+var activation struct {
+	sync.Once
+	names     []string
+	listeners []net.Listener
+	err       error
+}
+
+// activated returns the listeners passed by systemd socket activation, and
+// their names, unsetting the environment variables that pass them so they
+// aren't inherited by child processes.
+func activated() ([]net.Listener, []string, error) {
+	activation.Do(func() {
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			f := os.NewFile(uintptr(sdListenFdsStart+i), "")
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				activation.err = err
+				return
+			}
+			name := ""
+			if i < len(names) {
+				name = names[i]
+			}
+			activation.listeners = append(activation.listeners, l)
+			activation.names = append(activation.names, name)
+		}
+	})
+	return activation.listeners, activation.names, activation.err
+}
+
+// listen returns the socket passed by systemd socket activation with the
+// given name, or with fallback, if exactly one socket was passed with another
+// name, that socket. Otherwise, it listens on TCP address addr.
+func listen(name, addr string, fallback bool) (net.Listener, error) {
+	ls, names, err := activated()
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range names {
+		if n == name {
+			return ls[i], nil
+		}
+	}
+	if fallback && len(ls) == 1 && !knownListener(names[0]) {
+		return ls[0], nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// knownListener returns true if name is one of the socket names used by
+// listen.
+func knownListener(name string) bool {
+	switch name {
+	case "http", "grpc", "metrics", "input":
+		return true
+	}
+	return false
+}
+
+// sdNotify sends state to the systemd service manager, if it's given a
+// socket with NOTIFY_SOCKET. Otherwise, it does nothing.
+func sdNotify(state string) error {
+	s := os.Getenv("NOTIFY_SOCKET")
+	if s == "" {
+		return nil
+	}
+	if s[0] == '@' {
+		// abstract socket
+		s = "\x00" + s[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s,
+		Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells systemd that a server is ready, with its status, and
+// starts sending watchdog keep-alives at half the interval systemd expects
+// them, if it's enabled with WatchdogSec= in the service unit.
+func notifyReady(status string) {
+	if err := sdNotify("READY=1\nSTATUS=" + status); err != nil {
+		errorf("sd_notify error: %s", err)
+		return
+	}
+	if p := os.Getenv("WATCHDOG_PID"); p != "" &&
+		p != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	us, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || us == 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(us) * time.Microsecond / 2)
+		defer t.Stop()
+		for range t.C {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				errorf("sd_notify error: %s", err)
+			}
+		}
+	}()
+}
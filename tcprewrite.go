@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+var mapFormat = flag.String("map-format", "csv",
+	"with map export, the format of the mappings- csv, or tcprewrite for "+
+		"tcprewrite options")
+
+// TCPRewriteMap wraps an Anonymizer and records how each MAC address, IPv4
+// and IPv6 source and destination address is rewritten, to write them as
+// options for tcprewrite, so replay tooling can apply the same transformation
+// to related captures. Unlike the CSV maps, whole MAC
+// addresses are recorded, rather than their OUI and NIC parts, as tcprewrite
+// substitutes whole addresses. Values that are left alone, or rewritten to
+// more than one value, as encryption does, aren't written.
+type TCPRewriteMap struct {
+	Anonymizer
+
+	// Inconsistent is the number of values rewritten to more than one value.
+	Inconsistent int
+
+	macs map[string]map[string]bool
+	src  map[string]map[string]bool
+	dst  map[string]map[string]bool
+}
+
+// NewTCPRewriteMap returns a new TCPRewriteMap wrapping a.
+func NewTCPRewriteMap(a Anonymizer) *TCPRewriteMap {
+	return &TCPRewriteMap{
+		Anonymizer: a,
+		macs:       make(map[string]map[string]bool),
+		src:        make(map[string]map[string]bool),
+		dst:        make(map[string]map[string]bool),
+	}
+}
+
+// record records that o was rewritten to p in m.
+func (t *TCPRewriteMap) record(m map[string]map[string]bool, o, p string) {
+	if m[o] == nil {
+		m[o] = make(map[string]bool)
+	}
+	m[o][p] = true
+}
+
+// MAC anonymizes and records a MAC address.
+func (t *TCPRewriteMap) MAC(b []byte) {
+	o := net.HardwareAddr(append([]byte(nil), b...)).String()
+	t.Anonymizer.MAC(b)
+	t.record(t.macs, o, net.HardwareAddr(b).String())
+}
+
+// IPv4 anonymizes and records an IPv4 address.
+func (t *TCPRewriteMap) IPv4(b []byte, r Role) {
+	o := net.IP(append([]byte(nil), b...)).String() + "/32"
+	t.Anonymizer.IPv4(b, r)
+	t.recordIP(r, o, net.IP(b).String()+"/32")
+}
+
+// IPv6 anonymizes and records an IPv6 address.
+func (t *TCPRewriteMap) IPv6(b []byte, r Role) {
+	o := "[" + net.IP(append([]byte(nil), b...)).String() + "]/128"
+	t.Anonymizer.IPv6(b, r)
+	t.recordIP(r, o, "["+net.IP(b).String()+"]/128")
+}
+
+// recordIP records that IP address o, in role r, was rewritten to p.
+func (t *TCPRewriteMap) recordIP(r Role, o, p string) {
+	if r == Dst {
+		t.record(t.dst, o, p)
+	} else {
+		t.record(t.src, o, p)
+	}
+}
+
+// Stats returns the statistics of the wrapped anonymizer, if it has them.
+func (t *TCPRewriteMap) Stats() (s AnonymizerStats) {
+	if sa, ok := t.Anonymizer.(interface{ Stats() AnonymizerStats }); ok {
+		s = sa.Stats()
+	}
+	return
+}
+
+// Err returns any error from the wrapped anonymizer.
+func (t *TCPRewriteMap) Err() (err error) {
+	if ea, ok := t.Anonymizer.(interface{ Err() error }); ok {
+		err = ea.Err()
+	}
+	return
+}
+
+// pairs returns the values in m rewritten to one other value, as sorted
+// "original" sep "rewritten" pairs.
+func (t *TCPRewriteMap) pairs(m map[string]map[string]bool,
+	sep string) (ps []string) {
+	for o, rs := range m {
+		if len(rs) > 1 {
+			t.Inconsistent++
+			continue
+		}
+		for p := range rs {
+			if p != o {
+				ps = append(ps, o+sep+p)
+			}
+		}
+	}
+	sort.Strings(ps)
+	return
+}
+
+// Write writes the tcprewrite options, one per line, so they may be given to
+// tcprewrite with e.g. tcprewrite $(cat maps.txt): --srcipmap and --dstipmap
+// for the addresses rewritten in each role, and --enet-subsmac for each MAC
+// address.
+func (t *TCPRewriteMap) Write(w io.Writer) (err error) {
+	t.Inconsistent = 0
+	for _, o := range []struct {
+		name string
+		m    map[string]map[string]bool
+	}{
+		{"srcipmap", t.src},
+		{"dstipmap", t.dst},
+	} {
+		if ps := t.pairs(o.m, ":"); len(ps) > 0 {
+			if _, err = fmt.Fprintf(w, "--%s=%s\n", o.name,
+				strings.Join(ps, ",")); err != nil {
+				return
+			}
+		}
+	}
+	for _, p := range t.pairs(t.macs, ",") {
+		if _, err = fmt.Fprintf(w, "--enet-subsmac=%s\n", p); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"time"
+)
+
+var timeBase = flag.String("time-base", "",
+	"shift capture timestamps so the first packet is at this time (RFC 3339, "+
+		"e.g. 2000-01-01T00:00:00Z), keeping the shift in -state-file")
+
+// TimeShift shifts capture timestamps by a whole number of seconds, so the
+// first packet is at a base time, hiding the capture date while keeping the
+// times between packets. The shift is chosen at the first packet, and saved
+// with the anonymizer's state, so files anonymized with the same state file
+// share it, keeping the timing relationships between them. Only capture
+// timestamps are shifted, not those in packet headers.
+type TimeShift struct {
+	base  int64
+	shift int64
+	set   bool
+}
+
+// NewTimeShift returns a time shift that moves the first packet to base.
+func NewTimeShift(base time.Time) *TimeShift {
+	return &TimeShift{base: base.Unix()}
+}
+
+// ParseTimeShift returns a time shift for base, an RFC 3339 time.
+func ParseTimeShift(base string) (*TimeShift, error) {
+	t, err := time.Parse(time.RFC3339, base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time base: %s", base)
+	}
+	if t.Unix() < 0 || t.Unix() > math.MaxUint32 {
+		return nil, fmt.Errorf("time base out of range: %s", base)
+	}
+	return NewTimeShift(t), nil
+}
+
+// apply shifts the timestamp of packet header ph, and for pcapng input, the
+// original timestamp of the last packet read by r, choosing the shift if it's
+// the first packet.
+func (t *TimeShift) apply(ph *PacketHeader, r *PcapReader) error {
+	if !t.set {
+		t.shift = t.base - int64(ph.TimestampSec)
+		t.set = true
+	}
+	s := int64(ph.TimestampSec) + t.shift
+	if s < 0 || s > math.MaxUint32 {
+		return fmt.Errorf("shifted timestamp out of range: %d", s)
+	}
+	ph.TimestampSec = uint32(s)
+	if r != nil && r.iface != nil {
+		r.ts += uint64(t.shift) * r.iface.units
+	}
+	return nil
+}
+
+// time returns tm shifted, once the shift is chosen, for reporting times
+// consistent with the output. A nil TimeShift returns tm.
+func (t *TimeShift) time(tm time.Time) time.Time {
+	if t == nil || !t.set {
+		return tm
+	}
+	return tm.Add(time.Duration(t.shift) * time.Second)
+}
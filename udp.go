@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var portMapStr = flag.String("port-map", "",
+	"payload handlers to enable, on their usual UDP ports or those given "+
+		"(e.g. \"dns vxlan=4789,8472\"), none by default")
+
+// udpProtocol is the IP protocol number for UDP.
+const udpProtocol = 17
+
+// udpHdrLen is the length of a UDP header.
+const udpHdrLen = 8
+
+// PayloadHandlers are the handlers for UDP payloads by name, as used in
+// -port-map, with their usual ports.
+var PayloadHandlers = map[string]struct {
+	Handler Handler
+	Ports   []uint16
+}{
+	"dns":   {&DNSHandler{}, []uint16{53}},
+	"vxlan": {&VXLANHandler{}, []uint16{4789}},
+}
+
+// udpPort is the payload handler bound to a UDP port.
+type udpPort struct {
+	name    string
+	handler Handler
+}
+
+// udpPorts are the payload handlers by UDP port, set by parsePortMap.
+var udpPorts = map[uint16]udpPort{}
+
+// parsePortMap sets udpPorts from the -port-map flag.
+func parsePortMap() (err error) {
+	udpPorts, err = portMap(*portMapStr)
+	return
+}
+
+// portMap returns the payload handlers by UDP port from the port map s, which
+// enables each handler named, on its usual ports, or the ports given after
+// an equals sign.
+func portMap(s string) (map[uint16]udpPort, error) {
+	ports := make(map[string][]uint16)
+	for _, f := range strings.Fields(s) {
+		name, list, ok := strings.Cut(f, "=")
+		h, known := PayloadHandlers[name]
+		if !known {
+			return nil, fmt.Errorf("unknown payload handler in port map: %s",
+				name)
+		}
+		if !ok {
+			ports[name] = h.Ports
+			continue
+		}
+		ports[name] = nil
+		for _, s := range strings.Split(list, ",") {
+			p, err := strconv.ParseUint(s, 10, 16)
+			if err != nil || p == 0 {
+				return nil, fmt.Errorf("invalid port for %s: %s", name, s)
+			}
+			ports[name] = append(ports[name], uint16(p))
+		}
+	}
+	var names []string
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := make(map[uint16]udpPort)
+	for _, name := range names {
+		for _, p := range ports[name] {
+			if u, ok := m[p]; ok {
+				return nil, fmt.Errorf("port %d bound to both %s and %s", p,
+					u.name, name)
+			}
+			m[p] = udpPort{name, PayloadHandlers[name].Handler}
+		}
+	}
+	return m, nil
+}
+
+// handleUDP anonymizes the UDP payload at offset n in b, if a payload handler
+// is bound to its destination or source port. Otherwise, the offset of the
+// UDP header is returned, so it's truncated along with the payload, as before
+// UDP was parsed. Payloads that aren't understood, or are cut short by the
+// snaplen, are unknown structure, as payloads may not be what their port
+// suggests. The ports are kept, as they select the handler, including when
+// decrypting, and the checksum is left alone, as for IPv4 header checksums.
+func handleUDP(b []byte, n int, anon Anonymizer) (int, error) {
+	if n+udpHdrLen > len(b) {
+		return n, nil
+	}
+	u, ok := udpPorts[binary.BigEndian.Uint16(b[n+2:])]
+	if !ok {
+		if u, ok = udpPorts[binary.BigEndian.Uint16(b[n:])]; !ok {
+			return n, nil
+		}
+	}
+	n += udpHdrLen
+	m, err := u.handler.Handle(b[n:], anon)
+	if err != nil && !errors.Is(err, ErrUnknown) {
+		err = unknownProtocol("malformed %s", u.name)
+	}
+	return n + m, err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+)
+
+var usbFlag = flag.Bool("usb", false,
+	"anonymize USB captures, scrubbing serial numbers and keeping all else")
+
+// USB link types
+const (
+	usbLinuxLinkType = 220
+	usbPcapLinkType  = 249
+)
+
+// USB descriptor types
+const (
+	usbDescDevice = 1
+	usbDescString = 3
+)
+
+// usbTransferControl is the transfer type for control transfers, in both
+// Linux and USBPcap headers.
+const usbTransferControl = 2
+
+// usbLinuxHdrLen is the length of a Linux usbmon memory-mapped header.
+const usbLinuxHdrLen = 64
+
+// usbPcapHdrLen is the minimum length of a USBPcap header.
+const usbPcapHdrLen = 27
+
+// USBPcap control stages
+const (
+	usbPcapStageSetup    = 0
+	usbPcapStageComplete = 3
+)
+
+// enableUSB adds the USB handlers if -usb was given. They're opt-in, as they
+// keep all data but serial numbers, rather than truncating it.
+func enableUSB() {
+	if !*usbFlag {
+		return
+	}
+	s := newUSBScrubber()
+	Handlers[usbLinuxLinkType] = &USBLinuxHandler{s}
+	Handlers[usbPcapLinkType] = &USBPcapHandler{s}
+}
+
+// usbDevice identifies a USB device by bus and address.
+type usbDevice struct {
+	bus  uint16
+	addr uint16
+}
+
+// usbRequest is a pending GET_DESCRIPTOR request.
+type usbRequest struct {
+	dev   usbDevice
+	typ   byte
+	index byte
+}
+
+// usbScrubber scrubs USB serial number string descriptors. Device descriptors
+// are followed to learn each device's serial number string index, and
+// GET_DESCRIPTOR requests are matched to their completions by URB or IRP ID.
+// For devices whose device descriptor wasn't seen, all strings are scrubbed.
+type usbScrubber struct {
+	serials map[usbDevice]byte
+	pending map[uint64]usbRequest
+}
+
+func newUSBScrubber() *usbScrubber {
+	return &usbScrubber{
+		serials: make(map[usbDevice]byte),
+		pending: make(map[uint64]usbRequest),
+	}
+}
+
+// setup records the request for control transfer id if setup is a standard
+// GET_DESCRIPTOR request for a device or string descriptor.
+func (s *usbScrubber) setup(id uint64, dev usbDevice, setup []byte) {
+	if len(setup) < 8 || setup[0] != 0x80 || setup[1] != 6 {
+		return
+	}
+	if t := setup[3]; t == usbDescDevice || t == usbDescString {
+		s.pending[id] = usbRequest{dev, t, setup[2]}
+	}
+}
+
+// complete handles the data returned for control transfer id, scrubbing the
+// string if it's a serial number.
+func (s *usbScrubber) complete(id uint64, data []byte, anon Anonymizer) {
+	r, ok := s.pending[id]
+	if !ok {
+		return
+	}
+	delete(s.pending, id)
+	switch r.typ {
+	case usbDescDevice:
+		// iSerialNumber
+		if len(data) >= 17 {
+			s.serials[r.dev] = data[16]
+		}
+	case usbDescString:
+		// string 0 holds the language IDs
+		serial, known := s.serials[r.dev]
+		if r.index == 0 || known && r.index != serial {
+			return
+		}
+		if len(data) < 2 || data[1] != usbDescString {
+			return
+		}
+		l := int(data[0])
+		if l > len(data) {
+			l = len(data)
+		}
+		if l > 2 {
+			anon.Text(data[2:l])
+		}
+	}
+}
+
+// USBLinuxHandler scrubs serial numbers from Linux usbmon captures with the
+// memory-mapped header.
+type USBLinuxHandler struct {
+	s *usbScrubber
+}
+
+// Handle anonymizes one packet.
+func (h *USBLinuxHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < usbLinuxHdrLen {
+		err = fmt.Errorf("short usbmon header (increase snaplen)")
+		return
+	}
+	n = len(b)
+	if b[9] != usbTransferControl {
+		return
+	}
+	id := binary.LittleEndian.Uint64(b)
+	dev := usbDevice{binary.LittleEndian.Uint16(b[12:]), uint16(b[11])}
+	switch b[8] {
+	case 'S':
+		if b[14] == 0 {
+			h.s.setup(id, dev, b[40:48])
+		}
+	case 'C':
+		h.s.complete(id, b[usbLinuxHdrLen:], anon)
+	}
+	return
+}
+
+// USBPcapHandler scrubs serial numbers from USBPcap captures.
+type USBPcapHandler struct {
+	s *usbScrubber
+}
+
+// Handle anonymizes one packet.
+func (h *USBPcapHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < usbPcapHdrLen {
+		err = fmt.Errorf("short USBPcap header (increase snaplen)")
+		return
+	}
+	hl := int(binary.LittleEndian.Uint16(b))
+	if hl < usbPcapHdrLen || hl > len(b) {
+		err = fmt.Errorf("invalid USBPcap header length: %d", hl)
+		return
+	}
+	n = len(b)
+	if b[22] != usbTransferControl || hl < usbPcapHdrLen+1 {
+		return
+	}
+	id := binary.LittleEndian.Uint64(b[2:])
+	dev := usbDevice{binary.LittleEndian.Uint16(b[17:]),
+		binary.LittleEndian.Uint16(b[19:])}
+	switch b[27] {
+	case usbPcapStageSetup:
+		h.s.setup(id, dev, b[hl:])
+	case usbPcapStageComplete:
+		h.s.complete(id, b[hl:], anon)
+	}
+	return
+}
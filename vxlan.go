@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// vxlanHdrLen is the length of a VXLAN header.
+const vxlanHdrLen = 8
+
+// vxlanFlagVNI is the VXLAN flag for a valid VNI.
+const vxlanFlagVNI = 0x08
+
+// VXLANHandler anonymizes VXLAN payloads, by anonymizing the encapsulated
+// Ethernet frame. The VNI is kept, as it identifies a segment like a VLAN ID
+// in the overlay.
+type VXLANHandler struct {
+}
+
+// Handle anonymizes one payload.
+func (h *VXLANHandler) Handle(b []byte, anon Anonymizer) (n int, err error) {
+	if len(b) < vxlanHdrLen {
+		err = fmt.Errorf("short VXLAN header (increase snaplen)")
+		return
+	}
+	if b[0] != vxlanFlagVNI {
+		err = unknownProtocol("VXLAN flags 0x%02x", b[0])
+		return
+	}
+	n = vxlanHdrLen
+	m, err := (&EthHandler{}).Handle(b[n:], anon)
+	n += m
+	return
+}
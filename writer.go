@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// asyncBufSize is the size of each asyncWriter buffer.
+const asyncBufSize = 256 * 1024
+
+// asyncWriter is a double-buffered Writer that writes from a goroutine, so
+// output latency (e.g. to NFS or object storage) overlaps with processing.
+// Write errors are returned by later calls to Write, or by Close.
+type asyncWriter struct {
+	w    io.Writer
+	buf  []byte
+	full chan []byte
+	free chan []byte
+	done chan struct{}
+	mtx  sync.Mutex
+	err  error
+}
+
+func newAsyncWriter(w io.Writer, size int) *asyncWriter {
+	a := &asyncWriter{
+		w:    w,
+		buf:  make([]byte, 0, size),
+		full: make(chan []byte),
+		free: make(chan []byte, 2),
+		done: make(chan struct{}),
+	}
+	a.free <- make([]byte, 0, size)
+	go a.loop()
+	return a
+}
+
+// loop writes full buffers and returns them to the free channel.
+func (a *asyncWriter) loop() {
+	defer close(a.done)
+	for b := range a.full {
+		if a.error() == nil {
+			if _, err := a.w.Write(b); err != nil {
+				a.mtx.Lock()
+				a.err = err
+				a.mtx.Unlock()
+			}
+		}
+		a.free <- b[:0]
+	}
+}
+
+func (a *asyncWriter) error() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.err
+}
+
+func (a *asyncWriter) Write(b []byte) (n int, err error) {
+	if err = a.error(); err != nil {
+		return
+	}
+	for len(b) > 0 {
+		c := copy(a.buf[len(a.buf):cap(a.buf)], b)
+		a.buf = a.buf[:len(a.buf)+c]
+		b = b[c:]
+		n += c
+		if len(a.buf) == cap(a.buf) {
+			a.full <- a.buf
+			a.buf = <-a.free
+		}
+	}
+	return
+}
+
+// Close writes any buffered data and waits for the writer goroutine to stop.
+// It does not close the underlying Writer.
+func (a *asyncWriter) Close() error {
+	if len(a.buf) > 0 {
+		a.full <- a.buf
+	}
+	close(a.full)
+	<-a.done
+	return a.error()
+}